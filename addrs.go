@@ -0,0 +1,48 @@
+package tailscale
+
+import "net/netip"
+
+// hostAddrs are the addresses of the A and AAAA records of a name, parsed once when the records are
+// published rather than for every query.
+type hostAddrs struct {
+	v4, v6 []netip.Addr
+}
+
+// get returns the addresses of the A records, or of the AAAA records if v6 is set.
+func (a hostAddrs) get(v6 bool) []netip.Addr {
+	if v6 {
+		return a.v6
+	}
+	return a.v4
+}
+
+// addrIndex parses the addresses of the A and AAAA records in entries, by name. Values that aren't
+// addresses are logged and left out, so they're never served.
+func (t *Tailscale) addrIndex(entries map[string]map[string][]string) map[string]hostAddrs {
+	index := make(map[string]hostAddrs, len(entries))
+	for name, records := range entries {
+		var addrs hostAddrs
+		addrs.v4 = t.parseAddrs(name, "A", records["A"])
+		addrs.v6 = t.parseAddrs(name, "AAAA", records["AAAA"])
+		if addrs.v4 != nil || addrs.v6 != nil {
+			index[name] = addrs
+		}
+	}
+	return index
+}
+
+func (t *Tailscale) parseAddrs(name, rrtype string, values []string) []netip.Addr {
+	if len(values) == 0 {
+		return nil
+	}
+	addrs := make([]netip.Addr, 0, len(values))
+	for _, value := range values {
+		addr, err := netip.ParseAddr(value)
+		if err != nil {
+			log.Warningf("Invalid %s record for %s: %v", rrtype, t.logName(name), err)
+			continue
+		}
+		addrs = append(addrs, addr)
+	}
+	return addrs
+}
@@ -0,0 +1,256 @@
+package tailscale
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	clog "github.com/coredns/coredns/plugin/pkg/log"
+	"github.com/miekg/dns"
+	"tailscale.com/client/tailscale/apitype"
+)
+
+// The companion agent protocol lets nodes register the addresses they have on their local networks,
+// which are then published as lan.<host>.<zone>. Agents POST a lanRegistration as JSON to agentPath
+// over HTTPS, through the tailnet. The node registering is identified by the tailnet address the
+// request comes from, so nodes can only register addresses for themselves, and only nodes published
+// in the zone can register. Registrations expire unless they're refreshed, and are dropped once their
+// node is no longer published.
+const (
+	// agentPath is the path agents register their LAN addresses at.
+	agentPath = "/tailscale/v1/lan"
+	// lanLabel is the label in front of a host name under which its LAN addresses are published.
+	lanLabel = "lan"
+	// maxLANAddresses is the maximum number of addresses a node may register.
+	maxLANAddresses = 16
+	// maxRegistrationSize is the maximum size of a registration request body.
+	maxRegistrationSize = 4096
+)
+
+// DefaultAgentExpiry is how long LAN addresses registered by an agent are published without being
+// refreshed.
+const DefaultAgentExpiry = 10 * time.Minute
+
+// lanRegistration is the request body of the companion agent protocol.
+type lanRegistration struct {
+	// Addresses are the LAN addresses of the node. An empty list removes the registration.
+	Addresses []netip.Addr `json:"addresses"`
+}
+
+// lanEntry holds the LAN addresses registered by a node.
+type lanEntry struct {
+	addrs   []netip.Addr
+	expires time.Time
+}
+
+// lanRegistry keeps the LAN addresses registered by nodes, by host name.
+type lanRegistry struct {
+	mu    sync.RWMutex
+	nodes map[string]lanEntry
+}
+
+// set replaces the LAN addresses of host, registered at now, and removes the entries that expired.
+// Registering no addresses removes host.
+func (r *lanRegistry) set(host string, addrs []netip.Addr, now, expires time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	maps.DeleteFunc(r.nodes, func(_ string, entry lanEntry) bool { return now.After(entry.expires) })
+	if len(addrs) == 0 {
+		delete(r.nodes, host)
+		return
+	}
+	if r.nodes == nil {
+		r.nodes = map[string]lanEntry{}
+	}
+	r.nodes[host] = lanEntry{addrs: addrs, expires: expires}
+}
+
+// retain removes the entries of the hosts keep returns false for.
+func (r *lanRegistry) retain(keep func(host string) bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	maps.DeleteFunc(r.nodes, func(host string, _ lanEntry) bool { return !keep(host) })
+}
+
+// addrs returns the unexpired LAN addresses of host in the given address family.
+func (r *lanRegistry) addrs(host string, v6 bool, now time.Time) []netip.Addr {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	entry, ok := r.nodes[host]
+	if !ok || now.After(entry.expires) {
+		return nil
+	}
+	var addrs []netip.Addr
+	for _, addr := range entry.addrs {
+		if addr.Is6() == v6 {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+// exists reports whether host has unexpired LAN addresses.
+func (r *lanRegistry) exists(host string, now time.Time) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	entry, ok := r.nodes[host]
+	return ok && !now.After(entry.expires)
+}
+
+// publishedHost returns the name the node with the stable ID id is published under in d, if it is.
+func publishedHost(d *zoneData, id string) (string, bool) {
+	for _, owner := range d.owners {
+		if owner.id == id && d.sources[owner.host] == sourceDevice {
+			return owner.host, true
+		}
+	}
+	return "", false
+}
+
+// whoIs identifies the node at remoteAddr.
+func (t *Tailscale) whoIs(ctx context.Context, remoteAddr string) (*apitype.WhoIsResponse, error) {
+	if t.whoIsFunc != nil {
+		return t.whoIsFunc(ctx, remoteAddr)
+	}
+	if t.lc == nil {
+		return nil, errors.New("not connected to the tailnet")
+	}
+	return t.lc.WhoIs(ctx, remoteAddr)
+}
+
+// serveAgent handles a LAN address registration of a companion agent.
+func (t *Tailscale) serveAgent(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	who, err := t.whoIs(r.Context(), r.RemoteAddr)
+	if err != nil || who.Node == nil {
+		log.Debugf("Rejecting LAN registration from unknown node %s: %v", r.RemoteAddr, err)
+		http.Error(w, "unknown node", http.StatusForbidden)
+		return
+	}
+	// Nodes the zone doesn't publish, like those filtered out or offline, have no lan.<host> to
+	// register for.
+	host, ok := publishedHost(t.load(), string(who.Node.StableID))
+	if !ok {
+		log.Debugf("Rejecting LAN registration from unpublished node %s", t.logName(who.Node.ComputedName))
+		http.Error(w, "node not published", http.StatusForbidden)
+		return
+	}
+
+	var reg lanRegistration
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRegistrationSize)).Decode(&reg); err != nil {
+		http.Error(w, "invalid registration: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(reg.Addresses) > maxLANAddresses {
+		http.Error(w, "too many addresses", http.StatusBadRequest)
+		return
+	}
+	for i, addr := range reg.Addresses {
+		addr = addr.Unmap()
+		if !addr.IsValid() || addr.IsUnspecified() || addr.IsMulticast() || isTailnetAddr(addr) {
+			http.Error(w, "invalid address "+addr.String(), http.StatusBadRequest)
+			return
+		}
+		reg.Addresses[i] = addr
+	}
+
+	now := time.Now()
+	t.lan.set(host, reg.Addresses, now, now.Add(t.agentExpiry))
+	if clog.D.Value() {
+		log.Debugf("Registered %d LAN addresses for %s", len(reg.Addresses), t.logName(host))
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// startAgent starts the HTTPS endpoint for companion agents on the configured address, if any. When
+// the plugin runs its own tsnet node the endpoint listens on the tailnet only. The certificate is
+// the node's Tailscale HTTPS certificate, so HTTPS must be enabled for the tailnet.
+func (t *Tailscale) startAgent() error {
+	if t.agentAddr == "" {
+		return nil
+	}
+	var ln net.Listener
+	var err error
+	if t.srv != nil {
+		ln, err = t.srv.Listen("tcp", t.agentAddr)
+	} else {
+		ln, err = net.Listen("tcp", t.agentAddr)
+	}
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(agentPath, t.serveAgent)
+	t.agentSrv = &http.Server{
+		Handler:           mux,
+		TLSConfig:         &tls.Config{GetCertificate: t.lc.GetCertificate},
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	srv := t.agentSrv
+	t.bg.Go("agent_endpoint", func(context.Context) error {
+		if err := srv.ServeTLS(ln, "", ""); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			return fmt.Errorf("agent endpoint: %w", err)
+		}
+		return nil
+	})
+	log.Infof("Agent endpoint listening on %s", ln.Addr())
+	return nil
+}
+
+// stopAgent stops the endpoint for companion agents.
+func (t *Tailscale) stopAgent() error {
+	if t.agentSrv == nil {
+		return nil
+	}
+	err := t.agentSrv.Close()
+	t.agentSrv = nil
+	return err
+}
+
+// resolveLAN adds the LAN addresses registered for the host of domainName to msg, if domainName is
+// lan.<host>.<zone> of a published host. It reports whether any were added; if not, the name is
+// resolved like any other name below the host. The name belongs to the host, so views hide it along
+// with the host, see visible.
+func (t *Tailscale) resolveLAN(d *zoneData, domainName string, msg *dns.Msg, v6 bool) bool {
+	prefix, host := t.splitName(d, domainName)
+	if !strings.EqualFold(prefix, lanLabel) || !lanPublished(d, host) {
+		return false
+	}
+	addrs := t.lan.addrs(host, v6, time.Now())
+	if len(addrs) == 0 {
+		return false
+	}
+	ttl := t.ttl()
+	slab := slabPool.Get().(*rrSlab)
+	defer slabPool.Put(slab)
+	for _, addr := range addrs {
+		if v6 {
+			msg.Answer = append(msg.Answer, slab.newAAAA(domainName, ttl, addr))
+		} else {
+			msg.Answer = append(msg.Answer, slab.newA(domainName, ttl, addr))
+		}
+	}
+	return true
+}
+
+// lanPublished reports whether the LAN addresses registered for host are published, which they are as
+// long as host is the name of a published node.
+func lanPublished(d *zoneData, host string) bool {
+	owner, ok := d.owners[host]
+	return ok && owner.host == host && d.sources[host] == sourceDevice
+}
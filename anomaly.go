@@ -0,0 +1,98 @@
+package tailscale
+
+import (
+	"container/list"
+	"hash/maphash"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// Defaults of the enumeration detector.
+const (
+	DefaultEnumerationThreshold = 200
+	DefaultEnumerationWindow    = time.Minute
+)
+
+// maxTrackedClients bounds the memory used by the enumeration detector. Once more clients are tracked,
+// the client that was seen least recently is dropped.
+const maxTrackedClients = 10000
+
+// enumerationShards is the number of shards clients are spread over, so that queries of different
+// clients rarely wait for each other.
+const enumerationShards = 16
+
+// enumerationDetector flags clients querying an unusual number of distinct names within a window, which
+// is what walking the zone to map the tailnet looks like. Names are only kept in memory until the
+// window of their client has passed.
+type enumerationDetector struct {
+	threshold int
+	window    time.Duration
+
+	seed   maphash.Seed
+	shards [enumerationShards]enumerationShard
+}
+
+// enumerationShard tracks the clients of a shard, ordered from the most to the least recently seen.
+type enumerationShard struct {
+	mu      sync.Mutex
+	clients map[netip.Addr]*list.Element // of *clientWindow
+	recent  list.List
+}
+
+// clientWindow holds the distinct names a client queried since start.
+type clientWindow struct {
+	client  netip.Addr
+	start   time.Time
+	names   map[string]struct{}
+	flagged bool
+}
+
+func newEnumerationDetector(threshold int, window time.Duration) *enumerationDetector {
+	d := &enumerationDetector{threshold: threshold, window: window, seed: maphash.MakeSeed()}
+	for i := range d.shards {
+		d.shards[i].clients = map[netip.Addr]*list.Element{}
+	}
+	return d
+}
+
+// shard returns the shard client is tracked in.
+func (d *enumerationDetector) shard(client netip.Addr) *enumerationShard {
+	addr := client.As16()
+	return &d.shards[maphash.Bytes(d.seed, addr[:])%enumerationShards]
+}
+
+// observe records a query of client for name at now. It returns true, once per window, when the client
+// reaches the threshold of distinct names.
+func (d *enumerationDetector) observe(client netip.Addr, name string, now time.Time) bool {
+	s := d.shard(client)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var cw *clientWindow
+	if e, ok := s.clients[client]; ok {
+		s.recent.MoveToFront(e)
+		cw = e.Value.(*clientWindow)
+		if now.Sub(cw.start) > d.window {
+			*cw = clientWindow{client: client, start: now, names: map[string]struct{}{}}
+		}
+	} else {
+		if len(s.clients) >= maxTrackedClients/enumerationShards {
+			oldest := s.recent.Remove(s.recent.Back()).(*clientWindow)
+			delete(s.clients, oldest.client)
+		}
+		cw = &clientWindow{client: client, start: now, names: map[string]struct{}{}}
+		s.clients[client] = s.recent.PushFront(cw)
+	}
+	if cw.flagged {
+		return false
+	}
+	cw.names[name] = struct{}{}
+	if len(cw.names) < d.threshold {
+		return false
+	}
+	// The names aren't needed anymore once the client is flagged for this window.
+	cw.flagged = true
+	cw.names = nil
+	return true
+}
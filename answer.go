@@ -0,0 +1,108 @@
+package tailscale
+
+import (
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// slabSize is the number of records of each type allocated at once by an rrSlab.
+const slabSize = 64
+
+// rrSlab hands out records carved from preallocated blocks, so building an answer costs one
+// allocation per block rather than one per record.
+//
+// Records are never handed out twice: once added to a response they belong to it, since plugins
+// further up the chain (cache, rewrite, ...) keep references to them and may modify them. A block
+// stays alive until the last record carved from it is released.
+type rrSlab struct {
+	a     []dns.A
+	aaaa  []dns.AAAA
+	cname []dns.CNAME
+	ip    []byte
+}
+
+var slabPool = sync.Pool{New: func() any { return new(rrSlab) }}
+
+func (s *rrSlab) newA(name string, ttl uint32, addr netip.Addr) *dns.A {
+	if len(s.a) == 0 {
+		s.a = make([]dns.A, slabSize)
+	}
+	rr := &s.a[0]
+	s.a = s.a[1:]
+	rr.Hdr = dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl}
+	rr.A = s.newIP(addr)
+	return rr
+}
+
+func (s *rrSlab) newAAAA(name string, ttl uint32, addr netip.Addr) *dns.AAAA {
+	if len(s.aaaa) == 0 {
+		s.aaaa = make([]dns.AAAA, slabSize)
+	}
+	rr := &s.aaaa[0]
+	s.aaaa = s.aaaa[1:]
+	rr.Hdr = dns.RR_Header{Name: name, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: ttl}
+	rr.AAAA = s.newIP(addr)
+	return rr
+}
+
+func (s *rrSlab) newCNAME(name string, ttl uint32, target string) *dns.CNAME {
+	if len(s.cname) == 0 {
+		s.cname = make([]dns.CNAME, slabSize)
+	}
+	rr := &s.cname[0]
+	s.cname = s.cname[1:]
+	rr.Hdr = dns.RR_Header{Name: name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: ttl}
+	rr.Target = target
+	return rr
+}
+
+// newIP returns addr as a net.IP backed by the slab. IPv4 addresses use their 4-byte form.
+func (s *rrSlab) newIP(addr netip.Addr) net.IP {
+	n := addr.BitLen() / 8
+	if len(s.ip) < n {
+		s.ip = make([]byte, slabSize*net.IPv6len)
+	}
+	ip := net.IP(s.ip[:n:n])
+	s.ip = s.ip[n:]
+	if addr.Is4() {
+		a4 := addr.As4()
+		copy(ip, a4[:])
+	} else {
+		a16 := addr.As16()
+		copy(ip, a16[:])
+	}
+	return ip
+}
+
+// splitName splits a name in the zone into the host label directly below the zone and the labels
+// in front of it, lowercased. In a tag subzone, or the subzone of a user in d, the host is the label
+// below the subzone along with the subzone's label, e.g. "node.k8s". prefix is empty if the name has
+// no labels in front of the host. Host is empty for the zone apex. Fully qualified names that are
+// lowercase already, like query names, are split without allocating.
+func (t *Tailscale) splitName(d *zoneData, domainName string) (prefix, host string) {
+	// Names are matched case-insensitively, and entries are keyed by lowercase names. Query names are
+	// lowercase already, but CNAME targets of static records needn't be.
+	domainName = strings.ToLower(domainName)
+	numCommonLabels := dns.CompareDomainName(dns.Fqdn(domainName), dns.Fqdn(t.zone))
+	start, overshot := dns.PrevLabel(domainName, numCommonLabels+1)
+	if overshot {
+		return "", ""
+	}
+	host = domainName[start:]
+	if end := strings.IndexByte(host, '.'); end >= 0 {
+		host = host[:end]
+	}
+	if start > 0 && (t.subzoneLabels[host] || d.userLabels[host]) {
+		end := start + len(host)
+		start, _ = dns.PrevLabel(domainName, numCommonLabels+2)
+		host = domainName[start:end]
+	}
+	if start > 0 {
+		prefix = domainName[:start-1]
+	}
+	return prefix, host
+}
@@ -0,0 +1,55 @@
+package tailscale
+
+import (
+	"context"
+
+	"github.com/miekg/dns"
+)
+
+// Policies for ANY queries.
+const (
+	// anyHINFO answers ANY queries for existing names with a single synthesized HINFO record
+	// (RFC 8482, section 4.2).
+	anyHINFO = "hinfo"
+	// anyAll answers ANY queries with all the records of the name.
+	anyAll = "all"
+)
+
+// DefaultAny answers ANY queries with a HINFO record, as RFC 8482 recommends.
+const DefaultAny = anyHINFO
+
+// hinfoRecord returns the HINFO record answering ANY queries for name (RFC 8482, section 4.2).
+func (t *Tailscale) hinfoRecord(name string) dns.RR {
+	return &dns.HINFO{
+		Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeHINFO, Class: dns.ClassINET, Ttl: t.ttl()},
+		Cpu: "RFC8482",
+	}
+}
+
+// resolveAny adds the answer to an ANY query for domainName to msg, according to the any policy.
+// Names with CNAME records only have those, which are followed like for CNAME queries. HTTPS records
+// are only included if the node has ALPN protocols, as they otherwise repeat its addresses.
+func (t *Tailscale) resolveAny(ctx context.Context, d *zoneData, domainName string, msg *dns.Msg) {
+	if t.anyPolicy != anyAll {
+		if t.nameExists(d, domainName) {
+			msg.Answer = append(msg.Answer, t.hinfoRecord(domainName))
+		}
+		return
+	}
+
+	_, name := t.splitName(d, domainName)
+	if _, ok := d.entries[name]["CNAME"]; ok {
+		t.resolveCNAME(ctx, d, domainName, msg, TypeAll)
+		return
+	}
+	t.resolveA(ctx, d, domainName, msg)
+	t.resolveAAAA(ctx, d, domainName, msg)
+	t.resolveTXT(ctx, d, domainName, msg)
+	t.resolveSRV(d, domainName, msg)
+	t.resolveTagPTR(d, domainName, msg)
+	t.resolveRebindMarker(d, domainName, msg)
+	t.resolveStats(d, domainName, msg)
+	if len(d.entries[name]["ALPN"]) > 0 {
+		t.resolveSVCB(ctx, d, domainName, dns.TypeHTTPS, msg)
+	}
+}
@@ -0,0 +1,264 @@
+package tailscale
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"tailscale.com/tailcfg"
+)
+
+// The API backend polls the device list of the tailnet from the Tailscale API, so CoreDNS can serve
+// the tailnet's records without being a member of it.
+const (
+	// DefaultAPIURL is the base URL of the Tailscale API.
+	DefaultAPIURL = "https://api.tailscale.com"
+	// DefaultTailnet is the tailnet of the API key or OAuth client.
+	DefaultTailnet = "-"
+	// DefaultAPIInterval is how often the device list is polled.
+	DefaultAPIInterval = time.Minute
+
+	// apiTimeout bounds each request to the API.
+	apiTimeout = 30 * time.Second
+	// tokenMargin is how long before it expires an OAuth access token is replaced.
+	tokenMargin = time.Minute
+)
+
+// apiClient fetches the devices of a tailnet from the Tailscale API, authenticating with an API key or
+// an OAuth client. It is used by a single goroutine.
+type apiClient struct {
+	baseURL string
+	tailnet string
+	http    *http.Client
+
+	// apiKey is the API key, if the client doesn't use OAuth.
+	apiKey string
+	// clientID and clientSecret are the OAuth client credentials, exchanged for an access token.
+	clientID     string
+	clientSecret string
+	token        string
+	tokenExpiry  time.Time
+}
+
+// apiDevice is a device in the device list of the Tailscale API.
+type apiDevice struct {
+	// ID is the numeric ID of the device, as a string.
+	ID string `json:"id"`
+	// NodeID is the stable ID of the device.
+	NodeID string `json:"nodeId"`
+	// Name is the MagicDNS name of the device.
+	Name      string   `json:"name"`
+	Addresses []string `json:"addresses"`
+	Tags      []string `json:"tags"`
+	// IsExternal is set for devices shared into the tailnet.
+	IsExternal bool `json:"isExternal"`
+	// ConnectedToControl is whether the device is connected, nil if the API doesn't say.
+	ConnectedToControl *bool `json:"connectedToControl"`
+	// Created is when the device was added to the tailnet.
+	Created time.Time `json:"created"`
+	// IsEphemeral is set for devices removed from the tailnet once they go offline.
+	IsEphemeral bool `json:"isEphemeral"`
+}
+
+// devices returns the devices of the tailnet.
+func (c *apiClient) devices(ctx context.Context) ([]apiDevice, error) {
+	u := fmt.Sprintf("%s/api/v2/tailnet/%s/devices", c.baseURL, url.PathEscape(c.tailnet))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.authorize(ctx, req); err != nil {
+		return nil, err
+	}
+
+	var list struct {
+		Devices []apiDevice `json:"devices"`
+	}
+	if err := c.do(req, &list); err != nil {
+		return nil, fmt.Errorf("listing devices: %w", err)
+	}
+	return list.Devices, nil
+}
+
+// authorize adds the credentials to req, requesting a new OAuth access token if needed.
+func (c *apiClient) authorize(ctx context.Context, req *http.Request) error {
+	if c.clientID == "" {
+		req.Header.Set("Authorization", "Bearer "+c.apiKey)
+		return nil
+	}
+	if c.token == "" || time.Until(c.tokenExpiry) < tokenMargin {
+		if err := c.refreshToken(ctx); err != nil {
+			return err
+		}
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	return nil
+}
+
+// refreshToken exchanges the OAuth client credentials for an access token.
+func (c *apiClient) refreshToken(ctx context.Context) error {
+	form := url.Values{
+		"client_id":     {c.clientID},
+		"client_secret": {c.clientSecret},
+		"grant_type":    {"client_credentials"},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.baseURL+"/api/v2/oauth/token", strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := c.do(req, &token); err != nil {
+		return fmt.Errorf("requesting OAuth token: %w", err)
+	}
+	if token.AccessToken == "" {
+		return errors.New("requesting OAuth token: no access token in response")
+	}
+	c.token = token.AccessToken
+	c.tokenExpiry = time.Now().Add(time.Duration(token.ExpiresIn) * time.Second)
+	return nil
+}
+
+// do sends req and decodes the JSON response into v. The request and the rate limit reported by the
+// response are recorded in the API metrics.
+func (c *apiClient) do(req *http.Request, v any) error {
+	resp, err := c.http.Do(req)
+	if err != nil {
+		APIRequests.WithLabelValues("", c.tailnet, "0").Inc()
+		return err
+	}
+	defer resp.Body.Close()
+	APIRequests.WithLabelValues("", c.tailnet, strconv.Itoa(resp.StatusCode)).Inc()
+	c.recordQuota(resp.Header, resp.StatusCode, time.Now())
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return &apiError{code: resp.StatusCode, status: resp.Status, body: strings.TrimSpace(string(body))}
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// apiError is a response with a status other than 200, with the start of its body.
+type apiError struct {
+	code   int
+	status string
+	body   string
+}
+
+func (e *apiError) Error() string { return fmt.Sprintf("%s: %s", e.status, e.body) }
+
+// rateLimitHeader returns the value of the rate limit header with the given suffix, e.g. "Remaining",
+// in either its common X-RateLimit- form or the RateLimit- form of the IETF draft, and whether it's
+// set to a non-negative integer.
+func rateLimitHeader(h http.Header, suffix string) (int64, bool) {
+	for _, name := range []string{"X-RateLimit-" + suffix, "RateLimit-" + suffix} {
+		if v := h.Get(name); v != "" {
+			n, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+			return n, err == nil && n >= 0
+		}
+	}
+	return 0, false
+}
+
+// recordQuota exports the rate limit reported by the headers h of a response with status code,
+// received at now. Reset times are given in seconds from now, or as Unix times by some APIs, which
+// are told apart by their size. Responses refusing a request for its rate leave no quota, and may
+// only say when to retry.
+func (c *apiClient) recordQuota(h http.Header, code int, now time.Time) {
+	if limit, ok := rateLimitHeader(h, "Limit"); ok {
+		APIQuotaLimit.WithLabelValues("", c.tailnet).Set(float64(limit))
+	}
+	remaining, ok := rateLimitHeader(h, "Remaining")
+	if code == http.StatusTooManyRequests {
+		remaining, ok = 0, true
+	}
+	if ok {
+		APIQuotaRemaining.WithLabelValues("", c.tailnet).Set(float64(remaining))
+	}
+
+	reset, ok := rateLimitHeader(h, "Reset")
+	if !ok && code == http.StatusTooManyRequests {
+		reset, ok = retryAfter(h, now)
+	}
+	if !ok {
+		return
+	}
+	// Any delta is shorter than the Unix times of this century.
+	if reset < 1e9 {
+		reset += now.Unix()
+	}
+	APIQuotaReset.WithLabelValues("", c.tailnet).Set(float64(reset))
+}
+
+// retryAfter returns the seconds from now the Retry-After header of h asks to wait, given either in
+// seconds or as an HTTP date.
+func retryAfter(h http.Header, now time.Time) (int64, bool) {
+	v := h.Get("Retry-After")
+	if v == "" {
+		return 0, false
+	}
+	if n, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return n, n >= 0
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return max(int64(t.Sub(now).Seconds()), 0), true
+	}
+	return 0, false
+}
+
+// nodeID returns the node ID of the device, which stays the same across polls: its numeric ID, which is
+// the node ID control assigned, or one derived from its stable ID if the API doesn't report that.
+func (d apiDevice) nodeID() tailcfg.NodeID {
+	if id, err := strconv.ParseInt(d.ID, 10, 64); err == nil && id > 0 {
+		return tailcfg.NodeID(id)
+	}
+	h := fnv.New64a()
+	h.Write([]byte(d.NodeID))
+	return tailcfg.NodeID(h.Sum64() >> 1)
+}
+
+// devicesTailnet converts the device list of the API into a Tailnet, so it is published the same
+// way as the network map of a tailnet member. Devices shared into the tailnet are left out, like
+// shared nodes are. Device names are logged as logName formats them.
+func devicesTailnet(devices []apiDevice, logName func(string) string) *Tailnet {
+	tn := &Tailnet{}
+	for _, device := range devices {
+		if device.IsExternal {
+			continue
+		}
+		node := &tailcfg.Node{
+			ID:           device.nodeID(),
+			StableID:     tailcfg.StableNodeID(device.NodeID),
+			Name:         device.Name,
+			ComputedName: strings.SplitN(device.Name, ".", 2)[0],
+			Tags:         device.Tags,
+			Online:       device.ConnectedToControl,
+			Created:      device.Created,
+		}
+		if device.IsEphemeral {
+			node.CapMap = tailcfg.NodeCapMap{nodeAttrEphemeral: nil}
+		}
+		for _, s := range device.Addresses {
+			addr, err := netip.ParseAddr(s)
+			if err != nil {
+				log.Warningf("Ignoring invalid address %q of device %s: %v", s, logName(node.ComputedName), err)
+				continue
+			}
+			node.Addresses = append(node.Addresses, netip.PrefixFrom(addr, addr.BitLen()))
+		}
+		tn.Peers = append(tn.Peers, node.View())
+	}
+	return tn
+}
@@ -0,0 +1,89 @@
+package tailscale
+
+import (
+	"slices"
+	"strings"
+
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/appctype"
+)
+
+// DefaultAppConnectorLabel is the label of the subzone the apps of app connectors are published in.
+const DefaultAppConnectorLabel = "apps"
+
+// appConnectorsCap is the node attribute the tailnet policy configures app connectors with. It's
+// sent to every node, so the plugin learns the apps from the network map of its own node.
+const appConnectorsCap tailcfg.NodeCapability = "tailscale.com/app-connectors"
+
+// appConnector is a published node running the app connector service.
+type appConnector struct {
+	hostname string
+	tags     []string
+}
+
+// isAppConnector reports whether node advertises the app connector service.
+func isAppConnector(node tailcfg.NodeView) bool {
+	return node.Hostinfo().Valid() && node.Hostinfo().AppConnector().EqualBool(true)
+}
+
+// appLabel turns the name of an app in the policy, which may be any string, into a DNS label.
+func appLabel(name string) string {
+	label := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9':
+			return r
+		case r >= 'A' && r <= 'Z':
+			return r - 'A' + 'a'
+		default:
+			return '-'
+		}
+	}, name)
+	return strings.Trim(label, "-")
+}
+
+// appConnectorRecords returns the records of the apps configured in the policy, as found in the
+// attributes of self, by <app>.<label>: the addresses of the connectors serving the app, and its
+// domains as TXT record. devices holds the records of the connectors. Apps without any connector
+// are left out.
+func (t *Tailscale) appConnectorRecords(self tailcfg.NodeView, connectors []appConnector, devices map[string]map[string][]string) map[string]map[string][]string {
+	if t.appConnectorLabel == "" || !self.Valid() {
+		return nil
+	}
+	attrs, err := tailcfg.UnmarshalNodeCapJSON[appctype.AppConnectorAttr](self.CapMap().AsMap(), appConnectorsCap)
+	if err != nil {
+		log.Warningf("Unable to parse app connectors: %v", err)
+		return nil
+	}
+
+	apps := map[string]map[string][]string{}
+	for _, attr := range attrs {
+		name, ok := t.fitName(appLabel(attr.Name))
+		if !ok || name == "" {
+			continue
+		}
+		entry := apps[name+"."+t.appConnectorLabel]
+		if entry == nil {
+			entry = map[string][]string{}
+		}
+		for _, c := range connectors {
+			if !slices.Contains(attr.Connectors, "*") && !slices.ContainsFunc(c.tags, func(tag string) bool { return slices.Contains(attr.Connectors, tag) }) {
+				continue
+			}
+			for _, rrtype := range []string{"A", "AAAA"} {
+				entry[rrtype] = append(entry[rrtype], devices[c.hostname][rrtype]...)
+			}
+		}
+		if len(entry["A"]) == 0 && len(entry["AAAA"]) == 0 {
+			continue
+		}
+		for _, domain := range attr.Domains {
+			entry["TXT"] = append(entry["TXT"], strings.ToLower(domain))
+		}
+		for rrtype, values := range entry {
+			slices.Sort(values)
+			entry[rrtype] = slices.Compact(values)
+		}
+		apps[name+"."+t.appConnectorLabel] = entry
+	}
+	return apps
+}
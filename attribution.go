@@ -0,0 +1,110 @@
+package tailscale
+
+import (
+	"context"
+	"strings"
+
+	"github.com/coredns/coredns/plugin/metadata"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+// Metadata labels of the queries answered by the plugin, for plugins like dnstap and log to record.
+const (
+	// metadataNode is the names of the nodes the answer holds records of, comma-separated.
+	metadataNode = "tailscale/node"
+	// metadataNodeID is the stable IDs of those nodes, comma-separated.
+	metadataNodeID = "tailscale/node_id"
+	// metadataSource is what the query name was resolved from, see answerSource.
+	metadataSource = "tailscale/answer_source"
+)
+
+// Sources of answers, as recorded in the metadata of queries.
+const (
+	// answerHostname answers with the records of a node's own name.
+	answerHostname = "hostname"
+	// answerTagCNAME answers with a CNAME record from a cname- tag and the records of its targets.
+	answerTagCNAME = "tag_cname"
+	// answerTag answers with other records derived from tags, like addresses from cdns- tags, apps
+	// and the topology of the tailnet.
+	answerTag = "tag"
+	// answerStatic answers with static records of the Corefile.
+	answerStatic = "static"
+	// answerStore answers with records loaded from the store, before the first sync.
+	answerStore = "store"
+)
+
+// attribution is what the answer to a query was resolved from. It's filled in once the answer is
+// built, and read by the metadata functions of the query when plugins ask for them.
+type attribution struct {
+	nodes   []string
+	nodeIDs []string
+	source  string
+}
+
+// attributionKey is the context key of the attribution of a query.
+type attributionKey struct{}
+
+// Metadata implements the metadata.Provider interface. The values are empty until the plugin has
+// answered the query, and for queries it doesn't answer.
+func (t *Tailscale) Metadata(ctx context.Context, state request.Request) context.Context {
+	a := &attribution{}
+	ctx = context.WithValue(ctx, attributionKey{}, a)
+	metadata.SetValueFunc(ctx, metadataNode, func() string { return strings.Join(a.nodes, ",") })
+	metadata.SetValueFunc(ctx, metadataNodeID, func() string { return strings.Join(a.nodeIDs, ",") })
+	metadata.SetValueFunc(ctx, metadataSource, func() string { return a.source })
+	return ctx
+}
+
+// attribute records the nodes whose records the answer msg to the query of state holds, and what
+// the query name was resolved from, in the attribution of the query in ctx if it has one. The
+// metadata of the query and its line in the query log both read it from there.
+func (t *Tailscale) attribute(ctx context.Context, d *zoneData, state request.Request, msg *dns.Msg) {
+	if a, ok := ctx.Value(attributionKey{}).(*attribution); ok {
+		*a = t.attributeAnswer(d, state.Name(), msg)
+	}
+}
+
+// attributeAnswer returns the nodes whose records msg, the answer to a query for qname, holds, and
+// what qname was resolved from.
+func (t *Tailscale) attributeAnswer(d *zoneData, qname string, msg *dns.Msg) attribution {
+	var a attribution
+	switch d.sources[t.ownerName(d, t.primaryName(qname))] {
+	case sourceDevice:
+		a.source = answerHostname
+	case sourceTag:
+		a.source = answerTag
+		if len(msg.Answer) > 0 && msg.Answer[0].Header().Rrtype == dns.TypeCNAME {
+			a.source = answerTagCNAME
+		}
+	case sourceManual:
+		a.source = answerStatic
+	case sourceStore:
+		a.source = answerStore
+	}
+
+	seen := map[string]bool{}
+	for _, rr := range msg.Answer {
+		name := rr.Header().Name
+		if ptr, ok := rr.(*dns.PTR); ok {
+			// Reverse lookups answer with the name of the node.
+			name = ptr.Ptr
+		}
+		owner, ok := d.owners[t.ownerName(d, t.primaryName(name))]
+		if !ok || seen[owner.host] {
+			continue
+		}
+		seen[owner.host] = true
+		a.nodes = append(a.nodes, t.logName(owner.host))
+		a.nodeIDs = append(a.nodeIDs, owner.id)
+	}
+	return a
+}
+
+// primaryName returns name, a name in any of the zones, in the primary zone.
+func (t *Tailscale) primaryName(name string) string {
+	if zone := t.matchZone(name); zone != "" && zone != t.zone {
+		return moveName(name, zone, t.zone)
+	}
+	return name
+}
@@ -0,0 +1,65 @@
+package tailscale
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+)
+
+// Backends the records of the tailnet are read from.
+const (
+	// backendLocalAPI watches the network map of tailscaled, or of the embedded tsnet node.
+	backendLocalAPI = "localapi"
+	// backendAPI polls the device list from the Tailscale API.
+	backendAPI = "api"
+	// backendHeadscale polls the nodes of a Headscale server.
+	backendHeadscale = "headscale"
+)
+
+// backends returns the backends configured, most preferred first. Without an explicit list, the API
+// or Headscale is used if credentials for it are configured, and the LocalAPI otherwise.
+func (c Config) backends() []string {
+	switch {
+	case len(c.Backends) > 0:
+		return c.Backends
+	case c.usesAPI():
+		return []string{backendAPI}
+	case c.usesHeadscale():
+		return []string{backendHeadscale}
+	}
+	return []string{backendLocalAPI}
+}
+
+// validateBackendOrder checks the configured backends. The API and Headscale can only be a fallback
+// for the LocalAPI, as they have no way to tell that a better backend is available again.
+func (c Config) validateBackendOrder() error {
+	backends := c.backends()
+	switch {
+	case len(backends) == 1 && slices.Contains([]string{backendLocalAPI, backendAPI, backendHeadscale}, backends[0]):
+	case slices.Equal(backends, []string{backendLocalAPI, backendAPI}), slices.Equal(backends, []string{backendLocalAPI, backendHeadscale}):
+	default:
+		return fmt.Errorf("invalid backend %v, want localapi, api, headscale, or localapi then api or headscale", backends)
+	}
+	if slices.Contains(backends, backendAPI) != c.usesAPI() {
+		if c.usesAPI() {
+			return errors.New("api_key and oauth require the api backend")
+		}
+		return errors.New("the api backend requires api_key or oauth")
+	}
+	if slices.Contains(backends, backendHeadscale) != c.usesHeadscale() {
+		if c.usesHeadscale() {
+			return errors.New("headscale requires the headscale backend")
+		}
+		return errors.New("the headscale backend requires headscale")
+	}
+	return nil
+}
+
+// setActiveBackend reports backend as the one the records currently come from. Backends other than
+// the built-in ones are reported by the name of their Source.
+func setActiveBackend(backend string) {
+	for _, b := range []string{backendLocalAPI, backendAPI, backendHeadscale} {
+		ActiveBackend.WithLabelValues("", b).Set(0)
+	}
+	ActiveBackend.WithLabelValues("", backend).Set(1)
+}
@@ -0,0 +1,46 @@
+package tailscale
+
+import (
+	"context"
+	"runtime/pprof"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// background runs the long-lived goroutines of a running instance in a single group: watching the
+// tailnet, polling the API and serving the endpoints. stop cancels all of them together and waits
+// until every one has returned, so none outlives the instance across reloads.
+type background struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	group  errgroup.Group
+}
+
+func newBackground() *background {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &background{ctx: ctx, cancel: cancel}
+}
+
+// Go runs fn in the group. The goroutine is labeled with name, in goroutine profiles and in the
+// goroutines metric. An error returned while the group is running is logged; it doesn't stop the
+// other goroutines, which keep the plugin serving.
+func (b *background) Go(name string, fn func(ctx context.Context) error) {
+	b.group.Go(func() error {
+		Goroutines.WithLabelValues(name).Inc()
+		defer Goroutines.WithLabelValues(name).Dec()
+		var err error
+		pprof.Do(b.ctx, pprof.Labels("tailscale", name), func(ctx context.Context) {
+			err = fn(ctx)
+		})
+		if err != nil && b.ctx.Err() == nil {
+			log.Errorf("Background task %s failed: %v", name, err)
+		}
+		return nil
+	})
+}
+
+// stop cancels the context of the group and waits for its goroutines to return.
+func (b *background) stop() {
+	b.cancel()
+	b.group.Wait()
+}
@@ -0,0 +1,88 @@
+package tailscale
+
+import (
+	"runtime"
+	"runtime/debug"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// modulePath is the module path of the plugin, used to find its version in the binary's build info.
+const modulePath = "github.com/ShrewdHydra/coredns-tailscale"
+
+// versionLabel and configLabel are the labels below the zone at which the plugin version and the
+// configuration hash are published as CH TXT records.
+const (
+	versionLabel = "version"
+	configLabel  = "config"
+)
+
+// version and commit identify the plugin build. They are read from the build info of the CoreDNS
+// binary, unless set at link time with -ldflags "-X github.com/ShrewdHydra/coredns-tailscale.version=...".
+var (
+	version string
+	commit  string
+)
+
+func init() {
+	version, commit = buildVersion(version, commit)
+	BuildInfo.WithLabelValues(version, runtime.Version(), commit).Set(1)
+}
+
+// buildVersion fills in the version and commit not set at link time from the build info. When the
+// plugin is compiled into CoreDNS it is a dependency, so its version is the one of the required
+// module; the VCS revision is only recorded when this module is the main module, e.g. in tests.
+func buildVersion(version, commit string) (string, string) {
+	info, ok := debug.ReadBuildInfo()
+	if ok && version == "" {
+		if info.Main.Path == modulePath {
+			version = info.Main.Version
+		}
+		for _, dep := range info.Deps {
+			if dep.Path != modulePath {
+				continue
+			}
+			version = dep.Version
+			if dep.Replace != nil && dep.Replace.Version != "" {
+				version = dep.Replace.Version
+			}
+		}
+	}
+	if ok && commit == "" && info.Main.Path == modulePath {
+		for _, setting := range info.Settings {
+			if setting.Key == "vcs.revision" {
+				commit = setting.Value
+			}
+		}
+	}
+	if version == "" {
+		version = "(devel)"
+	}
+	if commit == "" {
+		commit = "unknown"
+	}
+	return version, commit
+}
+
+// resolveVersion adds the plugin version or the configuration hash as a CH TXT record to msg if
+// domainName is the version or config name.
+func (t *Tailscale) resolveVersion(d *zoneData, domainName string, msg *dns.Msg) {
+	prefix, name := t.splitName(d, domainName)
+	if prefix != "" {
+		return
+	}
+	var txt []string
+	switch {
+	case strings.EqualFold(name, versionLabel):
+		txt = []string{version, commit}
+	case strings.EqualFold(name, configLabel):
+		txt = []string{t.configHash}
+	default:
+		return
+	}
+	msg.Answer = append(msg.Answer, &dns.TXT{
+		Hdr: dns.RR_Header{Name: domainName, Rrtype: dns.TypeTXT, Class: dns.ClassCHAOS, Ttl: 0},
+		Txt: txt,
+	})
+}
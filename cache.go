@@ -0,0 +1,142 @@
+package tailscale
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/miekg/dns"
+)
+
+// DefaultAnswerCacheSize is the number of answers answer_cache keeps by default.
+const DefaultAnswerCacheSize = 10000
+
+// answerKey identifies a cached answer. Clients that may be answered differently, because of their
+// view, rebind protection or filter_aaaa, are told apart by client, which is empty for the others.
+type answerKey struct {
+	qname  string
+	zone   string
+	qtype  uint16
+	qclass uint16
+	client string
+}
+
+// answerClient returns the part of the key of cached answers that depends on the client: its view,
+// whether it's outside the tailnet and whether its AAAA records are filtered.
+func answerClient(view *clientView, external, filterAAAA bool) string {
+	if view == nil && !external && !filterAAAA {
+		return ""
+	}
+	var b strings.Builder
+	if view != nil {
+		b.WriteString(view.name)
+		b.WriteByte(0)
+		b.WriteString(view.self)
+		b.WriteByte(0)
+		b.WriteString(strings.Join(view.show, ","))
+	}
+	if external {
+		b.WriteString("\x00external")
+	}
+	if filterAAAA {
+		b.WriteString("\x00filter_aaaa")
+	}
+	return b.String()
+}
+
+// answerCache keeps answers packed, so a cached answer is unpacked into records of its own for every
+// query, which may change them. Answers are cached in a generation, and all of them are dropped at
+// once by starting a new one when the records change: answers built from the old records are put in
+// the generation they started in, which is no longer used. A nil answerCache caches nothing.
+type answerCache struct {
+	size int
+	gen  atomic.Pointer[answerGen]
+}
+
+// answerGen is a generation of up to size cached answers.
+type answerGen struct {
+	size    int
+	answers sync.Map // answerKey → *cachedAnswer
+	count   atomic.Int64
+}
+
+type cachedAnswer struct {
+	rcode  int
+	packed []byte
+}
+
+// newAnswerCache returns a cache of size answers.
+func newAnswerCache(size int) *answerCache {
+	c := &answerCache{size: size}
+	c.gen.Store(&answerGen{size: c.size})
+	return c
+}
+
+// generation returns the current generation, which an answer must be put in once built. It returns
+// nil for a nil cache.
+func (c *answerCache) generation() *answerGen {
+	if c == nil {
+		return nil
+	}
+	return c.gen.Load()
+}
+
+// get copies the records of the answer cached in the generation for key into msg and returns its
+// rcode, reporting whether there was one. A nil generation has none.
+func (g *answerGen) get(key answerKey, msg *dns.Msg) (int, bool) {
+	if g == nil {
+		return 0, false
+	}
+	v, ok := g.answers.Load(key)
+	if !ok {
+		return 0, false
+	}
+	entry := v.(*cachedAnswer)
+	var cached dns.Msg
+	if err := cached.Unpack(entry.packed); err != nil {
+		log.Warningf("Unable to unpack cached answer: %v", err)
+		return 0, false
+	}
+	msg.Answer, msg.Ns, msg.Extra = cached.Answer, cached.Ns, cached.Extra
+	return entry.rcode, true
+}
+
+// put caches the records of msg with rcode for key, unless the generation is nil. A full generation is
+// emptied first, so a scan of the zone doesn't grow it beyond its size. It returns an error if the
+// records can't be packed, leaving the name to be logged by the caller as privacy requires.
+func (g *answerGen) put(key answerKey, msg *dns.Msg, rcode int) error {
+	if g == nil {
+		return nil
+	}
+	// Only the records are kept, without compression, which could change the case of names.
+	packed, err := (&dns.Msg{Answer: msg.Answer, Ns: msg.Ns, Extra: msg.Extra}).Pack()
+	if err != nil {
+		return err
+	}
+	if g.count.Load() >= int64(g.size) {
+		g.answers.Clear()
+		g.count.Store(0)
+	}
+	if _, loaded := g.answers.Swap(key, &cachedAnswer{rcode: rcode, packed: packed}); !loaded {
+		g.count.Add(1)
+	}
+	return nil
+}
+
+// flush drops all cached answers. It does nothing for a nil cache.
+func (c *answerCache) flush() {
+	if c == nil {
+		return
+	}
+	c.gen.Store(&answerGen{size: c.size})
+}
+
+// cacheableName reports whether the answers for domainName only depend on the records, which excludes
+// the LAN addresses registered by agents, that expire, and the zone statistics.
+func (t *Tailscale) cacheableName(d *zoneData, domainName string) bool {
+	if t.isStatsName(d, domainName) {
+		return false
+	}
+	prefix, _ := t.splitName(d, domainName)
+	return !strings.EqualFold(prefix, lanLabel)
+}
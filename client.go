@@ -0,0 +1,79 @@
+package tailscale
+
+import (
+	"context"
+	"net/netip"
+
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+// clientIP returns the address of the client that sent the request.
+//
+// When CoreDNS sits behind a DNS load balancer such as dnsdist, the source address of every query is
+// the proxy's. If the query arrived from one of the configured trusted proxies and carries an EDNS0
+// Client Subnet option with a full-length source prefix (/32 or /128), the address in that option is
+// returned instead. On the listeners of the embedded node, the address a trusted proxy sent in a
+// PROXY protocol header is the source address already, see proxyPacketConn.
+func (t *Tailscale) clientIP(state request.Request) netip.Addr {
+	remote, err := netip.ParseAddr(state.IP())
+	if err != nil {
+		return netip.Addr{}
+	}
+	remote = remote.Unmap()
+
+	if !t.isTrustedProxy(remote) {
+		return remote
+	}
+
+	opt := state.Req.IsEdns0()
+	if opt == nil {
+		return remote
+	}
+	for _, o := range opt.Option {
+		ecs, ok := o.(*dns.EDNS0_SUBNET)
+		if !ok {
+			continue
+		}
+		addr, ok := netip.AddrFromSlice(ecs.Address)
+		if !ok {
+			break
+		}
+		addr = addr.Unmap()
+		if int(ecs.SourceNetmask) != addr.BitLen() {
+			// Only a full-length prefix identifies a single client.
+			log.Debugf("Ignoring client subnet %s/%d from trusted proxy %s", addr, ecs.SourceNetmask, remote)
+			break
+		}
+		return addr
+	}
+	return remote
+}
+
+// clientKey is the context key of the client address of a query.
+type clientKey struct{}
+
+// withClient returns a context carrying client, the address ServeDNS determined for the client of
+// the query, for responding to it without looking at the request again.
+func withClient(ctx context.Context, client netip.Addr) context.Context {
+	return context.WithValue(ctx, clientKey{}, client)
+}
+
+// queryClient returns the client address of the query of state, as carried by ctx, or determined
+// from state for responses written outside of ServeDNS.
+func (t *Tailscale) queryClient(ctx context.Context, state request.Request) netip.Addr {
+	if client, ok := ctx.Value(clientKey{}).(netip.Addr); ok {
+		return client
+	}
+	return t.clientIP(state)
+}
+
+// isTrustedProxy reports whether addr is within one of the configured trusted proxy ranges.
+func (t *Tailscale) isTrustedProxy(addr netip.Addr) bool {
+	for _, pfx := range t.trustedProxies {
+		if pfx.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,88 @@
+package tailscale
+
+import (
+	"maps"
+	"slices"
+
+	clog "github.com/coredns/coredns/plugin/pkg/log"
+	"github.com/miekg/dns"
+)
+
+// dropInvalidCNAMEs removes the CNAME targets of entries that aren't valid names, or that lead back
+// to their owner, which can happen when static records and tag CNAME records point to each other.
+// The entries changed are replaced rather than modified, as they may belong to a source. It returns
+// the names of the owners of the targets removed, sorted, and warns when they differ from the last
+// call.
+func (t *Tailscale) dropInvalidCNAMEs(entries map[string]map[string][]string) []string {
+	var dropped []string
+	for _, host := range slices.Sorted(maps.Keys(entries)) {
+		targets := entries[host]["CNAME"]
+		valid := make([]string, 0, len(targets))
+		for _, target := range targets {
+			if _, ok := dns.IsDomainName(target); !ok {
+				if clog.D.Value() {
+					log.Debugf("Invalid CNAME target %q of %s, ignoring it", target, t.logName(host))
+				}
+				continue
+			}
+			if t.cnameReaches(entries, target, host, map[string]bool{}) {
+				if clog.D.Value() {
+					log.Debugf("CNAME record of %s to %s leads back to it, ignoring it", t.logName(host), t.logName(target))
+				}
+				continue
+			}
+			valid = append(valid, target)
+		}
+		if len(valid) == len(targets) {
+			continue
+		}
+
+		entry := maps.Clone(entries[host])
+		entry["CNAME"] = valid
+		if len(valid) == 0 {
+			delete(entry, "CNAME")
+		}
+		if len(entry) == 0 {
+			// Nothing is left of a name with just CNAME records.
+			delete(entries, host)
+		} else {
+			entries[host] = entry
+		}
+		dropped = append(dropped, host)
+	}
+
+	// The same records come with every network map, so only changes are worth a warning.
+	t.cnameMu.Lock()
+	defer t.cnameMu.Unlock()
+	if len(dropped) > 0 && !slices.Equal(dropped, t.droppedCNAMEs) {
+		names := make([]string, len(dropped))
+		for i, host := range dropped {
+			names[i] = t.logName(host)
+		}
+		log.Warningf("Ignoring CNAME records of %v that are invalid or loop", names)
+	}
+	t.droppedCNAMEs = dropped
+	return dropped
+}
+
+// cnameReaches reports whether following the CNAME records from target, a name, leads to the host
+// owner. Targets outside the zone lead nowhere.
+func (t *Tailscale) cnameReaches(entries map[string]map[string][]string, target, owner string, seen map[string]bool) bool {
+	if !dns.IsSubDomain(dns.Fqdn(t.zone), dns.Fqdn(target)) {
+		return false
+	}
+	_, host := t.splitName(t.load(), target)
+	if host == owner {
+		return true
+	}
+	if host == "" || seen[host] {
+		return false
+	}
+	seen[host] = true
+	for _, next := range entries[host]["CNAME"] {
+		if t.cnameReaches(entries, next, owner, seen) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,151 @@
+package tailscale
+
+import (
+	"maps"
+	"slices"
+	"strings"
+
+	"tailscale.com/tailcfg"
+)
+
+// Policies for hostnames more than one node has, e.g. after truncation or when the same machine is
+// added to the tailnet again.
+const (
+	// collisionMerge publishes the records of all the nodes under the hostname.
+	collisionMerge = "merge"
+	// collisionOnline publishes the node that's online, the newest one if more or none are.
+	collisionOnline = "online"
+	// collisionNewest publishes the node added to the tailnet last.
+	collisionNewest = "newest"
+	// collisionError publishes none of the nodes.
+	collisionError = "error"
+)
+
+// DefaultHostnameCollisions merges the records of the nodes sharing a hostname.
+const DefaultHostnameCollisions = collisionMerge
+
+// namedNode is a node to publish with the hostname it's published under.
+type namedNode struct {
+	node     tailcfg.NodeView
+	hostname string
+}
+
+// nodeOnline reports whether node is known to be online.
+func nodeOnline(node tailcfg.NodeView) bool {
+	online, ok := node.Online().GetOk()
+	return ok && online
+}
+
+// newerNode reports whether a was added to the tailnet after b. Nodes added at the same time, or
+// without the time, are ordered by ID, which control hands out in increasing order.
+func newerNode(a, b tailcfg.NodeView) bool {
+	if !a.Created().Equal(b.Created()) {
+		return a.Created().After(b.Created())
+	}
+	return a.ID() > b.ID()
+}
+
+// preferNode reports whether a is published rather than b under the hostname they share, according
+// to the hostname_collisions policy.
+func (t *Tailscale) preferNode(a, b tailcfg.NodeView) bool {
+	if t.collisionPolicy == collisionOnline && nodeOnline(a) != nodeOnline(b) {
+		return nodeOnline(a)
+	}
+	return newerNode(a, b)
+}
+
+// nodeLogName returns the name of node to log, its MagicDNS name, which is unique in the tailnet.
+func nodeLogName(node tailcfg.NodeView) string {
+	if node.Name() != "" {
+		return strings.TrimSuffix(node.Name(), ".")
+	}
+	return string(node.StableID())
+}
+
+// resolveCollisions applies the hostname_collisions policy to nodes, returning the nodes to publish,
+// in order, and the hostnames more than one node has, with the names of the nodes sorted.
+func (t *Tailscale) resolveCollisions(nodes []namedNode) ([]namedNode, map[string][]string) {
+	byName := map[string][]int{}
+	for i, n := range nodes {
+		byName[n.hostname] = append(byName[n.hostname], i)
+	}
+
+	collisions := map[string][]string{}
+	drop := map[int]bool{}
+	for hostname, idx := range byName {
+		if len(idx) < 2 {
+			continue
+		}
+		names := make([]string, len(idx))
+		for i, j := range idx {
+			names[i] = nodeLogName(nodes[j].node)
+		}
+		slices.Sort(names)
+		collisions[hostname] = names
+
+		switch t.collisionPolicy {
+		case collisionMerge:
+		case collisionError:
+			for _, j := range idx {
+				drop[j] = true
+			}
+		default:
+			keep := idx[0]
+			for _, j := range idx[1:] {
+				if t.preferNode(nodes[j].node, nodes[keep].node) {
+					keep = j
+				}
+			}
+			for _, j := range idx {
+				drop[j] = j != keep
+			}
+		}
+	}
+	if len(drop) == 0 {
+		return nodes, collisions
+	}
+	kept := make([]namedNode, 0, len(nodes))
+	for i, n := range nodes {
+		if !drop[i] {
+			kept = append(kept, n)
+		}
+	}
+	return kept, collisions
+}
+
+// mergeRecords adds the records of src that dst doesn't have yet to dst, for nodes merged under one
+// hostname.
+func mergeRecords(dst, src map[string][]string) {
+	for rrtype, values := range src {
+		for _, value := range values {
+			if !slices.Contains(dst[rrtype], value) {
+				dst[rrtype] = append(dst[rrtype], value)
+			}
+		}
+	}
+}
+
+// reportCollisions logs the hostnames more than one node has, when they differ from the last ones,
+// and exports their number.
+func (t *Tailscale) reportCollisions(collisions map[string][]string) {
+	t.mu.Lock()
+	changed := !maps.EqualFunc(collisions, t.collidingHosts, slices.Equal)
+	t.collidingHosts = collisions
+	t.mu.Unlock()
+
+	HostnameCollisions.WithLabelValues("", t.zone).Set(float64(len(collisions)))
+	if !changed {
+		return
+	}
+	for _, hostname := range slices.Sorted(maps.Keys(collisions)) {
+		nodes := strings.Join(collisions[hostname], ", ")
+		switch t.collisionPolicy {
+		case collisionMerge:
+			log.Warningf("Nodes %s share the name %s, merging their records", nodes, t.logName(hostname))
+		case collisionError:
+			log.Errorf("Nodes %s share the name %s, not publishing any of them", nodes, t.logName(hostname))
+		default:
+			log.Warningf("Nodes %s share the name %s, publishing the %s one", nodes, t.logName(hostname), t.collisionPolicy)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package tailscale
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Kinds of answer composition, see answerComposition.
+const (
+	compositionCNAME       = "cname"
+	compositionCNAMEChain  = "cname_chain"
+	compositionMultiTarget = "multi_target"
+	compositionFlattened   = "flattened"
+)
+
+// answerComposition returns the kinds of resolution the answer to qname, in zone, took, in the order
+// of the constants: following a CNAME record, a chain of more than one, a CNAME with more than one
+// target, and looking up the addresses of targets outside of zone upstream, whose records are
+// flattened into the answer.
+func answerComposition(answer []dns.RR, qname, zone string) []string {
+	targets := map[string][]string{}
+	flattened := false
+	for _, rr := range answer {
+		owner := strings.ToLower(rr.Header().Name)
+		if cname, ok := rr.(*dns.CNAME); ok {
+			targets[owner] = append(targets[owner], strings.ToLower(cname.Target))
+			continue
+		}
+		if !dns.IsSubDomain(dns.Fqdn(zone), owner) {
+			flattened = true
+		}
+	}
+	if len(targets) == 0 {
+		return nil
+	}
+
+	kinds := []string{compositionCNAME}
+	if cnameDepth(targets, strings.ToLower(qname), map[string]bool{}) > 1 {
+		kinds = append(kinds, compositionCNAMEChain)
+	}
+	for _, t := range targets {
+		if len(t) > 1 {
+			kinds = append(kinds, compositionMultiTarget)
+			break
+		}
+	}
+	if flattened {
+		kinds = append(kinds, compositionFlattened)
+	}
+	return kinds
+}
+
+// cnameDepth returns the length of the longest chain of CNAME records in targets starting at name.
+// seen holds the names of the chain so far, which loops end.
+func cnameDepth(targets map[string][]string, name string, seen map[string]bool) int {
+	if seen[name] {
+		return 0
+	}
+	seen[name] = true
+	defer delete(seen, name)
+	depth := 0
+	for _, target := range targets[name] {
+		depth = max(depth, 1+cnameDepth(targets, target, seen))
+	}
+	return depth
+}
@@ -0,0 +1,1596 @@
+package tailscale
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/upstream"
+	"github.com/miekg/dns"
+)
+
+// Default values for the plugin configuration.
+const (
+	// DefaultHostname is the hostname of the embedded tsnet node when an auth key is configured.
+	DefaultHostname = "coredns"
+	// DefaultLongNames skips records whose name is too long to publish.
+	DefaultLongNames = "reject"
+	// DefaultPrivacy logs query names verbatim.
+	DefaultPrivacy = "off"
+	// DefaultShedAction answers REFUSED to queries shed under overload.
+	DefaultShedAction = "refuse"
+	// DefaultPTRTarget answers PTR queries with names in the primary zone.
+	DefaultPTRTarget = "zone"
+)
+
+// Config is the effective configuration of a tailscale plugin instance. It is populated from the
+// Corefile by setup, or built programmatically with NewConfig, and turned into a plugin with New.
+type Config struct {
+	// Zones are the zones the plugin is authoritative for. The same records are served in each of
+	// them, and names in answers use the zone of the query. CNAME targets are built in the first zone.
+	Zones []string `json:"zones" yaml:"zones"`
+
+	// TSNet makes the plugin join the tailnet with an embedded tsnet node instead of connecting to the
+	// local tailscaled. Setting AuthKey implies it.
+	TSNet bool `json:"tsnet" yaml:"tsnet"`
+	// AuthKey is the auth key the embedded node logs in with, or env:NAME for the environment
+	// variable holding it. Without one, tsnet uses TS_AUTHKEY or logs a login URL.
+	AuthKey string `json:"authkey,omitempty" yaml:"authkey,omitempty"`
+	// Hostname is the hostname of the embedded tsnet node. Defaults to DefaultHostname.
+	Hostname string `json:"hostname" yaml:"hostname"`
+	// StateDir is the directory the embedded node keeps its state in. Defaults to a directory
+	// derived from the hostname below the user's configuration directory.
+	StateDir string `json:"state_dir,omitempty" yaml:"state_dir,omitempty"`
+	// TailnetListen is the address, usually :53, the embedded node serves DNS on in the tailnet. Empty
+	// disables it.
+	TailnetListen string `json:"tailnet_listen,omitempty" yaml:"tailnet_listen,omitempty"`
+
+	// PollInterval is how often the full netmap is fetched again while watching tailscaled or the
+	// embedded node for updates, as a fallback for missed updates. Defaults to 0, which only fetches it
+	// when reconnecting.
+	PollInterval time.Duration `json:"poll_interval" yaml:"poll_interval"`
+
+	// APIKey or OAuthClientID and OAuthClientSecret, if set, make the plugin poll the device list of
+	// Tailnet from the Tailscale API every APIInterval, instead of connecting to the tailnet.
+	APIKey            string        `json:"api_key,omitempty" yaml:"api_key,omitempty"`
+	OAuthClientID     string        `json:"oauth_client_id,omitempty" yaml:"oauth_client_id,omitempty"`
+	OAuthClientSecret string        `json:"oauth_client_secret,omitempty" yaml:"oauth_client_secret,omitempty"`
+	Tailnet           string        `json:"tailnet" yaml:"tailnet"`
+	APIInterval       time.Duration `json:"api_interval" yaml:"api_interval"`
+
+	// HeadscaleURL and HeadscaleAPIKey, if set, make the plugin poll the nodes of a Headscale server
+	// every HeadscaleInterval, instead of connecting to the tailnet.
+	HeadscaleURL      string        `json:"headscale_url,omitempty" yaml:"headscale_url,omitempty"`
+	HeadscaleAPIKey   string        `json:"headscale_api_key,omitempty" yaml:"headscale_api_key,omitempty"`
+	HeadscaleInterval time.Duration `json:"headscale_interval" yaml:"headscale_interval"`
+
+	// Backends lists the backends records are read from, most preferred first: "localapi" for
+	// tailscaled or the embedded node, "api" for the Tailscale API, "headscale" for a Headscale
+	// server. With the LocalAPI first, the other backend is polled while the LocalAPI is unavailable.
+	// Defaults to the API or Headscale if credentials for it are set, else the LocalAPI.
+	Backends []string `json:"backends,omitempty" yaml:"backends,omitempty"`
+
+	// Store is the backend keeping a durable copy of the records at StorePath, so they are served
+	// right away after a restart: "bolt" for a bbolt database file. Empty keeps records in memory only.
+	Store     string `json:"store,omitempty" yaml:"store,omitempty"`
+	StorePath string `json:"store_path,omitempty" yaml:"store_path,omitempty"`
+
+	// Export is the name of the export provider the records are mirrored to, in ExportZone at the
+	// provider, see RegisterExportProvider. ExportArgs configure the provider. Empty disables exporting.
+	Export     string   `json:"export,omitempty" yaml:"export,omitempty"`
+	ExportZone string   `json:"export_zone,omitempty" yaml:"export_zone,omitempty"`
+	ExportArgs []string `json:"export_args,omitempty" yaml:"export_args,omitempty"`
+
+	// RecordNetMaps is a file every network map received is appended to, for replaying them when
+	// reporting a bug. Empty disables recording.
+	RecordNetMaps string `json:"record_netmaps,omitempty" yaml:"record_netmaps,omitempty"`
+
+	// TTL is the TTL of records in seconds. Defaults to 60.
+	TTL uint32 `json:"ttl" yaml:"ttl"`
+	// NegativeTTL is the TTL of negative answers (NXDOMAIN and NODATA) in seconds. Defaults to 60.
+	NegativeTTL uint32 `json:"negative_ttl" yaml:"negative_ttl"`
+	// TTLJitter is the maximum number of seconds randomly added to or removed from answer TTLs.
+	// Defaults to 0, and must be less than the TTL.
+	TTLJitter uint32 `json:"ttl_jitter" yaml:"ttl_jitter"`
+
+	// Privacy controls how query names are logged: "off", "hash" or "truncate". Defaults to DefaultPrivacy.
+	Privacy string `json:"privacy" yaml:"privacy"`
+	// PrivacyKey is the hex encoded key, of at least 16 bytes, names are hashed with in the "hash"
+	// privacy mode. Instances whose logs are correlated should share it. Defaults to a random key per
+	// instance.
+	PrivacyKey string `json:"privacy_key,omitempty" yaml:"privacy_key,omitempty"`
+
+	// LongNames is what happens to device and tag names longer than a DNS label (63 bytes), or making
+	// the name in the zone longer than 255 bytes: "reject" skips their records, "truncate" shortens
+	// them. Defaults to DefaultLongNames.
+	LongNames string `json:"long_names" yaml:"long_names"`
+
+	// TrustedProxies lists proxies allowed to report the real client address via EDNS0 Client Subnet.
+	TrustedProxies []netip.Prefix `json:"trusted_proxies,omitempty" yaml:"trusted_proxies,omitempty"`
+
+	// MaxInflight is the number of queries that may be processed concurrently before further queries
+	// are shed. Defaults to 0, which disables load shedding.
+	MaxInflight int `json:"max_inflight" yaml:"max_inflight"`
+	// ShedAction is what happens to shed queries: "refuse" answers REFUSED, "fallthrough" passes them
+	// to the next plugin. Defaults to DefaultShedAction.
+	ShedAction string `json:"shed_action" yaml:"shed_action"`
+
+	// AnswerCacheSize is the number of answers kept until the records change, so they aren't built
+	// again for every query. Defaults to 0, which disables the cache.
+	AnswerCacheSize int `json:"answer_cache_size" yaml:"answer_cache_size"`
+
+	// AnswerOrder is the order of the records of RRsets with more than one record in answers: "fixed"
+	// keeps the order they're built in, "shuffle" shuffles them and "round_robin" rotates them with
+	// every response. Defaults to DefaultAnswerOrder. AnswerOrderSeed, if not 0, seeds the shuffle so
+	// it's repeatable.
+	AnswerOrder     string `json:"answer_order" yaml:"answer_order"`
+	AnswerOrderSeed uint64 `json:"answer_order_seed,omitempty" yaml:"answer_order_seed,omitempty"`
+
+	// HealthCheck leaves the addresses of unreachable nodes out of answers with more than one:
+	// "online" takes the nodes offline in the network map for unreachable, "tcp" and "https" probe
+	// HealthCheckPort of every address every HealthCheckInterval, and take it for unreachable once
+	// HealthCheckFailures probes failed in a row. Defaults to "", which disables health checks.
+	HealthCheck         string        `json:"health_check,omitempty" yaml:"health_check,omitempty"`
+	HealthCheckPort     uint16        `json:"health_check_port,omitempty" yaml:"health_check_port,omitempty"`
+	HealthCheckInterval time.Duration `json:"health_check_interval" yaml:"health_check_interval"`
+	HealthCheckFailures int           `json:"health_check_failures" yaml:"health_check_failures"`
+
+	// QueryLogRate writes a JSON line to standard output for every query answered, with the identity
+	// of the client in the tailnet, up to QueryLogRate lines per second. Defaults to 0, which disables
+	// the query log.
+	QueryLogRate int `json:"query_log_rate" yaml:"query_log_rate"`
+
+	// MaxLookups is the number of lookups, CNAME hops and glue included, answering a single query
+	// may take. Defaults to DefaultMaxLookups.
+	MaxLookups int `json:"max_lookups" yaml:"max_lookups"`
+	// MaxCNAMEChain is the number of CNAME records followed in a row when answering a query. Defaults
+	// to DefaultMaxCNAMEChain.
+	MaxCNAMEChain int `json:"max_cname_chain" yaml:"max_cname_chain"`
+
+	// Upstream looks up CNAME targets outside the zones through CoreDNS, adding their records to the
+	// answer. Defaults to false, which leaves them to the client.
+	Upstream bool `json:"upstream" yaml:"upstream"`
+
+	// Records are static records in zone file format, with names relative to the primary zone, e.g.
+	// "grafana CNAME monitoring". They are the manual record source.
+	Records []string `json:"records,omitempty" yaml:"records,omitempty"`
+
+	// Precedence lists the record sources ("manual", "tag", "device") from highest to lowest
+	// precedence. When sources have records for the same name, only the highest one's are served.
+	// Defaults to manual, tag, device.
+	Precedence []string `json:"precedence" yaml:"precedence"`
+
+	// NSID is the server identifier returned to clients that request it (RFC 5001). Defaults to empty,
+	// which disables NSID.
+	NSID string `json:"nsid,omitempty" yaml:"nsid,omitempty"`
+
+	// Cookies enables DNS cookies (RFC 7873). Defaults to false.
+	Cookies bool `json:"cookies" yaml:"cookies"`
+	// CookieSecret is the hex encoded secret, of at least 16 bytes, server cookies are derived from.
+	// Instances answering for the same clients behind an anycast address should share it. Defaults to
+	// a random secret per instance.
+	CookieSecret string `json:"cookie_secret,omitempty" yaml:"cookie_secret,omitempty"`
+
+	// MagicDNS passes queries for the MagicDNS domain of the tailnet on to MagicDNSResolver, so CoreDNS
+	// can be the only resolver of clients. Defaults to false.
+	MagicDNS         bool   `json:"magicdns" yaml:"magicdns"`
+	MagicDNSResolver string `json:"magicdns_resolver" yaml:"magicdns_resolver"`
+	// MagicDNSOverlap is what happens when the zones overlap with the DNS settings of the tailnet:
+	// "warn" logs the overlaps, "adjust" also stops passing queries on to MagicDNS that split DNS
+	// routes back to this node. Defaults to DefaultMagicDNSOverlap.
+	MagicDNSOverlap string `json:"magicdns_overlap" yaml:"magicdns_overlap"`
+
+	// DNSSEC signs responses to clients that set the DO bit. Defaults to false.
+	DNSSEC bool `json:"dnssec" yaml:"dnssec"`
+	// DNSSECKeys are the base names of the key pairs to sign with, as written by dnssec-keygen.
+	// Defaults to a key generated on startup.
+	DNSSECKeys []string `json:"dnssec_keys,omitempty" yaml:"dnssec_keys,omitempty"`
+
+	// Padding pads responses to queries over encrypted transports that ask for it to a multiple of
+	// this many bytes (RFC 7830). Defaults to 0, which disables padding.
+	Padding int `json:"padding" yaml:"padding"`
+
+	// RebindMarker publishes a _dns-rebind-ok.<zone> TXT record documenting that the zone serves
+	// private addresses. Defaults to false.
+	RebindMarker bool `json:"rebind_marker" yaml:"rebind_marker"`
+
+	// Stats publishes a _stats.<zone> TXT record with the number of hosts and records, and how long
+	// ago the records were synced. Defaults to false.
+	Stats bool `json:"stats" yaml:"stats"`
+
+	// TagEnumeration publishes PTR records to the nodes with each tag at _tag.<tag>.<zone>, e.g.
+	// _tag.prod.<zone> for tag:prod.
+	TagEnumeration bool `json:"tag_enumeration" yaml:"tag_enumeration"`
+
+	// ExposeMetadata publishes a TXT record with the operating system, Tailscale version, last seen
+	// time and exit node status of every node at _meta.<host>.<zone>. Defaults to false.
+	ExposeMetadata bool `json:"expose_metadata" yaml:"expose_metadata"`
+	// RebindProtection only answers with private, CGNAT, loopback and link-local addresses to clients
+	// inside the tailnet or RebindAllow, so resolvers with rebinding protection aren't tripped.
+	// Defaults to false.
+	RebindProtection bool `json:"rebind_protection" yaml:"rebind_protection"`
+	// RebindAllow lists additional client ranges considered internal by RebindProtection.
+	RebindAllow []netip.Prefix `json:"rebind_allow,omitempty" yaml:"rebind_allow,omitempty"`
+
+	// FilterAAAA strips AAAA records from the answers to the clients in these ranges, and
+	// FilterAAAATags from those to the nodes with one of these tags, for clients whose IPv6
+	// connectivity is broken. Defaults to none.
+	FilterAAAA     []netip.Prefix `json:"filter_aaaa,omitempty" yaml:"filter_aaaa,omitempty"`
+	FilterAAAATags []string       `json:"filter_aaaa_tags,omitempty" yaml:"filter_aaaa_tags,omitempty"`
+
+	// PreferFamily is the address family listed first in answers and additional sections with both,
+	// "ipv4" or "ipv6". Defaults to DefaultPreferFamily.
+	PreferFamily string `json:"prefer_family" yaml:"prefer_family"`
+
+	// IPv4 and IPv6 restrict the addresses of nodes that are published: "only" publishes those of the
+	// family alone, "off" none of them. Defaults to "", publishing both families.
+	IPv4 string `json:"ipv4,omitempty" yaml:"ipv4,omitempty"`
+	IPv6 string `json:"ipv6,omitempty" yaml:"ipv6,omitempty"`
+
+	// Any is how ANY queries are answered: "hinfo" with a single HINFO record for existing names
+	// (RFC 8482), "all" with all the records of the name. Defaults to DefaultAny.
+	Any string `json:"any" yaml:"any"`
+
+	// AnswerHooks are the names of the answer hooks run on every response, in order, see
+	// RegisterAnswerHook. Defaults to none.
+	AnswerHooks []string `json:"answer_hooks,omitempty" yaml:"answer_hooks,omitempty"`
+
+	// InternalErrors is how queries left without an answer by an internal failure, like an exhausted
+	// lookup budget or records not synced yet, are answered: "servfail", or "negative" with NXDOMAIN
+	// or NODATA like names that don't exist. Defaults to DefaultInternalErrors.
+	InternalErrors string `json:"internal_errors" yaml:"internal_errors"`
+
+	// EnumerationDetect flags clients querying EnumerationThreshold distinct names within
+	// EnumerationWindow, which may be an attempt to map the tailnet. Defaults to false.
+	EnumerationDetect    bool          `json:"enumeration_detect" yaml:"enumeration_detect"`
+	EnumerationThreshold int           `json:"enumeration_threshold" yaml:"enumeration_threshold"`
+	EnumerationWindow    time.Duration `json:"enumeration_window" yaml:"enumeration_window"`
+
+	// NameServers are the name servers published in the NS records of the zones, and the first of
+	// them in the SOA record. Names in the primary zone are moved to the zone of the query. Defaults to
+	// the hostname in the primary zone.
+	NameServers []string `json:"name_servers,omitempty" yaml:"name_servers,omitempty"`
+	// SOAMbox is the mailbox of the person responsible for the zones, as a domain name or email
+	// address. Defaults to hostmaster in the primary zone.
+	SOAMbox string `json:"soa_mbox,omitempty" yaml:"soa_mbox,omitempty"`
+	// SOARefresh, SOARetry and SOAExpire are the SOA timers in seconds.
+	SOARefresh uint32 `json:"soa_refresh" yaml:"soa_refresh"`
+	SOARetry   uint32 `json:"soa_retry" yaml:"soa_retry"`
+	SOAExpire  uint32 `json:"soa_expire" yaml:"soa_expire"`
+
+	// Services publishes SRV records for the services of nodes with a tag. SRVHostinfo also publishes
+	// the services nodes advertise on well-known ports. Defaults to none.
+	Services    []ServiceMapping `json:"services,omitempty" yaml:"services,omitempty"`
+	SRVHostinfo bool             `json:"srv_hostinfo" yaml:"srv_hostinfo"`
+
+	// Wildcard decides whether the records of hosts are served for names below them: "on" for every
+	// host, "off" for none, or a tag for the machines with the tag. Defaults to DefaultWildcard.
+	Wildcard string `json:"wildcard" yaml:"wildcard"`
+
+	// IncludeTags only publishes nodes with at least one of the tags, and ExcludeTags never publishes
+	// nodes with any of them. Defaults to all nodes.
+	IncludeTags []string `json:"include_tags,omitempty" yaml:"include_tags,omitempty"`
+	ExcludeTags []string `json:"exclude_tags,omitempty" yaml:"exclude_tags,omitempty"`
+
+	// Profiles are named record policies applied to the nodes with their tags. A node with the tags
+	// of several profiles gets the first one. Defaults to none.
+	Profiles []Profile `json:"profiles,omitempty" yaml:"profiles,omitempty"`
+
+	// Views restrict the machines clients see by who they are in the tailnet. A client gets the first
+	// view that applies to it. Defaults to none, every client sees all machines.
+	Views []View `json:"views,omitempty" yaml:"views,omitempty"`
+	// ViewCapability is the app capability views are granted with in the policy file of the tailnet,
+	// which take precedence over Views. Empty doesn't read views from the policy file.
+	ViewCapability string `json:"view_capability,omitempty" yaml:"view_capability,omitempty"`
+
+	// OfflineNodes is what happens to the records of nodes reported offline: "serve" keeps serving
+	// them, "omit" removes them, and "flag" serves them with a TTL of at most OfflineTTL, so clients
+	// soon look them up again. Profiles with online_only omit their nodes regardless. Defaults to
+	// DefaultOfflineNodes.
+	OfflineNodes string `json:"offline_nodes" yaml:"offline_nodes"`
+	// OfflineTTL is the TTL of offline nodes with OfflineNodes "flag". Defaults to DefaultOfflineTTL.
+	OfflineTTL uint32 `json:"offline_ttl" yaml:"offline_ttl"`
+
+	// AdaptiveTTL shortens the TTL of the records of nodes likely to change soon: it's halved for
+	// ephemeral nodes, and again every time a node went offline within AdaptiveTTLWindow, down to
+	// AdaptiveTTLMin seconds. Defaults to false.
+	AdaptiveTTL       bool          `json:"adaptive_ttl" yaml:"adaptive_ttl"`
+	AdaptiveTTLMin    uint32        `json:"adaptive_ttl_min" yaml:"adaptive_ttl_min"`
+	AdaptiveTTLWindow time.Duration `json:"adaptive_ttl_window" yaml:"adaptive_ttl_window"`
+
+	// HostnameCollisions is what happens when more than one node has the same hostname: "merge"
+	// publishes the records of all of them, "online" the one that's online, "newest" the one added to
+	// the tailnet last, and "error" none of them. Defaults to DefaultHostnameCollisions.
+	HostnameCollisions string `json:"hostname_collisions" yaml:"hostname_collisions"`
+
+	// Subzones maps tags to the label of a subzone their nodes are published in as well, e.g. nodes
+	// tagged tag:k8s at <host>.k8s.<zone>. An empty label uses the tag's name. Defaults to none.
+	Subzones map[string]string `json:"subzones,omitempty" yaml:"subzones,omitempty"`
+
+	// UserSubzones also publishes the nodes of each user in a subzone named after the user, e.g. the
+	// nodes of alice@example.com at <host>.alice.<zone>. Tagged nodes aren't. Defaults to false.
+	UserSubzones bool `json:"user_subzones" yaml:"user_subzones"`
+
+	// ALPN maps tags to the ALPN protocols, e.g. h2 and http/1.1, advertised in the SVCB and HTTPS
+	// records of nodes with the tag. Defaults to none, which leaves the protocols to the client.
+	ALPN map[string][]string `json:"alpn,omitempty" yaml:"alpn,omitempty"`
+
+	// Glue adds the addresses of names in the zones that NS, MX, SRV, SVCB and HTTPS answers point to,
+	// to the additional section. Defaults to false.
+	Glue bool `json:"glue" yaml:"glue"`
+
+	// PTRTarget is the name PTR queries are answered with: "zone" for the node's name in the primary
+	// zone, or "magicdns" for its MagicDNS name. Defaults to DefaultPTRTarget.
+	PTRTarget string `json:"ptr_target" yaml:"ptr_target"`
+
+	// TransferPeers restricts zone transfers to the listed tailnet nodes, by machine name or as
+	// tag:<name> for every node with the tag. Empty leaves transfers to the transfer plugin.
+	TransferPeers []string `json:"transfer_peers,omitempty" yaml:"transfer_peers,omitempty"`
+
+	// AppConnectorLabel publishes the apps served by app connectors as <app>.<label>.<zone>, with the
+	// addresses of their connectors and their domains. Empty doesn't publish them.
+	AppConnectorLabel string `json:"app_connector_label,omitempty" yaml:"app_connector_label,omitempty"`
+	// TopologyRecords publishes the addresses of the exit nodes at exit-nodes.<zone>, of the subnet
+	// routers at routers.<zone>, and of the routers of each subnet route at <route>.routes.<zone>.
+	TopologyRecords bool `json:"topology_records" yaml:"topology_records"`
+	// EndpointLabel publishes the public endpoints of nodes, the addresses they're reachable at from
+	// the internet, as <host>.<label>.<zone>. Empty doesn't publish them.
+	EndpointLabel string `json:"endpoint_label,omitempty" yaml:"endpoint_label,omitempty"`
+
+	// AgentAddr is the address of the HTTPS endpoint companion agents register the LAN addresses of
+	// their node at, published as lan.<host>.<zone>. Empty disables the endpoint.
+	AgentAddr string `json:"agent_addr,omitempty" yaml:"agent_addr,omitempty"`
+	// AgentExpiry is how long registered LAN addresses are published without being refreshed.
+	// Defaults to DefaultAgentExpiry.
+	AgentExpiry time.Duration `json:"agent_expiry" yaml:"agent_expiry"`
+
+	// DebugAddr is the address of the debug HTTP endpoint, which lists recent sync events. Empty
+	// disables the endpoint.
+	DebugAddr string `json:"debug_addr,omitempty" yaml:"debug_addr,omitempty"`
+	// SyncEvents is the number of sync events kept for the debug endpoint. Defaults to 100.
+	SyncEvents int `json:"sync_events" yaml:"sync_events"`
+
+	// MaxStaleness is how old the records may get, while changes aren't pushed by the LocalAPI,
+	// before the instance reports itself unhealthy. Defaults to 0, which never does.
+	MaxStaleness time.Duration `json:"max_staleness" yaml:"max_staleness"`
+
+	// Fallthrough enables passing queries without an answer on to the next plugin.
+	Fallthrough bool `json:"fallthrough" yaml:"fallthrough"`
+	// FallthroughZones restricts fallthrough to the listed zones. Empty means all zones.
+	FallthroughZones []string `json:"fallthrough_zones,omitempty" yaml:"fallthrough_zones,omitempty"`
+	// FallthroughTypes restricts fallthrough to queries of the listed types, e.g. "MX". Queries of other
+	// types are answered with NXDOMAIN or NODATA. Empty means all types.
+	FallthroughTypes []string `json:"fallthrough_types,omitempty" yaml:"fallthrough_types,omitempty"`
+	// PassthroughUnknownTypes passes queries for types the plugin has no records of, like MX or NAPTR,
+	// on to the next plugin instead of answering them with NXDOMAIN or NODATA. Defaults to false.
+	PassthroughUnknownTypes bool `json:"passthrough_unknown_types" yaml:"passthrough_unknown_types"`
+}
+
+// Option modifies a Config.
+type Option func(*Config)
+
+// DefaultConfig returns a Config with every setting at its default. The zone must still be set.
+func DefaultConfig() Config {
+	return Config{
+		Hostname:             DefaultHostname,
+		Tailnet:              DefaultTailnet,
+		APIInterval:          DefaultAPIInterval,
+		HeadscaleInterval:    DefaultHeadscaleInterval,
+		TTL:                  defaultTTL,
+		NegativeTTL:          defaultTTL,
+		Privacy:              DefaultPrivacy,
+		LongNames:            DefaultLongNames,
+		ShedAction:           DefaultShedAction,
+		MaxLookups:           DefaultMaxLookups,
+		MaxCNAMEChain:        DefaultMaxCNAMEChain,
+		Wildcard:             DefaultWildcard,
+		PTRTarget:            DefaultPTRTarget,
+		Precedence:           slices.Clone(defaultPrecedence),
+		EnumerationThreshold: DefaultEnumerationThreshold,
+		EnumerationWindow:    DefaultEnumerationWindow,
+		SOARefresh:           DefaultSOARefresh,
+		SOARetry:             DefaultSOARetry,
+		SOAExpire:            DefaultSOAExpire,
+		AgentExpiry:          DefaultAgentExpiry,
+		SyncEvents:           DefaultSyncEvents,
+		MagicDNSResolver:     DefaultMagicDNSResolver,
+		MagicDNSOverlap:      DefaultMagicDNSOverlap,
+		OfflineNodes:         DefaultOfflineNodes,
+		OfflineTTL:           DefaultOfflineTTL,
+		AdaptiveTTLMin:       DefaultAdaptiveTTLMin,
+		AdaptiveTTLWindow:    DefaultAdaptiveTTLWindow,
+		HostnameCollisions:   DefaultHostnameCollisions,
+		Any:                  DefaultAny,
+		InternalErrors:       DefaultInternalErrors,
+		PreferFamily:         DefaultPreferFamily,
+		AnswerOrder:          DefaultAnswerOrder,
+		HealthCheckInterval:  DefaultHealthCheckInterval,
+		HealthCheckFailures:  DefaultHealthCheckFailures,
+	}
+}
+
+// NewConfig returns the default configuration with opts applied in order.
+func NewConfig(opts ...Option) Config {
+	cfg := DefaultConfig()
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	return cfg
+}
+
+// WithZone sets the zone the plugin is authoritative for.
+func WithZone(zone string) Option {
+	return WithZones(zone)
+}
+
+// WithZones sets the zones the plugin is authoritative for, the first one being the primary zone.
+func WithZones(zones ...string) Option {
+	return func(c *Config) { c.Zones = zones }
+}
+
+// WithAuthKey makes the plugin join the tailnet with an embedded tsnet node using key.
+func WithAuthKey(key string) Option {
+	return func(c *Config) { c.AuthKey = key }
+}
+
+// WithPollInterval fetches the full netmap again every interval while watching for updates.
+func WithPollInterval(interval time.Duration) Option {
+	return func(c *Config) { c.PollInterval = interval }
+}
+
+// WithAPIKey makes the plugin poll the Tailscale API with an API key instead of connecting to the
+// tailnet.
+func WithAPIKey(key string) Option {
+	return func(c *Config) { c.APIKey = key }
+}
+
+// WithOAuth makes the plugin poll the Tailscale API with an OAuth client instead of connecting to the
+// tailnet.
+func WithOAuth(clientID, clientSecret string) Option {
+	return func(c *Config) {
+		c.OAuthClientID = clientID
+		c.OAuthClientSecret = clientSecret
+	}
+}
+
+// WithTailnet sets the tailnet polled from the Tailscale API, and how often.
+func WithTailnet(tailnet string, interval time.Duration) Option {
+	return func(c *Config) {
+		c.Tailnet = tailnet
+		c.APIInterval = interval
+	}
+}
+
+// WithHeadscale makes the plugin poll the nodes of the Headscale server at url with an API key every
+// interval, instead of connecting to the tailnet.
+func WithHeadscale(url, apiKey string, interval time.Duration) Option {
+	return func(c *Config) {
+		c.HeadscaleURL = url
+		c.HeadscaleAPIKey = apiKey
+		c.HeadscaleInterval = interval
+	}
+}
+
+// WithBackends sets the backends records are read from, most preferred first.
+func WithBackends(backends ...string) Option {
+	return func(c *Config) { c.Backends = backends }
+}
+
+// WithTSNet makes the plugin join the tailnet with an embedded tsnet node keeping its state in dir,
+// and serve DNS in the tailnet on listen unless it is empty.
+func WithTSNet(dir, listen string) Option {
+	return func(c *Config) {
+		c.TSNet = true
+		c.StateDir = dir
+		c.TailnetListen = listen
+	}
+}
+
+// WithHostname sets the hostname of the embedded tsnet node.
+func WithHostname(hostname string) Option {
+	return func(c *Config) { c.Hostname = hostname }
+}
+
+// WithStore keeps a durable copy of the records at path with backend.
+func WithStore(backend, path string) Option {
+	return func(c *Config) {
+		c.Store = backend
+		c.StorePath = path
+	}
+}
+
+// WithExport mirrors the records to zone at the export provider registered under provider, configured
+// with args.
+func WithExport(provider, zone string, args ...string) Option {
+	return func(c *Config) {
+		c.Export = provider
+		c.ExportZone = zone
+		c.ExportArgs = args
+	}
+}
+
+// WithRecordNetMaps appends every network map received to path.
+func WithRecordNetMaps(path string) Option {
+	return func(c *Config) { c.RecordNetMaps = path }
+}
+
+// WithTTL sets the TTL of records and of negative answers, in seconds.
+func WithTTL(ttl, negative uint32) Option {
+	return func(c *Config) {
+		c.TTL = ttl
+		c.NegativeTTL = negative
+	}
+}
+
+// WithTTLJitter sets the maximum TTL jitter in seconds.
+func WithTTLJitter(seconds uint32) Option {
+	return func(c *Config) { c.TTLJitter = seconds }
+}
+
+// WithPrivacy sets the privacy mode used when logging query names.
+func WithPrivacy(mode string) Option {
+	return func(c *Config) { c.Privacy = mode }
+}
+
+// WithPrivacyKey sets the key names are hashed with in the "hash" privacy mode. If key is empty a
+// random key is generated.
+func WithPrivacyKey(key string) Option {
+	return func(c *Config) { c.PrivacyKey = key }
+}
+
+// WithLongNames sets the policy for names too long to publish, "reject" or "truncate".
+func WithLongNames(policy string) Option {
+	return func(c *Config) { c.LongNames = policy }
+}
+
+// WithTrustedProxies adds proxies allowed to report the real client address.
+func WithTrustedProxies(prefixes ...netip.Prefix) Option {
+	return func(c *Config) { c.TrustedProxies = append(c.TrustedProxies, prefixes...) }
+}
+
+// WithMaxInflight enables load shedding above max concurrent queries, handling shed queries with
+// action ("refuse" or "fallthrough").
+func WithMaxInflight(max int, action string) Option {
+	return func(c *Config) {
+		c.MaxInflight = max
+		c.ShedAction = action
+	}
+}
+
+// WithAnswerOrder sets the order of the records of RRsets in answers, "fixed", "shuffle" or
+// "round_robin". A seed other than 0 makes the shuffle repeatable.
+func WithAnswerOrder(order string, seed uint64) Option {
+	return func(c *Config) {
+		c.AnswerOrder = order
+		c.AnswerOrderSeed = seed
+	}
+}
+
+// WithHealthCheck leaves the addresses of unreachable nodes out of answers with more than one. mode
+// "online" takes offline nodes for unreachable, "tcp" and "https" probe port every interval and take
+// an address for unreachable after failures failed probes in a row. A zero interval or failures
+// keeps the default.
+func WithHealthCheck(mode string, port uint16, interval time.Duration, failures int) Option {
+	return func(c *Config) {
+		c.HealthCheck = mode
+		c.HealthCheckPort = port
+		if interval != 0 {
+			c.HealthCheckInterval = interval
+		}
+		if failures != 0 {
+			c.HealthCheckFailures = failures
+		}
+	}
+}
+
+// WithAnswerCache caches up to size answers until the records change, or DefaultAnswerCacheSize if
+// size is 0.
+func WithAnswerCache(size int) Option {
+	return func(c *Config) {
+		if size == 0 {
+			size = DefaultAnswerCacheSize
+		}
+		c.AnswerCacheSize = size
+	}
+}
+
+// WithQueryLog writes a line for every query answered, up to perSecond lines per second, or
+// DefaultQueryLogRate if 0.
+func WithQueryLog(perSecond int) Option {
+	return func(c *Config) {
+		if perSecond == 0 {
+			perSecond = DefaultQueryLogRate
+		}
+		c.QueryLogRate = perSecond
+	}
+}
+
+// WithMaxLookups limits answering a single query to max lookups.
+func WithMaxLookups(max int) Option {
+	return func(c *Config) { c.MaxLookups = max }
+}
+
+// WithMaxCNAMEChain follows at most max CNAME records in a row.
+func WithMaxCNAMEChain(max int) Option {
+	return func(c *Config) { c.MaxCNAMEChain = max }
+}
+
+// WithUpstream looks up CNAME targets outside the zones through CoreDNS.
+func WithUpstream() Option {
+	return func(c *Config) { c.Upstream = true }
+}
+
+// WithRecord adds static records, given as zone file lines.
+func WithRecord(lines ...string) Option {
+	return func(c *Config) { c.Records = append(c.Records, lines...) }
+}
+
+// WithPrecedence sets the order of precedence of record sources, highest first.
+func WithPrecedence(sources ...string) Option {
+	return func(c *Config) { c.Precedence = sources }
+}
+
+// WithNSID sets the server identifier returned to clients that request NSID.
+func WithNSID(id string) Option {
+	return func(c *Config) { c.NSID = id }
+}
+
+// WithCookies enables DNS cookies. If secret is empty a random secret is generated.
+func WithCookies(secret string) Option {
+	return func(c *Config) {
+		c.Cookies = true
+		c.CookieSecret = secret
+	}
+}
+
+// WithMagicDNS passes queries for MagicDNS names on to resolver, or DefaultMagicDNSResolver if empty.
+func WithMagicDNS(resolver string) Option {
+	return func(c *Config) {
+		c.MagicDNS = true
+		if resolver != "" {
+			c.MagicDNSResolver = resolver
+		}
+	}
+}
+
+// WithMagicDNSOverlap sets what happens when the zones overlap with the DNS settings of the tailnet,
+// "warn" or "adjust".
+func WithMagicDNSOverlap(action string) Option {
+	return func(c *Config) { c.MagicDNSOverlap = action }
+}
+
+// WithDNSSEC signs responses with the key pairs at keys, or with a generated key if there are none.
+func WithDNSSEC(keys ...string) Option {
+	return func(c *Config) {
+		c.DNSSEC = true
+		c.DNSSECKeys = append(c.DNSSECKeys, keys...)
+	}
+}
+
+// WithPadding pads responses over encrypted transports to a multiple of block bytes.
+func WithPadding(block int) Option {
+	return func(c *Config) { c.Padding = block }
+}
+
+// WithTagEnumeration publishes the _tag.<tag> PTR records of every tag.
+func WithTagEnumeration() Option {
+	return func(c *Config) { c.TagEnumeration = true }
+}
+
+// WithExposeMetadata publishes the _meta TXT record of every node.
+func WithExposeMetadata() Option {
+	return func(c *Config) { c.ExposeMetadata = true }
+}
+
+// WithRebindMarker publishes the _dns-rebind-ok TXT record.
+func WithRebindMarker() Option {
+	return func(c *Config) { c.RebindMarker = true }
+}
+
+// WithStats publishes the _stats TXT record.
+func WithStats() Option {
+	return func(c *Config) { c.Stats = true }
+}
+
+// WithRebindProtection only answers with internal addresses to clients inside the tailnet or allow.
+func WithRebindProtection(allow ...netip.Prefix) Option {
+	return func(c *Config) {
+		c.RebindProtection = true
+		c.RebindAllow = append(c.RebindAllow, allow...)
+	}
+}
+
+// WithFilterAAAA strips AAAA records from the answers to the clients in ranges, and to the nodes
+// with one of tags.
+func WithFilterAAAA(ranges []netip.Prefix, tags ...string) Option {
+	return func(c *Config) {
+		c.FilterAAAA = append(c.FilterAAAA, ranges...)
+		c.FilterAAAATags = append(c.FilterAAAATags, tags...)
+	}
+}
+
+// WithPreferFamily sets the address family listed first in answers with both, "ipv4" or "ipv6".
+func WithPreferFamily(family string) Option {
+	return func(c *Config) { c.PreferFamily = family }
+}
+
+// WithIPv4 sets the publication mode of IPv4 addresses, "only" or "off".
+func WithIPv4(mode string) Option {
+	return func(c *Config) { c.IPv4 = mode }
+}
+
+// WithIPv6 sets the publication mode of IPv6 addresses, "only" or "off".
+func WithIPv6(mode string) Option {
+	return func(c *Config) { c.IPv6 = mode }
+}
+
+// WithAny sets how ANY queries are answered, "hinfo" or "all".
+func WithAny(policy string) Option {
+	return func(c *Config) { c.Any = policy }
+}
+
+// WithAnswerHooks runs the answer hooks registered under names on every response.
+func WithAnswerHooks(names ...string) Option {
+	return func(c *Config) { c.AnswerHooks = append(c.AnswerHooks, names...) }
+}
+
+// WithInternalErrors sets how queries failed internally are answered, "servfail" or "negative".
+func WithInternalErrors(policy string) Option {
+	return func(c *Config) { c.InternalErrors = policy }
+}
+
+// WithEnumerationDetect flags clients querying threshold distinct names within window.
+func WithEnumerationDetect(threshold int, window time.Duration) Option {
+	return func(c *Config) {
+		c.EnumerationDetect = true
+		c.EnumerationThreshold = threshold
+		c.EnumerationWindow = window
+	}
+}
+
+// WithNameServers sets the name servers of the zones.
+func WithNameServers(names ...string) Option {
+	return func(c *Config) { c.NameServers = names }
+}
+
+// WithSOA sets the SOA mailbox and timers.
+func WithSOA(mbox string, refresh, retry, expire uint32) Option {
+	return func(c *Config) {
+		c.SOAMbox = mbox
+		c.SOARefresh = refresh
+		c.SOARetry = retry
+		c.SOAExpire = expire
+	}
+}
+
+// WithService publishes an SRV record for a service on every node with a tag.
+func WithService(m ServiceMapping) Option {
+	return func(c *Config) { c.Services = append(c.Services, m) }
+}
+
+// WithSRVHostinfo publishes SRV records for the services nodes advertise on well-known ports.
+func WithSRVHostinfo() Option {
+	return func(c *Config) { c.SRVHostinfo = true }
+}
+
+// WithWildcard sets the wildcard mode: "on", "off", or a tag.
+func WithWildcard(mode string) Option {
+	return func(c *Config) { c.Wildcard = mode }
+}
+
+// WithIncludeTags only publishes the nodes with at least one of tags.
+func WithIncludeTags(tags ...string) Option {
+	return func(c *Config) { c.IncludeTags = append(c.IncludeTags, tags...) }
+}
+
+// WithExcludeTags doesn't publish the nodes with any of tags.
+func WithExcludeTags(tags ...string) Option {
+	return func(c *Config) { c.ExcludeTags = append(c.ExcludeTags, tags...) }
+}
+
+// WithProfile adds the profile p, which applies to nodes after the profiles added before.
+func WithProfile(p Profile) Option {
+	return func(c *Config) { c.Profiles = append(c.Profiles, p) }
+}
+
+// WithView adds the view v, which applies to clients after the views added before.
+func WithView(v View) Option {
+	return func(c *Config) { c.Views = append(c.Views, v) }
+}
+
+// WithViewGrants answers clients with the views granted to them in the policy file with capability,
+// or DefaultViewCapability if empty.
+func WithViewGrants(capability string) Option {
+	return func(c *Config) {
+		if capability == "" {
+			capability = DefaultViewCapability
+		}
+		c.ViewCapability = capability
+	}
+}
+
+// WithSubzone also publishes the nodes with tag in the subzone label, or in one named after the tag if
+// label is empty.
+func WithSubzone(tag, label string) Option {
+	return func(c *Config) {
+		if c.Subzones == nil {
+			c.Subzones = map[string]string{}
+		}
+		c.Subzones[tag] = label
+	}
+}
+
+// WithUserSubzones also publishes the nodes of each user in a subzone named after the user.
+func WithUserSubzones() Option {
+	return func(c *Config) { c.UserSubzones = true }
+}
+
+// WithALPN advertises protocols in the SVCB and HTTPS records of nodes with tag.
+func WithALPN(tag string, protocols ...string) Option {
+	return func(c *Config) {
+		if c.ALPN == nil {
+			c.ALPN = map[string][]string{}
+		}
+		c.ALPN[tag] = append(c.ALPN[tag], protocols...)
+	}
+}
+
+// WithGlue adds the addresses of the targets of answers to the additional section.
+func WithGlue() Option {
+	return func(c *Config) { c.Glue = true }
+}
+
+// WithPTRTarget sets the name PTR queries are answered with, "zone" or "magicdns".
+func WithPTRTarget(target string) Option {
+	return func(c *Config) { c.PTRTarget = target }
+}
+
+// WithTransferPeers restricts zone transfers to the given tailnet nodes and tags.
+func WithTransferPeers(peers ...string) Option {
+	return func(c *Config) { c.TransferPeers = append(c.TransferPeers, peers...) }
+}
+
+// WithTopologyRecords publishes the records of the exit nodes, subnet routers and subnet routes.
+func WithTopologyRecords() Option {
+	return func(c *Config) { c.TopologyRecords = true }
+}
+
+// WithAppConnectors publishes the apps of app connectors in the subzone label, or
+// DefaultAppConnectorLabel if empty.
+func WithAppConnectors(label string) Option {
+	return func(c *Config) {
+		if label == "" {
+			label = DefaultAppConnectorLabel
+		}
+		c.AppConnectorLabel = label
+	}
+}
+
+// WithEndpoints publishes the public endpoints of nodes in the subzone label, or DefaultEndpointLabel
+// if empty.
+func WithEndpoints(label string) Option {
+	return func(c *Config) {
+		if label == "" {
+			label = DefaultEndpointLabel
+		}
+		c.EndpointLabel = label
+	}
+}
+
+// WithAgent serves the endpoint for companion agents on addr, publishing registrations for expiry.
+func WithAgent(addr string, expiry time.Duration) Option {
+	return func(c *Config) {
+		c.AgentAddr = addr
+		c.AgentExpiry = expiry
+	}
+}
+
+// WithDebug serves the debug endpoint on addr, keeping the last events sync events.
+func WithDebug(addr string, events int) Option {
+	return func(c *Config) {
+		c.DebugAddr = addr
+		c.SyncEvents = events
+	}
+}
+
+// WithOfflineNodes sets what happens to the records of offline nodes, "serve", "omit" or "flag",
+// and the TTL they're served with when flagged.
+func WithOfflineNodes(policy string, ttl uint32) Option {
+	return func(c *Config) {
+		c.OfflineNodes = policy
+		c.OfflineTTL = ttl
+	}
+}
+
+// WithAdaptiveTTL shortens the TTL of the records of ephemeral and flapping nodes, down to minTTL
+// seconds, counting how often they went offline within window.
+func WithAdaptiveTTL(minTTL uint32, window time.Duration) Option {
+	return func(c *Config) {
+		c.AdaptiveTTL = true
+		c.AdaptiveTTLMin = minTTL
+		c.AdaptiveTTLWindow = window
+	}
+}
+
+// WithHostnameCollisions sets what happens when more than one node has the same hostname, "merge",
+// "online", "newest" or "error".
+func WithHostnameCollisions(policy string) Option {
+	return func(c *Config) { c.HostnameCollisions = policy }
+}
+
+// WithMaxStaleness reports the instance unhealthy once its records are older than d.
+func WithMaxStaleness(d time.Duration) Option {
+	return func(c *Config) { c.MaxStaleness = d }
+}
+
+// WithFallthrough enables fallthrough, optionally restricted to zones.
+func WithFallthrough(zones ...string) Option {
+	return func(c *Config) {
+		c.Fallthrough = true
+		c.FallthroughZones = zones
+	}
+}
+
+// WithFallthroughTypes restricts fallthrough to queries of the types named by types.
+func WithFallthroughTypes(types ...string) Option {
+	return func(c *Config) { c.FallthroughTypes = append(c.FallthroughTypes, types...) }
+}
+
+// WithPassthroughUnknownTypes passes queries for types the plugin has no records of to the next plugin.
+func WithPassthroughUnknownTypes() Option {
+	return func(c *Config) { c.PassthroughUnknownTypes = true }
+}
+
+// Hash returns a digest of the configuration, identical for instances configured the same way. The
+// digest is published to anyone who asks, so secrets are left out: a digest of them would let guesses
+// be checked against it.
+func (c Config) Hash() string {
+	settings := configSettings(c)
+	for name := range secretSettings {
+		delete(settings, name)
+	}
+	b, err := json.Marshal(settings)
+	if err != nil {
+		panic(err)
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// Validate reports whether the configuration is usable.
+func (c Config) Validate() error {
+	if len(c.Zones) == 0 {
+		return errors.New("zone is required")
+	}
+	seen := map[string]bool{}
+	for _, zone := range c.Zones {
+		if _, ok := dns.IsDomainName(zone); !ok || zone == "" {
+			return fmt.Errorf("invalid zone %q", zone)
+		}
+		if seen[dns.CanonicalName(zone)] {
+			return fmt.Errorf("duplicate zone %q", zone)
+		}
+		seen[dns.CanonicalName(zone)] = true
+	}
+	if c.embedded() && c.Hostname == "" {
+		return errors.New("hostname is required for the embedded tsnet node")
+	}
+	if c.TailnetListen != "" {
+		if !c.embedded() {
+			return errors.New("listening in the tailnet requires the embedded tsnet node")
+		}
+		host, port, err := net.SplitHostPort(c.TailnetListen)
+		if err != nil || host != "" {
+			return fmt.Errorf("invalid tailnet listen address %q, want :PORT", c.TailnetListen)
+		}
+		if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+			return fmt.Errorf("invalid tailnet listen port %q", port)
+		}
+	}
+	if err := c.validateBackend(); err != nil {
+		return err
+	}
+	switch c.Store {
+	case "":
+	case storeBolt:
+		if c.StorePath == "" {
+			return errors.New("store path is required")
+		}
+	default:
+		return fmt.Errorf("unknown store %q", c.Store)
+	}
+	if c.TTL == 0 || c.TTL > maxTTL || c.NegativeTTL == 0 || c.NegativeTTL > maxTTL {
+		return fmt.Errorf("ttl must be between 1 and %d seconds", maxTTL)
+	}
+	if c.TTLJitter >= c.TTL {
+		return fmt.Errorf("ttl_jitter must be less than the TTL of %d seconds", c.TTL)
+	}
+	if c.LongNames != longNamesReject && c.LongNames != longNamesTruncate {
+		return fmt.Errorf("unknown long_names policy %q", c.LongNames)
+	}
+	if _, ok := parsePrivacy(c.Privacy); !ok {
+		return fmt.Errorf("unknown privacy mode %q", c.Privacy)
+	}
+	if c.PrivacyKey != "" {
+		if c.Privacy != "hash" {
+			return errors.New("a privacy key is only used by the hash privacy mode")
+		}
+		key, err := hex.DecodeString(c.PrivacyKey)
+		if err != nil {
+			return fmt.Errorf("invalid privacy key: %v", err)
+		}
+		if len(key) < privacyKeyLen {
+			return fmt.Errorf("privacy key must be at least %d bytes", privacyKeyLen)
+		}
+	}
+	if c.QueryLogRate < 0 {
+		return errors.New("query_log rate must not be negative")
+	}
+	if c.MaxInflight < 0 {
+		return errors.New("max_inflight must not be negative")
+	}
+	if c.ShedAction != "refuse" && c.ShedAction != "fallthrough" {
+		return fmt.Errorf("unknown shed action %q", c.ShedAction)
+	}
+	if c.AnswerCacheSize < 0 {
+		return errors.New("answer_cache size must not be negative")
+	}
+	if c.AnswerCacheSize > 0 && c.TTLJitter > 0 {
+		// Cached answers would keep the TTLs they were built with.
+		return errors.New("answer_cache can't be used with ttl_jitter")
+	}
+	if c.AnswerOrder != orderFixed && c.AnswerOrder != orderShuffle && c.AnswerOrder != orderRoundRobin {
+		return fmt.Errorf("unknown answer_order %q", c.AnswerOrder)
+	}
+	if c.AnswerOrderSeed != 0 && c.AnswerOrder != orderShuffle {
+		return errors.New("answer_order seed requires shuffle")
+	}
+	switch c.HealthCheck {
+	case "":
+	case healthCheckOnline:
+		if c.HealthCheckPort != 0 {
+			return errors.New("health_check online takes no port")
+		}
+	case healthCheckTCP, healthCheckHTTPS:
+		if c.HealthCheckPort == 0 {
+			return fmt.Errorf("health_check %s requires a port", c.HealthCheck)
+		}
+		if c.HealthCheckInterval <= 0 {
+			return errors.New("health_check interval must be positive")
+		}
+		if c.HealthCheckFailures <= 0 {
+			return errors.New("health_check failures must be positive")
+		}
+	default:
+		return fmt.Errorf("unknown health_check %q", c.HealthCheck)
+	}
+	if _, _, err := net.SplitHostPort(c.MagicDNSResolver); c.MagicDNS && err != nil {
+		return fmt.Errorf("invalid magicdns resolver %q: %v", c.MagicDNSResolver, err)
+	}
+	if c.MagicDNSOverlap != "warn" && c.MagicDNSOverlap != "adjust" {
+		return fmt.Errorf("unknown magicdns_overlap %q", c.MagicDNSOverlap)
+	}
+	if c.Padding < 0 || c.Padding > dns.MaxMsgSize {
+		return fmt.Errorf("padding block must be between 1 and %d bytes", dns.MaxMsgSize)
+	}
+	if c.MaxLookups <= 0 {
+		return errors.New("max_lookups must be positive")
+	}
+	if c.MaxCNAMEChain <= 0 {
+		return errors.New("max_cname_chain must be positive")
+	}
+	if err := validatePrecedence(c.Precedence); err != nil {
+		return err
+	}
+	_, ttls, err := parseRecords(c.Records, c.Zones[0])
+	if err != nil {
+		return err
+	}
+	for _, name := range slices.Sorted(maps.Keys(ttls)) {
+		for _, rrtype := range slices.Sorted(maps.Keys(ttls[name])) {
+			if err := validateTTLOverride("the "+rrtype+" records of "+name, ttls[name][rrtype], c.TTLJitter); err != nil {
+				return err
+			}
+		}
+	}
+	if c.CookieSecret != "" {
+		secret, err := hex.DecodeString(c.CookieSecret)
+		if err != nil {
+			return fmt.Errorf("invalid cookie secret: %v", err)
+		}
+		if len(secret) < cookieSecretLen {
+			return fmt.Errorf("cookie secret must be at least %d bytes", cookieSecretLen)
+		}
+	}
+	for _, pfx := range c.TrustedProxies {
+		if !pfx.IsValid() {
+			return fmt.Errorf("invalid trusted proxy %s", pfx)
+		}
+	}
+	if c.EnumerationDetect && (c.EnumerationThreshold < 1 || c.EnumerationWindow <= 0) {
+		return errors.New("enumeration_detect threshold and window must be positive")
+	}
+	for _, ns := range c.NameServers {
+		if _, ok := dns.IsDomainName(ns); !ok || ns == "" {
+			return fmt.Errorf("invalid name server %q", ns)
+		}
+	}
+	if _, ok := dns.IsDomainName(soaMbox(c.SOAMbox)); c.SOAMbox != "" && !ok {
+		return fmt.Errorf("invalid SOA mailbox %q", c.SOAMbox)
+	}
+	if c.SOARefresh == 0 || c.SOARetry == 0 || c.SOAExpire == 0 {
+		return errors.New("SOA timers must be positive")
+	}
+	for _, m := range c.Services {
+		if err := m.validate(); err != nil {
+			return err
+		}
+		if err := validateTTLOverride("service "+m.Service, m.TTL, c.TTLJitter); err != nil {
+			return err
+		}
+	}
+	if err := validateWildcard(c.Wildcard); err != nil {
+		return err
+	}
+	if err := validateTagFilter("include_tags", c.IncludeTags); err != nil {
+		return err
+	}
+	if err := validateTagFilter("exclude_tags", c.ExcludeTags); err != nil {
+		return err
+	}
+	if err := validateProfiles(c.Profiles, c.TTLJitter); err != nil {
+		return err
+	}
+	if err := validateViews(c.Views, c.ViewCapability); err != nil {
+		return err
+	}
+	switch c.OfflineNodes {
+	case offlineServe, offlineOmit:
+	case offlineFlag:
+		if err := validateTTLOverride("offline nodes", c.OfflineTTL, c.TTLJitter); err != nil {
+			return err
+		}
+		if c.OfflineTTL == 0 {
+			return errors.New("ttl of offline nodes must be positive")
+		}
+	default:
+		return fmt.Errorf("unknown offline_nodes policy %q", c.OfflineNodes)
+	}
+	if c.AdaptiveTTL {
+		if c.AdaptiveTTLMin == 0 {
+			return errors.New("adaptive_ttl minimum TTL must be positive")
+		}
+		if err := validateTTLOverride("adaptive_ttl", c.AdaptiveTTLMin, c.TTLJitter); err != nil {
+			return err
+		}
+		if c.AdaptiveTTLWindow <= 0 {
+			return fmt.Errorf("adaptive_ttl window must be positive, got %s", c.AdaptiveTTLWindow)
+		}
+	}
+	switch c.HostnameCollisions {
+	case collisionMerge, collisionOnline, collisionNewest, collisionError:
+	default:
+		return fmt.Errorf("unknown hostname_collisions policy %q", c.HostnameCollisions)
+	}
+	if err := validateSubzones(c.Subzones); err != nil {
+		return err
+	}
+	if err := validateALPN(c.ALPN); err != nil {
+		return err
+	}
+	if c.EndpointLabel != "" {
+		if err := validateLabel("endpoints", c.EndpointLabel, c.Subzones); err != nil {
+			return err
+		}
+	}
+	if c.AppConnectorLabel != "" {
+		if err := validateLabel("app_connectors", c.AppConnectorLabel, c.Subzones, c.EndpointLabel); err != nil {
+			return err
+		}
+	}
+	if c.TopologyRecords {
+		if err := validateLabel("topology_records", routesLabel, c.Subzones, c.EndpointLabel, c.AppConnectorLabel); err != nil {
+			return err
+		}
+	}
+	if c.PTRTarget != "zone" && c.PTRTarget != "magicdns" {
+		return fmt.Errorf("unknown ptr_target %q", c.PTRTarget)
+	}
+	for _, peer := range c.TransferPeers {
+		if !validTransferPeer(peer) {
+			return fmt.Errorf("invalid transfer peer %q", peer)
+		}
+	}
+	if c.AgentAddr != "" && c.AgentExpiry <= 0 {
+		return fmt.Errorf("agent expiry must be positive, got %s", c.AgentExpiry)
+	}
+	if c.SyncEvents < 0 {
+		return fmt.Errorf("sync events must not be negative, got %d", c.SyncEvents)
+	}
+	if c.MaxStaleness < 0 {
+		return fmt.Errorf("max_staleness must not be negative, got %s", c.MaxStaleness)
+	}
+	for _, pfx := range c.RebindAllow {
+		if !pfx.IsValid() {
+			return fmt.Errorf("invalid rebind_protection range %s", pfx)
+		}
+	}
+	for _, pfx := range c.FilterAAAA {
+		if !pfx.IsValid() {
+			return fmt.Errorf("invalid filter_aaaa range %s", pfx)
+		}
+	}
+	if err := validateTagFilter("filter_aaaa", c.FilterAAAATags); err != nil {
+		return err
+	}
+	if c.PreferFamily != familyIPv4 && c.PreferFamily != familyIPv6 {
+		return fmt.Errorf("unknown prefer_family %q", c.PreferFamily)
+	}
+	for family, mode := range map[string]string{familyIPv4: c.IPv4, familyIPv6: c.IPv6} {
+		if mode != "" && mode != familyOnly && mode != familyOff {
+			return fmt.Errorf("unknown %s mode %q", family, mode)
+		}
+	}
+	if a, aaaa := publishedFamilies(c.IPv4, c.IPv6); !a && !aaaa {
+		return fmt.Errorf("ipv4 %s and ipv6 %s leave no addresses to publish", c.IPv4, c.IPv6)
+	}
+	if c.Any != anyHINFO && c.Any != anyAll {
+		return fmt.Errorf("unknown any policy %q", c.Any)
+	}
+	if _, err := lookupAnswerHooks(c.AnswerHooks); err != nil {
+		return err
+	}
+	if c.Export != "" {
+		if _, err := lookupExportProvider(c.Export); err != nil {
+			return err
+		}
+		if _, ok := dns.IsDomainName(c.ExportZone); !ok || c.ExportZone == "" {
+			return fmt.Errorf("invalid export zone %q", c.ExportZone)
+		}
+	}
+	if c.InternalErrors != internalServfail && c.InternalErrors != internalNegative {
+		return fmt.Errorf("unknown internal_errors policy %q", c.InternalErrors)
+	}
+	if len(c.FallthroughTypes) > 0 && !c.Fallthrough {
+		return errors.New("fallthrough types require fallthrough")
+	}
+	for _, typ := range c.FallthroughTypes {
+		if _, ok := dns.StringToType[strings.ToUpper(typ)]; !ok {
+			return fmt.Errorf("unknown fallthrough type %q", typ)
+		}
+	}
+	return nil
+}
+
+// embedded reports whether the plugin runs an embedded tsnet node.
+func (c Config) embedded() bool {
+	return c.TSNet || c.AuthKey != ""
+}
+
+// usesAPI reports whether the records are polled from the Tailscale API.
+func (c Config) usesAPI() bool {
+	return c.APIKey != "" || c.OAuthClientID != ""
+}
+
+// usesHeadscale reports whether the records are polled from a Headscale server.
+func (c Config) usesHeadscale() bool {
+	return c.HeadscaleURL != ""
+}
+
+// validateBackend checks that at most one way of getting the records of the tailnet is configured,
+// and that nothing relies on being a tailnet member when polling the Tailscale API or Headscale.
+func (c Config) validateBackend() error {
+	if (c.OAuthClientID == "") != (c.OAuthClientSecret == "") {
+		return errors.New("oauth requires a client ID and a client secret")
+	}
+	if c.APIKey != "" && c.OAuthClientID != "" {
+		return errors.New("api_key and oauth are mutually exclusive")
+	}
+	if c.PollInterval < 0 {
+		return fmt.Errorf("poll_interval must not be negative, got %s", c.PollInterval)
+	}
+	if err := c.validateBackendOrder(); err != nil {
+		return err
+	}
+	// polled names the backend polled, and intervalDirective the directive setting how often.
+	var polled, intervalDirective string
+	switch {
+	case c.usesAPI():
+		if c.Tailnet == "" {
+			return errors.New("tailnet is required")
+		}
+		if c.APIInterval <= 0 {
+			return fmt.Errorf("API poll interval must be positive, got %s", c.APIInterval)
+		}
+		polled, intervalDirective = "the Tailscale API", "tailnet"
+	case c.usesHeadscale():
+		if u, err := url.Parse(c.HeadscaleURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid Headscale URL %q, want http(s)://HOST[:PORT]", c.HeadscaleURL)
+		}
+		if c.HeadscaleAPIKey == "" {
+			return errors.New("headscale requires an API key")
+		}
+		if c.HeadscaleInterval <= 0 {
+			return fmt.Errorf("Headscale poll interval must be positive, got %s", c.HeadscaleInterval)
+		}
+		polled, intervalDirective = "Headscale", "headscale"
+	default:
+		return nil
+	}
+	if len(c.backends()) > 1 {
+		// The polled backend is only a fallback, the LocalAPI settings still apply.
+		return nil
+	}
+	if c.PollInterval != 0 {
+		return fmt.Errorf("poll_interval can't be used with %s, set the interval with %s", polled, intervalDirective)
+	}
+	if c.embedded() {
+		return fmt.Errorf("tsnet and authkey can't be used with %s", polled)
+	}
+	// Identifying clients needs a tailnet member.
+	if c.AgentAddr != "" {
+		return fmt.Errorf("agent can't be used with %s", polled)
+	}
+	if len(c.TransferPeers) > 0 {
+		return fmt.Errorf("transfer_peers can't be used with %s", polled)
+	}
+	if len(c.Views) > 0 || c.ViewCapability != "" {
+		return fmt.Errorf("views can't be used with %s", polled)
+	}
+	return nil
+}
+
+// New validates cfg and returns a plugin instance configured by it. The instance doesn't connect to
+// the tailnet until it is started.
+func New(cfg Config) (*Tailscale, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	zones := make([]string, len(cfg.Zones))
+	for i, zone := range cfg.Zones {
+		zones[i] = dns.CanonicalName(zone)
+	}
+
+	t := &Tailscale{
+		cfg:               cfg,
+		configHash:        cfg.Hash(),
+		zone:              zones[0],
+		zones:             zones,
+		embedded:          cfg.embedded(),
+		hostname:          cfg.Hostname,
+		stateDir:          cfg.StateDir,
+		tailnetListen:     cfg.TailnetListen,
+		pollInterval:      cfg.PollInterval,
+		storeBackend:      cfg.Store,
+		storePath:         cfg.StorePath,
+		recordPath:        cfg.RecordNetMaps,
+		recordTTL:         cfg.TTL,
+		negativeTTL:       cfg.NegativeTTL,
+		ttlJitter:         cfg.TTLJitter,
+		trustedProxies:    cfg.TrustedProxies,
+		maxInflight:       int64(cfg.MaxInflight),
+		maxLookups:        cfg.MaxLookups,
+		maxCNAMEChain:     cfg.MaxCNAMEChain,
+		shedFallthrough:   cfg.ShedAction == "fallthrough",
+		passUnknownTypes:  cfg.PassthroughUnknownTypes,
+		precedence:        cfg.Precedence,
+		nsid:              cfg.NSID,
+		padding:           cfg.Padding,
+		magicDNS:          cfg.MagicDNS,
+		magicDNSResolver:  cfg.MagicDNSResolver,
+		overlapAdjust:     cfg.MagicDNSOverlap == "adjust",
+		rebindMarker:      cfg.RebindMarker,
+		stats:             cfg.Stats,
+		tagEnumeration:    cfg.TagEnumeration,
+		exposeMetadata:    cfg.ExposeMetadata,
+		rebindProtection:  cfg.RebindProtection,
+		rebindAllow:       cfg.RebindAllow,
+		filterAAAA:        cfg.FilterAAAA,
+		filterAAAATags:    cfg.FilterAAAATags,
+		anyPolicy:         cfg.Any,
+		internalErrors:    cfg.InternalErrors,
+		preferIPv6:        cfg.PreferFamily == familyIPv6,
+		truncateNames:     cfg.LongNames == longNamesTruncate,
+		ptrMagicDNS:       cfg.PTRTarget == "magicdns",
+		glue:              cfg.Glue,
+		alpn:              cfg.ALPN,
+		includeTags:       cfg.IncludeTags,
+		wildcard:          cfg.Wildcard,
+		excludeTags:       cfg.ExcludeTags,
+		profiles:          cfg.Profiles,
+		views:             cfg.Views,
+		viewCapability:    cfg.ViewCapability,
+		offlineNodes:      cfg.OfflineNodes,
+		collisionPolicy:   cfg.HostnameCollisions,
+		userSubzones:      cfg.UserSubzones,
+		offlineTTL:        cfg.OfflineTTL,
+		adaptiveTTLMin:    cfg.AdaptiveTTLMin,
+		services:          cfg.Services,
+		srvHostinfo:       cfg.SRVHostinfo,
+		soaMbox:           soaMbox(cfg.SOAMbox),
+		soaRefresh:        cfg.SOARefresh,
+		soaRetry:          cfg.SOARetry,
+		soaExpire:         cfg.SOAExpire,
+		transferPeers:     cfg.TransferPeers,
+		endpointLabel:     strings.ToLower(cfg.EndpointLabel),
+		appConnectorLabel: strings.ToLower(cfg.AppConnectorLabel),
+		agentAddr:         cfg.AgentAddr,
+		agentExpiry:       cfg.AgentExpiry,
+		debugAddr:         cfg.DebugAddr,
+		maxStaleness:      cfg.MaxStaleness,
+		events:            newEventRing(cfg.SyncEvents),
+	}
+	var err error
+	if t.answerHooks, err = lookupAnswerHooks(cfg.AnswerHooks); err != nil {
+		return nil, err
+	}
+	if cfg.Export != "" {
+		factory, err := lookupExportProvider(cfg.Export)
+		if err != nil {
+			return nil, err
+		}
+		if t.exporter, err = factory(cfg.ExportArgs); err != nil {
+			return nil, fmt.Errorf("export provider %s: %v", cfg.Export, err)
+		}
+		t.exporterName = cfg.Export
+		t.exportZone = dns.CanonicalName(cfg.ExportZone)
+		t.exportPending = make(chan struct{}, 1)
+	}
+	if t.authkey, err = resolveSecret(cfg.AuthKey); err != nil {
+		return nil, fmt.Errorf("authkey: %v", err)
+	}
+	if cfg.usesAPI() {
+		apiKey, err := resolveSecret(cfg.APIKey)
+		if err != nil {
+			return nil, fmt.Errorf("api_key: %v", err)
+		}
+		clientSecret, err := resolveSecret(cfg.OAuthClientSecret)
+		if err != nil {
+			return nil, fmt.Errorf("oauth: %v", err)
+		}
+		t.api = &apiClient{
+			baseURL:      DefaultAPIURL,
+			tailnet:      cfg.Tailnet,
+			http:         &http.Client{},
+			apiKey:       apiKey,
+			clientID:     cfg.OAuthClientID,
+			clientSecret: clientSecret,
+		}
+		t.apiInterval = cfg.APIInterval
+		t.apiFallback = len(cfg.backends()) > 1
+	}
+	if cfg.usesHeadscale() {
+		apiKey, err := resolveSecret(cfg.HeadscaleAPIKey)
+		if err != nil {
+			return nil, fmt.Errorf("headscale: %v", err)
+		}
+		t.headscale = &headscaleClient{
+			baseURL: strings.TrimSuffix(cfg.HeadscaleURL, "/"),
+			apiKey:  apiKey,
+			http:    &http.Client{},
+		}
+		t.apiInterval = cfg.HeadscaleInterval
+		t.apiFallback = len(cfg.backends()) > 1
+	}
+	if cfg.AdaptiveTTL {
+		t.flaps = &flapTracker{window: cfg.AdaptiveTTLWindow}
+	}
+	if cfg.AnswerCacheSize > 0 {
+		t.answers = newAnswerCache(cfg.AnswerCacheSize)
+	}
+	t.order = newAnswerOrder(cfg.AnswerOrder, cfg.AnswerOrderSeed)
+	t.healthCheck = cfg.HealthCheck
+	t.healthCheckPort = cfg.HealthCheckPort
+	t.healthCheckInterval = cfg.HealthCheckInterval
+	t.healthCheckFailures = cfg.HealthCheckFailures
+	if cfg.QueryLogRate > 0 {
+		t.queryLog = newQueryLog(cfg.QueryLogRate, os.Stdout)
+	}
+	a, aaaa := publishedFamilies(cfg.IPv4, cfg.IPv6)
+	t.omitA, t.omitAAAA = !a, !aaaa
+	if len(cfg.Subzones) > 0 {
+		t.subzones = map[string]string{}
+		t.subzoneLabels = map[string]bool{}
+		for tag, label := range cfg.Subzones {
+			t.subzones[tag] = subzoneLabel(tag, label)
+			t.subzoneLabels[t.subzones[tag]] = true
+		}
+	}
+	if t.appConnectorLabel != "" {
+		// Apps are published below their label like the nodes of a tag subzone.
+		if t.subzoneLabels == nil {
+			t.subzoneLabels = map[string]bool{}
+		}
+		t.subzoneLabels[t.appConnectorLabel] = true
+	}
+	if cfg.TopologyRecords {
+		// Routes are published below their label like the nodes of a tag subzone.
+		t.topology = true
+		if t.subzoneLabels == nil {
+			t.subzoneLabels = map[string]bool{}
+		}
+		t.subzoneLabels[routesLabel] = true
+	}
+	// Static records are served right away, the others once the tailnet is synced.
+	t.static, t.staticTTLs, _ = parseRecords(cfg.Records, t.zone)
+	t.dropInvalidCNAMEs(t.static)
+	sources := map[string]string{}
+	for name := range t.static {
+		sources[name] = sourceManual
+	}
+	t.data.Store(&zoneData{
+		entries:      t.static,
+		addrs:        t.addrIndex(t.static),
+		sources:      sources,
+		ttlOverrides: t.staticTTLs,
+		updated:      updateTimes(nil, t.static, nil, time.Now()),
+		reverse:      t.reverseIndex(t.static),
+		tags:         t.tagIndex(t.static),
+	})
+	if cfg.Upstream {
+		t.upstream = upstream.New()
+	}
+	if cfg.EnumerationDetect {
+		t.enumeration = newEnumerationDetector(cfg.EnumerationThreshold, cfg.EnumerationWindow)
+	}
+	for _, ns := range cfg.NameServers {
+		t.ns = append(t.ns, dns.CanonicalName(ns))
+	}
+	t.privacy, _ = parsePrivacy(cfg.Privacy)
+	if t.privacy == privacyHash {
+		if cfg.PrivacyKey != "" {
+			t.privacyKey, _ = hex.DecodeString(cfg.PrivacyKey)
+		} else {
+			t.privacyKey = make([]byte, privacyKeyLen)
+			if _, err := rand.Read(t.privacyKey); err != nil {
+				return nil, fmt.Errorf("unable to generate privacy key: %v", err)
+			}
+		}
+	}
+	if cfg.Cookies {
+		if cfg.CookieSecret != "" {
+			t.cookieSecret, _ = hex.DecodeString(cfg.CookieSecret)
+		} else {
+			t.cookieSecret = make([]byte, cookieSecretLen)
+			if _, err := rand.Read(t.cookieSecret); err != nil {
+				return nil, fmt.Errorf("unable to generate cookie secret: %v", err)
+			}
+		}
+	}
+	if cfg.DNSSEC {
+		if t.dnssec, err = newDNSSECSigner(cfg.DNSSECKeys, t.logName); err != nil {
+			return nil, err
+		}
+		if len(cfg.DNSSECKeys) == 0 {
+			log.Warning("Signing with a generated DNSSEC key, which changes with every start")
+		}
+		for _, zone := range t.zones {
+			for _, ds := range t.dnssec.ds(zone) {
+				log.Infof("DS record for %s: %s", zone, ds)
+			}
+		}
+	}
+	if cfg.Fallthrough {
+		t.fall.SetZonesFromArgs(cfg.FallthroughZones)
+	}
+	for _, typ := range cfg.FallthroughTypes {
+		if t.fallTypes == nil {
+			t.fallTypes = map[uint16]bool{}
+		}
+		t.fallTypes[dns.StringToType[strings.ToUpper(typ)]] = true
+	}
+	return t, nil
+}
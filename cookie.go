@@ -0,0 +1,126 @@
+package tailscale
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"net/netip"
+	"time"
+
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+const (
+	// clientCookieLen is the length of a client cookie (RFC 7873, section 4).
+	clientCookieLen = 8
+	// serverCookieLen is the length of the server cookies we generate, in the RFC 9018 layout:
+	// version (1), reserved (3), timestamp (4) and hash (8).
+	serverCookieLen = 16
+	// cookieVersion is the RFC 9018 server cookie version.
+	cookieVersion = 1
+	// cookieLifetime is how long a server cookie stays valid, and cookieClockSkew how far in the
+	// future its timestamp may be (RFC 9018, section 4.3).
+	cookieLifetime  = time.Hour
+	cookieClockSkew = 5 * time.Minute
+	// cookieSecretLen is the length of the random secret used when none is configured.
+	cookieSecretLen = 16
+)
+
+// requestCookie returns the client and server cookie sent with r, and whether r carried a COOKIE
+// option at all. Malformed cookies are reported through valid.
+func requestCookie(r *dns.Msg) (client, server []byte, present, valid bool) {
+	opt := r.IsEdns0()
+	if opt == nil {
+		return nil, nil, false, true
+	}
+	for _, o := range opt.Option {
+		c, ok := o.(*dns.EDNS0_COOKIE)
+		if !ok {
+			continue
+		}
+		raw, err := hex.DecodeString(c.Cookie)
+		// A server cookie, if present, must be between 8 and 32 bytes long.
+		if err != nil || len(raw) < clientCookieLen || (len(raw) > clientCookieLen && len(raw) < clientCookieLen+8) || len(raw) > clientCookieLen+32 {
+			return nil, nil, true, false
+		}
+		return raw[:clientCookieLen], raw[clientCookieLen:], true, true
+	}
+	return nil, nil, false, true
+}
+
+// checkCookie validates the DNS cookie of a request. It returns dns.RcodeSuccess if the query should
+// be answered, dns.RcodeFormatError for a malformed cookie, or dns.RcodeBadCookie if a UDP query
+// carries a server cookie that we didn't issue or that has expired. Clients receiving BADCOOKIE get a
+// fresh server cookie to retry with, while off-path attackers spoofing the client can't learn it.
+func (t *Tailscale) checkCookie(state request.Request, addr netip.Addr) int {
+	client, server, present, valid := requestCookie(state.Req)
+	switch {
+	case !present:
+		return dns.RcodeSuccess
+	case !valid:
+		log.Debug("Malformed DNS cookie")
+		return dns.RcodeFormatError
+	case len(server) == 0:
+		// First contact, the client will receive a server cookie with the response.
+		return dns.RcodeSuccess
+	case state.Proto() == "tcp":
+		// TCP can't be spoofed off-path, so there is nothing to validate.
+		return dns.RcodeSuccess
+	}
+
+	if !t.validServerCookie(client, server, addr, time.Now()) {
+		log.Debugf("Invalid server cookie from %s", addr)
+		return dns.RcodeBadCookie
+	}
+	return dns.RcodeSuccess
+}
+
+// serverCookie computes the server cookie for a client cookie and address at the given time.
+func (t *Tailscale) serverCookie(client []byte, addr netip.Addr, now time.Time) []byte {
+	cookie := make([]byte, serverCookieLen)
+	cookie[0] = cookieVersion
+	binary.BigEndian.PutUint32(cookie[4:8], uint32(now.Unix()))
+	copy(cookie[8:], t.cookieHash(client, cookie[:8], addr))
+	return cookie
+}
+
+// validServerCookie reports whether server is a cookie we issued for client at addr, and is still
+// fresh.
+func (t *Tailscale) validServerCookie(client, server []byte, addr netip.Addr, now time.Time) bool {
+	if len(server) != serverCookieLen || server[0] != cookieVersion {
+		return false
+	}
+	issued := time.Unix(int64(binary.BigEndian.Uint32(server[4:8])), 0)
+	if issued.Before(now.Add(-cookieLifetime)) || issued.After(now.Add(cookieClockSkew)) {
+		return false
+	}
+	return hmac.Equal(server[8:], t.cookieHash(client, server[:8], addr))
+}
+
+// cookieHash returns the hash part of a server cookie. RFC 9018 uses SipHash-2-4, which is only needed
+// for interoperability between servers of different vendors sharing a secret. A truncated HMAC-SHA256
+// provides the same guarantees for cookies that are only ever validated by this plugin.
+func (t *Tailscale) cookieHash(client, header []byte, addr netip.Addr) []byte {
+	mac := hmac.New(sha256.New, t.cookieSecret)
+	mac.Write(client)
+	mac.Write(header)
+	if addr.IsValid() {
+		mac.Write(addr.AsSlice())
+	}
+	return mac.Sum(nil)[:8]
+}
+
+// addCookie adds the COOKIE option to the response opt, echoing the client cookie of the request
+// along with a fresh server cookie for the client at addr.
+func (t *Tailscale) addCookie(state request.Request, addr netip.Addr, opt *dns.OPT) {
+	client, _, present, valid := requestCookie(state.Req)
+	if !present || !valid {
+		return
+	}
+	cookie := bytes.Clone(client)
+	cookie = append(cookie, t.serverCookie(client, addr, time.Now())...)
+	opt.Option = append(opt.Option, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: hex.EncodeToString(cookie)})
+}
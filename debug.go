@@ -0,0 +1,62 @@
+package tailscale
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// debugEventsPath is the path of the debug endpoint listing recent sync events.
+const debugEventsPath = "/tailscale/events"
+
+// debugMux returns the handler of the debug endpoint.
+func (t *Tailscale) debugMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc(debugEventsPath, t.serveEvents)
+	mux.HandleFunc(debugRecordsPath, t.serveRecords)
+	mux.HandleFunc(debugHealthPath, t.serveHealth)
+	mux.HandleFunc(debugSelfTestPath, t.serveSelfTest)
+	return mux
+}
+
+// serveEvents writes the recent sync events as JSON, oldest first.
+func (t *Tailscale) serveEvents(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(t.events.snapshot()); err != nil {
+		log.Warningf("Unable to write sync events: %v", err)
+	}
+}
+
+// startDebug starts the debug endpoint on the configured address, if any.
+func (t *Tailscale) startDebug() error {
+	if t.debugAddr == "" {
+		return nil
+	}
+	ln, err := net.Listen("tcp", t.debugAddr)
+	if err != nil {
+		return err
+	}
+	t.debugSrv = &http.Server{Handler: t.debugMux()}
+	srv := t.debugSrv
+	t.bg.Go("debug_endpoint", func(context.Context) error {
+		if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			return fmt.Errorf("debug endpoint: %w", err)
+		}
+		return nil
+	})
+	log.Infof("Debug endpoint listening on %s", ln.Addr())
+	return nil
+}
+
+// stopDebug stops the debug endpoint.
+func (t *Tailscale) stopDebug() error {
+	if t.debugSrv == nil {
+		return nil
+	}
+	err := t.debugSrv.Close()
+	t.debugSrv = nil
+	return err
+}
@@ -0,0 +1,297 @@
+package tailscale
+
+import (
+	"crypto"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+const (
+	// sigValidity is how long signatures are valid for, and sigRefresh how long before they expire
+	// cached signatures are replaced. Like the dnssec plugin, signatures are backdated by sigSkew
+	// for validators whose clocks are behind.
+	sigValidity = 8 * 24 * time.Hour
+	sigRefresh  = 2 * 24 * time.Hour
+	sigSkew     = 3 * time.Hour
+	// maxCachedSigs bounds the number of cached signatures. The cache is emptied when it's full.
+	maxCachedSigs = 10000
+)
+
+// NSEC type bitmaps of negative answers. Names below the apex claim every type the plugin serves
+// except the one queried, like the black lies of the dnssec plugin, so that resolvers can't use the
+// NSEC record to deny types that do exist. CNAME is left out, as validators don't accept a NODATA
+// proof for a name with a CNAME. Names that don't exist at all use compact denial of existence
+// (RFC 9824).
+var (
+	apexTypes = []uint16{dns.TypeNS, dns.TypeSOA, dns.TypeRRSIG, dns.TypeNSEC, dns.TypeDNSKEY}
+	nameTypes = []uint16{dns.TypeA, dns.TypePTR, dns.TypeTXT, dns.TypeAAAA, dns.TypeSRV, dns.TypeRRSIG, dns.TypeNSEC, dns.TypeSVCB, dns.TypeHTTPS}
+	nxTypes   = []uint16{dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNXNAME}
+)
+
+// dnssecKey is a key responses are signed with.
+type dnssecKey struct {
+	key    *dns.DNSKEY
+	signer crypto.Signer
+	tag    uint16
+}
+
+// loadDNSSECKey reads the key pair at path, the base name of the .key and .private files written by
+// dnssec-keygen, e.g. Kexample.com.+013+12345.
+func loadDNSSECKey(path string) (dnssecKey, error) {
+	base := strings.TrimSuffix(strings.TrimSuffix(path, ".key"), ".private")
+	pub, err := os.Open(base + ".key")
+	if err != nil {
+		return dnssecKey{}, err
+	}
+	defer pub.Close()
+	rr, err := dns.ReadRR(pub, base+".key")
+	if err != nil {
+		return dnssecKey{}, err
+	}
+	key, ok := rr.(*dns.DNSKEY)
+	if !ok {
+		return dnssecKey{}, fmt.Errorf("%s.key: not a DNSKEY record", base)
+	}
+
+	priv, err := os.Open(base + ".private")
+	if err != nil {
+		return dnssecKey{}, err
+	}
+	defer priv.Close()
+	pk, err := key.ReadPrivateKey(priv, base+".private")
+	if err != nil {
+		return dnssecKey{}, err
+	}
+	signer, ok := pk.(crypto.Signer)
+	if !ok {
+		return dnssecKey{}, fmt.Errorf("%s.private: unsupported key", base)
+	}
+	return dnssecKey{key: key, signer: signer, tag: key.KeyTag()}, nil
+}
+
+// generateDNSSECKey generates an ECDSA P-256 key signing both the keys and the records of the zones.
+func generateDNSSECKey() (dnssecKey, error) {
+	key := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: ".", Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET},
+		Flags:     dns.ZONE | dns.SEP,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+	pk, err := key.Generate(256)
+	if err != nil {
+		return dnssecKey{}, err
+	}
+	return dnssecKey{key: key, signer: pk.(crypto.Signer), tag: key.KeyTag()}, nil
+}
+
+// dnssecSigner signs the RRsets of responses as they're written.
+type dnssecSigner struct {
+	keys []dnssecKey
+	// logName formats names for logs, see Tailscale.logName.
+	logName func(string) string
+
+	mu    sync.Mutex
+	cache map[string][]*dns.RRSIG
+}
+
+// newDNSSECSigner returns a signer with the keys at paths, or with a generated key if there are none.
+// Names are logged as logName formats them.
+func newDNSSECSigner(paths []string, logName func(string) string) (*dnssecSigner, error) {
+	s := &dnssecSigner{logName: logName, cache: map[string][]*dns.RRSIG{}}
+	for _, path := range paths {
+		k, err := loadDNSSECKey(path)
+		if err != nil {
+			return nil, fmt.Errorf("dnssec: %v", err)
+		}
+		s.keys = append(s.keys, k)
+	}
+	if len(s.keys) == 0 {
+		k, err := generateDNSSECKey()
+		if err != nil {
+			return nil, fmt.Errorf("dnssec: unable to generate key: %v", err)
+		}
+		s.keys = append(s.keys, k)
+	}
+	return s, nil
+}
+
+// dnskeys returns the DNSKEY records of zone.
+func (s *dnssecSigner) dnskeys(zone string, ttl uint32) []dns.RR {
+	var rrs []dns.RR
+	for _, k := range s.keys {
+		key := *k.key
+		key.Hdr = dns.RR_Header{Name: zone, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: ttl}
+		rrs = append(rrs, &key)
+	}
+	return rrs
+}
+
+// ds returns the DS records to publish in the parent zone for zone.
+func (s *dnssecSigner) ds(zone string) []*dns.DS {
+	var rrs []*dns.DS
+	for _, key := range s.dnskeys(zone, 0) {
+		if key := key.(*dns.DNSKEY); key.Flags&dns.SEP != 0 {
+			rrs = append(rrs, key.ToDS(dns.SHA256))
+		}
+	}
+	return rrs
+}
+
+// sign returns the signatures of rrset for zone, with origTTL as the original TTL. Signatures are
+// cached, so an RRset is only signed again shortly before its signatures expire.
+func (s *dnssecSigner) sign(rrset []dns.RR, zone string, origTTL uint32, now time.Time) []dns.RR {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %d", zone, origTTL)
+	for _, rr := range rrset {
+		// The TTL of responses varies, while the original TTL of signatures doesn't.
+		rr = dns.Copy(rr)
+		rr.Header().Ttl = 0
+		rr.Header().Name = dns.CanonicalName(rr.Header().Name)
+		b.WriteString("\n" + rr.String())
+	}
+	key := b.String()
+
+	s.mu.Lock()
+	sigs, ok := s.cache[key]
+	s.mu.Unlock()
+	if !ok || time.Unix(int64(sigs[0].Expiration), 0).Sub(now) < sigRefresh {
+		sigs = nil
+		for _, k := range s.keys {
+			sig := &dns.RRSIG{
+				Algorithm:  k.key.Algorithm,
+				KeyTag:     k.tag,
+				SignerName: zone,
+				OrigTtl:    origTTL,
+				Inception:  uint32(now.Add(-sigSkew).Unix()),
+				Expiration: uint32(now.Add(sigValidity).Unix()),
+			}
+			if err := sig.Sign(k.signer, rrset); err != nil {
+				log.Warningf("Unable to sign %s %s: %v", s.logName(rrset[0].Header().Name), dns.TypeToString[rrset[0].Header().Rrtype], err)
+				return nil
+			}
+			sigs = append(sigs, sig)
+		}
+		s.mu.Lock()
+		if len(s.cache) >= maxCachedSigs {
+			clear(s.cache)
+		}
+		s.cache[key] = sigs
+		s.mu.Unlock()
+	}
+
+	rrs := make([]dns.RR, len(sigs))
+	for i, sig := range sigs {
+		sig := *sig
+		sig.Hdr.Name = rrset[0].Header().Name
+		sig.Hdr.Ttl = rrset[0].Header().Ttl
+		rrs[i] = &sig
+	}
+	return rrs
+}
+
+// signSection returns the records of a section of a response followed by the signatures of their
+// RRsets in zone. Records outside zone, such as the answers of upstream lookups, aren't signed.
+func (s *dnssecSigner) signSection(rrs []dns.RR, zone string, origTTL uint32, now time.Time) []dns.RR {
+	type rrsetKey struct {
+		name   string
+		rrtype uint16
+	}
+	var order []rrsetKey
+	rrsets := map[rrsetKey][]dns.RR{}
+	for _, rr := range rrs {
+		h := rr.Header()
+		if h.Rrtype == dns.TypeRRSIG || h.Rrtype == dns.TypeOPT || !dns.IsSubDomain(zone, h.Name) {
+			continue
+		}
+		k := rrsetKey{dns.CanonicalName(h.Name), h.Rrtype}
+		if _, ok := rrsets[k]; !ok {
+			order = append(order, k)
+		}
+		rrsets[k] = append(rrsets[k], rr)
+	}
+	for _, k := range order {
+		rrs = append(rrs, s.sign(rrsets[k], zone, origTTL, now)...)
+	}
+	return rrs
+}
+
+// signedTTL returns the original TTL of signatures, the highest TTL records are served with.
+func (t *Tailscale) signedTTL() uint32 {
+	ttl := max(t.baseTTL(), t.negTTL())
+	for _, p := range t.profiles {
+		ttl = max(ttl, p.TTL)
+	}
+	for _, m := range t.services {
+		ttl = max(ttl, m.TTL)
+	}
+	for _, byType := range t.staticTTLs {
+		for _, rrTTL := range byType {
+			ttl = max(ttl, rrTTL)
+		}
+	}
+	return ttl + t.ttlJitter
+}
+
+// signResponse signs msg for clients that set the DO bit. Negative answers get a signed NSEC record
+// for the query name and are turned into NOERROR responses, as the NSEC record proves the name
+// doesn't exist (RFC 9824).
+func (t *Tailscale) signResponse(state request.Request, msg *dns.Msg) {
+	if t.dnssec == nil || !state.Do() || (msg.Rcode != dns.RcodeSuccess && msg.Rcode != dns.RcodeNameError) {
+		return
+	}
+	zone := t.matchZone(state.Name())
+	if zone == "" {
+		return
+	}
+	now := time.Now()
+	origTTL := t.signedTTL()
+
+	if len(msg.Answer) > 0 {
+		msg.Answer = t.dnssec.signSection(msg.Answer, zone, origTTL, now)
+		msg.Ns = t.dnssec.signSection(msg.Ns, zone, origTTL, now)
+		msg.Extra = t.dnssec.signSection(msg.Extra, zone, origTTL, now)
+		return
+	}
+	if len(msg.Ns) != 1 || msg.Ns[0].Header().Rrtype != dns.TypeSOA {
+		return
+	}
+
+	soa := msg.Ns[0]
+	nsec := &dns.NSEC{
+		Hdr:        dns.RR_Header{Name: state.QName(), Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: soa.Header().Ttl},
+		NextDomain: `\000.` + state.QName(),
+	}
+	switch {
+	case msg.Rcode == dns.RcodeNameError:
+		nsec.TypeBitMap = nxTypes
+	case dns.CountLabel(state.Name()) == dns.CountLabel(zone):
+		nsec.TypeBitMap = withoutType(apexTypes, state.QType())
+	default:
+		nsec.TypeBitMap = withoutType(nameTypes, state.QType())
+	}
+	denial := append([]dns.RR{nsec}, t.dnssec.sign([]dns.RR{nsec}, zone, origTTL, now)...)
+
+	msg.Rcode = dns.RcodeSuccess
+	if state.QType() == dns.TypeNSEC {
+		msg.Answer, msg.Ns = denial, nil
+		return
+	}
+	msg.Ns = append(t.dnssec.signSection(msg.Ns, zone, origTTL, now), denial...)
+}
+
+// withoutType returns types without qtype, unless that is NSEC or RRSIG, which are always there.
+func withoutType(types []uint16, qtype uint16) []uint16 {
+	out := make([]uint16, 0, len(types))
+	for _, t := range types {
+		if t != qtype || t == dns.TypeNSEC || t == dns.TypeRRSIG {
+			out = append(out, t)
+		}
+	}
+	return out
+}
@@ -0,0 +1,191 @@
+package tailscale
+
+import (
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/core/dnsserver"
+	"github.com/miekg/dns"
+)
+
+// corefileInput is a Corefile given as a string, for starting a CoreDNS instance with caddy.
+type corefileInput string
+
+func (i corefileInput) Body() []byte       { return []byte(i) }
+func (i corefileInput) Path() string       { return "Corefile" }
+func (i corefileInput) ServerType() string { return "dns" }
+
+// startCoreDNS starts a CoreDNS instance running corefile, stopped at the end of the test, and returns
+// the UDP address of its first server. Only the tailscale plugin is available in the instance.
+func startCoreDNS(t *testing.T, corefile string) string {
+	t.Helper()
+	// The plugin isn't part of CoreDNS, so it isn't in the order of directives either.
+	if !slices.Contains(dnsserver.Directives, "tailscale") {
+		dnsserver.Directives = append(dnsserver.Directives, "tailscale")
+	}
+	caddy.Quiet = true
+	dnsserver.Quiet = true
+
+	i, err := caddy.Start(corefileInput(corefile))
+	if err != nil {
+		t.Fatalf("unable to start CoreDNS: %v", err)
+	}
+	t.Cleanup(func() { i.Stop() })
+
+	servers := i.Servers()
+	if len(servers) == 0 || servers[0].LocalAddr() == nil {
+		t.Fatal("CoreDNS has no UDP listener")
+	}
+	return servers[0].LocalAddr().String()
+}
+
+// e2eCase is a query against a running instance and the answer expected.
+type e2eCase struct {
+	qname   string
+	qtype   uint16
+	rcode   int
+	answers []string
+}
+
+func runE2E(t *testing.T, addr string, tests []e2eCase) {
+	t.Helper()
+	client := &dns.Client{Net: "udp"}
+	for _, tc := range tests {
+		msg := new(dns.Msg)
+		msg.SetQuestion(tc.qname, tc.qtype)
+		resp, _, err := client.Exchange(msg, addr)
+		if err != nil {
+			t.Errorf("%s %s: %v", tc.qname, dns.TypeToString[tc.qtype], err)
+			continue
+		}
+		if resp.Rcode != tc.rcode {
+			t.Errorf("%s %s: want rcode %s, got %s", tc.qname, dns.TypeToString[tc.qtype], dns.RcodeToString[tc.rcode], dns.RcodeToString[resp.Rcode])
+		}
+		if !resp.Authoritative {
+			t.Errorf("%s %s: want an authoritative answer", tc.qname, dns.TypeToString[tc.qtype])
+		}
+		var answers []string
+		for _, rr := range resp.Answer {
+			// Compare the data of each record only; TTLs and owner names are covered elsewhere.
+			answers = append(answers, rr.String()[len(rr.Header().String()):])
+		}
+		if !slices.Equal(answers, tc.answers) {
+			t.Errorf("%s %s: want answers %q, got %q", tc.qname, dns.TypeToString[tc.qtype], tc.answers, answers)
+		}
+	}
+}
+
+func TestE2EStaticRecords(t *testing.T) {
+	// The tailnet is never reachable in tests, so misses are only answered as such with
+	// internal_errors negative, see TestE2ENotSynced.
+	addr := startCoreDNS(t, `example.com:0 {
+  tailscale example.com {
+    internal_errors negative
+    record grafana CNAME monitoring.example.org.
+    record nas A 192.168.1.10
+    record status TXT "all systems go"
+    ttl 30
+  }
+}`)
+
+	runE2E(t, addr, []e2eCase{
+		{"nas.example.com.", dns.TypeA, dns.RcodeSuccess, []string{"192.168.1.10"}},
+		{"NAS.Example.com.", dns.TypeA, dns.RcodeSuccess, []string{"192.168.1.10"}},
+		{"nas.example.com.", dns.TypeAAAA, dns.RcodeSuccess, nil},
+		{"grafana.example.com.", dns.TypeA, dns.RcodeSuccess, []string{"monitoring.example.org."}},
+		{"status.example.com.", dns.TypeTXT, dns.RcodeSuccess, []string{`"all systems go"`}},
+		{"missing.example.com.", dns.TypeA, dns.RcodeNameError, nil},
+	})
+
+	// The TTL of the Corefile makes it through to the wire.
+	msg := new(dns.Msg)
+	msg.SetQuestion("nas.example.com.", dns.TypeA)
+	resp, err := dns.Exchange(msg, addr)
+	if err != nil || len(resp.Answer) != 1 || resp.Answer[0].Header().Ttl != 30 {
+		t.Errorf("want an answer with TTL 30, got %v (err %v)", resp, err)
+	}
+}
+
+func TestE2ENotSynced(t *testing.T) {
+	addr := startCoreDNS(t, `example.com:0 {
+  tailscale example.com {
+    record nas A 192.168.1.10
+  }
+}`)
+
+	// Static records are answered, but misses may be names of the tailnet not synced yet.
+	runE2E(t, addr, []e2eCase{
+		{"nas.example.com.", dns.TypeA, dns.RcodeSuccess, []string{"192.168.1.10"}},
+		{"missing.example.com.", dns.TypeA, dns.RcodeServerFailure, nil},
+	})
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("missing.example.com.", dns.TypeA)
+	msg.SetEdns0(dns.DefaultMsgSize, false)
+	resp, err := dns.Exchange(msg, addr)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var ede *dns.EDNS0_EDE
+	if opt := resp.IsEdns0(); opt != nil {
+		for _, o := range opt.Option {
+			if e, ok := o.(*dns.EDNS0_EDE); ok {
+				ede = e
+			}
+		}
+	}
+	if ede == nil || ede.InfoCode != dns.ExtendedErrorCodeNotReady {
+		t.Errorf("want the Not Ready extended error, got %v", resp)
+	}
+	if len(resp.Ns) != 0 {
+		t.Errorf("want no SOA record to cache, got %v", resp.Ns)
+	}
+}
+
+func TestE2EStoredRecords(t *testing.T) {
+	// Records of nodes stored by an earlier run are served before the tailnet is reachable, which it
+	// never is in tests.
+	path := filepath.Join(t.TempDir(), "records.db")
+	store, err := openStore(storeBolt, path)
+	if err != nil {
+		t.Fatalf("unable to open store: %v", err)
+	}
+	err = store.save("example.com.", map[string]map[string][]string{
+		"web": {"A": {"100.64.0.1"}, "AAAA": {"fd7a:115c:a1e0::1"}, "TXT": {"tag:prod"}},
+		"db":  {"A": {"100.64.0.2"}},
+		"app": {"CNAME": {"web.example.com."}},
+	}, 1)
+	if err == nil {
+		err = store.close()
+	}
+	if err != nil {
+		t.Fatalf("unable to store records: %v", err)
+	}
+
+	addr := startCoreDNS(t, `example.com:0 100.64.0.0/10:0 {
+  tailscale example.com {
+    store bolt `+path+`
+  }
+}`)
+
+	runE2E(t, addr, []e2eCase{
+		{"web.example.com.", dns.TypeA, dns.RcodeSuccess, []string{"100.64.0.1"}},
+		{"web.example.com.", dns.TypeAAAA, dns.RcodeSuccess, []string{"fd7a:115c:a1e0::1"}},
+		{"web.example.com.", dns.TypeTXT, dns.RcodeSuccess, []string{`"tag:prod"`}},
+		{"app.example.com.", dns.TypeA, dns.RcodeSuccess, []string{"web.example.com.", "100.64.0.1"}},
+		{"sub.web.example.com.", dns.TypeA, dns.RcodeNameError, nil},
+		{"db.example.com.", dns.TypeAAAA, dns.RcodeSuccess, nil},
+		{"2.0.64.100.in-addr.arpa.", dns.TypePTR, dns.RcodeSuccess, []string{"db.example.com."}},
+		// The SOA serial is the stored one.
+		{"example.com.", dns.TypeSOA, dns.RcodeSuccess, []string{"coredns.example.com. hostmaster.example.com. 1 7200 1800 1209600 60"}},
+	})
+
+	// Queries outside the zones aren't answered by the plugin, and there's no other plugin.
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.org.", dns.TypeA)
+	if resp, err := dns.Exchange(msg, addr); err != nil || resp.Rcode != dns.RcodeRefused {
+		t.Errorf("want REFUSED outside the zones, got %v (err %v)", resp, err)
+	}
+}
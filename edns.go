@@ -0,0 +1,98 @@
+package tailscale
+
+import (
+	"context"
+	"encoding/hex"
+
+	"github.com/coredns/coredns/plugin/pkg/transport"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+// DefaultPaddingBlock is the block size responses are padded to if none is configured, as recommended
+// by RFC 8467.
+const DefaultPaddingBlock = 468
+
+// encryptedTransport reports whether queries over the server transport tr are encrypted, which they
+// must be for padding to have any use (RFC 7830, section 6).
+func encryptedTransport(tr string) bool {
+	switch tr {
+	case transport.TLS, transport.HTTPS, transport.QUIC:
+		return true
+	}
+	return false
+}
+
+// finishResponse echoes the case of the query name, runs the answer hooks on the response msg, signs
+// it, negotiates EDNS0 with the client, including the Extended DNS Error of a failed query, and makes
+// the response fit its buffer. It is called just before a response is written, which must not be if
+// an answer hook fails or ctx is done.
+func (t *Tailscale) finishResponse(ctx context.Context, state request.Request, msg *dns.Msg) error {
+	// Responses nobody waits for anymore aren't worth signing.
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if len(state.Req.Question) > 0 {
+		echoQueryCase(msg, state.Req.Question[0].Name)
+	}
+	if err := t.runAnswerHooks(ctx, state, msg); err != nil {
+		return err
+	}
+	t.signResponse(state, msg)
+
+	var pad bool
+	if reqOpt := state.Req.IsEdns0(); reqOpt != nil {
+		// RFC 6891: a response to a request with an OPT record carries one as well, which also echoes the
+		// DO bit (RFC 3225).
+		opt := responseOpt(reqOpt, msg)
+		for _, o := range reqOpt.Option {
+			switch o.Option() {
+			case dns.EDNS0NSID:
+				// RFC 5001: the NSID option is only included if the client asked for it.
+				if t.nsid != "" {
+					opt.Option = append(opt.Option, &dns.EDNS0_NSID{Code: dns.EDNS0NSID, Nsid: hex.EncodeToString([]byte(t.nsid))})
+				}
+			case dns.EDNS0COOKIE:
+				if t.cookieSecret != nil {
+					t.addCookie(state, t.queryClient(ctx, state), opt)
+				}
+			case dns.EDNS0PADDING:
+				// RFC 8467: only responses to padded queries are padded.
+				pad = t.padding > 0 && t.encrypted
+			}
+		}
+		// RFC 8914: tell why the answer is incomplete, or why the query failed.
+		if f := queryFailure(ctx); f != nil {
+			opt.Option = append(opt.Option, &dns.EDNS0_EDE{InfoCode: f.code, ExtraText: f.text})
+		}
+	}
+
+	// Drop the records that don't fit the client's buffer (512 bytes without EDNS0) and set TC, so the
+	// client retries over TCP instead of being sent a datagram that never arrives or a CNAME without
+	// its target.
+	state.Scrub(msg)
+
+	// Padding comes last, as it depends on the final length of the response.
+	if pad {
+		padResponse(msg, t.padding)
+	}
+	return nil
+}
+
+// padResponse adds an EDNS0 Padding option to msg, which must have an OPT record, so that its length
+// is a multiple of block (RFC 7830).
+func padResponse(msg *dns.Msg, block int) {
+	// The option adds its code and length to the message as well.
+	n := msg.Len() + 4
+	msg.IsEdns0().Option = append(msg.IsEdns0().Option, &dns.EDNS0_PADDING{Padding: make([]byte, (block-n%block)%block)})
+}
+
+// responseOpt returns the OPT record of msg, adding one based on the request's if there is none yet.
+func responseOpt(reqOpt *dns.OPT, msg *dns.Msg) *dns.OPT {
+	if opt := msg.IsEdns0(); opt != nil {
+		return opt
+	}
+	// RFC 6891 treats sizes below 512 bytes as 512.
+	msg.SetEdns0(max(reqOpt.UDPSize(), dns.MinMsgSize), reqOpt.Do())
+	return msg.IsEdns0()
+}
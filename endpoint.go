@@ -0,0 +1,86 @@
+package tailscale
+
+import (
+	"net/netip"
+	"slices"
+	"strings"
+
+	"github.com/miekg/dns"
+	"tailscale.com/tailcfg"
+)
+
+// DefaultEndpointLabel is the label of the subzone public endpoints are published in.
+const DefaultEndpointLabel = "ext"
+
+// cgnatRange is the shared address space of RFC 6598, which tailnet addresses are taken from and
+// carrier-grade NATs use. Neither is reachable from the internet.
+var cgnatRange = netip.MustParsePrefix("100.64.0.0/10")
+
+// publicEndpoints returns the records of the public addresses node is reachable at from the
+// internet, as last reported to the coordination server. Private, CGNAT and link-local endpoints
+// are left out, and so are ports, since several endpoints often share an address.
+func publicEndpoints(node tailcfg.NodeView) map[string][]string {
+	var v4, v6 []netip.Addr
+	for _, ep := range node.Endpoints().All() {
+		addr := ep.Addr().Unmap()
+		if !addr.IsGlobalUnicast() || addr.IsPrivate() || cgnatRange.Contains(addr) {
+			continue
+		}
+		if addr.Is4() {
+			v4 = append(v4, addr)
+		} else {
+			v6 = append(v6, addr)
+		}
+	}
+	entry := map[string][]string{}
+	for rrtype, addrs := range map[string][]netip.Addr{"A": v4, "AAAA": v6} {
+		slices.SortFunc(addrs, netip.Addr.Compare)
+		for _, addr := range slices.Compact(addrs) {
+			entry[rrtype] = append(entry[rrtype], addr.String())
+		}
+	}
+	if len(entry) == 0 {
+		return nil
+	}
+	return entry
+}
+
+// endpointName reports whether prefix and host, as returned by splitName, name a node in the
+// subzone of public endpoints, or the subzone itself if prefix is empty. The node is returned.
+func (t *Tailscale) endpointName(d *zoneData, prefix, host string) (node string, ok bool) {
+	if t.endpointLabel == "" || !strings.EqualFold(host, t.endpointLabel) {
+		return "", false
+	}
+	if prefix == "" {
+		return "", true
+	}
+	node = strings.ToLower(prefix)
+	_, ok = d.endpoints[node]
+	return node, ok
+}
+
+// resolveEndpoint adds the public endpoint addresses of the node to msg, if domainName is
+// <host>.<label>.<zone>. It reports whether domainName is in the subzone of endpoints, in which case
+// it isn't resolved like other names.
+func (t *Tailscale) resolveEndpoint(d *zoneData, domainName string, msg *dns.Msg, v6 bool) bool {
+	prefix, host := t.splitName(d, domainName)
+	node, ok := t.endpointName(d, prefix, host)
+	if !ok {
+		// Names below the subzone that aren't nodes with public endpoints don't exist.
+		return t.endpointLabel != "" && strings.EqualFold(host, t.endpointLabel)
+	}
+	if node == "" {
+		return true
+	}
+	ttl := t.hostTTL(d, node)
+	slab := slabPool.Get().(*rrSlab)
+	defer slabPool.Put(slab)
+	for _, addr := range d.endpointAddrs[node].get(v6) {
+		if v6 {
+			msg.Answer = append(msg.Answer, slab.newAAAA(domainName, ttl, addr))
+		} else {
+			msg.Answer = append(msg.Answer, slab.newA(domainName, ttl, addr))
+		}
+	}
+	return true
+}
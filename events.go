@@ -0,0 +1,91 @@
+package tailscale
+
+import (
+	"maps"
+	"slices"
+	"sync"
+	"time"
+)
+
+// DefaultSyncEvents is the number of sync events kept for the debug endpoint.
+const DefaultSyncEvents = 100
+
+// Kinds of sync events.
+const (
+	eventAdd    = "add"
+	eventRemove = "remove"
+	eventChange = "change"
+	eventError  = "error"
+)
+
+// syncEvent is a single change to the served records, or a failure to sync them.
+type syncEvent struct {
+	Time   time.Time `json:"time"`
+	Kind   string    `json:"kind"`
+	Name   string    `json:"name,omitempty"`
+	Detail string    `json:"detail,omitempty"`
+}
+
+// eventRing keeps the most recent sync events in a fixed size ring buffer, so that transient issues
+// can still be inspected long after they were logged. A nil or zero size ring keeps no events.
+type eventRing struct {
+	mu     sync.Mutex
+	events []syncEvent
+	next   int
+	full   bool
+}
+
+func newEventRing(size int) *eventRing {
+	return &eventRing{events: make([]syncEvent, size)}
+}
+
+// add records an event, overwriting the oldest one if the buffer is full.
+func (r *eventRing) add(e syncEvent) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.events) == 0 {
+		return
+	}
+	r.events[r.next] = e
+	r.next = (r.next + 1) % len(r.events)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// snapshot returns a copy of the recorded events, oldest first.
+func (r *eventRing) snapshot() []syncEvent {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.full {
+		return slices.Clone(r.events[:r.next])
+	}
+	return slices.Concat(r.events[r.next:], r.events[:r.next])
+}
+
+// diffEntries compares the records served before and after a sync, and returns an event for every
+// name that was added, removed or whose records changed, sorted by name.
+func (t *Tailscale) diffEntries(old, updated map[string]map[string][]string, now time.Time) []syncEvent {
+	var events []syncEvent
+	for _, name := range slices.Sorted(maps.Keys(updated)) {
+		records, ok := old[name]
+		switch {
+		case !ok:
+			events = append(events, syncEvent{Time: now, Kind: eventAdd, Name: t.logName(name)})
+		case !maps.EqualFunc(records, updated[name], slices.Equal):
+			events = append(events, syncEvent{Time: now, Kind: eventChange, Name: t.logName(name)})
+		}
+	}
+	for _, name := range slices.Sorted(maps.Keys(old)) {
+		if _, ok := updated[name]; !ok {
+			events = append(events, syncEvent{Time: now, Kind: eventRemove, Name: t.logName(name)})
+		}
+	}
+	return events
+}
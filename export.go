@@ -0,0 +1,227 @@
+package tailscale
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// exportRetry is how long a failed export waits before it's tried again, unless the records change
+// meanwhile.
+const exportRetry = 30 * time.Second
+
+// ExportRecord is a record exported to an external DNS provider. It has the fields of the records of
+// libdns (github.com/libdns/libdns), so the providers implemented with libdns, like those of Route 53
+// or Cloudflare, are adapted by converting between them.
+type ExportRecord struct {
+	// Name is relative to the zone, "@" for its apex.
+	Name string
+	// Type is the record type, e.g. "A".
+	Type string
+	// Value is the data of the record in presentation format, e.g. "100.64.0.1".
+	Value string
+	TTL   time.Duration
+}
+
+// ExportProvider is an external DNS provider the records of the zone are mirrored to. Its methods work
+// like those of the libdns interfaces with the same names: SetRecords replaces the records of the
+// names and types of recs, DeleteRecords deletes recs. zone is fully qualified.
+type ExportProvider interface {
+	GetRecords(ctx context.Context, zone string) ([]ExportRecord, error)
+	SetRecords(ctx context.Context, zone string, recs []ExportRecord) ([]ExportRecord, error)
+	DeleteRecords(ctx context.Context, zone string, recs []ExportRecord) ([]ExportRecord, error)
+}
+
+// ExportProviderFactory returns the provider configured by args, the arguments of the export directive
+// after the zone.
+type ExportProviderFactory func(args []string) (ExportProvider, error)
+
+// exportProviders holds the registered export providers by name.
+var exportProviders = struct {
+	sync.RWMutex
+	m map[string]ExportProviderFactory
+}{m: map[string]ExportProviderFactory{}}
+
+// RegisterExportProvider registers the factory of an export provider under name, for instances to
+// enable with export. Like RegisterAnswerHook, it's meant to be called from an init function, and
+// panics if name is empty or already registered.
+func RegisterExportProvider(name string, factory ExportProviderFactory) {
+	if name == "" || factory == nil {
+		panic("tailscale: export provider without name or factory")
+	}
+	exportProviders.Lock()
+	defer exportProviders.Unlock()
+	if _, ok := exportProviders.m[name]; ok {
+		panic(fmt.Sprintf("tailscale: export provider %q registered twice", name))
+	}
+	exportProviders.m[name] = factory
+}
+
+// lookupExportProvider returns the factory of the export provider registered under name.
+func lookupExportProvider(name string) (ExportProviderFactory, error) {
+	exportProviders.RLock()
+	defer exportProviders.RUnlock()
+	factory, ok := exportProviders.m[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown export provider %q", name)
+	}
+	return factory, nil
+}
+
+// requestExport has the records exported once the exporter gets to it. Requests made meanwhile are
+// merged, as the exporter always exports the current records. It does nothing without an exporter.
+func (t *Tailscale) requestExport() {
+	if t.exporter == nil {
+		return
+	}
+	select {
+	case t.exportPending <- struct{}{}:
+	default:
+	}
+}
+
+// runExport exports the records whenever requested, until ctx is done. Failed exports are retried
+// after exportRetry.
+func (t *Tailscale) runExport(ctx context.Context) {
+	var retry <-chan time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.exportPending:
+		case <-retry:
+		}
+		retry = nil
+		if err := t.export(ctx); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			ExportFailures.WithLabelValues("", t.zone, t.exporterName).Inc()
+			t.events.add(syncEvent{Time: time.Now(), Kind: eventError, Detail: err.Error()})
+			log.Warningf("Unable to export records to %s, retrying in %s: %v", t.exporterName, exportRetry, err)
+			retry = time.After(exportRetry)
+		}
+	}
+}
+
+// export makes the records of the export zone at the provider those of the zone, as transferred. The
+// export zone is managed entirely by the plugin: records other than SOA and NS that the zone doesn't
+// have are deleted.
+func (t *Tailscale) export(ctx context.Context) error {
+	zone := t.exportZone
+	want := exportRecords(t.zoneRRsets(t.load(), zone), zone)
+	have, err := t.exporter.GetRecords(ctx, zone)
+	if err != nil {
+		return fmt.Errorf("unable to get the records of %s: %w", zone, err)
+	}
+	set, del := diffExport(have, want, zone)
+	// Deleting first lets a name change from a CNAME to addresses, or back.
+	if len(del) > 0 {
+		if _, err := t.exporter.DeleteRecords(ctx, zone, del); err != nil {
+			return fmt.Errorf("unable to delete %d records of %s: %w", len(del), zone, err)
+		}
+	}
+	if len(set) > 0 {
+		if _, err := t.exporter.SetRecords(ctx, zone, set); err != nil {
+			return fmt.Errorf("unable to set %d records of %s: %w", len(set), zone, err)
+		}
+	}
+	ExportedRecords.WithLabelValues("", t.zone, t.exporterName).Set(float64(len(want)))
+	if len(set) > 0 || len(del) > 0 {
+		log.Infof("Exported %s to %s: set %d records, deleted %d", zone, t.exporterName, len(set), len(del))
+	}
+	return nil
+}
+
+// exportRecords converts the records in rrsets, all in zone, to records of a provider.
+func exportRecords(rrsets [][]dns.RR, zone string) []ExportRecord {
+	var recs []ExportRecord
+	for _, rrs := range rrsets {
+		for _, rr := range rrs {
+			hdr := rr.Header()
+			recs = append(recs, ExportRecord{
+				Name:  relativeName(hdr.Name, zone),
+				Type:  dns.TypeToString[hdr.Rrtype],
+				Value: strings.TrimPrefix(rr.String(), hdr.String()),
+				TTL:   time.Duration(hdr.Ttl) * time.Second,
+			})
+		}
+	}
+	return recs
+}
+
+// relativeName returns name relative to zone, "@" for the apex.
+func relativeName(name, zone string) string {
+	name, zone = dns.CanonicalName(name), dns.CanonicalName(zone)
+	if name == zone {
+		return "@"
+	}
+	return strings.TrimSuffix(name, "."+zone)
+}
+
+// exportKey identifies the records of a name and type at a provider.
+type exportKey struct {
+	name, rrtype string
+}
+
+// diffExport returns the records of want to set at the provider, whose records are have, so it has
+// the records of want: the records of every name and type whose records differ. del are the records
+// of have to delete, those of names and types that want has none of, except SOA and NS records.
+func diffExport(have, want []ExportRecord, zone string) (set, del []ExportRecord) {
+	key := func(r ExportRecord) exportKey {
+		// Providers may give absolute names.
+		name := r.Name
+		if strings.HasSuffix(name, ".") {
+			name = relativeName(name, zone)
+		}
+		return exportKey{strings.ToLower(name), strings.ToUpper(r.Type)}
+	}
+	group := func(recs []ExportRecord) (map[exportKey][]ExportRecord, []exportKey) {
+		groups := map[exportKey][]ExportRecord{}
+		var keys []exportKey
+		for _, r := range recs {
+			k := key(r)
+			if _, ok := groups[k]; !ok {
+				keys = append(keys, k)
+			}
+			groups[k] = append(groups[k], r)
+		}
+		return groups, keys
+	}
+	haveGroups, haveKeys := group(have)
+	wantGroups, wantKeys := group(want)
+
+	for _, k := range wantKeys {
+		if !sameRecords(haveGroups[k], wantGroups[k]) {
+			set = append(set, wantGroups[k]...)
+		}
+	}
+	for _, k := range haveKeys {
+		if _, ok := wantGroups[k]; !ok && k.rrtype != "SOA" && k.rrtype != "NS" {
+			del = append(del, haveGroups[k]...)
+		}
+	}
+	return set, del
+}
+
+// sameRecords reports whether a and b, records of the same name and type, have the same values and
+// TTLs, in any order.
+func sameRecords(a, b []ExportRecord) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	values := func(recs []ExportRecord) []string {
+		v := make([]string, 0, len(recs))
+		for _, r := range recs {
+			v = append(v, fmt.Sprintf("%s %d", r.Value, r.TTL/time.Second))
+		}
+		slices.Sort(v)
+		return v
+	}
+	return slices.Equal(values(a), values(b))
+}
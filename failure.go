@@ -0,0 +1,78 @@
+package tailscale
+
+import (
+	"context"
+
+	"github.com/coredns/coredns/plugin/metrics"
+	"github.com/miekg/dns"
+)
+
+// Policies for queries left without an answer by an internal failure, rather than by names or records
+// that don't exist.
+const (
+	// internalServfail answers with SERVFAIL, so resolvers retry later or ask another server instead
+	// of caching the miss.
+	internalServfail = "servfail"
+	// internalNegative answers with NXDOMAIN or NODATA, like a genuine miss.
+	internalNegative = "negative"
+)
+
+// DefaultInternalErrors answers queries failed internally with SERVFAIL.
+const DefaultInternalErrors = internalServfail
+
+// failure is an internal failure that left the answer to a query incomplete. Responses to clients
+// with EDNS0 carry it as an Extended DNS Error (RFC 8914), and kind labels it in metrics.
+type failure struct {
+	kind string
+	code uint16
+	text string
+}
+
+var (
+	// failureNotSynced is a miss before the records were synced with the tailnet for the first time.
+	failureNotSynced = &failure{"not_synced", dns.ExtendedErrorCodeNotReady, "records not synced yet"}
+	// failureLookupBudget is a lookup refused because the query took more than max_lookups.
+	failureLookupBudget = &failure{"lookup_budget", dns.ExtendedErrorCodeOther, "lookup budget exhausted"}
+	// failureUpstream is a CNAME target outside the zone that couldn't be looked up.
+	failureUpstream = &failure{"upstream", dns.ExtendedErrorCodeNetworkError, "upstream lookup failed"}
+)
+
+// fail records f as the failure of the query answered with ctx, unless it already failed. It does
+// nothing when not serving a query.
+func fail(ctx context.Context, f *failure) {
+	r, ok := ctx.Value(resolutionKey{}).(*resolution)
+	if !ok || r.failure != nil {
+		return
+	}
+	r.failure = f
+	InternalErrors.WithLabelValues(metrics.WithServer(ctx), f.kind).Inc()
+}
+
+// queryFailure returns the failure of the query answered with ctx, nil if it had none.
+func queryFailure(ctx context.Context) *failure {
+	if r, ok := ctx.Value(resolutionKey{}).(*resolution); ok {
+		return r.failure
+	}
+	return nil
+}
+
+// notSynced reports whether the running instance has no records of the tailnet yet, neither synced
+// nor loaded from the store, so misses may be names that exist.
+func (t *Tailscale) notSynced() bool {
+	return t.source != nil && !t.synced.Load()
+}
+
+// failedRcode returns the rcode of a response to the query answered with ctx without records, rcode
+// for a genuine miss. Queries that failed internally are answered according to the internal_errors
+// policy.
+func (t *Tailscale) failedRcode(ctx context.Context, rcode int) int {
+	if t.notSynced() {
+		fail(ctx, failureNotSynced)
+	}
+	f := queryFailure(ctx)
+	if f == nil || t.internalErrors == internalNegative {
+		return rcode
+	}
+	log.Debugf("Answering with SERVFAIL after internal failure: %s", f.text)
+	return dns.RcodeServerFailure
+}
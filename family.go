@@ -0,0 +1,71 @@
+package tailscale
+
+import (
+	"slices"
+
+	"github.com/miekg/dns"
+)
+
+// Address families listed first in answers with both, see prefer_family.
+const (
+	familyIPv4 = "ipv4"
+	familyIPv6 = "ipv6"
+)
+
+// DefaultPreferFamily lists A records before AAAA records.
+const DefaultPreferFamily = familyIPv4
+
+// Publication modes of an address family, see ipv4 and ipv6. The empty mode publishes the family
+// along with the other one.
+const (
+	// familyOnly publishes the addresses of the family alone.
+	familyOnly = "only"
+	// familyOff publishes none of the addresses of the family.
+	familyOff = "off"
+)
+
+// publishedFamilies returns whether A and AAAA records are published with the modes ipv4 and ipv6.
+func publishedFamilies(ipv4, ipv6 string) (a, aaaa bool) {
+	return ipv4 != familyOff && ipv6 != familyOnly, ipv6 != familyOff && ipv4 != familyOnly
+}
+
+// omitFamilies removes the address records of the families that aren't published from entry.
+func (t *Tailscale) omitFamilies(entry map[string][]string) {
+	if t.omitA {
+		delete(entry, "A")
+	}
+	if t.omitAAAA {
+		delete(entry, "AAAA")
+	}
+}
+
+// preferAAAA moves the AAAA records of each run of address records in rrs in front of its A records,
+// for stub resolvers that only use the first address of an answer. Records keep their order
+// otherwise, so CNAME records stay in front of the addresses of their targets.
+func preferAAAA(rrs []dns.RR) {
+	isAddr := func(rr dns.RR) bool {
+		rrtype := rr.Header().Rrtype
+		return rrtype == dns.TypeA || rrtype == dns.TypeAAAA
+	}
+	for i := 0; i < len(rrs); {
+		if !isAddr(rrs[i]) {
+			i++
+			continue
+		}
+		j := i + 1
+		for j < len(rrs) && isAddr(rrs[j]) {
+			j++
+		}
+		slices.SortStableFunc(rrs[i:j], func(a, b dns.RR) int {
+			// AAAA records sort first, the order of types is otherwise kept.
+			if a.Header().Rrtype == b.Header().Rrtype {
+				return 0
+			}
+			if a.Header().Rrtype == dns.TypeAAAA {
+				return -1
+			}
+			return 1
+		})
+		i = j
+	}
+}
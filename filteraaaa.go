@@ -0,0 +1,65 @@
+package tailscale
+
+import (
+	"context"
+	"net/netip"
+	"slices"
+
+	"github.com/miekg/dns"
+)
+
+// filtersAAAA reports whether AAAA records are stripped from the answers to client, because it's in
+// one of the filter_aaaa ranges or is a node with one of the filter_aaaa tags. Nodes
+// are identified through the LocalAPI, so tags only apply to clients inside the tailnet, and only
+// while connected to it.
+func (t *Tailscale) filtersAAAA(ctx context.Context, client netip.Addr) bool {
+	if len(t.filterAAAA) == 0 && len(t.filterAAAATags) == 0 {
+		return false
+	}
+	for _, pfx := range t.filterAAAA {
+		if pfx.Contains(client) {
+			return true
+		}
+	}
+	if len(t.filterAAAATags) == 0 || !isTailnetAddr(client) {
+		return false
+	}
+	who, err := t.identify(ctx, client)
+	if err != nil || who.Node == nil {
+		log.Debugf("Unable to identify client %s for filter_aaaa: %v", client, err)
+		return false
+	}
+	return slices.ContainsFunc(who.Node.Tags, func(tag string) bool { return slices.Contains(t.filterAAAATags, tag) })
+}
+
+// stripAAAA removes the AAAA records from the answer and additional sections of msg, and the IPv6
+// hints from its SVCB and HTTPS records, and returns the number of records removed.
+func stripAAAA(msg *dns.Msg) int {
+	strip := func(rrs []dns.RR) []dns.RR {
+		kept := rrs[:0]
+		for _, rr := range rrs {
+			switch rr := rr.(type) {
+			case *dns.AAAA:
+				continue
+			case *dns.SVCB:
+				stripIPv6Hints(rr)
+			case *dns.HTTPS:
+				stripIPv6Hints(&rr.SVCB)
+			}
+			kept = append(kept, rr)
+		}
+		return kept
+	}
+	n := len(msg.Answer) + len(msg.Extra)
+	msg.Answer = strip(msg.Answer)
+	msg.Extra = strip(msg.Extra)
+	return n - len(msg.Answer) - len(msg.Extra)
+}
+
+// stripIPv6Hints removes the ipv6hint parameter from svcb.
+func stripIPv6Hints(svcb *dns.SVCB) {
+	svcb.Value = slices.DeleteFunc(svcb.Value, func(kv dns.SVCBKeyValue) bool {
+		_, ok := kv.(*dns.SVCBIPv6Hint)
+		return ok
+	})
+}
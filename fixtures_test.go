@@ -0,0 +1,98 @@
+package tailscale
+
+import (
+	"flag"
+	"fmt"
+	"math/rand/v2"
+	"net/netip"
+
+	"tailscale.com/tailcfg"
+)
+
+// syntheticPeers is the size of the synthetic tailnet used by benchmarks, e.g.
+// go test -bench Synthetic -peers 50000.
+var syntheticPeers = flag.Int("peers", 10000, "number of peers in the synthetic tailnet of benchmarks")
+
+// Building blocks of synthetic machine names, mimicking the mix of personal devices and servers of a
+// real tailnet.
+var (
+	syntheticOwners   = []string{"alice", "bob", "carol", "dave", "erin", "frank", "grace", "heidi", "ivan", "judy"}
+	syntheticDevices  = []string{"macbook-pro", "iphone", "pixel-8", "thinkpad", "desktop", "ipad"}
+	syntheticRoles    = []string{"web", "db", "cache", "worker", "k8s-node", "gateway", "monitoring"}
+	syntheticEnvs     = []string{"prod", "staging", "dev"}
+	syntheticServices = []string{"api", "grafana", "registry", "vault", "git", "wiki", "ci", "mail"}
+)
+
+// syntheticTailnet returns a tailnet with n nodes: the plugin's own node and n-1 peers. The same
+// seed always gives the same tailnet. About two thirds of the nodes are servers, tagged with
+// their role and environment, and a tenth of those also with a cname- tag shared with other servers.
+// A few nodes pin themselves to one address family, and about one in a hundred peers is a shared
+// node or a Mullvad exit node, which aren't published.
+func syntheticTailnet(n int, seed uint64) *Tailnet {
+	rng := rand.New(rand.NewPCG(seed, seed))
+	nodes := make([]tailcfg.NodeView, 0, n)
+	for i := range n {
+		node := &tailcfg.Node{
+			ID:        tailcfg.NodeID(i + 1),
+			Addresses: syntheticAddrs(i),
+		}
+		if rng.IntN(3) == 0 {
+			owner := syntheticOwners[rng.IntN(len(syntheticOwners))]
+			device := syntheticDevices[rng.IntN(len(syntheticDevices))]
+			node.ComputedName = fmt.Sprintf("%s-%s-%d", owner, device, i)
+		} else {
+			role := syntheticRoles[rng.IntN(len(syntheticRoles))]
+			env := syntheticEnvs[rng.IntN(len(syntheticEnvs))]
+			node.ComputedName = fmt.Sprintf("%s-%s-%04d", role, env, i)
+			node.Tags = []string{"tag:" + role, "tag:" + env}
+			if rng.IntN(10) == 0 {
+				service := syntheticServices[rng.IntN(len(syntheticServices))]
+				node.Tags = append(node.Tags, "tag:cname-"+service+"-"+env)
+			}
+			switch rng.IntN(50) {
+			case 0:
+				node.Tags = append(node.Tags, tagV4Only)
+			case 1:
+				node.Tags = append(node.Tags, tagV6Only)
+			}
+		}
+		if i > 0 {
+			switch rng.IntN(200) {
+			case 0:
+				node.Sharer = 1
+			case 1:
+				node.IsWireGuardOnly = true
+			}
+		}
+		nodes = append(nodes, node.View())
+	}
+	return &Tailnet{SelfNode: nodes[0], Peers: nodes[1:]}
+}
+
+// syntheticAddrs returns the tailnet addresses of the i-th synthetic node, numbered consecutively
+// from the start of the CGNAT and Tailscale ULA ranges.
+func syntheticAddrs(i int) []netip.Prefix {
+	v4 := netip.AddrFrom4([4]byte{100, 64 + byte(i>>16), byte(i >> 8), byte(i)}).Next()
+	v6 := netip.MustParseAddr("fd7a:115c:a1e0::").As16()
+	v6[13], v6[14], v6[15] = byte(i>>16), byte(i>>8), byte(i)
+	return []netip.Prefix{
+		netip.PrefixFrom(v4, 32),
+		netip.PrefixFrom(netip.AddrFrom16(v6).Next(), 128),
+	}
+}
+
+// syntheticTailscale returns a plugin instance serving a synthetic tailnet of n nodes in example.com.
+// It also returns the published names, sorted by node.
+func syntheticTailscale(n int) (*Tailscale, []string) {
+	ts := &Tailscale{zone: "example.com."}
+	tn := syntheticTailnet(n, 1)
+	ts.processTailnet(tn)
+
+	names := make([]string, 0, n)
+	for _, node := range append([]tailcfg.NodeView{tn.SelfNode}, tn.Peers...) {
+		if _, ok := ts.load().entries[node.ComputedName()]; ok {
+			names = append(names, node.ComputedName()+".example.com.")
+		}
+	}
+	return ts, names
+}
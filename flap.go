@@ -0,0 +1,109 @@
+package tailscale
+
+import (
+	"slices"
+	"time"
+
+	"tailscale.com/tailcfg"
+)
+
+// With adaptive_ttl, the records of nodes likely to change soon are served with shorter TTLs, so
+// clients don't hold on to stale answers: nodes that keep going offline and coming back, and
+// ephemeral nodes, which are removed from the tailnet once they go offline.
+const (
+	// DefaultAdaptiveTTLMin is the lowest TTL adaptive_ttl shortens the records of nodes to.
+	DefaultAdaptiveTTLMin = 10
+	// DefaultAdaptiveTTLWindow is how long adaptive_ttl remembers a node going offline.
+	DefaultAdaptiveTTLWindow = time.Hour
+)
+
+// nodeAttrEphemeral marks the nodes of network maps converted from the device lists of the API and
+// Headscale as ephemeral. Network maps of the LocalAPI don't say which nodes are.
+const nodeAttrEphemeral tailcfg.NodeCapability = "github.com/shrewdhydra/coredns-tailscale/ephemeral"
+
+// nodeEphemeral reports whether node is known to be ephemeral.
+func nodeEphemeral(node tailcfg.NodeView) bool {
+	return node.HasCap(nodeAttrEphemeral)
+}
+
+// flapState is the connection history of a node.
+type flapState struct {
+	online bool
+	// offline are the times the node went offline within the window.
+	offline []time.Time
+}
+
+// flapTracker follows the connection state of nodes across network maps, by hostname, to count how
+// often each of them went offline recently. It is only used by processTailnet, which doesn't run
+// concurrently.
+type flapTracker struct {
+	window time.Duration
+	nodes  map[string]*flapState
+}
+
+// observe records the connection state of the nodes in online, by hostname, at now, and returns the
+// number of times each of them went offline within the window. Nodes missing from online went
+// offline too, as they're omitted from the records while they are.
+func (f *flapTracker) observe(online map[string]bool, now time.Time) map[string]int {
+	if f.nodes == nil {
+		f.nodes = map[string]*flapState{}
+	}
+	for host, state := range f.nodes {
+		if _, ok := online[host]; !ok && state.online {
+			state.online = false
+			state.offline = append(state.offline, now)
+		}
+	}
+	flaps := map[string]int{}
+	for host, up := range online {
+		state, ok := f.nodes[host]
+		if !ok {
+			f.nodes[host] = &flapState{online: up}
+			continue
+		}
+		if state.online && !up {
+			state.offline = append(state.offline, now)
+		}
+		state.online = up
+	}
+	for host, state := range f.nodes {
+		state.offline = slices.DeleteFunc(state.offline, func(at time.Time) bool { return now.Sub(at) > f.window })
+		if _, ok := online[host]; !ok && len(state.offline) == 0 {
+			// Removed from the tailnet, or offline for longer than the window.
+			delete(f.nodes, host)
+			continue
+		}
+		if n := len(state.offline); n > 0 {
+			flaps[host] = n
+		}
+	}
+	return flaps
+}
+
+// flapScore is how much adaptive_ttl shortens the TTL of a node: one step if it's ephemeral, and
+// another for every time it went offline within the window.
+func flapScore(ephemeral bool, flaps int) int {
+	score := flaps
+	if ephemeral {
+		score++
+	}
+	return score
+}
+
+// scaleTTL halves ttl for every step of score, down to no less than minTTL. TTLs below minTTL are
+// kept.
+func scaleTTL(ttl, minTTL uint32, score int) uint32 {
+	if score <= 0 || ttl <= minTTL {
+		return ttl
+	}
+	return max(ttl>>min(score, 31), minTTL)
+}
+
+// adaptiveBaseTTL returns ttl, the TTL of records of host, shortened according to the score of its
+// node with adaptive_ttl.
+func (t *Tailscale) adaptiveBaseTTL(d *zoneData, host string, ttl uint32) uint32 {
+	if score, ok := d.flapScores[host]; ok {
+		return scaleTTL(ttl, t.adaptiveTTLMin, score)
+	}
+	return ttl
+}
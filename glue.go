@@ -0,0 +1,64 @@
+package tailscale
+
+import (
+	"context"
+
+	"github.com/miekg/dns"
+)
+
+// glueTargets returns the names the records in rrs point clients to, which they would look up next.
+// SVCB and HTTPS records with the target "." point to their owner name.
+func glueTargets(rrs []dns.RR) []string {
+	var targets []string
+	for _, rr := range rrs {
+		switch rr := rr.(type) {
+		case *dns.NS:
+			targets = append(targets, rr.Ns)
+		case *dns.MX:
+			targets = append(targets, rr.Mx)
+		case *dns.SRV:
+			targets = append(targets, rr.Target)
+		case *dns.SVCB:
+			targets = append(targets, svcbTarget(rr.Hdr.Name, rr.Target))
+		case *dns.HTTPS:
+			targets = append(targets, svcbTarget(rr.Hdr.Name, rr.Target))
+		}
+	}
+	return targets
+}
+
+// svcbTarget returns the target of a SVCB or HTTPS record owned by name.
+func svcbTarget(name, target string) string {
+	if target == "." {
+		return name
+	}
+	return target
+}
+
+// addGlue adds the A and AAAA records of the names in zone that the answers in msg point to, to the
+// additional section of msg, so clients don't need to look them up separately.
+func (t *Tailscale) addGlue(ctx context.Context, d *zoneData, msg *dns.Msg, zone string) {
+	if !t.glue {
+		return
+	}
+	seen := map[string]bool{}
+	for _, target := range glueTargets(msg.Answer) {
+		target = dns.CanonicalName(target)
+		if seen[target] || !dns.IsSubDomain(zone, target) {
+			continue
+		}
+		seen[target] = true
+
+		var glue dns.Msg
+		name := moveName(target, zone, t.zone)
+		t.resolveA(ctx, d, name, &glue)
+		t.resolveAAAA(ctx, d, name, &glue)
+		t.moveAnswers(&glue, zone)
+		for _, rr := range glue.Answer {
+			// Only the addresses of the target itself are glue, not those found through CNAMEs.
+			if rrtype := rr.Header().Rrtype; (rrtype == dns.TypeA || rrtype == dns.TypeAAAA) && rr.Header().Name == target {
+				msg.Extra = append(msg.Extra, rr)
+			}
+		}
+	}
+}
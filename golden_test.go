@@ -0,0 +1,224 @@
+package tailscale
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/google/go-cmp/cmp"
+	"github.com/miekg/dns"
+	"tailscale.com/tailcfg"
+)
+
+// updateGolden rewrites the golden files with the responses of the tests, e.g.
+// go test -run Golden -update.
+var updateGolden = flag.Bool("update", false, "rewrite the golden files of the answer tests")
+
+// goldenSerial is the SOA serial of the zone in golden tests, which would otherwise be the time of
+// the last sync.
+const goldenSerial = 2024010100
+
+// goldenTailnet returns an instance serving the tailnet described by lines, one machine or record per
+// line, synced as from the LocalAPI:
+//
+//	node NAME ADDR... [tag:TAG...]
+//	record NAME [TTL] [CLASS] TYPE RDATA...
+//
+// Record lines are given like the record directive.
+func goldenTailnet(t *testing.T, lines []string, opts ...Option) *Tailscale {
+	t.Helper()
+	var records []string
+	tn := &Tailnet{}
+	for _, line := range lines {
+		kind, rest, _ := strings.Cut(line, " ")
+		switch kind {
+		case "node":
+			fields := strings.Fields(rest)
+			node := &tailcfg.Node{ID: tailcfg.NodeID(len(tn.Peers) + 1), ComputedName: fields[0]}
+			for _, f := range fields[1:] {
+				if strings.HasPrefix(f, tagPrefix) {
+					node.Tags = append(node.Tags, f)
+					continue
+				}
+				addr := netip.MustParseAddr(f)
+				node.Addresses = append(node.Addresses, netip.PrefixFrom(addr, addr.BitLen()))
+			}
+			tn.Peers = append(tn.Peers, node.View())
+		case "record":
+			records = append(records, rest)
+		default:
+			t.Fatalf("unknown tailnet line %q", line)
+		}
+	}
+
+	ts, err := New(NewConfig(append([]Option{WithZone("example.com"), WithRecord(records...)}, opts...)...))
+	if err != nil {
+		t.Fatalf("unable to configure the instance: %v", err)
+	}
+	ts.ready.Store(true)
+	ts.processTailnet(tn)
+	ts.mu.Lock()
+	ts.update(func(d *zoneData) { d.serial = goldenSerial })
+	ts.mu.Unlock()
+	return ts
+}
+
+// goldenQuery answers query, given as NAME TYPE, and returns the response as written to the wire.
+func goldenQuery(t *testing.T, ts *Tailscale, query string) []byte {
+	t.Helper()
+	name, typ, ok := strings.Cut(query, " ")
+	qtype, known := dns.StringToType[typ]
+	if !ok || !known {
+		t.Fatalf("invalid query %q, want NAME TYPE", query)
+	}
+	msg := new(dns.Msg)
+	msg.SetQuestion(name, qtype)
+	msg.Id = 0xbeef
+
+	w := dnstest.NewRecorder(&test.ResponseWriter{})
+	if _, err := ts.ServeDNS(context.Background(), w, msg); err != nil {
+		t.Fatalf("%s: unexpected error: %v", query, err)
+	}
+	if w.Msg == nil {
+		t.Fatalf("%s: no response written", query)
+	}
+	wire, err := w.Msg.Pack()
+	if err != nil {
+		t.Fatalf("%s: unable to pack the response: %v", query, err)
+	}
+	return wire
+}
+
+// formatGolden renders the response to query, in wire format, as a hex dump followed by the records,
+// like dig prints them.
+func formatGolden(t *testing.T, query string, wire []byte) string {
+	t.Helper()
+	var resp dns.Msg
+	if err := resp.Unpack(wire); err != nil {
+		t.Fatalf("%s: unable to unpack the response: %v", query, err)
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, ";; QUERY %s\n", query)
+	for _, line := range strings.SplitAfter(strings.TrimSuffix(hex.Dump(wire), "\n"), "\n") {
+		b.WriteString(";; " + line)
+	}
+	b.WriteString("\n")
+	b.WriteString(resp.String())
+	return b.String()
+}
+
+// goldenScenarios are the answer tests. Their responses are kept in testdata/golden/NAME.golden,
+// so every change to what goes on the wire shows up in a diff of those files and has to be approved
+// by running the tests with -update.
+var goldenScenarios = []struct {
+	name    string
+	tailnet []string
+	opts    []Option
+	queries []string
+}{
+	{
+		name: "cname",
+		tailnet: []string{
+			"node web 100.64.0.1 fd7a:115c:a1e0::1",
+			"record app CNAME web",
+			"record www CNAME app",
+			"record docs CNAME docs.example.org.",
+			"record ping CNAME pong",
+			"record pong CNAME ping",
+		},
+		queries: []string{
+			"www.example.com. A",
+			"www.example.com. AAAA",
+			"www.example.com. CNAME",
+			"docs.example.com. A",
+			"ping.example.com. A",
+		},
+	},
+	{
+		name: "nodata",
+		tailnet: []string{
+			"node web 100.64.0.1",
+			"record status TXT \"all systems go\"",
+		},
+		queries: []string{
+			"web.example.com. AAAA",
+			"web.example.com. MX",
+			"status.example.com. A",
+		},
+	},
+	{
+		name: "nxdomain",
+		tailnet: []string{
+			"node web 100.64.0.1",
+		},
+		queries: []string{
+			"missing.example.com. A",
+			"missing.example.com. AAAA",
+		},
+	},
+	{
+		name: "apex",
+		tailnet: []string{
+			"node web 100.64.0.1",
+		},
+		queries: []string{
+			"example.com. SOA",
+			"example.com. NS",
+			"example.com. A",
+		},
+	},
+	{
+		name: "reverse",
+		tailnet: []string{
+			"node web 100.64.0.1 fd7a:115c:a1e0::1",
+		},
+		queries: []string{
+			"1.0.64.100.in-addr.arpa. PTR",
+			"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.e.1.a.c.5.1.1.a.7.d.f.ip6.arpa. PTR",
+			"1.0.64.100.in-addr.arpa. TXT",
+			"9.0.64.100.in-addr.arpa. PTR",
+		},
+	},
+}
+
+func TestGolden(t *testing.T) {
+	for _, sc := range goldenScenarios {
+		t.Run(sc.name, func(t *testing.T) {
+			ts := goldenTailnet(t, sc.tailnet, sc.opts...)
+			var got bytes.Buffer
+			for i, query := range sc.queries {
+				if i > 0 {
+					got.WriteString("\n")
+				}
+				got.WriteString(formatGolden(t, query, goldenQuery(t, ts, query)))
+			}
+
+			path := filepath.Join("testdata", "golden", sc.name+".golden")
+			if *updateGolden {
+				if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(path, got.Bytes(), 0o644); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			want, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatalf("unable to read the golden file, run the tests with -update to create it: %v", err)
+			}
+			if !bytes.Equal(got.Bytes(), want) {
+				t.Errorf("responses differ from %s, run the tests with -update if the change is intended (-want +got):\n%s", path, cmp.Diff(string(want), got.String()))
+			}
+		})
+	}
+}
@@ -0,0 +1,169 @@
+package tailscale
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strconv"
+	"time"
+
+	"tailscale.com/tailcfg"
+)
+
+// The Headscale backend polls the nodes of a self-hosted Headscale coordination server from its REST
+// API, for tailnets that tailscale.com's API doesn't know about.
+const (
+	// DefaultHeadscaleInterval is how often the nodes are polled.
+	DefaultHeadscaleInterval = time.Minute
+)
+
+// headscaleClient fetches the nodes of a Headscale server, authenticating with an API key as created
+// by `headscale apikeys create`. It is used by a single goroutine.
+type headscaleClient struct {
+	baseURL string
+	apiKey  string
+	http    *http.Client
+}
+
+// headscaleUser is the user, called namespace before Headscale 0.19, a node belongs to.
+type headscaleUser struct {
+	Name string `json:"name"`
+}
+
+// headscaleNode is a node in the node list of the Headscale API.
+type headscaleNode struct {
+	ID string `json:"id"`
+	// Name is the hostname the node reported, GivenName the name it is known by in MagicDNS, which
+	// may have been changed by the administrator.
+	Name        string   `json:"name"`
+	GivenName   string   `json:"givenName"`
+	IPAddresses []string `json:"ipAddresses"`
+	// ForcedTags are set by the administrator, ValidTags requested by the node and allowed by the
+	// policy.
+	ForcedTags []string       `json:"forcedTags"`
+	ValidTags  []string       `json:"validTags"`
+	User       *headscaleUser `json:"user"`
+	Namespace  *headscaleUser `json:"namespace"`
+	Online     bool           `json:"online"`
+	CreatedAt  time.Time      `json:"createdAt"`
+	// PreAuthKey is the key the node registered with, if any. Nodes registered with an ephemeral
+	// key are removed once they go offline.
+	PreAuthKey *struct {
+		Ephemeral bool `json:"ephemeral"`
+	} `json:"preAuthKey"`
+}
+
+// nodes returns the nodes of the Headscale server. Servers before 0.23 call them machines.
+func (c *headscaleClient) nodes(ctx context.Context) ([]headscaleNode, error) {
+	var list struct {
+		Nodes    []headscaleNode `json:"nodes"`
+		Machines []headscaleNode `json:"machines"`
+	}
+	err := c.get(ctx, "/api/v1/node", &list)
+	var apiErr *apiError
+	if errors.As(err, &apiErr) && apiErr.code == http.StatusNotFound {
+		err = c.get(ctx, "/api/v1/machine", &list)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("listing nodes: %w", err)
+	}
+	return append(list.Nodes, list.Machines...), nil
+}
+
+// get requests path from the Headscale API and decodes the JSON response into v. Requests are
+// counted in the API metrics like those to the Tailscale API, with the URL of the server as tailnet.
+func (c *headscaleClient) get(ctx context.Context, path string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.baseURL+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.apiKey)
+	api := &apiClient{http: c.http, tailnet: c.baseURL}
+	return api.do(req, v)
+}
+
+// headscaleTailnet converts the nodes of a Headscale server into a Tailnet, so they are published
+// the same way as the nodes of a tailnet. Their users are passed on as user profiles. Node names are
+// logged as logName formats them.
+func headscaleTailnet(nodes []headscaleNode, logName func(string) string) *Tailnet {
+	tn := &Tailnet{UserProfiles: map[tailcfg.UserID]tailcfg.UserProfile{}}
+	users := map[string]tailcfg.UserID{}
+	for i, hn := range nodes {
+		name := hn.GivenName
+		if name == "" {
+			name = hn.Name
+		}
+		id, err := strconv.ParseInt(hn.ID, 10, 64)
+		if err != nil || id <= 0 {
+			id = int64(i + 1)
+		}
+		online := hn.Online
+		node := &tailcfg.Node{
+			ID:           tailcfg.NodeID(id),
+			StableID:     tailcfg.StableNodeID(hn.ID),
+			ComputedName: name,
+			Online:       &online,
+			Created:      hn.CreatedAt,
+		}
+		if hn.Name != "" {
+			node.Hostinfo = (&tailcfg.Hostinfo{Hostname: hn.Name}).View()
+		}
+		if hn.PreAuthKey != nil && hn.PreAuthKey.Ephemeral {
+			node.CapMap = tailcfg.NodeCapMap{nodeAttrEphemeral: nil}
+		}
+		for _, tag := range slices.Concat(hn.ForcedTags, hn.ValidTags) {
+			if !slices.Contains(node.Tags, tag) {
+				node.Tags = append(node.Tags, tag)
+			}
+		}
+		user := hn.User
+		if user == nil {
+			user = hn.Namespace
+		}
+		if user != nil && user.Name != "" {
+			// User IDs only need to tell users apart within the tailnet.
+			if _, ok := users[user.Name]; !ok {
+				users[user.Name] = tailcfg.UserID(len(users) + 1)
+				tn.UserProfiles[users[user.Name]] = tailcfg.UserProfile{ID: users[user.Name], LoginName: user.Name}
+			}
+			node.User = users[user.Name]
+		}
+		for _, s := range hn.IPAddresses {
+			addr, err := netip.ParseAddr(s)
+			if err != nil {
+				log.Warningf("Ignoring invalid address %q of Headscale node %s: %v", s, logName(name), err)
+				continue
+			}
+			node.Addresses = append(node.Addresses, netip.PrefixFrom(addr, addr.BitLen()))
+		}
+		tn.Peers = append(tn.Peers, node.View())
+	}
+	return tn
+}
+
+// headscaleSource polls the nodes of a Headscale server.
+type headscaleSource struct {
+	client *headscaleClient
+	// logName formats node names for logs, see Tailscale.logName.
+	logName func(string) string
+}
+
+func (s *headscaleSource) Name() string { return backendHeadscale }
+
+func (s *headscaleSource) Fetch(ctx context.Context) (*Tailnet, error) {
+	ctx, cancel := context.WithTimeout(ctx, apiTimeout)
+	defer cancel()
+	nodes, err := s.client.nodes(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return headscaleTailnet(nodes, s.logName), nil
+}
+
+// Watch isn't supported, the Headscale API has no way to push changes of the nodes.
+func (s *headscaleSource) Watch(context.Context, func(*Tailnet)) error {
+	return errors.ErrUnsupported
+}
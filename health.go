@@ -0,0 +1,108 @@
+package tailscale
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// debugHealthPath is the path of the debug endpoint reporting whether the records are current.
+const debugHealthPath = "/tailscale/health"
+
+// syncHealth tracks how current the records of a running instance are. While the LocalAPI is
+// watched, every change is pushed as it happens and the records are current even if nothing changed
+// for a long time. Otherwise they're as old as the last successful refresh.
+type syncHealth struct {
+	mu   sync.Mutex
+	last time.Time
+	live bool
+}
+
+// runningHealth holds the sync health of the running instances, for the data age metric.
+var runningHealth = struct {
+	sync.Mutex
+	m map[*syncHealth]bool
+}{m: map[*syncHealth]bool{}}
+
+// start starts tracking the instance at now. Records served before the first refresh, from the
+// store or the Corefile, count as refreshed at start.
+func (h *syncHealth) start(now time.Time) {
+	h.mu.Lock()
+	h.last, h.live = now, false
+	h.mu.Unlock()
+	runningHealth.Lock()
+	runningHealth.m[h] = true
+	runningHealth.Unlock()
+}
+
+// stop stops tracking the instance.
+func (h *syncHealth) stop() {
+	runningHealth.Lock()
+	delete(runningHealth.m, h)
+	runningHealth.Unlock()
+}
+
+// refreshed records a successful refresh at now. live is set if changes are pushed from now on.
+func (h *syncHealth) refreshed(now time.Time, live bool) {
+	h.mu.Lock()
+	h.last, h.live = now, live
+	h.mu.Unlock()
+}
+
+// lost records that changes are no longer pushed as of now. Pushed records were current until then.
+func (h *syncHealth) lost(now time.Time) {
+	h.mu.Lock()
+	if h.live {
+		h.last = now
+	}
+	h.live = false
+	h.mu.Unlock()
+}
+
+// age returns how old the records are at now, 0 while changes are pushed.
+func (h *syncHealth) age(now time.Time) time.Duration {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.live {
+		return 0
+	}
+	return now.Sub(h.last)
+}
+
+// maxDataAge returns the age of the records of the running instance whose records are oldest, in
+// seconds.
+func maxDataAge() float64 {
+	now := time.Now()
+	runningHealth.Lock()
+	defer runningHealth.Unlock()
+	var age time.Duration
+	for h := range runningHealth.m {
+		age = max(age, h.age(now))
+	}
+	return age.Seconds()
+}
+
+// Health reports whether the instance serves current records: an error if the records are older
+// than max_staleness, because the tailnet couldn't be reached for that long. It always returns nil
+// without max_staleness. The health plugin doesn't ask plugins, so it's exposed on the debug endpoint
+// for load balancers to check.
+func (t *Tailscale) Health() error {
+	if t.maxStaleness == 0 {
+		return nil
+	}
+	if age := t.health.age(time.Now()); age > t.maxStaleness {
+		return fmt.Errorf("records not refreshed for %s, longer than max_staleness %s", age.Round(time.Second), t.maxStaleness)
+	}
+	return nil
+}
+
+// serveHealth answers OK while the instance is healthy, and 503 with the reason otherwise.
+func (t *Tailscale) serveHealth(w http.ResponseWriter, r *http.Request) {
+	if err := t.Health(); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	io.WriteString(w, http.StatusText(http.StatusOK))
+}
@@ -0,0 +1,249 @@
+package tailscale
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"maps"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/sync/errgroup"
+)
+
+// Health checks telling which node addresses are reachable, see health_check.
+const (
+	// healthCheckOnline takes the addresses of nodes offline in the network map for unreachable.
+	healthCheckOnline = "online"
+	// healthCheckTCP connects to a TCP port of every address.
+	healthCheckTCP = "tcp"
+	// healthCheckHTTPS requests / from an HTTPS port of every address.
+	healthCheckHTTPS = "https"
+)
+
+const (
+	// DefaultHealthCheckInterval is how often addresses are probed.
+	DefaultHealthCheckInterval = 10 * time.Second
+	// DefaultHealthCheckFailures is the number of probes of an address that must fail in a row for
+	// it to be taken for unreachable.
+	DefaultHealthCheckFailures = 3
+)
+
+// maxProbeTimeout is the longest a probe may take, or the interval of the probes if shorter.
+const maxProbeTimeout = 5 * time.Second
+
+// maxConcurrentProbes is the number of addresses probed at the same time.
+const maxConcurrentProbes = 32
+
+// reachability holds the node addresses taken for unreachable by the health check.
+type reachability struct {
+	// down holds the unreachable addresses. It's replaced as a whole, so queries read it without
+	// locking.
+	down atomic.Pointer[map[netip.Addr]bool]
+	// failures counts the probes of each address that failed in a row. Only the probe loop uses it.
+	failures map[netip.Addr]int
+}
+
+// load returns the unreachable addresses.
+func (r *reachability) load() map[netip.Addr]bool {
+	if down := r.down.Load(); down != nil {
+		return *down
+	}
+	return nil
+}
+
+// setUnreachable replaces the unreachable addresses with down, and exports their number.
+func (t *Tailscale) setUnreachable(down map[netip.Addr]bool) {
+	if old := t.reach.load(); !maps.Equal(old, down) {
+		log.Infof("%d node addresses are unreachable", len(down))
+	}
+	t.reach.down.Store(&down)
+	UnreachableAddrs.WithLabelValues("", t.zone).Set(float64(len(down)))
+}
+
+// offlineAddrs returns the addresses of the nodes that are offline, by the names in online, for the
+// online health check.
+func offlineAddrs(online map[string]bool, owners map[string]nodeOwner) map[netip.Addr]bool {
+	down := map[netip.Addr]bool{}
+	for host, up := range online {
+		if up {
+			continue
+		}
+		for _, addr := range owners[host].addrs {
+			down[addr] = true
+		}
+	}
+	return down
+}
+
+// runHealthChecks probes the addresses of the nodes every health check interval until ctx is done.
+func (t *Tailscale) runHealthChecks(ctx context.Context) {
+	ticker := time.NewTicker(t.healthCheckInterval)
+	defer ticker.Stop()
+	for {
+		t.probeAll(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// probeAll probes every address of the nodes published once, and updates the unreachable addresses:
+// an address is unreachable once as many probes as configured failed in a row, and reachable again
+// with the first that succeeds.
+func (t *Tailscale) probeAll(ctx context.Context) {
+	var addrs []netip.Addr
+	seen := map[netip.Addr]bool{}
+	for _, owner := range t.load().owners {
+		for _, addr := range owner.addrs {
+			if !seen[addr] {
+				seen[addr] = true
+				addrs = append(addrs, addr)
+			}
+		}
+	}
+
+	failed := make([]bool, len(addrs))
+	var g errgroup.Group
+	g.SetLimit(maxConcurrentProbes)
+	for i, addr := range addrs {
+		g.Go(func() error {
+			if err := t.probe(ctx, addr); err != nil {
+				log.Debugf("Health check of %s failed: %v", addr, err)
+				failed[i] = true
+			}
+			return nil
+		})
+	}
+	g.Wait()
+	if ctx.Err() != nil {
+		return
+	}
+
+	failures := make(map[netip.Addr]int, len(addrs))
+	down := map[netip.Addr]bool{}
+	for i, addr := range addrs {
+		if !failed[i] {
+			continue
+		}
+		failures[addr] = t.reach.failures[addr] + 1
+		if failures[addr] >= t.healthCheckFailures {
+			down[addr] = true
+		}
+	}
+	t.reach.failures = failures
+	t.setUnreachable(down)
+}
+
+// probe checks whether addr is reachable on the health check port.
+func (t *Tailscale) probe(ctx context.Context, addr netip.Addr) error {
+	ctx, cancel := context.WithTimeout(ctx, min(t.healthCheckInterval, maxProbeTimeout))
+	defer cancel()
+	target := net.JoinHostPort(addr.String(), strconv.Itoa(int(t.healthCheckPort)))
+	if t.healthCheck == healthCheckTCP {
+		conn, err := t.dialTailnet(ctx, "tcp", target)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: t.dialTailnet,
+		// Machines have certificates for their names, if any, not for their addresses.
+		TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+		DisableKeepAlives: true,
+	}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://"+target+"/", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return fmt.Errorf("status %s", resp.Status)
+	}
+	return nil
+}
+
+// dropUnreachable removes the address records of unreachable nodes from the answer section of msg,
+// as long as other addresses are left: from every RRset, and with a set of CNAME records of the
+// query name, the CNAME records whose targets only have unreachable addresses. It returns the
+// number of records removed.
+func (t *Tailscale) dropUnreachable(msg *dns.Msg) int {
+	down := t.reach.load()
+	if len(down) == 0 || len(msg.Answer) < 2 {
+		return 0
+	}
+	unreachable := func(rrs []dns.RR) bool {
+		var addrs int
+		for _, rr := range rrs {
+			if addr, ok := rrAddr(rr); ok {
+				if !down[addr] {
+					return false
+				}
+				addrs++
+			}
+		}
+		return addrs > 0
+	}
+
+	before := len(msg.Answer)
+	if chains := cnameChains(msg.Answer); len(chains) > 1 {
+		var answer []dns.RR
+		for _, chain := range chains {
+			if !unreachable(chain) {
+				answer = append(answer, chain...)
+			}
+		}
+		if len(answer) > 0 {
+			msg.Answer = answer
+		}
+	}
+
+	var answer []dns.RR
+	for i := 0; i < len(msg.Answer); {
+		j := i + 1
+		for j < len(msg.Answer) && sameRRset(msg.Answer[i], msg.Answer[j]) {
+			j++
+		}
+		run := msg.Answer[i:j]
+		if unreachable(run) {
+			answer = append(answer, run...)
+		} else {
+			for _, rr := range run {
+				if addr, ok := rrAddr(rr); !ok || !down[addr] {
+					answer = append(answer, rr)
+				}
+			}
+		}
+		i = j
+	}
+	msg.Answer = answer
+	return before - len(msg.Answer)
+}
+
+// rrAddr returns the address of an A or AAAA record.
+func rrAddr(rr dns.RR) (netip.Addr, bool) {
+	var ip []byte
+	switch rr := rr.(type) {
+	case *dns.A:
+		ip = rr.A
+	case *dns.AAAA:
+		ip = rr.AAAA
+	default:
+		return netip.Addr{}, false
+	}
+	addr, ok := netip.AddrFromSlice(ip)
+	return addr.Unmap(), ok
+}
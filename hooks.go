@@ -0,0 +1,69 @@
+package tailscale
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+// AnswerHook filters or changes the response msg to the query of state before it's written. Hooks
+// run after the plugin has built the response, and before it is signed and fit to the client's
+// buffer, so DNSSEC signatures and truncation cover their changes. Responses passed on from MagicDNS
+// go through them as well. A hook returning an error makes the query fail with SERVFAIL.
+type AnswerHook func(ctx context.Context, state request.Request, msg *dns.Msg) error
+
+// answerHooks holds the registered answer hooks by name.
+var answerHooks = struct {
+	sync.RWMutex
+	m map[string]AnswerHook
+}{m: map[string]AnswerHook{}}
+
+// RegisterAnswerHook registers hook under name, for instances to enable with answer_hook. It's meant
+// to be called from the init function of a package built into CoreDNS, and panics if name is empty
+// or already registered.
+func RegisterAnswerHook(name string, hook AnswerHook) {
+	if name == "" || hook == nil {
+		panic("tailscale: answer hook without name or function")
+	}
+	answerHooks.Lock()
+	defer answerHooks.Unlock()
+	if _, ok := answerHooks.m[name]; ok {
+		panic(fmt.Sprintf("tailscale: answer hook %q registered twice", name))
+	}
+	answerHooks.m[name] = hook
+}
+
+// namedAnswerHook is an answer hook enabled in an instance, with the name it's registered under.
+type namedAnswerHook struct {
+	name string
+	hook AnswerHook
+}
+
+// lookupAnswerHooks returns the answer hooks registered under names, in order.
+func lookupAnswerHooks(names []string) ([]namedAnswerHook, error) {
+	answerHooks.RLock()
+	defer answerHooks.RUnlock()
+	hooks := make([]namedAnswerHook, 0, len(names))
+	for _, name := range names {
+		hook, ok := answerHooks.m[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown answer hook %q", name)
+		}
+		hooks = append(hooks, namedAnswerHook{name, hook})
+	}
+	return hooks, nil
+}
+
+// runAnswerHooks runs the enabled answer hooks on msg, in order, stopping at the first error.
+func (t *Tailscale) runAnswerHooks(ctx context.Context, state request.Request, msg *dns.Msg) error {
+	for _, h := range t.answerHooks {
+		if err := h.hook(ctx, state, msg); err != nil {
+			log.Warningf("Answer hook %s failed for %s: %v", h.name, t.logName(state.Name()), err)
+			return fmt.Errorf("answer hook %s: %w", h.name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package tailscale
+
+import (
+	"context"
+	"net"
+
+	"github.com/coredns/coredns/plugin/metrics"
+	clog "github.com/coredns/coredns/plugin/pkg/log"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+// DefaultMagicDNSResolver is the resolver every Tailscale node runs, which answers for MagicDNS names.
+const DefaultMagicDNSResolver = "100.100.100.100:53"
+
+// magicDNSSuffix is the parent domain of the MagicDNS domains of tailnets.
+const magicDNSSuffix = "ts.net."
+
+// magicDNSZone returns the MagicDNS domain qname is in, or "" if it isn't in one. Once the domain of the
+// tailnet is known from the network map only names in it match, before that any name below ts.net
+// does.
+func (t *Tailscale) magicDNSZone(d *zoneData, qname string) string {
+	domain := d.magicDomain
+	if domain == "" {
+		domain = magicDNSSuffix
+	}
+	if dns.IsSubDomain(domain, dns.CanonicalName(qname)) {
+		return domain
+	}
+	return ""
+}
+
+// serveMagicDNS passes the query of state on to the MagicDNS resolver of the node and writes its
+// response, so clients can resolve MagicDNS names through CoreDNS as well.
+func (t *Tailscale) serveMagicDNS(ctx context.Context, state request.Request, zone string) (int, error) {
+	if clog.D.Value() {
+		log.Debugf("Passing query for %s on to MagicDNS", t.logName(state.Name()))
+	}
+	RequestCount.WithLabelValues(metrics.WithServer(ctx), zone, dns.TypeToString[state.QType()]).Inc()
+
+	resp, err := t.exchangeMagicDNS(ctx, state.Req, "udp")
+	if err == nil && resp.Truncated && state.Proto() == "tcp" {
+		resp, err = t.exchangeMagicDNS(ctx, state.Req, "tcp")
+	}
+	if err != nil {
+		MagicDNSErrorCount.WithLabelValues(metrics.WithServer(ctx)).Inc()
+		log.Warningf("MagicDNS query for %s failed: %v", t.logName(state.Name()), err)
+		return dns.RcodeServerFailure, err
+	}
+
+	resp.Id = state.Req.Id
+	// The resolver may answer in a case of its own, which clients randomizing the case of their
+	// queries (0x20 encoding) take for a spoofed response.
+	resp.Question = append([]dns.Question(nil), state.Req.Question...)
+	echoQueryCase(resp, state.QName())
+	if err := t.runAnswerHooks(ctx, state, resp); err != nil {
+		return dns.RcodeServerFailure, err
+	}
+	RcodeCount.WithLabelValues(dns.RcodeToString[resp.Rcode], metrics.WithServer(ctx)).Inc()
+	if err := t.writeMsg(ctx, state.W, resp); err != nil {
+		return dns.RcodeServerFailure, err
+	}
+	return dns.RcodeSuccess, nil
+}
+
+// exchangeMagicDNS sends r to the MagicDNS resolver over network. The embedded node dials the
+// resolver within its own network stack, since the host has no route to it.
+func (t *Tailscale) exchangeMagicDNS(ctx context.Context, r *dns.Msg, network string) (*dns.Msg, error) {
+	conn, err := t.dialTailnet(ctx, network, t.magicDNSResolver)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	client := &dns.Client{Net: network}
+	resp, _, err := client.ExchangeWithConnContext(ctx, r, &dns.Conn{Conn: conn})
+	return resp, err
+}
+
+// dialTailnet connects to address in the tailnet, within the network stack of the embedded node if
+// any, since the host has no route into the tailnet then.
+func (t *Tailscale) dialTailnet(ctx context.Context, network, address string) (net.Conn, error) {
+	if t.srv != nil {
+		return t.srv.Dial(ctx, network, address)
+	}
+	return (&net.Dialer{}).DialContext(ctx, network, address)
+}
@@ -0,0 +1,67 @@
+package tailscale
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"tailscale.com/tailcfg"
+)
+
+// metaLabel is the label in front of the name of a node at which its metadata TXT record is
+// published, with expose_metadata.
+const metaLabel = "_meta"
+
+// nodeMetadata returns the strings of the metadata TXT record of node, in key=value form (RFC 1464):
+// its operating system and Tailscale version, whether it's online and when it was last seen, and
+// whether it's an exit node. Values the network map doesn't have are left out.
+func nodeMetadata(node tailcfg.NodeView) []string {
+	var meta []string
+	if hi := node.Hostinfo(); hi.Valid() {
+		if os := hi.OS(); os != "" {
+			meta = append(meta, "os="+os)
+		}
+		if version := hi.IPNVersion(); version != "" {
+			meta = append(meta, "version="+version)
+		}
+	}
+	if online, ok := node.Online().GetOk(); ok {
+		meta = append(meta, "online="+strconv.FormatBool(online))
+	}
+	if lastSeen, ok := node.LastSeen().GetOk(); ok && !lastSeen.IsZero() {
+		meta = append(meta, "last_seen="+lastSeen.UTC().Format(time.RFC3339))
+	}
+	return append(meta, "exit_node="+strconv.FormatBool(isExitNode(node)))
+}
+
+// isExitNode reports whether node is an approved exit node, routing a default route.
+func isExitNode(node tailcfg.NodeView) bool {
+	for _, pfx := range node.AllowedIPs().All() {
+		if pfx.Bits() == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// isMetaName reports whether domainName is the name of the metadata TXT record of a node.
+func (t *Tailscale) isMetaName(d *zoneData, domainName string) bool {
+	prefix, name := t.splitName(d, domainName)
+	_, ok := d.meta[name]
+	return ok && strings.EqualFold(prefix, metaLabel)
+}
+
+// resolveMeta adds the metadata TXT record to msg if domainName is the name of one, reporting whether
+// it was.
+func (t *Tailscale) resolveMeta(d *zoneData, domainName string, msg *dns.Msg) bool {
+	if !t.isMetaName(d, domainName) {
+		return false
+	}
+	_, name := t.splitName(d, domainName)
+	msg.Answer = append(msg.Answer, &dns.TXT{
+		Hdr: dns.RR_Header{Name: domainName, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: t.rrsetTTL(d, name, "TXT")},
+		Txt: d.meta[name],
+	})
+	return true
+}
@@ -1,23 +1,27 @@
 package tailscale
 
 import (
+	"errors"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/core/dnsserver"
 	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/metrics"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promauto"
 )
 
 // Variables declared for monitoring.
 var (
 	// RequestCount exports a prometheus metric that is incremented every time a DNS request is processed.
-	RequestCount = promauto.NewCounterVec(prometheus.CounterOpts{
+	RequestCount = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Namespace: plugin.Namespace,
 		Subsystem: "tailscale",
 		Name:      "requests_total",
-		Help:      "Counter of DNS requests processed by record type.",
-	}, []string{"server", "type"})
+		Help:      "Counter of DNS requests processed by zone and record type.",
+	}, []string{"server", "zone", "type"})
 
 	// RcodeCount exports a prometheus metric that counts responses by return code.
-	RcodeCount = promauto.NewCounterVec(prometheus.CounterOpts{
+	RcodeCount = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Namespace: plugin.Namespace,
 		Subsystem: "tailscale",
 		Name:      "responses_total",
@@ -25,7 +29,7 @@ var (
 	}, []string{"rcode", "server"})
 
 	// RequestDuration exports a prometheus metric that tracks the duration of DNS requests.
-	RequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	RequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
 		Namespace: plugin.Namespace,
 		Subsystem: "tailscale",
 		Name:      "request_duration_seconds",
@@ -33,11 +37,329 @@ var (
 		Help:      "Histogram of the time each DNS request took to resolve.",
 	}, []string{"server"})
 
+	// QueryLogDropped exports a prometheus metric that counts lines of the query log dropped, by
+	// reason.
+	QueryLogDropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "tailscale",
+		Name:      "query_log_dropped_total",
+		Help:      "Counter of lines of the query log dropped because the rate was exceeded or too many were queued.",
+	}, []string{"server", "reason"})
+
+	// ShedCount exports a prometheus metric that counts queries shed because too many were in flight.
+	ShedCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "tailscale",
+		Name:      "shed_requests_total",
+		Help:      "Counter of DNS requests shed because the maximum number of in-flight requests was reached.",
+	}, []string{"server"})
+
+	// WriteErrorCount exports a prometheus metric that counts responses that couldn't be written, by reason.
+	WriteErrorCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "tailscale",
+		Name:      "write_errors_total",
+		Help:      "Counter of DNS responses that could not be written, by reason.",
+	}, []string{"server", "reason"})
+
+	// EnumerationCount exports a prometheus metric that counts clients flagged for querying an unusual
+	// number of distinct names.
+	EnumerationCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "tailscale",
+		Name:      "enumeration_suspects_total",
+		Help:      "Counter of clients that queried more distinct names within a window than the enumeration threshold.",
+	}, []string{"server"})
+
+	// LookupBudgetExhausted exports a prometheus metric that counts queries answered incompletely because
+	// they took more lookups than allowed.
+	LookupBudgetExhausted = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "tailscale",
+		Name:      "lookup_budget_exhausted_total",
+		Help:      "Counter of queries that exhausted their lookup budget.",
+	}, []string{"server"})
+
+	// InternalErrors exports a prometheus metric that shows the number of queries left without a full
+	// answer by an internal failure, by its kind.
+	InternalErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "tailscale",
+		Name:      "internal_errors_total",
+		Help:      "Counter of queries answered incompletely or with SERVFAIL after an internal failure.",
+	}, []string{"server", "kind"})
+
+	// AnswerCacheHits exports a prometheus metric that counts the queries answered from the answer cache.
+	AnswerCacheHits = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "tailscale",
+		Name:      "answer_cache_hits_total",
+		Help:      "Counter of DNS requests answered from the answer cache.",
+	}, []string{"server"})
+
+	// AnswerCacheMisses exports a prometheus metric that counts the queries whose answer wasn't cached.
+	AnswerCacheMisses = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "tailscale",
+		Name:      "answer_cache_misses_total",
+		Help:      "Counter of DNS requests whose answer wasn't in the answer cache.",
+	}, []string{"server"})
+
+	// AnswerCompositions exports a prometheus metric that counts the answers that took each kind of
+	// resolution beyond the records of the name itself, see answerComposition.
+	AnswerCompositions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "tailscale",
+		Name:      "answer_compositions_total",
+		Help:      "Counter of answers following CNAME records, chains of them, CNAME records with several targets, or with records flattened from upstream, by kind.",
+	}, []string{"server", "kind"})
+
+	// ViewCount exports a prometheus metric that counts the queries answered with a view, by its name.
+	ViewCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "tailscale",
+		Name:      "view_requests_total",
+		Help:      "Counter of DNS requests answered with a view, which hides the machines it doesn't show.",
+	}, []string{"server", "view"})
+
 	// NodeCount exports a prometheus metric that shows the number of Tailscale nodes in the Tailnet.
-	NodeCount = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	NodeCount = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Namespace: plugin.Namespace,
 		Subsystem: "tailscale",
 		Name:      "nodes_total",
 		Help:      "Number of Tailscale nodes in the Tailnet.",
+	}, []string{"server", "zone"})
+
+	// ConflictCount exports a prometheus metric that shows the number of names for which more than one
+	// record source had records.
+	ConflictCount = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "tailscale",
+		Name:      "record_conflicts",
+		Help:      "Number of names with records from more than one source, resolved by precedence.",
+	}, []string{"server", "zone"})
+
+	// SyncChanges exports a prometheus metric that shows how many names the last sync added, removed or
+	// changed records of.
+	SyncChanges = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "tailscale",
+		Name:      "last_sync_changes",
+		Help:      "Number of names added, removed or changed by the last sync, by kind.",
+	}, []string{"server", "zone", "kind"})
+
+	// LastSync exports a prometheus metric with the time of the last sync.
+	LastSync = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "tailscale",
+		Name:      "last_sync_timestamp_seconds",
+		Help:      "Unix time of the last sync of records with the tailnet.",
+	}, []string{"server", "zone"})
+
+	// RefreshFailures exports a prometheus metric that counts failures to read the records of the
+	// tailnet, by backend.
+	RefreshFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "tailscale",
+		Name:      "refresh_failures_total",
+		Help:      "Counter of failures to watch the LocalAPI or poll the API for the records of the tailnet, by backend.",
+	}, []string{"server", "zone", "backend"})
+
+	// RefreshDuration exports a prometheus metric that tracks how long fetching the full network map
+	// or device list took, by backend.
+	RefreshDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "tailscale",
+		Name:      "refresh_duration_seconds",
+		Buckets:   prometheus.ExponentialBuckets(0.005, 2, 14),
+		Help:      "Histogram of the time fetching and processing the full network map or device list took, by backend.",
+	}, []string{"server", "zone", "backend"})
+
+	// ExportedRecords exports a prometheus metric with the number of records of the last export to an
+	// external DNS provider, by provider.
+	ExportedRecords = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "tailscale",
+		Name:      "exported_records",
+		Help:      "Number of records of the zone at the external DNS provider after the last export, by provider.",
+	}, []string{"server", "zone", "provider"})
+
+	// ExportFailures exports a prometheus metric that counts failed exports to an external DNS
+	// provider, by provider.
+	ExportFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "tailscale",
+		Name:      "export_failures_total",
+		Help:      "Counter of failures to export the records to an external DNS provider, by provider.",
+	}, []string{"server", "zone", "provider"})
+
+	// APIRequests exports a prometheus metric that counts the requests made to the Tailscale API, by
+	// tailnet and HTTP status code, 0 for requests that got no response.
+	APIRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "tailscale",
+		Name:      "api_requests_total",
+		Help:      "Counter of requests made to the Tailscale API, by tailnet and HTTP status code.",
+	}, []string{"server", "tailnet", "code"})
+
+	// APIQuotaLimit, APIQuotaRemaining and APIQuotaReset export prometheus metrics with the rate
+	// limit of the Tailscale API credentials, as reported by the last response that had it, by tailnet.
+	APIQuotaLimit = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "tailscale",
+		Name:      "api_quota_limit",
+		Help:      "Number of requests the Tailscale API allows in the current rate limit window, by tailnet.",
+	}, []string{"server", "tailnet"})
+	APIQuotaRemaining = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "tailscale",
+		Name:      "api_quota_remaining",
+		Help:      "Number of requests left in the current rate limit window of the Tailscale API, by tailnet.",
+	}, []string{"server", "tailnet"})
+	APIQuotaReset = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "tailscale",
+		Name:      "api_quota_reset_timestamp_seconds",
+		Help:      "Unix time at which the rate limit window of the Tailscale API resets, by tailnet.",
+	}, []string{"server", "tailnet"})
+
+	// DataAge exports a prometheus metric with the age of the oldest records served.
+	DataAge = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "tailscale",
+		Name:      "data_age_seconds",
+		Help:      "Seconds since the records were last known to be current, 0 while the LocalAPI pushes changes.",
+	}, maxDataAge)
+
+	// ActiveBackend exports a prometheus metric that shows which backend the records currently come from.
+	ActiveBackend = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "tailscale",
+		Name:      "active_backend",
+		Help:      "A metric with a constant '1' value for the backend the records currently come from, and '0' for the others.",
+	}, []string{"server", "backend"})
+
+	// MagicDNSErrorCount exports a prometheus metric that counts queries for MagicDNS names that
+	// couldn't be passed on to the resolver of the node.
+	MagicDNSErrorCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "tailscale",
+		Name:      "magicdns_errors_total",
+		Help:      "Counter of queries for MagicDNS names that couldn't be passed on to the resolver of the node.",
 	}, []string{"server"})
+
+	// MagicDNSOverlaps exports a prometheus metric that shows the zones overlapping with the DNS
+	// settings of the tailnet.
+	MagicDNSOverlaps = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "tailscale",
+		Name:      "magicdns_overlaps",
+		Help:      "A metric with a constant '1' value for each zone overlapping with the DNS settings of the tailnet, by kind of overlap.",
+	}, []string{"server", "zone", "kind"})
+
+	// TagRecordIssues exports a prometheus metric that shows the problems with the records nodes
+	// advertise through tags, by kind.
+	TagRecordIssues = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "tailscale",
+		Name:      "tag_record_issues",
+		Help:      "Number of invalid record tags, and of addresses advertised through tags that more than one node has.",
+	}, []string{"server", "zone", "kind"})
+
+	// HostnameCollisions exports a prometheus metric that shows the number of hostnames more than one
+	// node has.
+	HostnameCollisions = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "tailscale",
+		Name:      "hostname_collisions",
+		Help:      "Number of hostnames more than one node has.",
+	}, []string{"server", "zone"})
+
+	// UnreachableAddrs exports a prometheus metric that shows the number of node addresses the health
+	// check takes for unreachable.
+	UnreachableAddrs = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "tailscale",
+		Name:      "unreachable_addresses",
+		Help:      "Number of node addresses the health check takes for unreachable.",
+	}, []string{"server", "zone"})
+
+	// ReloadCount exports a prometheus metric that counts the reloads of each instance, by primary
+	// zone.
+	ReloadCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "tailscale",
+		Name:      "reloads_total",
+		Help:      "Counter of reloads of each instance, by primary zone.",
+	}, []string{"zone"})
+
+	// Goroutines exports a prometheus metric that shows the number of background goroutines running,
+	// by task.
+	Goroutines = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "tailscale",
+		Name:      "goroutines",
+		Help:      "Number of background goroutines running, by task.",
+	}, []string{"task"})
+
+	// BuildInfo exports a prometheus metric that identifies the plugin version running.
+	BuildInfo = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "tailscale",
+		Name:      "build_info",
+		Help:      "A metric with a constant '1' value labeled by the version, Go version and commit of the plugin.",
+	}, []string{"version", "goversion", "commit"})
+
+	// ConfigInfo exports a prometheus metric that identifies the configuration of each running
+	// instance, so instances with diverging configurations stand out.
+	ConfigInfo = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "tailscale",
+		Name:      "config_info",
+		Help:      "A metric with a constant '1' value labeled by the primary zone and configuration hash of each instance.",
+	}, []string{"zone", "hash"})
 )
+
+// collectors are all the metrics of the plugin, see registerMetrics.
+var collectors = []prometheus.Collector{
+	RequestCount, RcodeCount, RequestDuration, ShedCount, WriteErrorCount, EnumerationCount,
+	LookupBudgetExhausted, InternalErrors, AnswerCacheHits, AnswerCacheMisses, AnswerCompositions,
+	ViewCount, NodeCount, ConflictCount, SyncChanges, LastSync, RefreshFailures, RefreshDuration,
+	ExportedRecords, ExportFailures, APIRequests, APIQuotaLimit, APIQuotaRemaining, APIQuotaReset,
+	DataAge, ActiveBackend, MagicDNSErrorCount, MagicDNSOverlaps, TagRecordIssues, HostnameCollisions,
+	UnreachableAddrs, QueryLogDropped, ReloadCount, Goroutines, BuildInfo, ConfigInfo,
+}
+
+// zoneGauges are the metrics describing the records of an instance, labeled with its primary zone,
+// which are dropped when it shuts down.
+var zoneGauges = []*prometheus.GaugeVec{
+	NodeCount, ConflictCount, SyncChanges, LastSync, ExportedRecords, TagRecordIssues, HostnameCollisions,
+	UnreachableAddrs,
+}
+
+// registerMetrics registers the metrics with the prometheus plugin of the server block of c, or with
+// the default registry, which the prometheus plugin of other server blocks serves, if it has none.
+// Metrics already registered, by another server block or before a reload, are left as they are, so
+// registering is safe for any number of instances.
+func registerMetrics(c *caddy.Controller) {
+	if m, ok := dnsserver.GetConfig(c).Handler("prometheus").(*metrics.Metrics); ok {
+		for _, collector := range collectors {
+			m.MustRegister(collector)
+		}
+		return
+	}
+	for _, collector := range collectors {
+		if err := prometheus.Register(collector); err != nil && !errors.As(err, new(prometheus.AlreadyRegisteredError)) {
+			log.Errorf("Unable to register metrics: %v", err)
+		}
+	}
+}
+
+// deleteZoneMetrics drops the metrics describing the records of the instance with the primary zone,
+// so that a zone removed from the Corefile doesn't leave them behind. The instance replacing it on
+// reload sets them again.
+func deleteZoneMetrics(zone string) {
+	for _, gauge := range zoneGauges {
+		gauge.DeletePartialMatch(prometheus.Labels{"zone": zone})
+	}
+}
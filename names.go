@@ -0,0 +1,59 @@
+package tailscale
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Policies for names that are too long to be published, see fitName.
+const (
+	// longNamesReject skips records whose name is too long.
+	longNamesReject = "reject"
+	// longNamesTruncate shortens the name until it fits.
+	longNamesTruncate = "truncate"
+)
+
+const (
+	// maxLabelLen is the maximum length of a single label (RFC 1035, section 2.3.4).
+	maxLabelLen = 63
+	// maxNameLen is the maximum length of a fully qualified name in presentation form, trailing dot
+	// included, which is 255 octets on the wire.
+	maxNameLen = 254
+)
+
+// fitName checks that label, derived from a device name or tag, can be published directly below the
+// zone. Labels that are too long are truncated, or rejected, according to the long_names policy. It
+// returns the label to publish, and false if the records for label must be skipped.
+func (t *Tailscale) fitName(label string) (string, bool) {
+	// The same label is published in every zone, so the longest one limits it.
+	zoneLen := len(dns.Fqdn(t.zone))
+	for _, zone := range t.zones {
+		zoneLen = max(zoneLen, len(zone))
+	}
+	maxLen := min(maxLabelLen, maxNameLen-zoneLen-1)
+	if len(label) <= maxLen {
+		return label, true
+	}
+	if t.truncateNames && maxLen > 0 {
+		log.Warningf("Name %s is longer than %d bytes, truncating it", t.logName(label), maxLen)
+		// Hostnames must not end in a hyphen (RFC 952), which truncation could leave behind.
+		return strings.TrimRight(label[:maxLen], "-"), true
+	}
+	log.Warningf("Name %s is longer than %d bytes, not publishing records for it", t.logName(label), maxLen)
+	return "", false
+}
+
+// echoQueryCase sets the owner names of the records in msg that are the query name qname, which is
+// resolved in lowercase, back to qname as the client sent it. Names are case-insensitive, but
+// clients may expect their case back (RFC 1034, section 3.1), and resolvers randomizing the case of
+// queries (0x20 encoding) check it.
+func echoQueryCase(msg *dns.Msg, qname string) {
+	for _, section := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range section {
+			if hdr := rr.Header(); hdr.Name != qname && strings.EqualFold(hdr.Name, qname) {
+				hdr.Name = qname
+			}
+		}
+	}
+}
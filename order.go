@@ -0,0 +1,131 @@
+package tailscale
+
+import (
+	"math/rand/v2"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/miekg/dns"
+)
+
+// Orders of the records of RRsets in answers, for client-side load balancing.
+const (
+	// orderFixed keeps the order records are built in.
+	orderFixed = "fixed"
+	// orderShuffle shuffles the records of every response.
+	orderShuffle = "shuffle"
+	// orderRoundRobin rotates the records by one with every response.
+	orderRoundRobin = "round_robin"
+)
+
+// DefaultAnswerOrder keeps the order records are built in.
+const DefaultAnswerOrder = orderFixed
+
+// answerOrder permutes the records of answers, see reorder.
+type answerOrder struct {
+	mode string
+	// rotation counts the responses rotated by round_robin.
+	rotation atomic.Uint64
+	// rnd shuffles records in a repeatable order when seeded, and is nil otherwise. Guarded by mu.
+	mu  sync.Mutex
+	rnd *rand.Rand
+}
+
+// newAnswerOrder returns the order of mode. Shuffles with a seed other than 0 are the same for every
+// instance started with it, for tests.
+func newAnswerOrder(mode string, seed uint64) *answerOrder {
+	if mode == orderFixed {
+		return nil
+	}
+	o := &answerOrder{mode: mode}
+	if mode == orderShuffle && seed != 0 {
+		o.rnd = rand.New(rand.NewPCG(seed, seed))
+	}
+	return o
+}
+
+// reorder permutes the records of each RRset in the answer section of msg. With a set of CNAME
+// records of the query name, like that of a tag used by several nodes, the CNAME records are
+// permuted along with the records of their targets that follow them. Records of different RRsets
+// keep their order, so address families stay in the order of prefer_family.
+func (o *answerOrder) reorder(msg *dns.Msg) {
+	if o == nil || len(msg.Answer) < 2 {
+		return
+	}
+	var rotation int
+	if o.mode == orderRoundRobin {
+		rotation = int(o.rotation.Add(1) - 1)
+	}
+	permute := func(n int, swap func(i, j int)) {
+		if o.mode == orderRoundRobin {
+			rotate(n, rotation%n, swap)
+			return
+		}
+		if o.rnd == nil {
+			rand.Shuffle(n, swap)
+			return
+		}
+		o.mu.Lock()
+		o.rnd.Shuffle(n, swap)
+		o.mu.Unlock()
+	}
+
+	if chains := cnameChains(msg.Answer); len(chains) > 1 {
+		permute(len(chains), func(i, j int) { chains[i], chains[j] = chains[j], chains[i] })
+		answer := make([]dns.RR, 0, len(msg.Answer))
+		for _, chain := range chains {
+			answer = append(answer, chain...)
+		}
+		msg.Answer = answer
+	}
+
+	for i := 0; i < len(msg.Answer); {
+		j := i + 1
+		for j < len(msg.Answer) && sameRRset(msg.Answer[i], msg.Answer[j]) {
+			j++
+		}
+		if run := msg.Answer[i:j]; len(run) > 1 {
+			permute(len(run), func(a, b int) { run[a], run[b] = run[b], run[a] })
+		}
+		i = j
+	}
+}
+
+// rotate rotates the n elements swapped by swap left by k.
+func rotate(n, k int, swap func(i, j int)) {
+	reverse := func(i, j int) {
+		for ; i < j; i, j = i+1, j-1 {
+			swap(i, j)
+		}
+	}
+	reverse(0, k-1)
+	reverse(k, n-1)
+	reverse(0, n-1)
+}
+
+// sameRRset reports whether a and b belong to the same RRset.
+func sameRRset(a, b dns.RR) bool {
+	return a.Header().Rrtype == b.Header().Rrtype && a.Header().Class == b.Header().Class && strings.EqualFold(a.Header().Name, b.Header().Name)
+}
+
+// cnameChains splits rrs into chains if it starts with more than one CNAME record of the same name:
+// each of those CNAME records followed by the records after it, up to the next one. It returns nil
+// for other answers.
+func cnameChains(rrs []dns.RR) [][]dns.RR {
+	if rrs[0].Header().Rrtype != dns.TypeCNAME {
+		return nil
+	}
+	var chains [][]dns.RR
+	start := 0
+	for i := 1; i < len(rrs); i++ {
+		if sameRRset(rrs[0], rrs[i]) {
+			chains = append(chains, rrs[start:i])
+			start = i
+		}
+	}
+	if start == 0 {
+		return nil
+	}
+	return append(chains, rrs[start:])
+}
@@ -0,0 +1,159 @@
+package tailscale
+
+import (
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// DefaultMagicDNSOverlap only warns about zones overlapping with the DNS settings of the tailnet.
+const DefaultMagicDNSOverlap = "warn"
+
+// Kinds of overlaps between the zones and the DNS settings of the tailnet.
+const (
+	// overlapMagicDNS is a zone in the MagicDNS domain, whose names tailscaled answers itself.
+	overlapMagicDNS = "magicdns"
+	// overlapSearchDomain is a zone that is a search domain without a split DNS route, so names
+	// expanded into it are sent to the global resolvers of the tailnet rather than to CoreDNS.
+	overlapSearchDomain = "search_domain"
+	// overlapRoute is a zone routed to other resolvers by split DNS.
+	overlapRoute = "route"
+	// overlapLoop is a domain below ts.net that split DNS routes to this node, while magicdns passes
+	// queries for it back to tailscaled.
+	overlapLoop = "loop"
+)
+
+// overlap is a collision of a zone, or a domain passed on to MagicDNS, with the DNS settings of the
+// tailnet.
+type overlap struct {
+	zone   string
+	kind   string
+	domain string
+}
+
+func (o overlap) String() string {
+	switch o.kind {
+	case overlapMagicDNS:
+		return fmt.Sprintf("zone %s is in the MagicDNS domain %s, which tailscaled answers itself", o.zone, o.domain)
+	case overlapSearchDomain:
+		return fmt.Sprintf("zone %s is a search domain of the tailnet without a split DNS route, so tailnet clients resolve it elsewhere", o.zone)
+	case overlapRoute:
+		return fmt.Sprintf("zone %s is routed to other resolvers by the split DNS route for %s", o.zone, o.domain)
+	default:
+		return fmt.Sprintf("split DNS routes %s to this node, which passes it back to MagicDNS", o.domain)
+	}
+}
+
+// findOverlaps compares the zones with the DNS settings of tn. Only the network maps of a node have
+// them, so there are none for tailnets built from the API.
+func (t *Tailscale) findOverlaps(tn *Tailnet) []overlap {
+	if !tn.SelfNode.Valid() {
+		return nil
+	}
+	var self []netip.Addr
+	for _, p := range tn.SelfNode.Addresses().All() {
+		self = append(self, p.Addr())
+	}
+	// routedHere reports whether split DNS sends the domain to this node.
+	routedHere := func(domain string) bool {
+		for _, r := range tn.DNS.Routes[domain] {
+			addr, err := netip.ParseAddr(r.Addr)
+			if err != nil {
+				ap, perr := netip.ParseAddrPort(r.Addr)
+				if perr != nil {
+					continue
+				}
+				addr = ap.Addr()
+			}
+			if slices.Contains(self, addr) {
+				return true
+			}
+		}
+		return false
+	}
+
+	var overlaps []overlap
+	magicDomain := dns.CanonicalName(tn.Domain)
+	for _, zone := range t.zones {
+		if tn.Domain != "" && dns.IsSubDomain(magicDomain, zone) {
+			overlaps = append(overlaps, overlap{zone, overlapMagicDNS, magicDomain})
+			continue
+		}
+		// The most specific route at or above the zone decides where its names are sent.
+		route := ""
+		for domain := range tn.DNS.Routes {
+			if d := dns.CanonicalName(domain); dns.IsSubDomain(d, zone) && dns.CountLabel(d) >= dns.CountLabel(dns.CanonicalName(route)) {
+				route = domain
+			}
+		}
+		switch {
+		case route != "" && len(tn.DNS.Routes[route]) > 0 && !routedHere(route):
+			overlaps = append(overlaps, overlap{zone, overlapRoute, dns.CanonicalName(route)})
+		case route == "" && slices.ContainsFunc(tn.DNS.Domains, func(d string) bool { return dns.CanonicalName(d) == zone }):
+			overlaps = append(overlaps, overlap{zone, overlapSearchDomain, zone})
+		}
+	}
+	if t.magicDNS {
+		for domain := range tn.DNS.Routes {
+			if d := dns.CanonicalName(domain); dns.IsSubDomain(magicDNSSuffix, d) && routedHere(domain) {
+				overlaps = append(overlaps, overlap{"", overlapLoop, d})
+			}
+		}
+	}
+	slices.SortFunc(overlaps, func(a, b overlap) int {
+		return strings.Compare(a.zone+" "+a.domain, b.zone+" "+b.domain)
+	})
+	return overlaps
+}
+
+// checkOverlaps reports the overlaps of the zones with the DNS settings of the tailnet in tn, logging
+// them whenever they change. With magicdns_overlap adjust, domains split DNS routes to this node are
+// no longer passed on to MagicDNS, which would send them straight back.
+func (t *Tailscale) checkOverlaps(tn *Tailnet) {
+	if !tn.SelfNode.Valid() {
+		return
+	}
+	overlaps := t.findOverlaps(tn)
+	var loops []string
+	for _, o := range overlaps {
+		if o.kind == overlapLoop && t.overlapAdjust {
+			loops = append(loops, o.domain)
+		}
+	}
+
+	t.mu.Lock()
+	changed := !slices.Equal(t.overlaps, overlaps)
+	t.overlaps = overlaps
+	t.update(func(d *zoneData) { d.loopDomains = loops })
+	t.mu.Unlock()
+
+	MagicDNSOverlaps.Reset()
+	for _, o := range overlaps {
+		MagicDNSOverlaps.WithLabelValues("", o.zone, o.kind).Set(1)
+	}
+	if !changed {
+		return
+	}
+	if len(overlaps) == 0 {
+		log.Info("Zones no longer overlap with the DNS settings of the tailnet")
+		return
+	}
+	for _, o := range overlaps {
+		if o.kind == overlapLoop && t.overlapAdjust {
+			log.Warningf("Split DNS routes %s to this node; not passing queries for it on to MagicDNS", o.domain)
+			continue
+		}
+		log.Warningf("Overlap with the DNS settings of the tailnet: %s", o)
+	}
+}
+
+// loopDomain reports whether qname is in a domain split DNS routes to this node, which isn't passed
+// on to MagicDNS.
+func (t *Tailscale) loopDomain(d *zoneData, qname string) bool {
+	return slices.ContainsFunc(d.loopDomains, func(domain string) bool {
+		return dns.IsSubDomain(domain, dns.CanonicalName(qname))
+	})
+}
@@ -0,0 +1,64 @@
+package tailscale
+
+import (
+	"fmt"
+	"slices"
+
+	clog "github.com/coredns/coredns/plugin/pkg/log"
+)
+
+// Sources of records. When more than one source has records for the same name, the records of the
+// source with the highest precedence are served and the others are dropped.
+const (
+	// sourceManual records are configured statically in the Corefile.
+	sourceManual = "manual"
+	// sourceTag records are derived from node tags, e.g. CNAMEs from tag:cname-<name>.
+	sourceTag = "tag"
+	// sourceDevice records are the addresses of nodes, published under their hostnames.
+	sourceDevice = "device"
+)
+
+// defaultPrecedence lists the record sources from highest to lowest precedence.
+var defaultPrecedence = []string{sourceManual, sourceTag, sourceDevice}
+
+// validatePrecedence checks that order lists every record source exactly once.
+func validatePrecedence(order []string) error {
+	if len(order) != len(defaultPrecedence) {
+		return fmt.Errorf("precedence must list each of %v exactly once", defaultPrecedence)
+	}
+	for _, source := range defaultPrecedence {
+		if !slices.Contains(order, source) {
+			return fmt.Errorf("precedence must list each of %v exactly once", defaultPrecedence)
+		}
+	}
+	return nil
+}
+
+// mergeSources merges the records of each source into a single entries map. If more than one source
+// has records for a name, only those of the source with the highest precedence are kept. It returns
+// the merged entries, the source of the records of each name, and the number of names for which
+// sources conflicted.
+func (t *Tailscale) mergeSources(sources map[string]map[string]map[string][]string) (map[string]map[string][]string, map[string]string, int) {
+	order := t.precedence
+	if order == nil {
+		order = defaultPrecedence
+	}
+
+	entries := map[string]map[string][]string{}
+	owner := map[string]string{}
+	conflicts := map[string]bool{}
+	for _, source := range order {
+		for name, records := range sources[source] {
+			if winner, ok := owner[name]; ok {
+				if clog.D.Value() {
+					log.Debugf("Records for %s from %s conflict with records from %s, using %s", t.logName(name), source, winner, winner)
+				}
+				conflicts[name] = true
+				continue
+			}
+			owner[name] = source
+			entries[name] = records
+		}
+	}
+	return entries, owner, len(conflicts)
+}
@@ -0,0 +1,79 @@
+package tailscale
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/netip"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Privacy modes control how query names are written to logs.
+const (
+	// privacyOff logs names verbatim.
+	privacyOff = iota
+	// privacyHash replaces names with a truncated HMAC-SHA256 of the name, so repeated queries for the
+	// same name can still be correlated without revealing the name itself. The key keeps names from
+	// being recovered by hashing guesses, there are few enough names in a tailnet to try them all.
+	privacyHash
+	// privacyTruncate drops every label below the zone.
+	privacyTruncate
+)
+
+// privacyKeyLen is the length of the random key names are hashed with when none is configured.
+const privacyKeyLen = 16
+
+// parsePrivacy parses the argument to the privacy directive.
+func parsePrivacy(mode string) (int, bool) {
+	switch mode {
+	case "off":
+		return privacyOff, true
+	case "hash":
+		return privacyHash, true
+	case "truncate":
+		return privacyTruncate, true
+	}
+	return privacyOff, false
+}
+
+// logName returns name in a form suitable for logging under the configured privacy mode.
+// Name may be a fully qualified name or a single host label.
+func (t *Tailscale) logName(name string) string {
+	switch t.privacy {
+	case privacyHash:
+		mac := hmac.New(sha256.New, t.privacyKey)
+		mac.Write([]byte(strings.ToLower(dns.Fqdn(name))))
+		return "hmac:" + hex.EncodeToString(mac.Sum(nil)[:6])
+	case privacyTruncate:
+		if dns.IsSubDomain(dns.Fqdn(t.zone), dns.Fqdn(name)) && dns.CountLabel(name) > dns.CountLabel(t.zone) {
+			return "*." + dns.Fqdn(t.zone)
+		}
+		return "*"
+	}
+	return name
+}
+
+// logAddr returns addr, the address of a client, in a form suitable for logging under the configured
+// privacy mode. Hashed addresses can be correlated like hashed names, truncated ones keep their /24
+// or /48 network.
+func (t *Tailscale) logAddr(addr netip.Addr) string {
+	switch t.privacy {
+	case privacyHash:
+		mac := hmac.New(sha256.New, t.privacyKey)
+		mac.Write(addr.AsSlice())
+		return "hmac:" + hex.EncodeToString(mac.Sum(nil)[:6])
+	case privacyTruncate:
+		bits := 24
+		if addr.Is6() && !addr.Is4In6() {
+			bits = 48
+		}
+		prefix, err := addr.Unmap().Prefix(bits)
+		if err != nil {
+			return "*"
+		}
+		return prefix.String()
+	}
+	return addr.String()
+}
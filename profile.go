@@ -0,0 +1,130 @@
+package tailscale
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"strings"
+
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/views"
+)
+
+// Policies for the records of nodes reported offline, see Config.OfflineNodes.
+const (
+	offlineServe = "serve"
+	offlineOmit  = "omit"
+	offlineFlag  = "flag"
+)
+
+const (
+	// DefaultOfflineNodes serves offline nodes like the others.
+	DefaultOfflineNodes = offlineServe
+	// DefaultOfflineTTL is the TTL offline nodes are served with by offline_nodes flag, short enough
+	// for clients to notice soon when they're back.
+	DefaultOfflineTTL = 5
+)
+
+// Profile is a named set of record policies, applied to the nodes with one of its tags so that the
+// same policies don't need to be repeated for every class of nodes.
+type Profile struct {
+	Name string `json:"name" yaml:"name"`
+	// Tags the profile applies to. Defaults to the tag named after the profile, e.g. tag:ephemeral.
+	Tags []string `json:"tags,omitempty" yaml:"tags,omitempty"`
+	// TTL of the records of the nodes, 0 keeps the TTL of the zone.
+	TTL uint32 `json:"ttl,omitempty" yaml:"ttl,omitempty"`
+	// OnlineOnly only publishes the nodes while they're connected.
+	OnlineOnly bool `json:"online_only,omitempty" yaml:"online_only,omitempty"`
+}
+
+// tags returns the tags the profile applies to.
+func (p Profile) tags() []string {
+	if len(p.Tags) == 0 {
+		return []string{tagPrefix + p.Name}
+	}
+	return p.Tags
+}
+
+// validate reports whether the profile is usable.
+func (p Profile) validate() error {
+	// The name is used as a tag if no tags are given, so it's restricted to what tags allow.
+	if p.Name == "" || strings.Trim(strings.ToLower(p.Name), "abcdefghijklmnopqrstuvwxyz0123456789-") != "" {
+		return fmt.Errorf("invalid profile name %q", p.Name)
+	}
+	if err := validateTagFilter("profile", p.tags()); err != nil {
+		return err
+	}
+	if p.TTL > maxTTL {
+		return fmt.Errorf("ttl of profile %s must be at most %d seconds", p.Name, maxTTL)
+	}
+	return nil
+}
+
+// validateProfiles checks the profiles and that their names are unique.
+func validateProfiles(profiles []Profile, jitter uint32) error {
+	names := map[string]bool{}
+	for _, p := range profiles {
+		if err := p.validate(); err != nil {
+			return err
+		}
+		if names[p.Name] {
+			return fmt.Errorf("duplicate profile %q", p.Name)
+		}
+		names[p.Name] = true
+		if p.TTL != 0 && jitter >= p.TTL {
+			return fmt.Errorf("ttl_jitter must be less than the TTL of %d seconds of profile %s", p.TTL, p.Name)
+		}
+	}
+	return nil
+}
+
+// nodeProfile returns the profile of node, the first configured one that applies to one of its
+// tags.
+func (t *Tailscale) nodeProfile(node tailcfg.NodeView) (Profile, bool) {
+	for _, p := range t.profiles {
+		for _, tag := range p.tags() {
+			if views.SliceContains(node.Tags(), tag) {
+				return p, true
+			}
+		}
+	}
+	return Profile{}, false
+}
+
+// nodeOffline reports whether node is known to be disconnected. Nodes the network map has no
+// presence information for, like the self node, count as connected.
+func nodeOffline(node tailcfg.NodeView) bool {
+	online, ok := node.Online().GetOk()
+	return ok && !online
+}
+
+// hostBaseTTL returns the TTL of the records of host before any jitter is applied: the TTL of the
+// profile of its node, if it has one, or the TTL of the zone, shortened by adaptive_ttl.
+func (t *Tailscale) hostBaseTTL(d *zoneData, host string) uint32 {
+	if ttl, ok := d.profileTTLs[host]; ok {
+		return t.offlineBaseTTL(d, host, t.adaptiveBaseTTL(d, host, ttl))
+	}
+	return t.offlineBaseTTL(d, host, t.adaptiveBaseTTL(d, host, t.baseTTL()))
+}
+
+// offlineBaseTTL returns ttl, the TTL of records of host, capped at the offline TTL if host is a
+// node flagged offline.
+func (t *Tailscale) offlineBaseTTL(d *zoneData, host string, ttl uint32) uint32 {
+	if d.offline[host] {
+		return min(ttl, t.offlineTTL)
+	}
+	return ttl
+}
+
+// hostTTL returns the TTL to use for an RRset of host in a response, see ttl.
+func (t *Tailscale) hostTTL(d *zoneData, host string) uint32 {
+	return t.jitter(t.hostBaseTTL(d, host))
+}
+
+// jitter applies a random offset of up to ttl_jitter seconds to ttl.
+func (t *Tailscale) jitter(ttl uint32) uint32 {
+	if t.ttlJitter == 0 {
+		return ttl
+	}
+	offset := rand.Int64N(2*int64(t.ttlJitter)+1) - int64(t.ttlJitter)
+	return uint32(int64(ttl) + offset)
+}
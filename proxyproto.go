@@ -0,0 +1,181 @@
+package tailscale
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"sync"
+)
+
+// The listeners the embedded node serves DNS on in the tailnet read version 2 of the PROXY protocol
+// (https://www.haproxy.org/download/2.9/doc/proxy-protocol.txt) from trusted proxies, which put the
+// address of the client in a header in front of every datagram, or of every connection. Listeners of
+// CoreDNS itself can't, they unpack the header as a DNS message before the plugin sees the query.
+
+// proxySignature starts every PROXY protocol v2 header.
+var proxySignature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyHeaderLen is the length of the fixed part of a PROXY protocol v2 header, followed by the
+// addresses and TLVs.
+const proxyHeaderLen = 16
+
+// errNoProxyHeader is returned for data that doesn't start with a PROXY protocol v2 header.
+var errNoProxyHeader = errors.New("no PROXY protocol v2 header")
+
+// parseProxyHeader parses the PROXY protocol v2 header at the start of b. It returns the source
+// address of the client and the length of the header. Headers of the LOCAL command, sent by the proxy
+// for its own health checks, and of other address families carry no client, which is returned invalid.
+func parseProxyHeader(b []byte) (netip.AddrPort, int, error) {
+	if len(b) < proxyHeaderLen || !bytes.Equal(b[:len(proxySignature)], proxySignature) {
+		return netip.AddrPort{}, 0, errNoProxyHeader
+	}
+	if b[12]>>4 != 2 {
+		return netip.AddrPort{}, 0, errors.New("unsupported PROXY protocol version")
+	}
+	n := proxyHeaderLen + int(binary.BigEndian.Uint16(b[14:16]))
+	if len(b) < n {
+		return netip.AddrPort{}, 0, errors.New("truncated PROXY protocol header")
+	}
+	if b[12]&0xf == 0 {
+		// LOCAL
+		return netip.AddrPort{}, n, nil
+	}
+	addrs := b[proxyHeaderLen:n]
+	switch b[13] >> 4 {
+	case 1: // AF_INET
+		if len(addrs) < 12 {
+			return netip.AddrPort{}, 0, errors.New("truncated PROXY protocol addresses")
+		}
+		addr := netip.AddrFrom4([4]byte(addrs[0:4]))
+		return netip.AddrPortFrom(addr, binary.BigEndian.Uint16(addrs[8:10])), n, nil
+	case 2: // AF_INET6
+		if len(addrs) < 36 {
+			return netip.AddrPort{}, 0, errors.New("truncated PROXY protocol addresses")
+		}
+		addr := netip.AddrFrom16([16]byte(addrs[0:16])).Unmap()
+		return netip.AddrPortFrom(addr, binary.BigEndian.Uint16(addrs[32:34])), n, nil
+	}
+	return netip.AddrPort{}, n, nil
+}
+
+// proxiedAddr is the address of a query a trusted proxy forwarded: the client it came from, as the
+// address of the query, and the proxy, which responses are sent back to.
+type proxiedAddr struct {
+	client netip.AddrPort
+	proxy  net.Addr
+}
+
+func (a proxiedAddr) Network() string { return a.proxy.Network() }
+func (a proxiedAddr) String() string  { return a.client.String() }
+
+// proxyPacketConn strips the PROXY protocol header from the datagrams of trusted proxies, returning
+// their client as the source address. Datagrams without a header are read as they are.
+type proxyPacketConn struct {
+	net.PacketConn
+	trusted func(netip.Addr) bool
+}
+
+func (c proxyPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(b)
+		if err != nil {
+			return n, addr, err
+		}
+		udp, ok := addr.(*net.UDPAddr)
+		if !ok || !c.trusted(udp.AddrPort().Addr().Unmap()) {
+			return n, addr, nil
+		}
+		client, hdrLen, err := parseProxyHeader(b[:n])
+		if errors.Is(err, errNoProxyHeader) {
+			return n, addr, nil
+		}
+		if err != nil {
+			log.Debugf("Dropping datagram from trusted proxy %s: %v", addr, err)
+			continue
+		}
+		n = copy(b, b[hdrLen:n])
+		if !client.IsValid() {
+			return n, addr, nil
+		}
+		return n, proxiedAddr{client: client, proxy: addr}, nil
+	}
+}
+
+func (c proxyPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if p, ok := addr.(proxiedAddr); ok {
+		addr = p.proxy
+	}
+	return c.PacketConn.WriteTo(b, addr)
+}
+
+// proxyListener accepts connections whose PROXY protocol header, for connections of trusted proxies,
+// is read before their data.
+type proxyListener struct {
+	net.Listener
+	trusted func(netip.Addr) bool
+}
+
+func (l proxyListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	tcp, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok || !l.trusted(tcp.AddrPort().Addr().Unmap()) {
+		return conn, nil
+	}
+	return &proxyConn{Conn: conn, r: bufio.NewReader(conn)}, nil
+}
+
+// proxyConn is a connection of a trusted proxy. Its header is read with the first read, under the
+// deadline of that read, rather than when it's accepted, so a slow proxy doesn't hold up others.
+type proxyConn struct {
+	net.Conn
+	r *bufio.Reader
+
+	once   sync.Once
+	err    error
+	client netip.AddrPort
+}
+
+// readHeader reads the PROXY protocol header of the connection, if it has one.
+func (c *proxyConn) readHeader() {
+	c.once.Do(func() {
+		fixed, err := c.r.Peek(proxyHeaderLen)
+		if !bytes.HasPrefix(fixed, proxySignature) && !bytes.HasPrefix(proxySignature, fixed) {
+			// Not a header, the data is read as it is.
+			return
+		}
+		if err != nil {
+			c.err = err
+			return
+		}
+		hdr := make([]byte, proxyHeaderLen+int(binary.BigEndian.Uint16(fixed[14:16])))
+		if _, err := io.ReadFull(c.r, hdr); err != nil {
+			c.err = err
+			return
+		}
+		c.client, _, c.err = parseProxyHeader(hdr)
+	})
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	if c.readHeader(); c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(b)
+}
+
+// RemoteAddr returns the address of the client the proxy forwarded the connection for, reading the
+// header first if it wasn't yet, or that of the proxy if the header names no client.
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.readHeader()
+	if c.client.IsValid() {
+		return proxiedAddr{client: c.client, proxy: c.Conn.RemoteAddr()}
+	}
+	return c.Conn.RemoteAddr()
+}
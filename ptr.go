@@ -0,0 +1,110 @@
+package tailscale
+
+import (
+	"context"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+const (
+	// net4Octets and net6Nibbles are the number of labels in front of in-addr.arpa and ip6.arpa in
+	// the reverse lookup name of a full address.
+	net4Octets  = 4
+	net6Nibbles = 32
+)
+
+// reverseAddr returns the address a reverse lookup name in in-addr.arpa or ip6.arpa stands for, and
+// whether it is the address of a tailnet node. Names of partial addresses (reverse zone cuts) don't
+// parse.
+func reverseAddr(name string) (netip.Addr, bool) {
+	name = strings.ToLower(dns.Fqdn(name))
+	var addr netip.Addr
+	switch {
+	case strings.HasSuffix(name, ".in-addr.arpa."):
+		labels := strings.Split(strings.TrimSuffix(name, ".in-addr.arpa."), ".")
+		if len(labels) != net4Octets {
+			return netip.Addr{}, false
+		}
+		var a4 [4]byte
+		for i, label := range labels {
+			octet, err := strconv.ParseUint(label, 10, 8)
+			if err != nil {
+				return netip.Addr{}, false
+			}
+			a4[len(a4)-1-i] = byte(octet)
+		}
+		addr = netip.AddrFrom4(a4)
+	case strings.HasSuffix(name, ".ip6.arpa."):
+		labels := strings.Split(strings.TrimSuffix(name, ".ip6.arpa."), ".")
+		if len(labels) != net6Nibbles {
+			return netip.Addr{}, false
+		}
+		var a16 [16]byte
+		for i, label := range labels {
+			nibble, err := strconv.ParseUint(label, 16, 4)
+			if err != nil || len(label) != 1 {
+				return netip.Addr{}, false
+			}
+			pos := len(labels) - 1 - i
+			a16[pos/2] |= byte(nibble) << (4 * (1 - pos%2))
+		}
+		addr = netip.AddrFrom16(a16)
+	default:
+		return netip.Addr{}, false
+	}
+	if !isTailnetAddr(addr) {
+		return netip.Addr{}, false
+	}
+	return addr, true
+}
+
+// reverseIndex maps the addresses in entries to the names they are published under. If several
+// names share an address, the lexicographically first one is used so answers are stable.
+func (t *Tailscale) reverseIndex(entries map[string]map[string][]string) map[netip.Addr]string {
+	reverse := map[netip.Addr]string{}
+	for name, records := range entries {
+		if strings.Contains(name, ".") {
+			// Names in tag subzones are aliases, PTR queries are answered with the name in the zone.
+			continue
+		}
+		fqdn := dns.Fqdn(name + "." + t.zone)
+		for _, value := range slices.Concat(records["A"], records["AAAA"]) {
+			addr, err := netip.ParseAddr(value)
+			if err != nil {
+				continue
+			}
+			if existing, ok := reverse[addr]; !ok || fqdn < existing {
+				reverse[addr] = fqdn
+			}
+		}
+	}
+	return reverse
+}
+
+// serveReverse answers a query for the reverse lookup name of a tailnet address with the name of the
+// node using that address. Addresses not in use by any node are NXDOMAIN, unless fallthrough applies,
+// and so are those of machines that view doesn't show.
+func (t *Tailscale) serveReverse(ctx context.Context, d *zoneData, state request.Request, msg *dns.Msg, addr netip.Addr, view *clientView) (int, error) {
+	target, ok := d.reverse[addr]
+	ok = ok && t.visibleAddr(d, view, addr)
+	if !ok {
+		log.Debugf("No node with address %s", addr)
+		return t.handleNoRecords(ctx, state.W, state.Req, msg, dns.RcodeNameError)
+	}
+
+	if state.QType() == dns.TypePTR {
+		msg.Answer = append(msg.Answer, &dns.PTR{
+			Hdr: dns.RR_Header{Name: state.Name(), Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: t.ttl()},
+			Ptr: target,
+		})
+	}
+	if len(msg.Answer) == 0 {
+		return t.handleNoRecords(ctx, state.W, state.Req, msg, dns.RcodeSuccess)
+	}
+	return t.writeAnswer(ctx, d, state, msg)
+}
@@ -0,0 +1,152 @@
+package tailscale
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/netip"
+	"time"
+
+	"github.com/coredns/coredns/plugin/metrics"
+	"github.com/miekg/dns"
+	"golang.org/x/time/rate"
+)
+
+// DefaultQueryLogRate is the number of lines the query log writes per second, at most.
+const DefaultQueryLogRate = 100
+
+// queryLogBuffer is the number of lines waiting for the identity of their client to be looked up.
+// Lines of queries answered while it's full are dropped, so a slow LocalAPI never holds up answers.
+const queryLogBuffer = 1024
+
+// queryLogLine is a line of the query log, written as JSON.
+type queryLogLine struct {
+	Time time.Time `json:"time"`
+	// Client is the address of the client, and ClientNode, ClientUser and ClientTags its identity in
+	// the tailnet, if it's a node of the tailnet.
+	Client     string   `json:"client"`
+	ClientNode string   `json:"client_node,omitempty"`
+	ClientUser string   `json:"client_user,omitempty"`
+	ClientTags []string `json:"client_tags,omitempty"`
+	Name       string   `json:"qname"`
+	Type       string   `json:"qtype"`
+	Rcode      string   `json:"rcode"`
+	Answers    int      `json:"answers"`
+	// Nodes are the nodes whose records the answer holds, and Source what the query name was
+	// resolved from, see attribution.
+	Nodes    []string `json:"nodes,omitempty"`
+	Source   string   `json:"source,omitempty"`
+	Duration float64  `json:"duration_seconds"`
+
+	client netip.Addr
+}
+
+// queryLog writes a line for every query answered, up to a rate, see query_log.
+type queryLog struct {
+	limiter *rate.Limiter
+	lines   chan queryLogLine
+	out     io.Writer
+}
+
+// newQueryLog returns a query log writing up to perSecond lines per second to out.
+func newQueryLog(perSecond int, out io.Writer) *queryLog {
+	return &queryLog{
+		limiter: rate.NewLimiter(rate.Limit(perSecond), perSecond),
+		lines:   make(chan queryLogLine, queryLogBuffer),
+		out:     out,
+	}
+}
+
+// queryLogKey is the context key of the query a line of the query log is written for.
+type queryLogKey struct{}
+
+// loggedQuery is when a query was received, and from which client.
+type loggedQuery struct {
+	start  time.Time
+	client netip.Addr
+}
+
+// begin returns a context marking the query from client as received now, for its line in the query
+// log. The context carries an attribution for the answer to be recorded in, unless the metadata of
+// the query holds one already.
+func (l *queryLog) begin(ctx context.Context, client netip.Addr) context.Context {
+	if _, ok := ctx.Value(attributionKey{}).(*attribution); !ok {
+		ctx = context.WithValue(ctx, attributionKey{}, &attribution{})
+	}
+	return context.WithValue(ctx, queryLogKey{}, loggedQuery{start: time.Now(), client: client})
+}
+
+// logQuery queues the line of the query in ctx, answered with msg, unless the rate of the query log
+// is exceeded or too many lines are queued already. Its client is identified in the background. The
+// nodes and source of the answer are those attribute recorded in ctx, empty for responses without
+// answers.
+func (t *Tailscale) logQuery(ctx context.Context, msg *dns.Msg) {
+	if t.queryLog == nil || len(msg.Question) == 0 {
+		return
+	}
+	q, ok := ctx.Value(queryLogKey{}).(loggedQuery)
+	if !ok {
+		return
+	}
+	if !t.queryLog.limiter.Allow() {
+		QueryLogDropped.WithLabelValues(metrics.WithServer(ctx), "rate").Inc()
+		return
+	}
+	var a attribution
+	if attributed, ok := ctx.Value(attributionKey{}).(*attribution); ok {
+		a = *attributed
+	}
+	line := queryLogLine{
+		Time:     q.start.UTC(),
+		Client:   t.logAddr(q.client),
+		Name:     t.logName(msg.Question[0].Name),
+		Type:     dns.TypeToString[msg.Question[0].Qtype],
+		Rcode:    dns.RcodeToString[msg.Rcode],
+		Answers:  len(msg.Answer),
+		Nodes:    a.nodes,
+		Source:   a.source,
+		Duration: time.Since(q.start).Seconds(),
+		client:   q.client,
+	}
+	select {
+	case t.queryLog.lines <- line:
+	default:
+		QueryLogDropped.WithLabelValues(metrics.WithServer(ctx), "queue").Inc()
+	}
+}
+
+// runQueryLog writes the queued lines of the query log until ctx is done.
+func (t *Tailscale) runQueryLog(ctx context.Context) {
+	enc := json.NewEncoder(t.queryLog.out)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case line := <-t.queryLog.lines:
+			t.writeQueryLogLine(ctx, enc, line)
+		}
+	}
+}
+
+// writeQueryLogLine identifies the client of line, if it's a node of the tailnet, and writes line to
+// enc. The names of the client's node, user and tags are written as privacy requires.
+func (t *Tailscale) writeQueryLogLine(ctx context.Context, enc *json.Encoder, line queryLogLine) {
+	if isTailnetAddr(line.client) {
+		if who, err := t.identify(ctx, line.client); err != nil {
+			log.Debugf("Unable to identify client %s for the query log: %v", t.logAddr(line.client), err)
+		} else {
+			if who.Node != nil {
+				line.ClientNode = t.logName(who.Node.ComputedName)
+				for _, tag := range who.Node.Tags {
+					line.ClientTags = append(line.ClientTags, t.logName(tag))
+				}
+			}
+			if who.UserProfile != nil && (who.Node == nil || !who.Node.IsTagged()) {
+				line.ClientUser = t.logName(who.UserProfile.LoginName)
+			}
+		}
+	}
+	if err := enc.Encode(line); err != nil {
+		log.Warningf("Unable to write the query log: %v", err)
+	}
+}
@@ -0,0 +1,101 @@
+package tailscale
+
+import (
+	"net/netip"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// rebindMarkerLabel is the label below the zone at which the rebind marker TXT record is published.
+const rebindMarkerLabel = "_dns-rebind-ok"
+
+// rebindMarkerText is the content of the rebind marker TXT record.
+const rebindMarkerText = "This zone intentionally answers with private and CGNAT addresses of Tailscale nodes."
+
+var (
+	// tailnetPrefixes are the address ranges Tailscale assigns node addresses from.
+	tailnetPrefixes = []netip.Prefix{
+		netip.MustParsePrefix("100.64.0.0/10"),
+		netip.MustParsePrefix("fd7a:115c:a1e0::/48"),
+	}
+	// cgnatPrefix is the shared address space of RFC 6598, which Tailscale IPv4 addresses are from.
+	cgnatPrefix = netip.MustParsePrefix("100.64.0.0/10")
+)
+
+// isInternalAddr reports whether addr is an address that DNS rebinding filters refuse to accept from
+// public DNS: RFC 1918 and unique local addresses, CGNAT, loopback and link-local addresses.
+func isInternalAddr(addr netip.Addr) bool {
+	return addr.IsPrivate() || cgnatPrefix.Contains(addr) || addr.IsLoopback() || addr.IsLinkLocalUnicast()
+}
+
+// isTailnetAddr reports whether addr is in one of the ranges Tailscale assigns node addresses from.
+func isTailnetAddr(addr netip.Addr) bool {
+	for _, pfx := range tailnetPrefixes {
+		if pfx.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// isInternalClient reports whether a query from addr comes from inside the tailnet, or from one of
+// the additionally configured internal ranges.
+func (t *Tailscale) isInternalClient(addr netip.Addr) bool {
+	if addr.IsLoopback() || isTailnetAddr(addr) {
+		return true
+	}
+	for _, pfx := range t.rebindAllow {
+		if pfx.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// isExternalClient reports whether rebind protection applies to client, whose answers must not carry
+// internal addresses.
+func (t *Tailscale) isExternalClient(client netip.Addr) bool {
+	return t.rebindProtection && !t.isInternalClient(client)
+}
+
+// stripInternalAnswers removes A and AAAA records with internal addresses from the answer section of
+// msg, and returns the number of records removed.
+func stripInternalAnswers(msg *dns.Msg) int {
+	answers := msg.Answer[:0]
+	for _, rr := range msg.Answer {
+		var ip []byte
+		switch rr := rr.(type) {
+		case *dns.A:
+			ip = rr.A
+		case *dns.AAAA:
+			ip = rr.AAAA
+		case *dns.SVCB:
+			stripInternalHints(rr)
+		case *dns.HTTPS:
+			stripInternalHints(&rr.SVCB)
+		}
+		if addr, ok := netip.AddrFromSlice(ip); ok && isInternalAddr(addr.Unmap()) {
+			continue
+		}
+		answers = append(answers, rr)
+	}
+	removed := len(msg.Answer) - len(answers)
+	msg.Answer = answers
+	return removed
+}
+
+// resolveRebindMarker adds the rebind marker TXT record to msg if domainName is the marker name.
+func (t *Tailscale) resolveRebindMarker(d *zoneData, domainName string, msg *dns.Msg) {
+	if !t.rebindMarker {
+		return
+	}
+	prefix, name := t.splitName(d, domainName)
+	if prefix != "" || !strings.EqualFold(name, rebindMarkerLabel) {
+		return
+	}
+	msg.Answer = append(msg.Answer, &dns.TXT{
+		Hdr: dns.RR_Header{Name: domainName, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: t.ttl()},
+		Txt: []string{rebindMarkerText},
+	})
+}
@@ -0,0 +1,161 @@
+package tailscale
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"slices"
+	"sync"
+)
+
+// secretSettings are the settings whose values aren't logged when they change. The arguments of the
+// export provider are among them, they usually hold its credentials.
+var secretSettings = map[string]bool{
+	"authkey":             true,
+	"api_key":             true,
+	"oauth_client_secret": true,
+	"headscale_api_key":   true,
+	"cookie_secret":       true,
+	"privacy_key":         true,
+	"export_args":         true,
+}
+
+// lastConfigs holds the configuration each instance last started with, by primary zone, so that a
+// reload can tell what changed. Instances are told apart by their primary zone like in ConfigInfo.
+var lastConfigs = struct {
+	sync.Mutex
+	m map[string]Config
+}{m: map[string]Config{}}
+
+// settingChange is a setting that differs between two configurations, with its values as JSON.
+type settingChange struct {
+	Setting string
+	Old     string
+	New     string
+}
+
+func (c settingChange) String() string {
+	return fmt.Sprintf("%s: %s -> %s", c.Setting, c.Old, c.New)
+}
+
+// configSettings returns the settings of c that are set, by the names they have in JSON, with their
+// values as JSON.
+func configSettings(c Config) map[string]json.RawMessage {
+	b, err := json.Marshal(c)
+	if err != nil {
+		// Config only holds types that marshal.
+		panic(err)
+	}
+	var m map[string]json.RawMessage
+	if err := json.Unmarshal(b, &m); err != nil {
+		panic(err)
+	}
+	return m
+}
+
+// diffConfigs returns the settings that differ between old and cur, by the names they have in JSON,
+// sorted. The values of secrets are redacted.
+func diffConfigs(old, cur Config) []settingChange {
+	before, after := configSettings(old), configSettings(cur)
+	all := maps.Clone(before)
+	maps.Copy(all, after)
+	names := slices.Sorted(maps.Keys(all))
+
+	var changes []settingChange
+	for _, name := range names {
+		o, n := before[name], after[name]
+		if bytes.Equal(o, n) {
+			continue
+		}
+		change := settingChange{Setting: name, Old: string(o), New: string(n)}
+		if change.Old == "" {
+			change.Old = "unset"
+		}
+		if change.New == "" {
+			change.New = "unset"
+		}
+		if secretSettings[name] {
+			change.Old, change.New = "[redacted]", "[redacted]"
+		}
+		changes = append(changes, change)
+	}
+	return changes
+}
+
+// logReload compares the configuration of the instance with the one the instance with the same
+// primary zone last started with, logging the settings that changed and counting the reload. It
+// does nothing on the first start.
+func (t *Tailscale) logReload() {
+	lastConfigs.Lock()
+	old, reloaded := lastConfigs.m[t.zone]
+	lastConfigs.m[t.zone] = t.cfg
+	lastConfigs.Unlock()
+	if !reloaded {
+		return
+	}
+
+	changes := diffConfigs(old, t.cfg)
+	ReloadCount.WithLabelValues(t.zone).Inc()
+	if len(changes) == 0 {
+		log.Infof("Reloaded %s without configuration changes", t.zone)
+		return
+	}
+	log.Infof("Reloaded %s with %d configuration changes", t.zone, len(changes))
+	for _, c := range changes {
+		log.Infof("Configuration of %s changed: %s", t.zone, c)
+	}
+}
+
+// handoffs holds the last network map of each instance that shut down, by primary zone, so that the
+// instance replacing it on reload serves the records of the tailnet right away instead of only after
+// its first sync.
+var handoffs = struct {
+	sync.Mutex
+	m map[string]handoff
+}{m: map[string]handoff{}}
+
+// handoff is the network map an instance left behind, and the tailnet it came from.
+type handoff struct {
+	tailnet string
+	tn      *Tailnet
+}
+
+// tailnet identifies the tailnet the records of c come from. A network map is only handed over to an
+// instance reading the same tailnet, the same way.
+func (c Config) tailnet() string {
+	return fmt.Sprint(c.Backends, c.embedded(), c.StateDir, c.Tailnet, c.HeadscaleURL)
+}
+
+// handOff leaves the network map the records were last built from for the instance replacing this
+// one. It does nothing if the instance never synced.
+func (t *Tailscale) handOff() {
+	tn := t.lastTailnet.Load()
+	if tn == nil {
+		return
+	}
+	handoffs.Lock()
+	defer handoffs.Unlock()
+	handoffs.m[t.zone] = handoff{tailnet: t.cfg.tailnet(), tn: tn}
+}
+
+// takeOver builds the records from the network map left by the previous instance with the same
+// primary zone, if it read the same tailnet. The records are then served until the first sync,
+// which replaces them, and the network map is only taken over once, by a single instance.
+func (t *Tailscale) takeOver() {
+	handoffs.Lock()
+	h, ok := handoffs.m[t.zone]
+	if ok {
+		delete(handoffs.m, t.zone)
+	}
+	handoffs.Unlock()
+	if !ok {
+		return
+	}
+	if h.tailnet != t.cfg.tailnet() {
+		log.Infof("Not taking over the records of the previous instance of %s, the tailnet changed", t.zone)
+		return
+	}
+	t.processTailnet(h.tn)
+	log.Infof("Took over the records of the previous instance of %s until the first sync", t.zone)
+}
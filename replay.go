@@ -0,0 +1,79 @@
+package tailscale
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"tailscale.com/tailcfg"
+)
+
+// recordedNetMap is a network map received by the plugin, as written to a recording. Only the nodes
+// are kept, which is all the plugin uses; keys, packet filters and the like are left out.
+type recordedNetMap struct {
+	Time     time.Time          `json:"time"`
+	Domain   string             `json:"domain,omitempty"`
+	SelfNode tailcfg.NodeView   `json:"self"`
+	Peers    []tailcfg.NodeView `json:"peers,omitempty"`
+}
+
+// netmapRecorder appends the network maps the plugin receives to a file, one JSON object per line,
+// so that the sequence of updates leading to a problem can be replayed.
+type netmapRecorder struct {
+	mu  sync.Mutex
+	f   *os.File
+	enc *json.Encoder
+}
+
+func openNetmapRecorder(path string) (*netmapRecorder, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	return &netmapRecorder{f: f, enc: json.NewEncoder(f)}, nil
+}
+
+// record appends tn to the recording. It does nothing on a nil recorder.
+func (r *netmapRecorder) record(tn *Tailnet) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	err := r.enc.Encode(recordedNetMap{
+		Time:     time.Now(),
+		Domain:   tn.Domain,
+		SelfNode: tn.SelfNode,
+		Peers:    tn.Peers,
+	})
+	if err != nil {
+		log.Warningf("Unable to record network map: %v", err)
+	}
+}
+
+func (r *netmapRecorder) close() error {
+	return r.f.Close()
+}
+
+// replayNetMaps processes the network maps of a recording in order, as if they were received from
+// the tailnet. After each one, step is called with its index, if not nil.
+func (t *Tailscale) replayNetMaps(r io.Reader, step func(i int)) error {
+	scanner := bufio.NewScanner(r)
+	// Network maps of large tailnets easily exceed the default line length.
+	scanner.Buffer(nil, 64<<20)
+	for i := 0; scanner.Scan(); i++ {
+		var rec recordedNetMap
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return fmt.Errorf("network map %d: %w", i, err)
+		}
+		t.processTailnet(&Tailnet{SelfNode: rec.SelfNode, Peers: rec.Peers, Domain: rec.Domain})
+		if step != nil {
+			step(i)
+		}
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,114 @@
+package tailscale
+
+import (
+	"context"
+	"slices"
+
+	"github.com/coredns/coredns/plugin/metrics"
+	clog "github.com/coredns/coredns/plugin/pkg/log"
+	"github.com/miekg/dns"
+)
+
+// DefaultMaxLookups is the number of lookups a single query may take. Every node of a tag:cname-
+// record takes two lookups, so it allows for tags on several hundred nodes.
+const DefaultMaxLookups = 1000
+
+// resolutionKey is the context key of the resolution state of a query.
+type resolutionKey struct{}
+
+// resolution is the state of answering a single query. Its budget limits the lookups made, CNAME
+// hops and glue included, however the records of the zone point to each other, and chain holds the
+// names whose CNAME records are being followed. upstream are the CNAME targets outside the zone yet
+// to be looked up, and failure is the first internal failure that left the answer incomplete. It is
+// only used by the goroutine serving the query.
+type resolution struct {
+	left      int
+	exhausted bool
+	cancelled bool
+	chain     []string
+	upstream  []upstreamTarget
+	failure   *failure
+}
+
+// lookupLimit returns the configured number of lookups a query may take.
+func (t *Tailscale) lookupLimit() int {
+	if t.maxLookups == 0 {
+		return DefaultMaxLookups
+	}
+	return t.maxLookups
+}
+
+// withResolution returns a context carrying a new resolution with a budget of max lookups, unless ctx
+// carries one already. Queries made upstream while answering another one share its resolution, so
+// records pointing back and forth through other plugins take from the same budget.
+func withResolution(ctx context.Context, max int) context.Context {
+	if _, ok := ctx.Value(resolutionKey{}).(*resolution); ok {
+		return ctx
+	}
+	return context.WithValue(ctx, resolutionKey{}, &resolution{left: max})
+}
+
+// spendLookup takes a lookup from the budget in ctx, reporting whether one was left. Lookups are
+// unlimited without a budget. The first lookup refused is logged and counted. Once ctx is done, the
+// client has given up on the answer and no lookups are left, so CNAME hops, glue and upstream lookups
+// stop there.
+func (t *Tailscale) spendLookup(ctx context.Context, domainName string) bool {
+	b, ok := ctx.Value(resolutionKey{}).(*resolution)
+	if err := ctx.Err(); err != nil {
+		if ok && !b.cancelled {
+			b.cancelled = true
+			if clog.D.Value() {
+				log.Debugf("Stopping resolution at %s: %v", t.logName(domainName), err)
+			}
+		}
+		return false
+	}
+	if !ok {
+		return true
+	}
+	if b.left > 0 {
+		b.left--
+		return true
+	}
+	if !b.exhausted {
+		b.exhausted = true
+		log.Warningf("Lookup budget exhausted at %s, answer is incomplete", t.logName(domainName))
+		LookupBudgetExhausted.WithLabelValues(metrics.WithServer(ctx)).Inc()
+		fail(ctx, failureLookupBudget)
+	}
+	return false
+}
+
+// DefaultMaxCNAMEChain is the number of CNAME records followed in a row.
+const DefaultMaxCNAMEChain = 8
+
+// cnameChainLimit returns the configured number of CNAME records followed in a row.
+func (t *Tailscale) cnameChainLimit() int {
+	if t.maxCNAMEChain == 0 {
+		return DefaultMaxCNAMEChain
+	}
+	return t.maxCNAMEChain
+}
+
+// enterCNAME adds domainName to the chain of CNAME records being followed, reporting false if it is
+// already part of the chain, which is a loop, or the chain is at its maximum length. If ok, leave
+// must be called once the CNAME records of domainName are done with. The returned context carries a
+// resolution, which ctx may lack when not serving a query.
+func (t *Tailscale) enterCNAME(ctx context.Context, domainName string) (_ context.Context, leave func(), ok bool) {
+	r, ok := ctx.Value(resolutionKey{}).(*resolution)
+	if !ok {
+		ctx = withResolution(ctx, t.lookupLimit())
+		r = ctx.Value(resolutionKey{}).(*resolution)
+	}
+	name := dns.CanonicalName(domainName)
+	if slices.Contains(r.chain, name) {
+		log.Warningf("CNAME loop at %s, not following it", t.logName(domainName))
+		return ctx, nil, false
+	}
+	if len(r.chain) >= t.cnameChainLimit() {
+		log.Warningf("More than %d CNAME records in a row at %s, not following them", t.cnameChainLimit(), t.logName(domainName))
+		return ctx, nil, false
+	}
+	r.chain = append(r.chain, name)
+	return ctx, func() { r.chain = r.chain[:len(r.chain)-1] }, true
+}
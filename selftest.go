@@ -0,0 +1,113 @@
+package tailscale
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// debugSelfTestPath is the path of the debug endpoint running the self-test.
+const debugSelfTestPath = "/tailscale/selftest"
+
+// loopbackAddr is the address self-test queries come from.
+var loopbackAddr = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}
+
+// loopbackWriter is the dns.ResponseWriter of self-test queries, keeping the response.
+type loopbackWriter struct {
+	msg *dns.Msg
+}
+
+func (w *loopbackWriter) LocalAddr() net.Addr       { return loopbackAddr }
+func (w *loopbackWriter) RemoteAddr() net.Addr      { return loopbackAddr }
+func (w *loopbackWriter) WriteMsg(m *dns.Msg) error { w.msg = m; return nil }
+func (w *loopbackWriter) Write([]byte) (int, error) {
+	return 0, errors.New("self-test responses must be written as messages")
+}
+func (w *loopbackWriter) Close() error        { return nil }
+func (w *loopbackWriter) TsigStatus() error   { return nil }
+func (w *loopbackWriter) TsigTimersOnly(bool) {}
+func (w *loopbackWriter) Hijack()             {}
+
+// selfTestName returns a name of the primary zone to look up in the self-test, with the type of
+// its records: the first name with addresses, in order. It returns false if there's none.
+func (t *Tailscale) selfTestName() (string, uint16, bool) {
+	d := t.load()
+	for _, name := range slices.Sorted(maps.Keys(d.entries)) {
+		if strings.Contains(name, ".") {
+			continue
+		}
+		if len(d.entries[name]["A"]) > 0 {
+			return name, dns.TypeA, true
+		}
+		if len(d.entries[name]["AAAA"]) > 0 {
+			return name, dns.TypeAAAA, true
+		}
+	}
+	return "", 0, false
+}
+
+// selfTestQuery answers a query for qname and qtype like a client would be answered, and checks
+// that it's answered with records of qname and qtype.
+func (t *Tailscale) selfTestQuery(ctx context.Context, qname string, qtype uint16) error {
+	req := new(dns.Msg)
+	req.SetQuestion(qname, qtype)
+	w := &loopbackWriter{}
+	rcode, err := t.ServeDNS(ctx, w, req)
+	if err != nil {
+		return fmt.Errorf("%s %s: %v", dns.TypeToString[qtype], t.logName(qname), err)
+	}
+	if w.msg == nil {
+		return fmt.Errorf("%s %s: no response, rcode %s", dns.TypeToString[qtype], t.logName(qname), dns.RcodeToString[rcode])
+	}
+	if w.msg.Rcode != dns.RcodeSuccess {
+		return fmt.Errorf("%s %s: answered %s", dns.TypeToString[qtype], t.logName(qname), dns.RcodeToString[w.msg.Rcode])
+	}
+	for _, rr := range w.msg.Answer {
+		if rr.Header().Rrtype == qtype && strings.EqualFold(rr.Header().Name, qname) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s %s: no %s record in the answer", dns.TypeToString[qtype], t.logName(qname), dns.TypeToString[qtype])
+}
+
+// SelfTest looks up the apex SOA record of each zone, and a name with addresses in each zone if
+// there is one, through the plugin like clients do. It returns the failures, which point at a
+// configuration that doesn't answer for the records of the tailnet, before clients notice.
+func (t *Tailscale) SelfTest(ctx context.Context) error {
+	zones := t.zones
+	if len(zones) == 0 {
+		zones = []string{t.zone}
+	}
+	name, qtype, hasName := t.selfTestName()
+
+	var errs []error
+	for _, zone := range zones {
+		zone = dns.Fqdn(zone)
+		if err := t.selfTestQuery(ctx, zone, dns.TypeSOA); err != nil {
+			errs = append(errs, err)
+		}
+		if hasName {
+			if err := t.selfTestQuery(ctx, name+"."+zone, qtype); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// serveSelfTest runs the self-test, answering OK if it passes, and 503 with the failures otherwise.
+func (t *Tailscale) serveSelfTest(w http.ResponseWriter, r *http.Request) {
+	if err := t.SelfTest(r.Context()); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	io.WriteString(w, http.StatusText(http.StatusOK))
+}
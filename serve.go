@@ -2,7 +2,6 @@ package tailscale
 
 import (
 	"context"
-	"net"
 	"strings"
 	"time"
 
@@ -20,202 +19,617 @@ const (
 	TypeAll = iota
 	TypeA
 	TypeAAAA
+	TypeTXT
+	TypeSVCB
+	TypeHTTPS
 )
 
+// defaultTTL is the TTL of records served by the plugin, unless configured otherwise.
+const defaultTTL = 60
+
+// maxTTL is the largest TTL allowed by RFC 2181, section 8.
+const maxTTL = 1<<31 - 1
+
+// baseTTL returns the configured TTL of records, before any jitter is applied.
+func (t *Tailscale) baseTTL() uint32 {
+	if t.recordTTL == 0 {
+		return defaultTTL
+	}
+	return t.recordTTL
+}
+
+// ttl returns the TTL to use for an RRset in a response. If ttl_jitter is configured, a random
+// offset in [-jitter, +jitter] is applied so that clients caching the same answer don't all
+// expire it, and re-query, at the same instant.
+func (t *Tailscale) ttl() uint32 {
+	return t.jitter(t.baseTTL())
+}
+
+// negTTL returns the TTL for which resolvers may cache negative answers (RFC 2308).
+func (t *Tailscale) negTTL() uint32 {
+	if t.negativeTTL == 0 {
+		return t.baseTTL()
+	}
+	return t.negativeTTL
+}
+
 // ServeDNS implements the plugin.Handler interface. This method gets called when tailscale is used
 // in a Server.
 
-func (t *Tailscale) resolveA(domainName string, msg *dns.Msg) {
-	log.Debugf("Resolving A record for %s in zone %s", domainName, t.zone)
-
-	// Get the number of labels in common between domain and zone
-	numCommonLabels := dns.CompareDomainName(domainName, t.zone)
-	labels := dns.SplitDomainName(domainName)
-	log.Debugf("Domain has %d labels, zone has %d labels in common", len(labels), numCommonLabels)
+func (t *Tailscale) resolveA(ctx context.Context, d *zoneData, domainName string, msg *dns.Msg) {
+	// Names are only formatted for debug logs when they're written, this is the hot path.
+	debug := clog.D.Value()
+	if debug {
+		log.Debugf("Resolving A record for %s in zone %s", t.logName(domainName), t.zone)
+	}
+	if !t.spendLookup(ctx, domainName) {
+		return
+	}
+	if t.resolveLAN(d, domainName, msg, false) || t.resolveEndpoint(d, domainName, msg, false) {
+		return
+	}
 
-	name := labels[len(labels)-numCommonLabels-1]
-	log.Debugf("Extracted base name: %s", name)
+	prefix, name := t.splitName(d, domainName)
+	if !t.wildcardAllowed(d, prefix, name) {
+		if debug {
+			log.Debugf("No wildcard records for names below %s", t.logName(name))
+		}
+		return
+	}
 
 	// Look for an A record
-	entries, ok := t.entries[name]["A"]
-	if ok {
-		log.Debugf("Found A record for %s with %d entries", name, len(entries))
-	} else {
-		log.Debugf("No A record found for %s", name)
+	entries, ok := d.entries[name]["A"]
+	if debug {
+		log.Debugf("Found %d A records for %s", len(entries), t.logName(name))
 	}
 
 	if ok {
-		log.Debugf("Adding A records for %s to response", name)
-		for _, entry := range entries {
-			log.Debugf("  - Adding A record: %s", entry)
-			msg.Answer = append(msg.Answer, &dns.A{
-				Hdr: dns.RR_Header{Name: domainName, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
-				A:   net.ParseIP(entry),
-			})
+		ttl := t.rrsetTTL(d, name, "A")
+		slab := slabPool.Get().(*rrSlab)
+		for _, addr := range d.addrs[name].v4 {
+			msg.Answer = append(msg.Answer, slab.newA(domainName, ttl, addr))
 		}
+		slabPool.Put(slab)
 	} else {
 		// There's no A record, so see if a CNAME exists
 		log.Debug("No v4 entry after lookup, so trying CNAME")
-		t.resolveCNAME(domainName, msg, TypeA)
+		t.resolveCNAME(ctx, d, domainName, msg, TypeA)
 	}
 }
 
-func (t *Tailscale) resolveAAAA(domainName string, msg *dns.Msg) {
-	log.Debugf("Resolving AAAA record for %s in zone %s", domainName, t.zone)
-
-	// Get the number of labels in common between domain and zone
-	numCommonLabels := dns.CompareDomainName(domainName, t.zone)
-	labels := dns.SplitDomainName(domainName)
-	log.Debugf("Domain has %d labels, zone has %d labels in common", len(labels), numCommonLabels)
+func (t *Tailscale) resolveAAAA(ctx context.Context, d *zoneData, domainName string, msg *dns.Msg) {
+	debug := clog.D.Value()
+	if debug {
+		log.Debugf("Resolving AAAA record for %s in zone %s", t.logName(domainName), t.zone)
+	}
+	if !t.spendLookup(ctx, domainName) {
+		return
+	}
+	if t.resolveLAN(d, domainName, msg, true) || t.resolveEndpoint(d, domainName, msg, true) {
+		return
+	}
 
-	name := labels[len(labels)-numCommonLabels-1]
-	log.Debugf("Extracted base name: %s", name)
+	prefix, name := t.splitName(d, domainName)
+	if !t.wildcardAllowed(d, prefix, name) {
+		if debug {
+			log.Debugf("No wildcard records for names below %s", t.logName(name))
+		}
+		return
+	}
 
 	// Look for an AAAA record
-	entries, ok := t.entries[name]["AAAA"]
-	if ok {
-		log.Debugf("Found AAAA record for %s with %d entries", name, len(entries))
-	} else {
-		log.Debugf("No AAAA record found for %s", name)
+	entries, ok := d.entries[name]["AAAA"]
+	if debug {
+		log.Debugf("Found %d AAAA records for %s", len(entries), t.logName(name))
 	}
 
 	if ok {
-		log.Debugf("Adding AAAA records for %s to response", name)
-		for _, entry := range entries {
-			log.Debugf("  - Adding AAAA record: %s", entry)
-			msg.Answer = append(msg.Answer, &dns.AAAA{
-				Hdr:  dns.RR_Header{Name: domainName, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: 60},
-				AAAA: net.ParseIP(entry),
-			})
+		ttl := t.rrsetTTL(d, name, "AAAA")
+		slab := slabPool.Get().(*rrSlab)
+		for _, addr := range d.addrs[name].v6 {
+			msg.Answer = append(msg.Answer, slab.newAAAA(domainName, ttl, addr))
 		}
+		slabPool.Put(slab)
 	} else {
 		// There's no AAAA record, so see if a CNAME exists
 		log.Debug("No v6 entry after lookup, so trying CNAME")
-		t.resolveCNAME(domainName, msg, TypeAAAA)
+		t.resolveCNAME(ctx, d, domainName, msg, TypeAAAA)
 	}
 }
 
-func (t *Tailscale) resolveCNAME(domainName string, msg *dns.Msg, lookupType int) {
-	log.Debugf("Resolving CNAME record for %s in zone %s", domainName, t.zone)
-
-	// Get the number of labels in common between domain and zone
-	numCommonLabels := dns.CompareDomainName(domainName, t.zone)
-	labels := dns.SplitDomainName(domainName)
-	log.Debugf("Domain has %d labels, zone has %d labels in common", len(labels), numCommonLabels)
+func (t *Tailscale) resolveCNAME(ctx context.Context, d *zoneData, domainName string, msg *dns.Msg, lookupType int) {
+	debug := clog.D.Value()
+	if debug {
+		log.Debugf("Resolving CNAME record for %s in zone %s", t.logName(domainName), t.zone)
+	}
+	if !t.spendLookup(ctx, domainName) {
+		return
+	}
 
-	indexUniqueLabels := len(labels) - numCommonLabels - 1
-	name := labels[indexUniqueLabels]
-	log.Debugf("Extracted base name: %s", name)
+	prefix, name := t.splitName(d, domainName)
+	if !t.wildcardAllowed(d, prefix, name) {
+		if debug {
+			log.Debugf("No wildcard records for names below %s", t.logName(name))
+		}
+		return
+	}
 
 	// Look for a CNAME record
-	targets, ok := t.entries[name]["CNAME"]
-	if ok {
-		log.Debugf("Found CNAME record for %s with %d entries", name, len(targets))
-	} else {
-		log.Debugf("No CNAME record found for %s", name)
+	targets, ok := d.entries[name]["CNAME"]
+	if debug {
+		log.Debugf("Found %d CNAME records for %s", len(targets), t.logName(name))
 	}
 
 	if ok {
-		log.Debugf("Adding CNAME records for %s to response", name)
+		ctx, leave, ok := t.enterCNAME(ctx, domainName)
+		if !ok {
+			return
+		}
+		defer leave()
+
+		ttl := t.rrsetTTL(d, name, "CNAME")
+		slab := slabPool.Get().(*rrSlab)
+		defer slabPool.Put(slab)
 		for _, target := range targets {
 			targetDomain := target
-			if indexUniqueLabels > 0 {
-				targetDomain = strings.Join(labels[:indexUniqueLabels], ".") + "." + target
+			if prefix != "" {
+				targetDomain = prefix + "." + target
+			}
+			msg.Answer = append(msg.Answer, slab.newCNAME(domainName, ttl, targetDomain))
+
+			// Targets outside the zone, which static records may point to, are looked up upstream if
+			// configured, and left to the client otherwise.
+			if !dns.IsSubDomain(dns.Fqdn(t.zone), dns.Fqdn(targetDomain)) {
+				t.deferUpstream(ctx, targetDomain, lookupType)
+				continue
 			}
-			log.Debugf("  - Adding CNAME record: %s", targetDomain)
-			msg.Answer = append(msg.Answer, &dns.CNAME{
-				Hdr:    dns.RR_Header{Name: domainName, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 60},
-				Target: targetDomain,
-			})
 
 			// Resolve local zone A or AAAA records if they exist for the referenced target
 			if lookupType == TypeAll || lookupType == TypeA {
 				log.Debug("CNAME record found, lookup up local recursive A")
-				t.resolveA(targetDomain, msg)
+				t.resolveA(ctx, d, targetDomain, msg)
 			}
 			if lookupType == TypeAll || lookupType == TypeAAAA {
 				log.Debug("CNAME record found, lookup up local recursive AAAA")
-				t.resolveAAAA(targetDomain, msg)
+				t.resolveAAAA(ctx, d, targetDomain, msg)
+			}
+			if lookupType == TypeTXT {
+				log.Debug("CNAME record found, lookup up local recursive TXT")
+				t.resolveTXT(ctx, d, targetDomain, msg)
+			}
+			if lookupType == TypeSVCB {
+				t.resolveSVCB(ctx, d, targetDomain, dns.TypeSVCB, msg)
+			}
+			if lookupType == TypeHTTPS {
+				t.resolveSVCB(ctx, d, targetDomain, dns.TypeHTTPS, msg)
 			}
 		}
 	}
 }
 
-func (t *Tailscale) handleNoRecords(ctx context.Context, w dns.ResponseWriter, r *dns.Msg, msg *dns.Msg) (int, error) {
-	log.Debugf("No records found for %s, checking fallthrough", r.Question[0].Name)
-	if t.fall.Through(r.Question[0].Name) {
+// resolveTXT adds the TXT record listing the tags of the node to msg. Like addresses, the tags are
+// served for subdomains of the node's name too.
+func (t *Tailscale) resolveTXT(ctx context.Context, d *zoneData, domainName string, msg *dns.Msg) {
+	debug := clog.D.Value()
+	if debug {
+		log.Debugf("Resolving TXT record for %s in zone %s", t.logName(domainName), t.zone)
+	}
+	if !t.spendLookup(ctx, domainName) {
+		return
+	}
+
+	if t.resolveMeta(d, domainName, msg) {
+		return
+	}
+
+	prefix, name := t.splitName(d, domainName)
+	if !t.wildcardAllowed(d, prefix, name) {
+		if debug {
+			log.Debugf("No wildcard records for names below %s", t.logName(name))
+		}
+		return
+	}
+	tags, ok := d.entries[name]["TXT"]
+	if !ok {
+		log.Debug("No TXT entry after lookup, so trying CNAME")
+		t.resolveCNAME(ctx, d, domainName, msg, TypeTXT)
+		return
+	}
+
+	if debug {
+		log.Debugf("Adding TXT record for %s with %d tags to response", t.logName(name), len(tags))
+	}
+	msg.Answer = append(msg.Answer, &dns.TXT{
+		Hdr: dns.RR_Header{Name: domainName, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: t.rrsetTTL(d, name, "TXT")},
+		Txt: tags,
+	})
+}
+
+// nameExists reports whether domainName exists in the zone, whatever types it has records for. Like
+// their records, the names of nodes exist with any labels in front of them.
+func (t *Tailscale) nameExists(d *zoneData, domainName string) bool {
+	prefix, host := t.splitName(d, domainName)
+	if host == "" {
+		return false
+	}
+	if _, ok := t.endpointName(d, prefix, host); ok {
+		return true
+	}
+	if _, ok := d.entries[host]; ok && t.prefixExists(d, prefix, host) {
+		return true
+	}
+	if t.rebindMarker && prefix == "" && strings.EqualFold(host, rebindMarkerLabel) {
+		return true
+	}
+	if t.isStatsName(d, domainName) || t.isMetaName(d, domainName) {
+		return true
+	}
+	if t.tagEnumerationExists(d, domainName) {
+		return true
+	}
+	if prefix == "" && (t.subzoneLabels[host] || d.userLabels[host]) {
+		// Tag subzones exist even without nodes, like the zone apex, and the subzones of users while
+		// they have nodes.
+		return true
+	}
+	return strings.EqualFold(prefix, lanLabel) && lanPublished(d, host) && t.lan.exists(host, time.Now())
+}
+
+// handleNoRecords is called when there are no answers for a query. If fallthrough is enabled for the
+// query name and type the request is passed on to the next plugin, otherwise a response with the given rcode
+// (NXDOMAIN, or NOERROR for NODATA) and an empty answer section is written. Queries without answers
+// because of an internal failure are answered with SERVFAIL instead, unless internal_errors is
+// negative, and don't fall through.
+func (t *Tailscale) handleNoRecords(ctx context.Context, w dns.ResponseWriter, r *dns.Msg, msg *dns.Msg, rcode int) (int, error) {
+	if clog.D.Value() {
+		log.Debugf("No records found for %s, checking fallthrough", t.logName(r.Question[0].Name))
+	}
+	rcode = t.failedRcode(ctx, rcode)
+	if rcode == dns.RcodeServerFailure {
+		// Resolvers would cache the SOA record as that of a negative answer, which this isn't.
+		msg.Ns = nil
+	} else if t.fallsThrough(r.Question[0]) {
 		log.Debug("falling through to next plugin")
 		return plugin.NextOrFailure(t.Name(), t.next, ctx, w, r)
-	} else {
-		log.Debug("No records and no fallthrough, returning NXDOMAIN")
-		RcodeCount.WithLabelValues(dns.RcodeToString[dns.RcodeNameError], metrics.WithServer(ctx)).Inc()
-		if err := w.WriteMsg(msg); err != nil {
-			log.Warningf("Error writing NXDOMAIN response: %v", err)
-			return dns.RcodeServerFailure, err
-		}
-		return dns.RcodeNameError, nil
 	}
+
+	log.Debugf("No records and no fallthrough, returning %s", dns.RcodeToString[rcode])
+	msg.Rcode = rcode
+	if err := t.finishResponse(ctx, request.Request{W: w, Req: r}, msg); err != nil {
+		return dns.RcodeServerFailure, err
+	}
+	RcodeCount.WithLabelValues(dns.RcodeToString[msg.Rcode], metrics.WithServer(ctx)).Inc()
+	if err := t.writeMsg(ctx, w, msg); err != nil {
+		return dns.RcodeServerFailure, err
+	}
+	return msg.Rcode, nil
+}
+
+// fallsThrough reports whether a query for q without an answer is passed on to the next plugin.
+func (t *Tailscale) fallsThrough(q dns.Question) bool {
+	if t.fallTypes != nil && !t.fallTypes[q.Qtype] {
+		return false
+	}
+	return t.fall.Through(q.Name)
+}
+
+// knownType reports whether the plugin serves records of qtype, in any zone and with any options.
+// Queries for other types are only ever answered with NXDOMAIN or NODATA.
+func knownType(qtype uint16) bool {
+	switch qtype {
+	case dns.TypeA, dns.TypeAAAA, dns.TypeCNAME, dns.TypeTXT, dns.TypeSRV, dns.TypePTR, dns.TypeSVCB,
+		dns.TypeHTTPS, dns.TypeANY, dns.TypeSOA, dns.TypeNS, dns.TypeDNSKEY, dns.TypeRRSIG, dns.TypeNSEC:
+		return true
+	}
+	return false
+}
+
+// shed drops a query that arrived while too many others were in flight. The query is either refused,
+// leaving the server to write the REFUSED response, or passed on to the next plugin.
+func (t *Tailscale) shed(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
+	ShedCount.WithLabelValues(metrics.WithServer(ctx)).Inc()
+	if t.shedFallthrough {
+		log.Debug("Too many in-flight queries, falling through to next plugin")
+		return plugin.NextOrFailure(t.Name(), t.next, ctx, w, r)
+	}
+	log.Debug("Too many in-flight queries, refusing")
+	RcodeCount.WithLabelValues(dns.RcodeToString[dns.RcodeRefused], metrics.WithServer(ctx)).Inc()
+	return dns.RcodeRefused, nil
+}
+
+// cookieError responds to a query whose DNS cookie failed validation with rcode. A BADCOOKIE response
+// carries a fresh server cookie for the client to retry with.
+func (t *Tailscale) cookieError(ctx context.Context, state request.Request, rcode int) (int, error) {
+	RcodeCount.WithLabelValues(dns.RcodeToString[rcode], metrics.WithServer(ctx)).Inc()
+	if rcode != dns.RcodeBadCookie {
+		// Leave writing the error response to the server.
+		return rcode, nil
+	}
+
+	msg := new(dns.Msg)
+	msg.SetRcode(state.Req, rcode)
+	if err := t.finishResponse(ctx, state, msg); err != nil {
+		return dns.RcodeServerFailure, err
+	}
+	if err := t.writeMsg(ctx, state.W, msg); err != nil {
+		return dns.RcodeServerFailure, err
+	}
+	return rcode, nil
 }
 
 func (t *Tailscale) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
 	state := request.Request{W: w, Req: r}
+	// The client is only determined once, everything answering the query uses the same address.
+	client := t.clientIP(state)
+	// So are the records: every lookup answering the query reads the same snapshot, even if the
+	// records change meanwhile. The generation of the answer cache is taken first, and answers are
+	// only looked up and cached in it: one built from records that changed since is put in a
+	// generation that's no longer used, see answerCache.
+	gen := t.answers.generation()
+	d := t.load()
+	ctx = withClient(ctx, client)
+	if t.queryLog != nil {
+		ctx = t.queryLog.begin(ctx, client)
+	}
 	qname := state.Name()
 	queryType := dns.TypeToString[r.Question[0].Qtype]
-	log.Debugf("Handling Tailscale %s query for %s", queryType, qname)
+	if clog.D.Value() {
+		log.Debugf("Handling Tailscale %s query for %s from %s", queryType, t.logName(qname), t.logAddr(client))
+	}
 
-	// Check if the query is for a zone we're authoritative for
-	if !dns.IsSubDomain(t.zone, qname) || qname == t.zone {
+	// Check if the query is for a zone we're authoritative for. Reverse lookups of tailnet addresses
+	// are answered too, if the server block routes them to us.
+	addr, reverse := reverseAddr(qname)
+	zone := t.matchZone(qname)
+	if !reverse && zone == "" && t.magicDNS {
+		var magicZone string
+		if !t.loopDomain(d, qname) {
+			magicZone = t.magicDNSZone(d, qname)
+		}
+		if magicZone != "" {
+			return t.serveMagicDNS(ctx, state, magicZone)
+		}
+	}
+	if !reverse && zone == "" {
 		log.Debug("Domain is not in zone, returning")
 		return plugin.NextOrFailure(t.Name(), t.next, ctx, w, r)
 	}
 
-	RequestCount.WithLabelValues(metrics.WithServer(ctx), queryType).Inc()
+	RequestCount.WithLabelValues(metrics.WithServer(ctx), zone, queryType).Inc()
+
+	// The server may hand over queries whose client already gave up, e.g. after waiting in line.
+	if err := ctx.Err(); err != nil {
+		if clog.D.Value() {
+			log.Debugf("Query for %s cancelled before it was answered: %v", t.logName(qname), err)
+		}
+		return dns.RcodeServerFailure, err
+	}
+
+	if t.enumeration != nil {
+		if t.enumeration.observe(client, qname, time.Now()) {
+			log.Warningf("Client %s queried %d distinct names within %s, possible zone enumeration", t.logAddr(client), t.enumeration.threshold, t.enumeration.window)
+			EnumerationCount.WithLabelValues(metrics.WithServer(ctx)).Inc()
+		}
+	}
+
+	if t.maxInflight > 0 {
+		defer t.inflight.Add(-1)
+		if n := t.inflight.Add(1); n > t.maxInflight {
+			return t.shed(ctx, w, r)
+		}
+	}
+
+	if t.cookieSecret != nil {
+		if rcode := t.checkCookie(state, client); rcode != dns.RcodeSuccess {
+			return t.cookieError(ctx, state, rcode)
+		}
+	}
+
+	if qtype := r.Question[0].Qtype; qtype == dns.TypeAXFR || qtype == dns.TypeIXFR {
+		return t.serveTransfer(ctx, state)
+	}
+
+	if t.passUnknownTypes && !knownType(r.Question[0].Qtype) {
+		log.Debugf("No %s records served, passing on to next plugin", queryType)
+		return plugin.NextOrFailure(t.Name(), t.next, ctx, w, r)
+	}
 
 	start := time.Now()
-	log.Debugf("Tailscale peers list has %d entries", len(t.entries))
+	log.Debugf("Tailscale peers list has %d entries", len(d.entries))
 	log.Debugf("Configured zone: %s", t.zone)
 
-	// if len(t.entries) > 0 {
-	// 	log.Debug("Available entries:")
-	// 	for name, types := range t.entries {
-	// 		log.Debugf("  ├─ Host: %s", name)
-	// 		for recordType, values := range types {
-	// 			log.Debugf("  │  ├─ %s: %v", recordType, values)
-	// 		}
-	// 	}
-	// }
-
 	msg := dns.Msg{}
 	msg.SetReply(r)
 	msg.Authoritative = true
+	ctx = withResolution(ctx, t.lookupLimit())
+
+	// Clients are identified once, the same view applies to reverse lookups.
+	view := t.clientView(ctx, client)
+
+	if reverse {
+		code, err := t.serveReverse(ctx, d, state, &msg, addr, view)
+		RequestDuration.WithLabelValues(metrics.WithServer(ctx)).Observe(time.Since(start).Seconds())
+		return code, err
+	}
+
+	filterAAAA := t.filtersAAAA(ctx, client)
+
+	// The zone apex always exists, even when no nodes are published (or all of them are filtered out),
+	// so types other than SOA and NS are answered with NODATA rather than NXDOMAIN.
+	if dns.CountLabel(qname) == dns.CountLabel(zone) {
+		t.resolveApex(d, zone, r.Question[0].Qtype, &msg)
+		if len(msg.Answer) == 0 {
+			msg.Ns = append(msg.Ns, t.soa(d, zone))
+		} else if !t.isExternalClient(client) {
+			t.addGlue(ctx, d, &msg, zone)
+		}
+		if t.preferIPv6 {
+			preferAAAA(msg.Extra)
+		}
+		if filterAAAA {
+			stripAAAA(&msg)
+		}
+
+		var code int
+		var err error
+		if len(msg.Answer) > 0 {
+			code, err = t.writeAnswer(ctx, d, state, &msg)
+		} else {
+			log.Debug("Query for zone apex, no records")
+			code, err = t.handleNoRecords(ctx, w, r, &msg, dns.RcodeSuccess)
+		}
+		RequestDuration.WithLabelValues(metrics.WithServer(ctx)).Observe(time.Since(start).Seconds())
+		return code, err
+	}
+
+	// Records are resolved in the primary zone, and moved to the zone of the query afterwards.
+	if zone != t.zone {
+		qname = moveName(qname, zone, t.zone)
+	}
+
+	// Answers only depend on the records and on what the client is, so they're cached for clients
+	// alike until the records change.
+	external := t.isExternalClient(client)
+	key := answerKey{qname: qname, zone: zone, qtype: r.Question[0].Qtype, qclass: r.Question[0].Qclass, client: answerClient(view, external, filterAAAA)}
+	rcode, hit := gen.get(key, &msg)
+	if t.answers != nil {
+		if hit {
+			AnswerCacheHits.WithLabelValues(metrics.WithServer(ctx)).Inc()
+		} else {
+			AnswerCacheMisses.WithLabelValues(metrics.WithServer(ctx)).Inc()
+		}
+	}
+	if !hit {
+		var cacheable bool
+		rcode, cacheable = t.buildAnswer(ctx, d, state, &msg, qname, zone, view, external, filterAAAA)
+		if cacheable {
+			if err := gen.put(key, &msg, rcode); err != nil {
+				log.Warningf("Unable to cache answer to %s: %v", t.logName(qname), err)
+			}
+		}
+	}
 
-	t.mu.RLock()
-	defer t.mu.RUnlock()
+	if len(msg.Answer) > 0 {
+		for _, kind := range answerComposition(msg.Answer, state.Name(), zone) {
+			AnswerCompositions.WithLabelValues(metrics.WithServer(ctx), kind).Inc()
+		}
+		code, err := t.writeAnswer(ctx, d, state, &msg)
+		RequestDuration.WithLabelValues(metrics.WithServer(ctx)).Observe(time.Since(start).Seconds())
+		return code, err
+	}
+	log.Debug("No answers in response")
+	code, err := t.handleNoRecords(ctx, w, r, &msg, rcode)
+	RequestDuration.WithLabelValues(metrics.WithServer(ctx)).Observe(time.Since(start).Seconds())
+	return code, err
+}
 
+// buildAnswer resolves the query of state for qname, in the primary zone, into msg, for a client
+// with view, outside the tailnet if external, and whose AAAA records are filtered if filterAAAA.
+// Answers are moved to zone, and negative ones carry its SOA record. It returns the rcode, and
+// whether the answer may be cached: answers that took lookups upstream, failed internally, or
+// depend on more than the records, like LAN addresses and zone statistics, may not.
+func (t *Tailscale) buildAnswer(ctx context.Context, d *zoneData, state request.Request, msg *dns.Msg, qname, zone string, view *clientView, external, filterAAAA bool) (int, bool) {
+	r := state.Req
 	switch r.Question[0].Qtype {
 	case dns.TypeA:
-		t.resolveA(qname, &msg)
+		t.resolveA(ctx, d, qname, msg)
 
 	case dns.TypeAAAA:
-		t.resolveAAAA(qname, &msg)
+		t.resolveAAAA(ctx, d, qname, msg)
 
 	case dns.TypeCNAME:
-		t.resolveCNAME(qname, &msg, TypeAll)
+		t.resolveCNAME(ctx, d, qname, msg, TypeAll)
+
+	case dns.TypeSRV:
+		t.resolveSRV(d, qname, msg)
+
+	case dns.TypePTR:
+		t.resolveTagPTR(d, qname, msg)
+
+	case dns.TypeSVCB, dns.TypeHTTPS:
+		t.resolveSVCB(ctx, d, qname, r.Question[0].Qtype, msg)
+
+	case dns.TypeANY:
+		t.resolveAny(ctx, d, qname, msg)
+
+	case dns.TypeTXT:
+		if r.Question[0].Qclass == dns.ClassCHAOS {
+			t.resolveVersion(d, qname, msg)
+		} else {
+			t.resolveRebindMarker(d, qname, msg)
+			t.resolveStats(d, qname, msg)
+			t.resolveTXT(ctx, d, qname, msg)
+		}
 	}
 
-	if len(msg.Answer) > 0 {
-		log.Debugf("Sending response with %d answers", len(msg.Answer))
-		RcodeCount.WithLabelValues(dns.RcodeToString[dns.RcodeSuccess], metrics.WithServer(ctx)).Inc()
-		if err := w.WriteMsg(&msg); err != nil {
-			log.Warningf("Error writing response: %v", err)
-			return dns.RcodeServerFailure, err
+	// A name without records of the queried type is answered with NODATA, only names that don't exist
+	// at all with NXDOMAIN. The version name is the only one in the CHAOS class.
+	rcode := dns.RcodeNameError
+	if r.Question[0].Qclass != dns.ClassCHAOS && t.nameExists(d, qname) {
+		rcode = dns.RcodeSuccess
+	}
+	cacheable := t.cacheableName(d, qname) && !t.notSynced() && !resolvedUpstream(ctx)
+
+	t.resolveUpstream(ctx, state, msg)
+
+	// Machines the view of the client doesn't show don't exist for it, nor do the names below them.
+	if view != nil {
+		if !t.visible(d, view, qname) {
+			msg.Answer, msg.Extra = nil, nil
+			rcode = dns.RcodeNameError
+		} else if n := t.applyView(d, view, msg); n > 0 {
+			log.Debugf("Removed %d records hidden by view %s", n, view.name)
 		}
-		RequestDuration.WithLabelValues(metrics.WithServer(ctx)).Observe(time.Since(start).Seconds())
-		return dns.RcodeSuccess, nil
-	} else {
-		log.Debug("No answers in response")
-		code, err := t.handleNoRecords(ctx, w, r, &msg)
-		RequestDuration.WithLabelValues(metrics.WithServer(ctx)).Observe(time.Since(start).Seconds())
-		return code, err
 	}
+
+	// Keep internal addresses away from clients outside the tailnet, whose resolvers may have DNS
+	// rebinding protection that discards such answers. The names still exist, so answer NODATA.
+	if external {
+		if n := stripInternalAnswers(msg); n > 0 {
+			log.Debugf("Removed %d internal addresses from answer to external client", n)
+			rcode = dns.RcodeSuccess
+		}
+	}
+
+	if zone != t.zone {
+		t.moveAnswers(msg, zone)
+	}
+	if !external {
+		t.addGlue(ctx, d, msg, zone)
+	}
+	if t.preferIPv6 {
+		preferAAAA(msg.Answer)
+		preferAAAA(msg.Extra)
+	}
+	// Clients with broken IPv6 would try the addresses and time out. Names with only AAAA records
+	// still exist, so answer NODATA.
+	if filterAAAA {
+		if n := stripAAAA(msg); n > 0 {
+			log.Debugf("Removed %d AAAA records from answer to filtered client", n)
+			rcode = dns.RcodeSuccess
+		}
+	}
+
+	if len(msg.Answer) == 0 {
+		msg.Ns = append(msg.Ns, t.soa(d, zone))
+	}
+	return rcode, cacheable && queryFailure(ctx) == nil && ctx.Err() == nil
+}
+
+// writeAnswer writes the positive response msg.
+func (t *Tailscale) writeAnswer(ctx context.Context, d *zoneData, state request.Request, msg *dns.Msg) (int, error) {
+	if dropped := t.dropUnreachable(msg); dropped > 0 {
+		log.Debugf("Dropped %d records of unreachable nodes", dropped)
+	}
+	t.attribute(ctx, d, state, msg)
+	log.Debugf("Sending response with %d answers", len(msg.Answer))
+	t.order.reorder(msg)
+	if err := t.finishResponse(ctx, state, msg); err != nil {
+		return dns.RcodeServerFailure, err
+	}
+	RcodeCount.WithLabelValues(dns.RcodeToString[msg.Rcode], metrics.WithServer(ctx)).Inc()
+	if err := t.writeMsg(ctx, state.W, msg); err != nil {
+		return dns.RcodeServerFailure, err
+	}
+	return msg.Rcode, nil
 }
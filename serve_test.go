@@ -1,23 +1,42 @@
 package tailscale
 
 import (
+	"bytes"
 	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
 	"reflect"
 	"sort"
+	"strconv"
+	"strings"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/coredns/coredns/plugin"
 	"github.com/coredns/coredns/plugin/pkg/dnstest"
 	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/plugin/transfer"
+	"github.com/coredns/coredns/request"
 	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/tailcfg"
 
 	clog "github.com/coredns/coredns/plugin/pkg/log"
 )
 
-func newTS() Tailscale {
-	return Tailscale{
-		zone: "example.com",
+func newTS() *Tailscale {
+	ts := &Tailscale{zone: "example.com."}
+	ts.data.Store(&zoneData{
 		entries: map[string]map[string][]string{
 			"test1": {
 				"A":    []string{"127.0.0.1"},
@@ -32,96 +51,2616 @@ func newTS() Tailscale {
 				"AAAA": []string{"::1"},
 			},
 			"test2": {
-				"CNAME": []string{"test2-1.example.com", "test2-2.example.com"},
+				"CNAME": []string{"test2-1.example.com.", "test2-2.example.com."},
 			},
 		},
+	})
+	ts.load().addrs = ts.addrIndex(ts.load().entries)
+	return ts
+}
+
+func TestServeDNSFallback(t *testing.T) {
+	clog.D.Set()
+	ts := newTS()
+	ts.fall.SetZonesFromArgs(nil)
+
+	test3 := net.ParseIP("100.100.100.100")
+
+	// No match, no next plugin.
+	var msg dns.Msg
+	msg.SetQuestion("test3.example.com.", dns.TypeA)
+	resp, err := ts.ServeDNS(context.Background(), dnstest.NewRecorder(&test.ResponseWriter{}), &msg)
+	if err == nil {
+		t.Fatal("expected error, got none")
+	}
+	if want, got := dns.RcodeServerFailure, resp; got != want {
+		t.Fatalf("want response code %d, got %d", want, got)
+	}
+
+	ts.next = plugin.HandlerFunc(func(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
+		msg := dns.Msg{}
+		msg.SetReply(r)
+		msg.Answer = append(msg.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: "test3.example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   test3,
+		})
+		if err := w.WriteMsg(&msg); err != nil {
+			return dns.RcodeServerFailure, err
+		}
+		return dns.RcodeSuccess, nil
+	})
+
+	// Match, next plugin configured.
+	msg.SetQuestion("test1.example.com.", dns.TypeA)
+	w := dnstest.NewRecorder(&test.ResponseWriter{})
+	resp, err = ts.ServeDNS(context.Background(), w, &msg)
+	if want, got := dns.RcodeSuccess, resp; got != want {
+		t.Fatalf("want response code %d, got %d", want, got)
+	}
+	if want, got := net.ParseIP("127.0.0.1"), w.Msg.Answer[0].(*dns.A).A; !got.Equal(want) {
+		t.Errorf("want %s, got: %s", want, got)
+	}
+
+	// No match, next plugin configured.
+	msg.SetQuestion("test3.example.com.", dns.TypeA)
+	w = dnstest.NewRecorder(&test.ResponseWriter{})
+	ts.ServeDNS(context.Background(), w, &msg)
+
+	if w.Msg == nil {
+		t.Fatal("no answer")
+	}
+	if want, got := 1, len(w.Msg.Answer); want != got {
+		t.Fatalf("want %d answer, got: %d", want, got)
+	}
+	if got := w.Msg.Answer[0].(*dns.A).A; !got.Equal(test3) {
+		t.Errorf("want %s, got: %s", test3, got)
+	}
+}
+
+func TestServeDNSFallbackTypes(t *testing.T) {
+	ts := newTS()
+	ts.fall.SetZonesFromArgs(nil)
+	ts.fallTypes = map[uint16]bool{dns.TypeMX: true, dns.TypeTXT: true}
+	var passed []uint16
+	ts.next = plugin.HandlerFunc(func(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
+		passed = append(passed, r.Question[0].Qtype)
+		return dns.RcodeSuccess, nil
+	})
+
+	tests := []struct {
+		qname string
+		qtype uint16
+		rcode int
+		next  bool
+	}{
+		{"test1.example.com", dns.TypeMX, dns.RcodeSuccess, true},
+		{"test3.example.com", dns.TypeMX, dns.RcodeSuccess, true},
+		// Names without addresses are answered authoritatively for the other types.
+		{"test2.example.com", dns.TypeAAAA, dns.RcodeSuccess, false},
+		{"test3.example.com", dns.TypeA, dns.RcodeNameError, false},
+		{"test1.example.com", dns.TypeSRV, dns.RcodeSuccess, false},
+	}
+	for _, tc := range tests {
+		passed = nil
+		var msg dns.Msg
+		msg.SetQuestion(tc.qname, tc.qtype)
+		w := dnstest.NewRecorder(&test.ResponseWriter{})
+		rcode, err := ts.ServeDNS(context.Background(), w, &msg)
+		if err != nil {
+			t.Fatalf("%s %s: unexpected error: %v", tc.qname, dns.TypeToString[tc.qtype], err)
+		}
+		if rcode != tc.rcode || (len(passed) > 0) != tc.next {
+			t.Errorf("%s %s: got rcode %d, passed on %v, want rcode %d, passed on %v", tc.qname, dns.TypeToString[tc.qtype], rcode, len(passed) > 0, tc.rcode, tc.next)
+		}
+	}
+}
+
+func TestServeDNSPassthroughUnknownTypes(t *testing.T) {
+	ts := newTS()
+	ts.passUnknownTypes = true
+	var passed []uint16
+	ts.next = plugin.HandlerFunc(func(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
+		passed = append(passed, r.Question[0].Qtype)
+		return dns.RcodeSuccess, nil
+	})
+
+	tests := []struct {
+		qname string
+		qtype uint16
+		rcode int
+		next  bool
+	}{
+		{"test1.example.com", dns.TypeMX, dns.RcodeSuccess, true},
+		{"example.com", dns.TypeNAPTR, dns.RcodeSuccess, true},
+		{"missing.example.com", dns.TypeMX, dns.RcodeSuccess, true},
+		// Types with records are answered without fallthrough, even when there are none.
+		{"test1.example.com", dns.TypeA, dns.RcodeSuccess, false},
+		{"test3.example.com", dns.TypeA, dns.RcodeNameError, false},
+		{"test1.example.com", dns.TypeSRV, dns.RcodeSuccess, false},
+	}
+	for _, tc := range tests {
+		passed = nil
+		var msg dns.Msg
+		msg.SetQuestion(tc.qname, tc.qtype)
+		w := dnstest.NewRecorder(&test.ResponseWriter{})
+		rcode, err := ts.ServeDNS(context.Background(), w, &msg)
+		if err != nil {
+			t.Fatalf("%s %s: unexpected error: %v", tc.qname, dns.TypeToString[tc.qtype], err)
+		}
+		if rcode != tc.rcode || (len(passed) > 0) != tc.next {
+			t.Errorf("%s %s: got rcode %d, passed on %v, want rcode %d, passed on %v", tc.qname, dns.TypeToString[tc.qtype], rcode, len(passed) > 0, tc.rcode, tc.next)
+		}
+	}
+}
+
+func TestServeDNSAnswerOrder(t *testing.T) {
+	ts := newTS()
+	ts.order = newAnswerOrder(orderRoundRobin, 0)
+	ts.load().entries["pool"] = map[string][]string{"A": {"100.64.0.1", "100.64.0.2", "100.64.0.3"}}
+	ts.load().addrs = ts.addrIndex(ts.load().entries)
+
+	answer := func(qname string) []string {
+		var msg dns.Msg
+		msg.SetQuestion(qname, dns.TypeA)
+		w := dnstest.NewRecorder(&test.ResponseWriter{})
+		if _, err := ts.ServeDNS(context.Background(), w, &msg); err != nil {
+			t.Fatalf("%s: unexpected error: %v", qname, err)
+		}
+		var got []string
+		for _, rr := range w.Msg.Answer {
+			switch rr := rr.(type) {
+			case *dns.A:
+				got = append(got, rr.A.String())
+			case *dns.CNAME:
+				got = append(got, rr.Target)
+			}
+		}
+		return got
+	}
+
+	for _, want := range [][]string{
+		{"100.64.0.1", "100.64.0.2", "100.64.0.3"},
+		{"100.64.0.2", "100.64.0.3", "100.64.0.1"},
+		{"100.64.0.3", "100.64.0.1", "100.64.0.2"},
+		{"100.64.0.1", "100.64.0.2", "100.64.0.3"},
+	} {
+		if got := answer("pool.example.com."); !reflect.DeepEqual(got, want) {
+			t.Errorf("round robin: got %v, want %v", got, want)
+		}
+	}
+
+	// The CNAME records of a name are rotated along with the addresses of their targets.
+	ts.order = newAnswerOrder(orderRoundRobin, 0)
+	for _, want := range [][]string{
+		{"test2-1.example.com.", "127.0.0.1", "test2-2.example.com.", "127.0.0.1"},
+		{"test2-2.example.com.", "127.0.0.1", "test2-1.example.com.", "127.0.0.1"},
+	} {
+		if got := answer("test2.example.com."); !reflect.DeepEqual(got, want) {
+			t.Errorf("CNAME round robin: got %v, want %v", got, want)
+		}
+	}
+
+	// Shuffles with the same seed are repeatable.
+	var orders [2][][]string
+	for i := range orders {
+		ts.order = newAnswerOrder(orderShuffle, 42)
+		for range 5 {
+			orders[i] = append(orders[i], answer("pool.example.com."))
+		}
+	}
+	if !reflect.DeepEqual(orders[0], orders[1]) {
+		t.Errorf("seeded shuffles differ: %v and %v", orders[0], orders[1])
+	}
+}
+
+func TestServeDNSHealthCheck(t *testing.T) {
+	ts := newTS()
+	ts.load().entries["pool"] = map[string][]string{"A": {"100.64.0.1", "100.64.0.2", "100.64.0.3"}}
+	ts.load().entries["test2-1"]["A"] = []string{"100.64.0.4"}
+	ts.load().addrs = ts.addrIndex(ts.load().entries)
+
+	answer := func(qname string) []string {
+		var msg dns.Msg
+		msg.SetQuestion(qname, dns.TypeA)
+		w := dnstest.NewRecorder(&test.ResponseWriter{})
+		if _, err := ts.ServeDNS(context.Background(), w, &msg); err != nil {
+			t.Fatalf("%s: unexpected error: %v", qname, err)
+		}
+		var got []string
+		for _, rr := range w.Msg.Answer {
+			switch rr := rr.(type) {
+			case *dns.A:
+				got = append(got, rr.A.String())
+			case *dns.CNAME:
+				got = append(got, rr.Target)
+			}
+		}
+		return got
+	}
+
+	tests := []struct {
+		name  string
+		down  []string
+		qname string
+		want  []string
+	}{
+		{"all reachable", nil, "pool.example.com.", []string{"100.64.0.1", "100.64.0.2", "100.64.0.3"}},
+		{"one unreachable", []string{"100.64.0.2"}, "pool.example.com.", []string{"100.64.0.1", "100.64.0.3"}},
+		{"all unreachable", []string{"100.64.0.1", "100.64.0.2", "100.64.0.3"}, "pool.example.com.", []string{"100.64.0.1", "100.64.0.2", "100.64.0.3"}},
+		{"single address", []string{"100.64.0.4"}, "test2-1.example.com.", []string{"100.64.0.4"}},
+		{"CNAME target unreachable", []string{"100.64.0.4"}, "test2.example.com.", []string{"test2-2.example.com.", "127.0.0.1"}},
+		{"every CNAME target unreachable", []string{"100.64.0.4", "127.0.0.1"}, "test2.example.com.", []string{"test2-1.example.com.", "100.64.0.4", "test2-2.example.com.", "127.0.0.1"}},
+	}
+	for _, tc := range tests {
+		down := map[netip.Addr]bool{}
+		for _, addr := range tc.down {
+			down[netip.MustParseAddr(addr)] = true
+		}
+		ts.setUnreachable(down)
+		if got := answer(tc.qname); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestServeDNSQueryLog(t *testing.T) {
+	ts := newTS()
+	ts.queryLog = newQueryLog(1, nil)
+	ts.whoIsFunc = func(ctx context.Context, remoteAddr string) (*apitype.WhoIsResponse, error) {
+		return &apitype.WhoIsResponse{Node: &tailcfg.Node{ComputedName: "laptop"}, UserProfile: &tailcfg.UserProfile{LoginName: "alice@example.com"}}, nil
+	}
+
+	query := func(qname string) {
+		var msg dns.Msg
+		msg.SetQuestion(qname, dns.TypeA)
+		w := dnstest.NewRecorder(&test.ResponseWriter{RemoteIP: "100.64.0.5"})
+		if _, err := ts.ServeDNS(context.Background(), w, &msg); err != nil {
+			t.Fatalf("%s: unexpected error: %v", qname, err)
+		}
+	}
+	query("test2.example.com.")
+	// The rate of one line per second is exceeded.
+	query("test1.example.com.")
+
+	if n := len(ts.queryLog.lines); n != 1 {
+		t.Fatalf("want one line queued, got %d", n)
+	}
+	var buf bytes.Buffer
+	ts.writeQueryLogLine(context.Background(), json.NewEncoder(&buf), <-ts.queryLog.lines)
+	var got map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatalf("invalid line %q: %v", buf.String(), err)
+	}
+	delete(got, "time")
+	delete(got, "duration_seconds")
+	want := map[string]any{
+		"client":      "100.64.0.5",
+		"client_node": "laptop",
+		"client_user": "alice@example.com",
+		"qname":       "test2.example.com.",
+		"qtype":       "A",
+		"rcode":       "NOERROR",
+		"answers":     float64(4),
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got line %v, want %v", got, want)
+	}
+
+	// The identity of the client honours privacy like query names.
+	ts.privacy = privacyHash
+	buf.Reset()
+	ts.writeQueryLogLine(context.Background(), json.NewEncoder(&buf), queryLogLine{client: netip.MustParseAddr("100.64.0.5")})
+	if strings.Contains(buf.String(), "laptop") || strings.Contains(buf.String(), "alice") {
+		t.Errorf("want the identity of the client hashed, got line %s", buf.String())
+	}
+}
+
+func TestServeDNSNoFallback(t *testing.T) {
+	clog.D.Set()
+	ts := newTS()
+
+	// No match
+	var msg dns.Msg
+	msg.SetQuestion("test3.example.com.", dns.TypeA)
+	resp, err := ts.ServeDNS(context.Background(), dnstest.NewRecorder(&test.ResponseWriter{}), &msg)
+	if err != nil {
+		t.Fatal("unexpected error")
+	}
+	if want, got := dns.RcodeNameError, resp; got != want {
+		t.Fatalf("want response code %d, got %d", want, got)
+	}
+
+	// Match
+	msg.SetQuestion("test1.example.com.", dns.TypeA)
+	w := dnstest.NewRecorder(&test.ResponseWriter{})
+	resp, err = ts.ServeDNS(context.Background(), w, &msg)
+	if want, got := dns.RcodeSuccess, resp; got != want {
+		t.Fatalf("want response code %d, got %d", want, got)
+	}
+	if want, got := net.ParseIP("127.0.0.1"), w.Msg.Answer[0].(*dns.A).A; !got.Equal(want) {
+		t.Errorf("want %s, got: %s", want, got)
+	}
+
+}
+
+func TestServeDNSApex(t *testing.T) {
+	clog.D.Set()
+	ts := newTS()
+
+	var msg dns.Msg
+	msg.SetQuestion("example.com.", dns.TypeA)
+	w := dnstest.NewRecorder(&test.ResponseWriter{})
+	resp, err := ts.ServeDNS(context.Background(), w, &msg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want, got := dns.RcodeSuccess, resp; got != want {
+		t.Fatalf("want response code %d, got %d", want, got)
+	}
+	if want, got := 0, len(w.Msg.Answer); want != got {
+		t.Fatalf("want %d answers, got: %d", want, got)
+	}
+	if !w.Msg.Authoritative {
+		t.Error("expected authoritative answer")
+	}
+}
+
+func TestServeDNSSOA(t *testing.T) {
+	ts := newTS()
+	ts.zone = "example.com."
+	ts.zones = []string{"example.com.", "ts.internal."}
+	ts.negativeTTL = 30
+	ts.load().serial = 1234
+
+	query := func(qname string, qtype uint16) *dns.Msg {
+		var msg dns.Msg
+		msg.SetQuestion(qname, qtype)
+		w := dnstest.NewRecorder(&test.ResponseWriter{})
+		if _, err := ts.ServeDNS(context.Background(), w, &msg); err != nil {
+			t.Fatalf("%s: unexpected error: %v", qname, err)
+		}
+		return w.Msg
+	}
+
+	resp := query("example.com.", dns.TypeSOA)
+	if len(resp.Answer) != 1 {
+		t.Fatalf("want 1 SOA answer, got %d", len(resp.Answer))
+	}
+	soa, ok := resp.Answer[0].(*dns.SOA)
+	if !ok {
+		t.Fatalf("want SOA record, got %s", resp.Answer[0])
+	}
+	testEquals(t, "SOA mname", "coredns.example.com.", soa.Ns)
+	testEquals(t, "SOA mbox", "hostmaster.example.com.", soa.Mbox)
+	testEquals(t, "SOA serial", uint32(1234), soa.Serial)
+	testEquals(t, "SOA minimum", uint32(30), soa.Minttl)
+
+	resp = query("ts.internal.", dns.TypeNS)
+	if len(resp.Answer) != 1 {
+		t.Fatalf("want 1 NS answer, got %d", len(resp.Answer))
+	}
+	if ns, ok := resp.Answer[0].(*dns.NS); !ok || ns.Ns != "coredns.ts.internal." {
+		t.Errorf("want NS coredns.ts.internal., got %s", resp.Answer[0])
+	}
+
+	// Negative answers carry the SOA of the zone of the query in the authority section.
+	for _, qname := range []string{"missing.ts.internal.", "ts.internal."} {
+		resp = query(qname, dns.TypeA)
+		if len(resp.Answer) != 0 || len(resp.Ns) != 1 {
+			t.Fatalf("%s: want no answers and 1 authority record, got %d and %d", qname, len(resp.Answer), len(resp.Ns))
+		}
+		if soa, ok := resp.Ns[0].(*dns.SOA); !ok || soa.Hdr.Name != "ts.internal." || soa.Hdr.Ttl != 30 {
+			t.Errorf("%s: want SOA of ts.internal. with TTL 30, got %s", qname, resp.Ns[0])
+		}
+	}
+
+	ts.ns = []string{"ns1.example.net.", "ns2.example.com."}
+	ts.soaMbox = soaMbox("dns@example.org")
+	resp = query("ts.internal.", dns.TypeSOA)
+	soa = resp.Answer[0].(*dns.SOA)
+	testEquals(t, "SOA mname", "ns1.example.net.", soa.Ns)
+	testEquals(t, "SOA mbox", "dns.example.org.", soa.Mbox)
+	resp = query("ts.internal.", dns.TypeNS)
+	if len(resp.Answer) != 2 || resp.Answer[1].(*dns.NS).Ns != "ns2.ts.internal." {
+		t.Errorf("want configured name servers, got %v", resp.Answer)
+	}
+}
+
+func TestServeDNSNoEntries(t *testing.T) {
+	clog.D.Set()
+	ts := Tailscale{zone: "example.com."}
+
+	testCases := []struct {
+		query string
+		qtype uint16
+		rcode int
+	}{
+		{"example.com.", dns.TypeA, dns.RcodeSuccess},
+		{"example.com.", dns.TypeAAAA, dns.RcodeSuccess},
+		{"example.com.", dns.TypeCNAME, dns.RcodeSuccess},
+		{"test1.example.com.", dns.TypeA, dns.RcodeNameError},
+		{"sub.test1.example.com.", dns.TypeAAAA, dns.RcodeNameError},
+	}
+
+	for _, tc := range testCases {
+		var msg dns.Msg
+		msg.SetQuestion(tc.query, tc.qtype)
+		w := dnstest.NewRecorder(&test.ResponseWriter{})
+		resp, err := ts.ServeDNS(context.Background(), w, &msg)
+		if err != nil {
+			t.Fatalf("%s %s: unexpected error: %v", tc.query, dns.TypeToString[tc.qtype], err)
+		}
+		if resp != tc.rcode || w.Msg.Rcode != tc.rcode {
+			t.Errorf("%s %s: want response code %d, got %d (message %d)", tc.query, dns.TypeToString[tc.qtype], tc.rcode, resp, w.Msg.Rcode)
+		}
+		if len(w.Msg.Answer) != 0 {
+			t.Errorf("%s %s: want no answers, got %d", tc.query, dns.TypeToString[tc.qtype], len(w.Msg.Answer))
+		}
+	}
+}
+
+func TestServeDNSShed(t *testing.T) {
+	clog.D.Set()
+	ts := newTS()
+	ts.maxInflight = 1
+
+	var msg dns.Msg
+	msg.SetQuestion("test1.example.com.", dns.TypeA)
+
+	// Below the limit queries are answered.
+	resp, err := ts.ServeDNS(context.Background(), dnstest.NewRecorder(&test.ResponseWriter{}), &msg)
+	if err != nil || resp != dns.RcodeSuccess {
+		t.Fatalf("want response code %d, got %d (%v)", dns.RcodeSuccess, resp, err)
+	}
+	if got := ts.inflight.Load(); got != 0 {
+		t.Fatalf("want no in-flight queries after answering, got %d", got)
+	}
+
+	// Simulate another query being processed.
+	ts.inflight.Add(1)
+	defer ts.inflight.Add(-1)
+
+	resp, err = ts.ServeDNS(context.Background(), dnstest.NewRecorder(&test.ResponseWriter{}), &msg)
+	if err != nil || resp != dns.RcodeRefused {
+		t.Fatalf("want response code %d, got %d (%v)", dns.RcodeRefused, resp, err)
+	}
+
+	ts.shedFallthrough = true
+	ts.next = test.NextHandler(dns.RcodeBadCookie, nil)
+	resp, _ = ts.ServeDNS(context.Background(), dnstest.NewRecorder(&test.ResponseWriter{}), &msg)
+	if resp != dns.RcodeBadCookie {
+		t.Fatalf("want query to fall through to next plugin, got response code %d", resp)
+	}
+}
+
+// errorWriter is a ResponseWriter whose writes fail with err.
+type errorWriter struct {
+	test.ResponseWriter
+	err error
+}
+
+func (w *errorWriter) WriteMsg(*dns.Msg) error { return w.err }
+
+func TestWriteMsgErrors(t *testing.T) {
+	ts := newTS()
+
+	testCases := []struct {
+		err    error
+		reason string
+	}{
+		{&net.OpError{Op: "write", Err: syscall.EPIPE}, writeErrClientGone},
+		{&net.OpError{Op: "write", Err: syscall.ECONNRESET}, writeErrClientGone},
+		{net.ErrClosed, writeErrClientGone},
+		{&net.OpError{Op: "write", Err: syscall.EMSGSIZE}, writeErrTooLarge},
+		{dns.ErrBuf, writeErrTooLarge},
+		{dns.ErrRdata, writeErrPack},
+		{&net.OpError{Op: "write", Err: os.ErrDeadlineExceeded}, writeErrDeadline},
+		{&net.OpError{Op: "write", Err: syscall.ENETUNREACH}, writeErrNetwork},
+	}
+	for _, tc := range testCases {
+		if got := writeErrorReason(tc.err); got != tc.reason {
+			t.Errorf("writeErrorReason(%v) = %s, want %s", tc.err, got, tc.reason)
+		}
+	}
+
+	var msg dns.Msg
+	msg.SetQuestion("test1.example.com.", dns.TypeA)
+	resp, err := ts.ServeDNS(context.Background(), &errorWriter{err: net.ErrClosed}, &msg)
+	if err == nil || resp != dns.RcodeServerFailure {
+		t.Errorf("want response code %d and error, got %d (%v)", dns.RcodeServerFailure, resp, err)
+	}
+
+	// Responses aren't written once the request deadline has passed.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	w := dnstest.NewRecorder(&test.ResponseWriter{})
+	if _, err := ts.ServeDNS(ctx, w, &msg); !errors.Is(err, context.Canceled) {
+		t.Errorf("want context.Canceled, got %v", err)
+	}
+	if w.Msg != nil {
+		t.Error("response written after request was cancelled")
+	}
+}
+
+func TestServeDNSNSID(t *testing.T) {
+	ts := newTS()
+	ts.nsid = "dns-1"
+
+	testCases := []struct {
+		name  string
+		query string
+		edns  bool
+		nsid  bool
+	}{
+		{"answer", "test1.example.com.", true, true},
+		{"nxdomain", "test3.example.com.", true, true},
+		{"not requested", "test1.example.com.", true, false},
+		{"no edns", "test1.example.com.", false, false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var msg dns.Msg
+			msg.SetQuestion(tc.query, dns.TypeA)
+			if tc.edns {
+				msg.SetEdns0(4096, false)
+				if tc.nsid {
+					msg.IsEdns0().Option = append(msg.IsEdns0().Option, &dns.EDNS0_NSID{Code: dns.EDNS0NSID})
+				}
+			}
+			w := dnstest.NewRecorder(&test.ResponseWriter{})
+			if _, err := ts.ServeDNS(context.Background(), w, &msg); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			var got string
+			if opt := w.Msg.IsEdns0(); opt != nil {
+				for _, o := range opt.Option {
+					if nsid, ok := o.(*dns.EDNS0_NSID); ok {
+						got = nsid.Nsid
+					}
+				}
+			}
+			want := ""
+			if tc.nsid {
+				want = hex.EncodeToString([]byte("dns-1"))
+			}
+			if got != want {
+				t.Errorf("want NSID %q, got %q", want, got)
+			}
+		})
+	}
+}
+
+func TestServeDNSEDNS0(t *testing.T) {
+	ts := newTS()
+	var addrs []string
+	for i := 1; i <= 100; i++ {
+		addrs = append(addrs, "100.64.0."+strconv.Itoa(i))
+	}
+	ts.load().entries["big"] = map[string][]string{"A": addrs}
+	ts.load().addrs = ts.addrIndex(ts.load().entries)
+
+	testCases := []struct {
+		name      string
+		edns      uint16
+		do        bool
+		tcp       bool
+		truncated bool
+	}{
+		{"no edns", 0, false, false, true},
+		{"small buffer", 512, false, false, true},
+		{"below minimum", 100, false, false, true},
+		{"large buffer", 4096, false, false, false},
+		{"do bit", 4096, true, false, false},
+		{"tcp", 0, false, true, false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var msg dns.Msg
+			msg.SetQuestion("big.example.com", dns.TypeA)
+			if tc.edns != 0 {
+				msg.SetEdns0(tc.edns, tc.do)
+			}
+			w := dnstest.NewRecorder(&test.ResponseWriter{TCP: tc.tcp})
+			if _, err := ts.ServeDNS(context.Background(), w, &msg); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if w.Msg.Truncated != tc.truncated {
+				t.Errorf("want truncated %t, got %t", tc.truncated, w.Msg.Truncated)
+			}
+			if tc.truncated == (len(w.Msg.Answer) == len(addrs)) {
+				t.Errorf("want truncated %t, got %d of %d answers", tc.truncated, len(w.Msg.Answer), len(addrs))
+			}
+			size := dns.MinMsgSize
+			if tc.edns != 0 {
+				size = max(int(tc.edns), dns.MinMsgSize)
+			}
+			if n := w.Msg.Len(); !tc.tcp && n > size {
+				t.Errorf("want at most %d bytes, got %d", size, n)
+			}
+
+			opt := w.Msg.IsEdns0()
+			if tc.edns == 0 {
+				if opt != nil {
+					t.Errorf("want no OPT record, got %s", opt)
+				}
+				return
+			}
+			if opt == nil {
+				t.Fatal("want an OPT record, got none")
+			}
+			if got := opt.UDPSize(); int(got) != size {
+				t.Errorf("want UDP size %d, got %d", size, got)
+			}
+			if got := opt.Do(); got != tc.do {
+				t.Errorf("want DO %t, got %t", tc.do, got)
+			}
+		})
+	}
+}
+
+func TestServeDNSPadding(t *testing.T) {
+	testCases := []struct {
+		name      string
+		padding   int
+		encrypted bool
+		requested bool
+		padded    bool
+	}{
+		{"encrypted", DefaultPaddingBlock, true, true, true},
+		{"small block", 128, true, true, true},
+		{"not requested", DefaultPaddingBlock, true, false, false},
+		{"unencrypted", DefaultPaddingBlock, false, true, false},
+		{"disabled", 0, true, true, false},
+	}
+	for _, tc := range testCases {
+		for _, query := range []string{"test1.example.com.", "test2.example.com.", "test3.example.com."} {
+			t.Run(tc.name+" "+query, func(t *testing.T) {
+				ts := newTS()
+				ts.zone = "example.com."
+				ts.load().entries["test2"]["CNAME"] = []string{"test2-1.example.com.", "test2-2.example.com."}
+				ts.padding = tc.padding
+				ts.encrypted = tc.encrypted
+				ts.fall.SetZonesFromArgs([]string{"example.org"})
+
+				var msg dns.Msg
+				msg.SetQuestion(query, dns.TypeA)
+				msg.SetEdns0(4096, false)
+				if tc.requested {
+					msg.IsEdns0().Option = append(msg.IsEdns0().Option, &dns.EDNS0_PADDING{})
+				}
+				w := dnstest.NewRecorder(&test.ResponseWriter{TCP: true})
+				if _, err := ts.ServeDNS(context.Background(), w, &msg); err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+
+				var padded bool
+				for _, o := range w.Msg.IsEdns0().Option {
+					_, ok := o.(*dns.EDNS0_PADDING)
+					padded = padded || ok
+				}
+				if padded != tc.padded {
+					t.Fatalf("want padded %t, got %t", tc.padded, padded)
+				}
+				buf, err := w.Msg.Pack()
+				if err != nil {
+					t.Fatalf("unable to pack response: %v", err)
+				}
+				if tc.padded && len(buf)%tc.padding != 0 {
+					t.Errorf("want a length that is a multiple of %d, got %d", tc.padding, len(buf))
+				}
+			})
+		}
+	}
+}
+
+func TestServeDNSMagicDNS(t *testing.T) {
+	resolver := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		msg := new(dns.Msg)
+		msg.SetReply(r)
+		msg.Answer = append(msg.Answer, test.A(r.Question[0].Name+" 600 IN A 100.64.0.9"))
+		w.WriteMsg(msg)
+	})
+	defer resolver.Close()
+
+	ts := newTS()
+	ts.magicDNS = true
+	ts.magicDNSResolver = resolver.Addr
+	ts.next = plugin.HandlerFunc(func(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
+		return dns.RcodeRefused, nil
+	})
+
+	testCases := []struct {
+		name   string
+		domain string
+		qname  string
+		passed bool
+	}{
+		{"domain unknown", "", "host.tail1234.ts.net.", true},
+		{"domain unknown other tailnet", "", "host.tail5678.ts.net.", true},
+		{"domain known", "tail1234.ts.net.", "Host.Tail1234.ts.net.", true},
+		{"other tailnet", "tail1234.ts.net.", "host.tail5678.ts.net.", false},
+		{"outside ts.net", "", "host.example.org.", false},
+		{"zone", "", "test1.example.com.", false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ts.load().magicDomain = tc.domain
+			var msg dns.Msg
+			msg.SetQuestion(tc.qname, dns.TypeA)
+			msg.Id = 4242
+			w := dnstest.NewRecorder(&test.ResponseWriter{})
+			rcode, err := ts.ServeDNS(context.Background(), w, &msg)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			passed := w.Msg != nil && len(w.Msg.Answer) == 1 && w.Msg.Answer[0].(*dns.A).A.Equal(net.ParseIP("100.64.0.9"))
+			if passed != tc.passed {
+				t.Fatalf("want passed on %t, got %t (rcode %d, response %v)", tc.passed, passed, rcode, w.Msg)
+			}
+			if passed && w.Msg.Id != msg.Id {
+				t.Errorf("want response id %d, got %d", msg.Id, w.Msg.Id)
+			}
+		})
+	}
+
+	// An unreachable resolver is a server failure.
+	resolver.Close()
+	before := testutil.ToFloat64(MagicDNSErrorCount.WithLabelValues(""))
+	ts.load().magicDomain = ""
+	var msg dns.Msg
+	msg.SetQuestion("host.tail1234.ts.net.", dns.TypeA)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	rcode, err := ts.ServeDNS(ctx, dnstest.NewRecorder(&test.ResponseWriter{}), &msg)
+	if err == nil || rcode != dns.RcodeServerFailure {
+		t.Errorf("want SERVFAIL with an error, got %d (err %v)", rcode, err)
+	}
+	if got := testutil.ToFloat64(MagicDNSErrorCount.WithLabelValues("")) - before; got != 1 {
+		t.Errorf("want 1 MagicDNS error, got %v", got)
+	}
+}
+
+func TestServeDNSMagicDNSQueryCase(t *testing.T) {
+	// The resolver answers in lowercase, whatever the case of the query.
+	resolver := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		msg := new(dns.Msg)
+		msg.SetReply(r)
+		qname := strings.ToLower(r.Question[0].Name)
+		msg.Question[0].Name = qname
+		msg.Answer = append(msg.Answer, test.A(qname+" 600 IN A 100.64.0.9"))
+		w.WriteMsg(msg)
+	})
+	defer resolver.Close()
+
+	ts := newTS()
+	ts.magicDNS = true
+	ts.magicDNSResolver = resolver.Addr
+
+	var msg dns.Msg
+	msg.SetQuestion("hOsT.TaIl1234.Ts.NeT.", dns.TypeA)
+	w := dnstest.NewRecorder(&test.ResponseWriter{})
+	if _, err := ts.ServeDNS(context.Background(), w, &msg); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(w.Msg.Question) != 1 || w.Msg.Question[0].Name != msg.Question[0].Name {
+		t.Errorf("want question %s, got %v", msg.Question[0].Name, w.Msg.Question)
+	}
+	if len(w.Msg.Answer) != 1 || w.Msg.Answer[0].Header().Name != msg.Question[0].Name {
+		t.Errorf("want an answer for %s, got %v", msg.Question[0].Name, w.Msg.Answer)
+	}
+}
+
+func TestServeDNSEndpoints(t *testing.T) {
+	ts := newTS()
+	ts.zone = "example.com."
+	ts.endpointLabel = "ext"
+	ts.load().endpoints = map[string]map[string][]string{
+		"test1": {"A": {"198.51.100.7"}, "AAAA": {"2001:db8::7"}},
+		"test3": {"AAAA": {"2001:db8::9"}},
+	}
+	ts.load().endpointAddrs = ts.addrIndex(ts.load().endpoints)
+
+	testCases := []struct {
+		qname   string
+		qtype   uint16
+		rcode   int
+		answers []string
+	}{
+		{"test1.ext.example.com.", dns.TypeA, dns.RcodeSuccess, []string{"198.51.100.7"}},
+		{"TEST1.Ext.example.com.", dns.TypeAAAA, dns.RcodeSuccess, []string{"2001:db8::7"}},
+		{"test3.ext.example.com.", dns.TypeA, dns.RcodeSuccess, nil},
+		{"test3.ext.example.com.", dns.TypeAAAA, dns.RcodeSuccess, []string{"2001:db8::9"}},
+		{"test1.ext.example.com.", dns.TypeTXT, dns.RcodeSuccess, nil},
+		{"ext.example.com.", dns.TypeA, dns.RcodeSuccess, nil},
+		// Nodes without public endpoints aren't in the subzone, even though they exist in the zone.
+		{"test2-1.ext.example.com.", dns.TypeA, dns.RcodeNameError, nil},
+		{"www.test1.ext.example.com.", dns.TypeA, dns.RcodeNameError, nil},
+		// The tailnet addresses are still served in the zone itself.
+		{"test1.example.com.", dns.TypeA, dns.RcodeSuccess, []string{"127.0.0.1"}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.qname+" "+dns.TypeToString[tc.qtype], func(t *testing.T) {
+			var msg dns.Msg
+			msg.SetQuestion(tc.qname, tc.qtype)
+			w := dnstest.NewRecorder(&test.ResponseWriter{})
+			if _, err := ts.ServeDNS(context.Background(), w, &msg); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if w.Msg.Rcode != tc.rcode {
+				t.Errorf("want rcode %s, got %s", dns.RcodeToString[tc.rcode], dns.RcodeToString[w.Msg.Rcode])
+			}
+			var answers []string
+			for _, rr := range w.Msg.Answer {
+				answers = append(answers, rr.String()[len(rr.Header().String()):])
+			}
+			if !reflect.DeepEqual(answers, tc.answers) {
+				t.Errorf("want answers %q, got %q", tc.answers, answers)
+			}
+		})
+	}
+}
+
+func TestServeDNSDNSSEC(t *testing.T) {
+	ts := newTS()
+	ts.zone = "example.com."
+	ts.zones = []string{"example.com."}
+	ts.load().entries["test2"]["CNAME"] = []string{"test2-1.example.com.", "test2-2.example.com."}
+	signer, err := newDNSSECSigner(nil, ts.logName)
+	if err != nil {
+		t.Fatalf("unable to create signer: %v", err)
+	}
+	ts.dnssec = signer
+	key := signer.dnskeys("example.com.", 3600)[0].(*dns.DNSKEY)
+
+	// verify checks that every RRset of rrs in the zone has a valid signature.
+	verify := func(t *testing.T, rrs []dns.RR) {
+		t.Helper()
+		sigs := map[string]*dns.RRSIG{}
+		rrsets := map[string][]dns.RR{}
+		for _, rr := range rrs {
+			if sig, ok := rr.(*dns.RRSIG); ok {
+				sigs[sig.Hdr.Name+dns.TypeToString[sig.TypeCovered]] = sig
+				continue
+			}
+			k := rr.Header().Name + dns.TypeToString[rr.Header().Rrtype]
+			rrsets[k] = append(rrsets[k], rr)
+		}
+		for k, rrset := range rrsets {
+			sig, ok := sigs[k]
+			if !ok {
+				t.Errorf("no signature for %s", k)
+				continue
+			}
+			if err := sig.Verify(key, rrset); err != nil {
+				t.Errorf("invalid signature for %s: %v", k, err)
+			}
+			if !sig.ValidityPeriod(time.Now()) {
+				t.Errorf("signature for %s isn't valid now", k)
+			}
+		}
+	}
+
+	testCases := []struct {
+		name    string
+		qname   string
+		qtype   uint16
+		answers []uint16
+		bitmap  []uint16
+	}{
+		{"answer", "test1.example.com.", dns.TypeA, []uint16{dns.TypeA, dns.TypeRRSIG}, nil},
+		{"cname", "test2.example.com.", dns.TypeA, []uint16{dns.TypeCNAME, dns.TypeA, dns.TypeCNAME, dns.TypeA, dns.TypeRRSIG, dns.TypeRRSIG, dns.TypeRRSIG}, nil},
+		{"dnskey", "example.com.", dns.TypeDNSKEY, []uint16{dns.TypeDNSKEY, dns.TypeRRSIG}, nil},
+		{"nodata", "test1.example.com.", dns.TypeTXT, nil, []uint16{dns.TypeA, dns.TypePTR, dns.TypeAAAA, dns.TypeSRV, dns.TypeRRSIG, dns.TypeNSEC, dns.TypeSVCB, dns.TypeHTTPS}},
+		{"apex nodata", "example.com.", dns.TypeA, nil, []uint16{dns.TypeNS, dns.TypeSOA, dns.TypeRRSIG, dns.TypeNSEC, dns.TypeDNSKEY}},
+		{"nxdomain", "test3.example.com.", dns.TypeA, nil, []uint16{dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNXNAME}},
+		{"nsec", "test3.example.com.", dns.TypeNSEC, []uint16{dns.TypeNSEC, dns.TypeRRSIG}, nil},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var msg dns.Msg
+			msg.SetQuestion(tc.qname, tc.qtype)
+			msg.SetEdns0(4096, true)
+			w := dnstest.NewRecorder(&test.ResponseWriter{})
+			if _, err := ts.ServeDNS(context.Background(), w, &msg); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if w.Msg.Rcode != dns.RcodeSuccess {
+				t.Errorf("want NOERROR, got %s", dns.RcodeToString[w.Msg.Rcode])
+			}
+
+			var types []uint16
+			for _, rr := range w.Msg.Answer {
+				types = append(types, rr.Header().Rrtype)
+			}
+			if !reflect.DeepEqual(types, tc.answers) {
+				t.Errorf("want answers of types %v, got %v", tc.answers, w.Msg.Answer)
+			}
+			verify(t, w.Msg.Answer)
+			verify(t, w.Msg.Ns)
+
+			if tc.bitmap == nil {
+				return
+			}
+			var nsec *dns.NSEC
+			for _, rr := range w.Msg.Ns {
+				if rr, ok := rr.(*dns.NSEC); ok {
+					nsec = rr
+				}
+			}
+			if nsec == nil {
+				t.Fatalf("want an NSEC record, got %v", w.Msg.Ns)
+			}
+			if nsec.Hdr.Name != tc.qname || nsec.NextDomain != `\000.`+tc.qname {
+				t.Errorf("want an NSEC record covering only %s, got %s", tc.qname, nsec)
+			}
+			if !reflect.DeepEqual(nsec.TypeBitMap, tc.bitmap) {
+				t.Errorf("want types %v, got %v", tc.bitmap, nsec.TypeBitMap)
+			}
+		})
+	}
+
+	// Clients that don't set the DO bit get unsigned answers.
+	var msg dns.Msg
+	msg.SetQuestion("test3.example.com.", dns.TypeA)
+	w := dnstest.NewRecorder(&test.ResponseWriter{})
+	if _, err := ts.ServeDNS(context.Background(), w, &msg); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if w.Msg.Rcode != dns.RcodeNameError || len(w.Msg.Ns) != 1 {
+		t.Errorf("want an unsigned NXDOMAIN response, got %v", w.Msg)
+	}
+}
+
+func TestLoadDNSSECKey(t *testing.T) {
+	generated, err := generateDNSSECKey()
+	if err != nil {
+		t.Fatalf("unable to generate key: %v", err)
+	}
+	generated.key.Hdr.Name = "example.com."
+	base := filepath.Join(t.TempDir(), fmt.Sprintf("Kexample.com.+%03d+%05d", generated.key.Algorithm, generated.tag))
+	if err := os.WriteFile(base+".key", []byte(generated.key.String()+"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(base+".private", []byte(generated.key.PrivateKeyString(generated.signer)), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{base, base + ".key", base + ".private"} {
+		k, err := loadDNSSECKey(path)
+		if err != nil {
+			t.Fatalf("%s: unable to load key: %v", path, err)
+		}
+		if k.tag != generated.tag || k.key.PublicKey != generated.key.PublicKey {
+			t.Errorf("%s: want key %d, got %d", path, generated.tag, k.tag)
+		}
+	}
+	if _, err := loadDNSSECKey(filepath.Join(t.TempDir(), "Kmissing")); err == nil {
+		t.Error("want an error for a missing key, got none")
+	}
+}
+
+func TestServeDNSCookies(t *testing.T) {
+	ts := newTS()
+	ts.cookieSecret = []byte("0123456789abcdef")
+
+	query := func(cookie string, tcp bool) (int, *dns.Msg) {
+		var msg dns.Msg
+		msg.SetQuestion("test1.example.com.", dns.TypeA)
+		msg.SetEdns0(4096, false)
+		msg.IsEdns0().Option = append(msg.IsEdns0().Option, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: cookie})
+		w := dnstest.NewRecorder(&test.ResponseWriter{TCP: tcp})
+		rcode, err := ts.ServeDNS(context.Background(), w, &msg)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return rcode, w.Msg
+	}
+	responseCookie := func(msg *dns.Msg) string {
+		if msg == nil || msg.IsEdns0() == nil {
+			return ""
+		}
+		for _, o := range msg.IsEdns0().Option {
+			if c, ok := o.(*dns.EDNS0_COOKIE); ok {
+				return c.Cookie
+			}
+		}
+		return ""
+	}
+
+	client := "0102030405060708"
+
+	// A client cookie alone is answered, and a server cookie issued.
+	rcode, resp := query(client, false)
+	if rcode != dns.RcodeSuccess || len(resp.Answer) != 1 {
+		t.Fatalf("want answer for client cookie, got rcode %d", rcode)
+	}
+	cookie := responseCookie(resp)
+	if len(cookie) != 2*(clientCookieLen+serverCookieLen) || !strings.HasPrefix(cookie, client) {
+		t.Fatalf("want client cookie echoed with server cookie, got %q", cookie)
+	}
+
+	// The issued server cookie is accepted.
+	if rcode, resp = query(cookie, false); rcode != dns.RcodeSuccess || len(resp.Answer) != 1 {
+		t.Fatalf("want answer for valid server cookie, got rcode %d", rcode)
+	}
+
+	// A forged server cookie is rejected over UDP, with a fresh cookie to retry with.
+	forged := client + "01000000" + "00000000" + "0000000000000000"
+	rcode, resp = query(forged, false)
+	if rcode != dns.RcodeBadCookie || resp.Rcode != dns.RcodeBadCookie || len(resp.Answer) != 0 {
+		t.Fatalf("want BADCOOKIE for forged server cookie, got rcode %d", rcode)
+	}
+	if got := responseCookie(resp); got == "" || got == forged {
+		t.Errorf("want fresh server cookie with BADCOOKIE, got %q", got)
+	}
+	if _, err := resp.Pack(); err != nil {
+		t.Errorf("BADCOOKIE response doesn't pack: %v", err)
+	}
+
+	// TCP can't be spoofed off-path, so the server cookie isn't checked.
+	if rcode, _ = query(forged, true); rcode != dns.RcodeSuccess {
+		t.Errorf("want answer over TCP, got rcode %d", rcode)
+	}
+
+	// Malformed cookies are a format error.
+	if rcode, _ = query("0102030405", false); rcode != dns.RcodeFormatError {
+		t.Errorf("want FORMERR for malformed cookie, got rcode %d", rcode)
+	}
+}
+
+func TestServeDNSRebindProtection(t *testing.T) {
+	ts := newTS()
+	ts.rebindProtection = true
+
+	query := func(remote string, qname string, qtype uint16) (int, *dns.Msg) {
+		var msg dns.Msg
+		msg.SetQuestion(qname, qtype)
+		w := dnstest.NewRecorder(&test.ResponseWriter{RemoteIP: remote})
+		rcode, err := ts.ServeDNS(context.Background(), w, &msg)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return rcode, w.Msg
+	}
+
+	// Clients outside the tailnet get NODATA instead of internal addresses.
+	rcode, resp := query("203.0.113.1", "test1.example.com.", dns.TypeA)
+	if rcode != dns.RcodeSuccess || resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 0 {
+		t.Errorf("external client: want NODATA, got rcode %d with %d answers", rcode, len(resp.Answer))
+	}
+
+	// CNAMEs are still answered, only the addresses are removed.
+	_, resp = query("203.0.113.1", "test2.example.com.", dns.TypeA)
+	for _, rr := range resp.Answer {
+		if _, ok := rr.(*dns.CNAME); !ok {
+			t.Errorf("external client: unexpected record %s", rr)
+		}
+	}
+
+	// Clients inside the tailnet get the full answer.
+	for _, remote := range []string{"100.64.0.5", "fd7a:115c:a1e0::5", "127.0.0.1"} {
+		if _, resp = query(remote, "test1.example.com.", dns.TypeA); len(resp.Answer) != 1 {
+			t.Errorf("tailnet client %s: want 1 answer, got %d", remote, len(resp.Answer))
+		}
+	}
+
+	ts.rebindAllow = []netip.Prefix{netip.MustParsePrefix("203.0.113.0/24")}
+	if _, resp = query("203.0.113.1", "test1.example.com.", dns.TypeA); len(resp.Answer) != 1 {
+		t.Errorf("allowed client: want 1 answer, got %d", len(resp.Answer))
+	}
+
+	// The rebind marker is only published when enabled.
+	if rcode, _ = query("203.0.113.1", "_dns-rebind-ok.example.com.", dns.TypeTXT); rcode != dns.RcodeNameError {
+		t.Errorf("marker disabled: want NXDOMAIN, got rcode %d", rcode)
+	}
+	ts.rebindMarker = true
+	rcode, resp = query("203.0.113.1", "_dns-rebind-ok.example.com.", dns.TypeTXT)
+	if rcode != dns.RcodeSuccess || len(resp.Answer) != 1 {
+		t.Fatalf("marker enabled: want TXT answer, got rcode %d", rcode)
+	}
+	if _, ok := resp.Answer[0].(*dns.TXT); !ok {
+		t.Errorf("marker enabled: want TXT record, got %s", resp.Answer[0])
+	}
+}
+
+func TestServeDNSViews(t *testing.T) {
+	node := func(id tailcfg.NodeID, name, addr string, user tailcfg.UserID, tags ...string) tailcfg.NodeView {
+		return (&tailcfg.Node{
+			ID:           id,
+			ComputedName: name,
+			Addresses:    []netip.Prefix{netip.MustParsePrefix(addr + "/32")},
+			User:         user,
+			Tags:         tags,
+		}).View()
+	}
+	tn := &Tailnet{
+		Peers: []tailcfg.NodeView{
+			node(1, "web", "100.64.0.1", 0, "tag:web"),
+			node(2, "db", "100.64.0.2", 0, "tag:db"),
+			node(3, "laptop", "100.64.0.3", 1),
+			node(4, "runner", "100.64.0.4", 0, "tag:ci"),
+			node(5, "phone", "100.64.0.5", 2),
+		},
+		UserProfiles: map[tailcfg.UserID]tailcfg.UserProfile{
+			1: {ID: 1, LoginName: "alice@example.com"},
+			2: {ID: 2, LoginName: "bob@example.com"},
+		},
+	}
+	ts := &Tailscale{
+		zone:   "example.com.",
+		static: map[string]map[string][]string{"www": {"CNAME": {"web.example.com."}}, "docs": {"A": {"192.0.2.1"}}},
+		views: []View{
+			{Name: "ci", Show: []string{"tag:web", "self"}},
+			{Name: "eng", Clients: []string{"alice@example.com"}, Show: []string{"*"}},
+			{Name: "guests", Clients: []string{"*"}, Show: []string{"web"}},
+		},
+		viewCapability: DefaultViewCapability,
+	}
+	ts.ready.Store(true)
+	ts.processTailnet(tn)
+	lanExpires := time.Now().Add(time.Hour)
+	ts.lan.set("web", []netip.Addr{netip.MustParseAddr("192.168.1.1")}, time.Now(), lanExpires)
+	ts.lan.set("db", []netip.Addr{netip.MustParseAddr("192.168.1.2")}, time.Now(), lanExpires)
+
+	ts.whoIsFunc = func(ctx context.Context, remoteAddr string) (*apitype.WhoIsResponse, error) {
+		switch remoteAddr {
+		case "100.64.0.3":
+			return &apitype.WhoIsResponse{Node: &tailcfg.Node{ComputedName: "laptop"}, UserProfile: &tailcfg.UserProfile{LoginName: "alice@example.com"}}, nil
+		case "100.64.0.4":
+			return &apitype.WhoIsResponse{Node: &tailcfg.Node{ComputedName: "runner", Tags: []string{"tag:ci"}}}, nil
+		case "100.64.0.5":
+			return &apitype.WhoIsResponse{
+				Node:        &tailcfg.Node{ComputedName: "phone"},
+				UserProfile: &tailcfg.UserProfile{LoginName: "bob@example.com"},
+				CapMap: tailcfg.PeerCapMap{
+					DefaultViewCapability: {`{"show": ["tag:db"]}`, `{"show": ["self"]}`},
+				},
+			}, nil
+		}
+		return nil, errors.New("no such node")
+	}
+
+	tests := []struct {
+		name   string
+		client string
+		qname  string
+		qtype  uint16
+		rcode  int
+		answer int
+	}{
+		{"view shows tag", "100.64.0.4", "web.example.com.", dns.TypeA, dns.RcodeSuccess, 1},
+		{"view shows self", "100.64.0.4", "runner.example.com.", dns.TypeA, dns.RcodeSuccess, 1},
+		{"view hides machine", "100.64.0.4", "db.example.com.", dns.TypeA, dns.RcodeNameError, 0},
+		{"view hides names below machine", "100.64.0.4", "x.db.example.com.", dns.TypeA, dns.RcodeNameError, 0},
+		{"view hides reverse", "100.64.0.4", "2.0.64.100.in-addr.arpa.", dns.TypePTR, dns.RcodeNameError, 0},
+		{"view shows reverse", "100.64.0.4", "1.0.64.100.in-addr.arpa.", dns.TypePTR, dns.RcodeSuccess, 1},
+		{"view shows LAN addresses", "100.64.0.4", "lan.web.example.com.", dns.TypeA, dns.RcodeSuccess, 1},
+		{"view hides LAN addresses", "100.64.0.4", "lan.db.example.com.", dns.TypeA, dns.RcodeNameError, 0},
+		{"static records visible", "100.64.0.4", "docs.example.com.", dns.TypeA, dns.RcodeSuccess, 1},
+		{"user view", "100.64.0.3", "db.example.com.", dns.TypeA, dns.RcodeSuccess, 1},
+		{"grant shows tag", "100.64.0.5", "db.example.com.", dns.TypeA, dns.RcodeSuccess, 1},
+		{"grant shows self", "100.64.0.5", "phone.example.com.", dns.TypeA, dns.RcodeSuccess, 1},
+		{"grant takes precedence", "100.64.0.5", "web.example.com.", dns.TypeA, dns.RcodeNameError, 0},
+		{"grant hides CNAME target", "100.64.0.5", "www.example.com.", dns.TypeA, dns.RcodeSuccess, 0},
+		{"unknown client", "100.64.0.9", "web.example.com.", dns.TypeA, dns.RcodeSuccess, 1},
+		{"outside client", "192.0.2.7", "laptop.example.com.", dns.TypeA, dns.RcodeNameError, 0},
+		{"outside client CNAME", "192.0.2.7", "www.example.com.", dns.TypeA, dns.RcodeSuccess, 2},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var msg dns.Msg
+			msg.SetQuestion(tc.qname, tc.qtype)
+			w := dnstest.NewRecorder(&test.ResponseWriter{RemoteIP: tc.client})
+			rcode, err := ts.ServeDNS(context.Background(), w, &msg)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if rcode != tc.rcode || len(w.Msg.Answer) != tc.answer {
+				t.Errorf("want rcode %d with %d answers, got %d with %v", tc.rcode, tc.answer, rcode, w.Msg.Answer)
+			}
+		})
+	}
+
+	// Identities are cached, until the records change.
+	ts.whoIsFunc = func(ctx context.Context, remoteAddr string) (*apitype.WhoIsResponse, error) {
+		return nil, errors.New("no such node")
+	}
+	if who, err := ts.identify(context.Background(), netip.MustParseAddr("100.64.0.4")); err != nil || who.Node.ComputedName != "runner" {
+		t.Errorf("want the cached identity of runner, got %v (err %v)", who, err)
+	}
+	tn.Peers = tn.Peers[:4]
+	ts.processTailnet(tn)
+	if _, err := ts.identify(context.Background(), netip.MustParseAddr("100.64.0.4")); err == nil {
+		t.Error("want the identity of runner looked up again after the records changed")
+	}
+}
+
+func TestServeDNSFilterAAAA(t *testing.T) {
+	ts := newTS()
+	ts.filterAAAA = []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")}
+	ts.filterAAAATags = []string{"tag:legacy"}
+	ts.whoIsFunc = func(ctx context.Context, remoteAddr string) (*apitype.WhoIsResponse, error) {
+		if remoteAddr == "100.64.0.5" {
+			return &apitype.WhoIsResponse{Node: &tailcfg.Node{Tags: []string{"tag:legacy"}}}, nil
+		}
+		return &apitype.WhoIsResponse{Node: &tailcfg.Node{}}, nil
+	}
+
+	query := func(remote string, qtype uint16) (int, *dns.Msg) {
+		var msg dns.Msg
+		msg.SetQuestion("test1.example.com", qtype)
+		w := dnstest.NewRecorder(&test.ResponseWriter{RemoteIP: remote})
+		rcode, err := ts.ServeDNS(context.Background(), w, &msg)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return rcode, w.Msg
+	}
+
+	// Filtered clients, by range or tag, get NODATA for AAAA queries, and A records as usual.
+	for _, remote := range []string{"192.0.2.10", "100.64.0.5"} {
+		rcode, resp := query(remote, dns.TypeAAAA)
+		if rcode != dns.RcodeSuccess || len(resp.Answer) != 0 {
+			t.Errorf("%s: want NODATA for AAAA, got rcode %d with answers %v", remote, rcode, resp.Answer)
+		}
+		if _, resp = query(remote, dns.TypeA); len(resp.Answer) != 1 {
+			t.Errorf("%s: want the A record, got %v", remote, resp.Answer)
+		}
+	}
+	for _, remote := range []string{"198.51.100.1", "100.64.0.6"} {
+		if _, resp := query(remote, dns.TypeAAAA); len(resp.Answer) != 1 {
+			t.Errorf("%s: want the AAAA record, got %v", remote, resp.Answer)
+		}
+	}
+}
+
+func TestServeDNSAnswerHooks(t *testing.T) {
+	RegisterAnswerHook("test-ttl", func(ctx context.Context, state request.Request, msg *dns.Msg) error {
+		for _, rr := range msg.Answer {
+			rr.Header().Ttl = 1
+		}
+		return nil
+	})
+	RegisterAnswerHook("test-fail", func(ctx context.Context, state request.Request, msg *dns.Msg) error {
+		if strings.HasPrefix(state.Name(), "test2") {
+			return errors.New("refused by policy")
+		}
+		return nil
+	})
+	defer func() {
+		if recover() == nil {
+			t.Error("want a panic registering an answer hook twice")
+		}
+	}()
+
+	ts := newTS()
+	var err error
+	if ts.answerHooks, err = lookupAnswerHooks([]string{"test-ttl", "test-fail"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := lookupAnswerHooks([]string{"test-missing"}); err == nil {
+		t.Error("want an error for an unknown answer hook")
+	}
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("test1.example.com", dns.TypeA)
+	w := dnstest.NewRecorder(&test.ResponseWriter{})
+	if rcode, err := ts.ServeDNS(context.Background(), w, msg); err != nil || rcode != dns.RcodeSuccess {
+		t.Fatalf("want rcode %d, got %d (err %v)", dns.RcodeSuccess, rcode, err)
+	}
+	if len(w.Msg.Answer) != 1 || w.Msg.Answer[0].Header().Ttl != 1 {
+		t.Errorf("want the answer changed by the hook, got %v", w.Msg.Answer)
+	}
+
+	// Failing hooks fail the query, leaving the SERVFAIL response to the server.
+	msg.SetQuestion("test2-1.example.com", dns.TypeA)
+	w = dnstest.NewRecorder(&test.ResponseWriter{})
+	if rcode, err := ts.ServeDNS(context.Background(), w, msg); err == nil || rcode != dns.RcodeServerFailure {
+		t.Errorf("want SERVFAIL with an error, got %d (err %v)", rcode, err)
+	}
+	if w.Msg != nil {
+		t.Errorf("want no response written, got %v", w.Msg)
+	}
+
+	RegisterAnswerHook("test-ttl", func(context.Context, request.Request, *dns.Msg) error { return nil })
+}
+
+func TestStripAAAA(t *testing.T) {
+	msg := &dns.Msg{
+		Answer: []dns.RR{
+			test.AAAA("a.example.com. 60 IN AAAA fd7a:115c:a1e0::1"),
+			test.A("a.example.com. 60 IN A 100.64.0.1"),
+			&dns.HTTPS{SVCB: dns.SVCB{
+				Hdr:    dns.RR_Header{Name: "a.example.com.", Rrtype: dns.TypeHTTPS, Class: dns.ClassINET, Ttl: 60},
+				Target: ".",
+				Value: []dns.SVCBKeyValue{
+					&dns.SVCBIPv4Hint{Hint: []net.IP{net.ParseIP("100.64.0.1")}},
+					&dns.SVCBIPv6Hint{Hint: []net.IP{net.ParseIP("fd7a:115c:a1e0::1")}},
+				},
+			}},
+		},
+		Extra: []dns.RR{test.AAAA("ns.example.com. 60 IN AAAA fd7a:115c:a1e0::2")},
+	}
+	if n := stripAAAA(msg); n != 2 {
+		t.Errorf("want 2 records removed, got %d", n)
+	}
+	if len(msg.Answer) != 2 || len(msg.Extra) != 0 {
+		t.Fatalf("want the A and HTTPS records left, got %v and %v", msg.Answer, msg.Extra)
+	}
+	if https := msg.Answer[1].(*dns.HTTPS); len(https.Value) != 1 || https.Value[0].Key() != dns.SVCB_IPV4HINT {
+		t.Errorf("want only the IPv4 hint left, got %s", https)
+	}
+}
+
+func TestPreferAAAA(t *testing.T) {
+	rrs := []dns.RR{
+		test.CNAME("www.example.com. 60 IN CNAME a.example.com."),
+		test.A("a.example.com. 60 IN A 100.64.0.1"),
+		test.A("a.example.com. 60 IN A 100.64.0.2"),
+		test.AAAA("a.example.com. 60 IN AAAA fd7a:115c:a1e0::1"),
+		test.CNAME("www.example.com. 60 IN CNAME b.example.com."),
+		test.A("b.example.com. 60 IN A 100.64.0.3"),
+		test.AAAA("b.example.com. 60 IN AAAA fd7a:115c:a1e0::3"),
+	}
+	preferAAAA(rrs)
+	var got []string
+	for _, rr := range rrs {
+		got = append(got, rr.Header().Name+" "+dns.TypeToString[rr.Header().Rrtype])
+	}
+	want := []string{
+		"www.example.com. CNAME", "a.example.com. AAAA", "a.example.com. A", "a.example.com. A",
+		"www.example.com. CNAME", "b.example.com. AAAA", "b.example.com. A",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("want %v, got %v", want, got)
+	}
+	if a := rrs[2].(*dns.A); a.A.String() != "100.64.0.1" {
+		t.Errorf("want the order of the A records kept, got %v", rrs)
+	}
+
+	ts := newTS()
+	ts.preferIPv6 = true
+	ts.anyPolicy = anyAll
+	msg := new(dns.Msg)
+	msg.SetQuestion("test1.example.com", dns.TypeANY)
+	w := dnstest.NewRecorder(&test.ResponseWriter{})
+	if _, err := ts.ServeDNS(context.Background(), w, msg); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(w.Msg.Answer) != 2 || w.Msg.Answer[0].Header().Rrtype != dns.TypeAAAA {
+		t.Errorf("want the AAAA record first, got %v", w.Msg.Answer)
+	}
+}
+
+func TestServeDNSNoData(t *testing.T) {
+	ts := newTS()
+	ts.wildcard = wildcardOn
+	ts.load().entries["test4"] = map[string][]string{"A": {"100.64.0.4"}}
+	ts.load().addrs = ts.addrIndex(ts.load().entries)
+
+	testCases := []struct {
+		query  string
+		qtype  uint16
+		rcode  int
+		answer int
+	}{
+		{"test4.example.com.", dns.TypeA, dns.RcodeSuccess, 1},
+		{"test4.example.com.", dns.TypeAAAA, dns.RcodeSuccess, 0},
+		{"test4.example.com.", dns.TypeTXT, dns.RcodeSuccess, 0},
+		{"test4.example.com.", dns.TypeMX, dns.RcodeSuccess, 0},
+		{"sub.test4.example.com.", dns.TypeAAAA, dns.RcodeSuccess, 0},
+		{"test1.example.com.", dns.TypeCNAME, dns.RcodeSuccess, 0},
+		{"test5.example.com.", dns.TypeAAAA, dns.RcodeNameError, 0},
+		{"test5.example.com.", dns.TypeMX, dns.RcodeNameError, 0},
+	}
+
+	for _, tc := range testCases {
+		var msg dns.Msg
+		msg.SetQuestion(tc.query, tc.qtype)
+		w := dnstest.NewRecorder(&test.ResponseWriter{})
+		rcode, err := ts.ServeDNS(context.Background(), w, &msg)
+		if err != nil {
+			t.Fatalf("%s %s: unexpected error: %v", tc.query, dns.TypeToString[tc.qtype], err)
+		}
+		if rcode != tc.rcode || w.Msg.Rcode != tc.rcode {
+			t.Errorf("%s %s: want response code %d, got %d (message %d)", tc.query, dns.TypeToString[tc.qtype], tc.rcode, rcode, w.Msg.Rcode)
+		}
+		if len(w.Msg.Answer) != tc.answer {
+			t.Errorf("%s %s: want %d answers, got %d", tc.query, dns.TypeToString[tc.qtype], tc.answer, len(w.Msg.Answer))
+		}
+		if tc.answer == 0 && len(w.Msg.Ns) != 1 {
+			t.Errorf("%s %s: want SOA in authority section, got %v", tc.query, dns.TypeToString[tc.qtype], w.Msg.Ns)
+		}
+	}
+}
+
+func TestServeDNSQueryCase(t *testing.T) {
+	ts := newTS()
+	ts.wildcard = wildcardOn
+	ts.load().entries["web"] = map[string][]string{"CNAME": {"TEST1.example.com"}}
+
+	tests := []struct {
+		qname string
+		qtype uint16
+		want  []string
+	}{
+		{"TeSt1.ExAmPlE.CoM", dns.TypeA, []string{"TeSt1.ExAmPlE.CoM A"}},
+		{"x.TEST1.example.com", dns.TypeAAAA, []string{"x.TEST1.example.com AAAA"}},
+		{"Test2.example.com", dns.TypeA, []string{"Test2.example.com CNAME", "test2-1.example.com A", "Test2.example.com CNAME", "test2-2.example.com A"}},
+		{"WEB.example.com", dns.TypeA, []string{"WEB.example.com CNAME", "TEST1.example.com A"}},
+	}
+	for _, tc := range tests {
+		msg := new(dns.Msg)
+		msg.SetQuestion(tc.qname, tc.qtype)
+		w := dnstest.NewRecorder(&test.ResponseWriter{})
+		if rcode, err := ts.ServeDNS(context.Background(), w, msg); err != nil || rcode != dns.RcodeSuccess {
+			t.Errorf("%s: want rcode %d, got %d (err %v)", tc.qname, dns.RcodeSuccess, rcode, err)
+			continue
+		}
+		var got []string
+		for _, rr := range w.Msg.Answer {
+			got = append(got, rr.Header().Name+" "+dns.TypeToString[rr.Header().Rrtype])
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: want answers %v, got %v", tc.qname, tc.want, got)
+		}
+	}
+
+	// Negative answers carry the SOA record of the zone, whose case isn't the query's.
+	ts.zone = "example.com."
+	msg := new(dns.Msg)
+	msg.SetQuestion("MISSING.example.com.", dns.TypeA)
+	w := dnstest.NewRecorder(&test.ResponseWriter{})
+	if rcode, _ := ts.ServeDNS(context.Background(), w, msg); rcode != dns.RcodeNameError || len(w.Msg.Ns) != 1 || w.Msg.Ns[0].Header().Name != "example.com." {
+		t.Errorf("want NXDOMAIN with the SOA record of example.com., got rcode %d and %v", rcode, w.Msg.Ns)
+	}
+	msg.SetQuestion("ExAmPlE.CoM.", dns.TypeSOA)
+	w = dnstest.NewRecorder(&test.ResponseWriter{})
+	if rcode, _ := ts.ServeDNS(context.Background(), w, msg); rcode != dns.RcodeSuccess || len(w.Msg.Answer) != 1 || w.Msg.Answer[0].Header().Name != "ExAmPlE.CoM." {
+		t.Errorf("want the SOA record of ExAmPlE.CoM., got rcode %d and %v", rcode, w.Msg.Answer)
+	}
+}
+
+func TestServeDNSExternalCNAME(t *testing.T) {
+	ts := newTS()
+	ts.load().entries["www"] = map[string][]string{"CNAME": {"www.example.org."}}
+	ts.load().entries["example"] = map[string][]string{"A": {"127.0.0.2"}}
+	ts.load().addrs = ts.addrIndex(ts.load().entries)
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("www.example.com", dns.TypeA)
+	w := dnstest.NewRecorder(&test.ResponseWriter{})
+	if _, err := ts.ServeDNS(context.Background(), w, msg); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// The target is outside the zone, so it isn't resolved, even though a host shares its label.
+	if len(w.Msg.Answer) != 1 {
+		t.Fatalf("want only the CNAME, got %v", w.Msg.Answer)
+	}
+	if cname, ok := w.Msg.Answer[0].(*dns.CNAME); !ok || cname.Target != "www.example.org." {
+		t.Errorf("want CNAME to www.example.org., got %s", w.Msg.Answer[0])
+	}
+}
+
+// fakeUpstream answers upstream lookups with lookup, recording the names and types looked up.
+type fakeUpstream struct {
+	lookups []string
+	lookup  func(ctx context.Context, state request.Request, name string, typ uint16) (*dns.Msg, error)
+}
+
+func (u *fakeUpstream) Lookup(ctx context.Context, state request.Request, name string, typ uint16) (*dns.Msg, error) {
+	u.lookups = append(u.lookups, name+" "+dns.TypeToString[typ])
+	return u.lookup(ctx, state, name, typ)
+}
+
+func TestServeDNSUpstreamCNAME(t *testing.T) {
+	ts := newTS()
+	ts.load().entries["www"] = map[string][]string{"CNAME": {"www.example.org."}}
+	ts.load().entries["broken"] = map[string][]string{"CNAME": {"broken.example.org."}}
+	u := &fakeUpstream{lookup: func(ctx context.Context, state request.Request, name string, typ uint16) (*dns.Msg, error) {
+		if name == "broken.example.org." {
+			return nil, errors.New("no full server is running")
+		}
+		resp := new(dns.Msg)
+		resp.SetQuestion(name, typ)
+		if typ == dns.TypeA {
+			resp.Answer = append(resp.Answer, test.A(name+" 300 IN A 192.0.2.1"))
+		}
+		return resp, nil
+	}}
+	ts.upstream = u
+
+	tests := []struct {
+		qname   string
+		qtype   uint16
+		answers []string
+	}{
+		{"www.example.com", dns.TypeA, []string{"www.example.org.", "192.0.2.1"}},
+		{"www.example.com", dns.TypeAAAA, []string{"www.example.org."}},
+		{"www.example.com", dns.TypeCNAME, []string{"www.example.org."}},
+		{"broken.example.com", dns.TypeA, []string{"broken.example.org."}},
+	}
+	for _, tc := range tests {
+		msg := new(dns.Msg)
+		msg.SetQuestion(tc.qname, tc.qtype)
+		w := dnstest.NewRecorder(&test.ResponseWriter{})
+		if _, err := ts.ServeDNS(context.Background(), w, msg); err != nil {
+			t.Errorf("%s %s: unexpected error: %v", tc.qname, dns.TypeToString[tc.qtype], err)
+			continue
+		}
+		var answers []string
+		for _, rr := range w.Msg.Answer {
+			answers = append(answers, strings.Fields(rr.String())[4])
+		}
+		if !reflect.DeepEqual(answers, tc.answers) {
+			t.Errorf("%s %s: want answers %v, got %v", tc.qname, dns.TypeToString[tc.qtype], tc.answers, w.Msg.Answer)
+		}
+	}
+	// CNAME queries aren't followed.
+	want := []string{"www.example.org. A", "www.example.org. AAAA", "broken.example.org. A"}
+	if !reflect.DeepEqual(u.lookups, want) {
+		t.Errorf("want upstream lookups %v, got %v", want, u.lookups)
+	}
+
+	// Records pointing back to the zone through other plugins share the budget of the query.
+	ts.load().entries["ping"] = map[string][]string{"CNAME": {"pong.example.org."}}
+	ts.maxLookups = 20
+	u.lookups = nil
+	u.lookup = func(ctx context.Context, state request.Request, name string, typ uint16) (*dns.Msg, error) {
+		msg := new(dns.Msg)
+		msg.SetQuestion("ping.example.com", typ)
+		w := dnstest.NewRecorder(&test.ResponseWriter{})
+		_, err := ts.ServeDNS(ctx, w, msg)
+		return w.Msg, err
+	}
+	msg := new(dns.Msg)
+	msg.SetQuestion("ping.example.com", dns.TypeA)
+	if _, err := ts.ServeDNS(context.Background(), dnstest.NewRecorder(&test.ResponseWriter{}), msg); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(u.lookups) == 0 || len(u.lookups) > 10 {
+		t.Errorf("want the loop through upstream cut off by the budget, got %d lookups", len(u.lookups))
+	}
+}
+
+func TestServeDNSCancelled(t *testing.T) {
+	ts := newTS()
+	ts.load().entries["multi"] = map[string][]string{"CNAME": {"a.example.org.", "b.example.org."}}
+	ctx, cancel := context.WithCancel(context.Background())
+	u := &fakeUpstream{lookup: func(context.Context, request.Request, string, uint16) (*dns.Msg, error) {
+		// The client gives up while the first target is looked up.
+		cancel()
+		return nil, context.Canceled
+	}}
+	ts.upstream = u
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("multi.example.com", dns.TypeA)
+	w := dnstest.NewRecorder(&test.ResponseWriter{})
+	if rcode, err := ts.ServeDNS(ctx, w, msg); !errors.Is(err, context.Canceled) || rcode != dns.RcodeServerFailure {
+		t.Errorf("want SERVFAIL with context.Canceled, got %d (err %v)", rcode, err)
+	}
+	if want := []string{"a.example.org. A"}; !reflect.DeepEqual(u.lookups, want) {
+		t.Errorf("want lookups %v, got %v", want, u.lookups)
+	}
+	if w.Msg != nil {
+		t.Errorf("want no response written, got %v", w.Msg)
+	}
+
+	// Queries cancelled before they're served aren't resolved at all.
+	msg.SetQuestion("test2.example.com", dns.TypeA)
+	w = dnstest.NewRecorder(&test.ResponseWriter{})
+	if rcode, err := ts.ServeDNS(ctx, w, msg); !errors.Is(err, context.Canceled) || rcode != dns.RcodeServerFailure || w.Msg != nil {
+		t.Errorf("want SERVFAIL with context.Canceled and no response, got %d (err %v) and %v", rcode, err, w.Msg)
+	}
+
+	// CNAME hops stop once the context is done.
+	var answer dns.Msg
+	ts.resolveA(withResolution(ctx, DefaultMaxLookups), ts.load(), "test2.example.com", &answer)
+	if len(answer.Answer) != 0 {
+		t.Errorf("want no records resolved with a cancelled context, got %v", answer.Answer)
+	}
+}
+
+func TestServeDNSSubzones(t *testing.T) {
+	ts := newTS()
+	ts.subzoneLabels = map[string]bool{"k8s": true}
+	ts.load().entries["test1.k8s"] = ts.load().entries["test1"]
+	ts.load().addrs = ts.addrIndex(ts.load().entries)
+
+	tests := []struct {
+		qname   string
+		rcode   int
+		answers int
+	}{
+		{"test1.k8s.example.com", dns.RcodeSuccess, 1},
+		{"sub.test1.k8s.example.com", dns.RcodeSuccess, 1},
+		{"k8s.example.com", dns.RcodeSuccess, 0},
+		{"test2-1.k8s.example.com", dns.RcodeNameError, 0},
+		{"test1.example.com", dns.RcodeSuccess, 1},
+	}
+	for _, tc := range tests {
+		msg := new(dns.Msg)
+		msg.SetQuestion(tc.qname, dns.TypeA)
+		w := dnstest.NewRecorder(&test.ResponseWriter{})
+		rcode, err := ts.ServeDNS(context.Background(), w, msg)
+		if err != nil || rcode != tc.rcode {
+			t.Errorf("%s: want rcode %d, got %d (err %v)", tc.qname, tc.rcode, rcode, err)
+			continue
+		}
+		if len(w.Msg.Answer) != tc.answers {
+			t.Errorf("%s: want %d answers, got %v", tc.qname, tc.answers, w.Msg.Answer)
+		}
+	}
+
+	if prefix, host := ts.splitName(ts.load(), "a.b.test1.k8s.example.com."); prefix != "a.b" || host != "test1.k8s" {
+		t.Errorf("splitName in subzone = %q, %q, want %q, %q", prefix, host, "a.b", "test1.k8s")
+	}
+}
+
+func TestServeDNSTagEnumeration(t *testing.T) {
+	ts := newTS()
+	ts.tagEnumeration = true
+	ts.load().entries["test1"]["TXT"] = []string{"tag:prod", "tag:web"}
+	ts.load().entries["test2-1"]["TXT"] = []string{"tag:Prod"}
+	ts.load().entries["test1.k8s"] = ts.load().entries["test1"]
+	ts.load().addrs = ts.addrIndex(ts.load().entries)
+	ts.load().tags = ts.tagIndex(ts.load().entries)
+
+	tests := []struct {
+		qname   string
+		qtype   uint16
+		rcode   int
+		targets []string
+	}{
+		{"_tag.prod.example.com", dns.TypePTR, dns.RcodeSuccess, []string{"test1.example.com.", "test2-1.example.com."}},
+		{"_TAG.web.example.com", dns.TypePTR, dns.RcodeSuccess, []string{"test1.example.com."}},
+		{"_tag.prod.example.com", dns.TypeA, dns.RcodeSuccess, nil},
+		{"_tag.db.example.com", dns.TypePTR, dns.RcodeNameError, nil},
+		{"web.example.com", dns.TypePTR, dns.RcodeSuccess, nil},
+		{"_tag.example.com", dns.TypePTR, dns.RcodeSuccess, nil},
+		{"x._tag.prod.example.com", dns.TypePTR, dns.RcodeNameError, nil},
+	}
+	for _, tc := range tests {
+		msg := new(dns.Msg)
+		msg.SetQuestion(tc.qname, tc.qtype)
+		w := dnstest.NewRecorder(&test.ResponseWriter{})
+		rcode, err := ts.ServeDNS(context.Background(), w, msg)
+		if err != nil || rcode != tc.rcode {
+			t.Errorf("%s %s: want rcode %d, got %d (err %v)", tc.qname, dns.TypeToString[tc.qtype], tc.rcode, rcode, err)
+			continue
+		}
+		var targets []string
+		for _, rr := range w.Msg.Answer {
+			if ptr, ok := rr.(*dns.PTR); ok {
+				targets = append(targets, ptr.Ptr)
+			}
+		}
+		if !reflect.DeepEqual(targets, tc.targets) {
+			t.Errorf("%s %s: want PTR targets %v, got %v", tc.qname, dns.TypeToString[tc.qtype], tc.targets, w.Msg.Answer)
+		}
+	}
+
+	// Without tag_enumeration, the names don't exist.
+	ts.tagEnumeration = false
+	msg := new(dns.Msg)
+	msg.SetQuestion("_tag.prod.example.com", dns.TypePTR)
+	if rcode, _ := ts.ServeDNS(context.Background(), dnstest.NewRecorder(&test.ResponseWriter{}), msg); rcode != dns.RcodeNameError {
+		t.Errorf("want NXDOMAIN without tag_enumeration, got rcode %d", rcode)
+	}
+}
+
+func TestServeDNSStats(t *testing.T) {
+	ts := newTS()
+	ts.stats = true
+	ts.load().serial = 42
+	ts.load().lastSync = time.Now().Add(-30 * time.Second)
+	ts.health.refreshed(time.Now(), true)
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("_STATS.example.com", dns.TypeTXT)
+	w := dnstest.NewRecorder(&test.ResponseWriter{})
+	if rcode, err := ts.ServeDNS(context.Background(), w, msg); err != nil || rcode != dns.RcodeSuccess {
+		t.Fatalf("want rcode %d, got %d (err %v)", dns.RcodeSuccess, rcode, err)
+	}
+	if len(w.Msg.Answer) != 1 {
+		t.Fatalf("want 1 answer, got %v", w.Msg.Answer)
+	}
+	txt := w.Msg.Answer[0].(*dns.TXT)
+	want := []string{"hosts=4", "names=4", "records=8", "serial=42", "last_sync_age=30", "data_age=0"}
+	if !reflect.DeepEqual(txt.Txt, want) || txt.Hdr.Ttl != 0 {
+		t.Errorf("want %v with TTL 0, got %v", want, txt)
+	}
+
+	// Other types are NODATA.
+	msg.SetQuestion("_stats.example.com", dns.TypeA)
+	w = dnstest.NewRecorder(&test.ResponseWriter{})
+	if rcode, _ := ts.ServeDNS(context.Background(), w, msg); rcode != dns.RcodeSuccess || len(w.Msg.Answer) != 0 {
+		t.Errorf("want NODATA for A, got rcode %d and %v", rcode, w.Msg.Answer)
+	}
+
+	// Before the first sync, and without stats.
+	ts.load().lastSync = time.Time{}
+	if got := ts.statsText(ts.load(), time.Now())[4]; got != "last_sync_age=never" {
+		t.Errorf("want last_sync_age=never before the first sync, got %s", got)
+	}
+	ts.stats = false
+	msg.SetQuestion("_stats.example.com", dns.TypeTXT)
+	if rcode, _ := ts.ServeDNS(context.Background(), dnstest.NewRecorder(&test.ResponseWriter{}), msg); rcode != dns.RcodeNameError {
+		t.Errorf("want NXDOMAIN without stats, got rcode %d", rcode)
+	}
+}
+
+func TestServeDNSAny(t *testing.T) {
+	ts := newTS()
+	ts.wildcard = wildcardOn
+	ts.load().entries["test1"]["TXT"] = []string{"tag:web"}
+
+	tests := []struct {
+		policy string
+		qname  string
+		rcode  int
+		want   []string
+	}{
+		{anyHINFO, "test1.example.com", dns.RcodeSuccess, []string{"test1.example.com HINFO"}},
+		{anyHINFO, "x.test1.example.com", dns.RcodeSuccess, []string{"x.test1.example.com HINFO"}},
+		{anyHINFO, "missing.example.com", dns.RcodeNameError, nil},
+		{anyHINFO, "example.com", dns.RcodeSuccess, []string{"example.com. HINFO"}},
+		{anyAll, "test1.example.com", dns.RcodeSuccess, []string{"test1.example.com A", "test1.example.com AAAA", "test1.example.com TXT"}},
+		{anyAll, "test2.example.com", dns.RcodeSuccess, []string{
+			"test2.example.com CNAME", "test2-1.example.com A", "test2-1.example.com AAAA",
+			"test2.example.com CNAME", "test2-2.example.com A", "test2-2.example.com AAAA",
+		}},
+		{anyAll, "missing.example.com", dns.RcodeNameError, nil},
+		{anyAll, "example.com", dns.RcodeSuccess, []string{"example.com. SOA", "example.com. NS"}},
+	}
+	for _, tc := range tests {
+		ts.anyPolicy = tc.policy
+		msg := new(dns.Msg)
+		msg.SetQuestion(tc.qname, dns.TypeANY)
+		w := dnstest.NewRecorder(&test.ResponseWriter{})
+		if rcode, err := ts.ServeDNS(context.Background(), w, msg); err != nil || rcode != tc.rcode {
+			t.Errorf("%s %s: want rcode %d, got %d (err %v)", tc.policy, tc.qname, tc.rcode, rcode, err)
+			continue
+		}
+		var got []string
+		for _, rr := range w.Msg.Answer {
+			got = append(got, rr.Header().Name+" "+dns.TypeToString[rr.Header().Rrtype])
+			if hinfo, ok := rr.(*dns.HINFO); ok && (hinfo.Cpu != "RFC8482" || hinfo.Os != "") {
+				t.Errorf("%s %s: want the HINFO record of RFC 8482, got %s", tc.policy, tc.qname, hinfo)
+			}
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s %s: want answers %v, got %v", tc.policy, tc.qname, tc.want, got)
+		}
+	}
+}
+
+func TestServeDNSLookupBudget(t *testing.T) {
+	ts := newTS()
+
+	query := func(qname string) *dns.Msg {
+		msg := new(dns.Msg)
+		msg.SetQuestion(qname, dns.TypeA)
+		w := dnstest.NewRecorder(&test.ResponseWriter{})
+		if _, err := ts.ServeDNS(context.Background(), w, msg); err != nil {
+			t.Fatalf("%s: unexpected error: %v", qname, err)
+		}
+		return w.Msg
+	}
+
+	if resp := query("test2.example.com"); len(resp.Answer) != 4 {
+		t.Errorf("want 2 CNAME and 2 A records within the default budget, got %v", resp.Answer)
+	}
+
+	// test2 itself, its CNAME, and the first target; the second target is over budget.
+	ts.maxLookups = 3
+	before := testutil.ToFloat64(LookupBudgetExhausted.WithLabelValues(""))
+	if resp := query("test2.example.com"); len(resp.Answer) != 3 {
+		t.Errorf("want the answer cut off at the budget, got %v", resp.Answer)
+	}
+	if got := testutil.ToFloat64(LookupBudgetExhausted.WithLabelValues("")) - before; got != 1 {
+		t.Errorf("want the exhausted budget counted once, got %v", got)
+	}
+
+}
+
+func TestServeDNSInternalErrors(t *testing.T) {
+	tests := []struct {
+		policy string
+		rcode  int
+	}{
+		{internalServfail, dns.RcodeServerFailure},
+		{internalNegative, dns.RcodeSuccess},
+	}
+	for _, tc := range tests {
+		ts := newTS()
+		ts.internalErrors = tc.policy
+		// The CNAME of test2 is over budget, which leaves the answer empty.
+		ts.maxLookups = 1
+		before := testutil.ToFloat64(InternalErrors.WithLabelValues("", "lookup_budget"))
+
+		msg := new(dns.Msg)
+		msg.SetQuestion("test2.example.com", dns.TypeA)
+		msg.SetEdns0(dns.DefaultMsgSize, false)
+		w := dnstest.NewRecorder(&test.ResponseWriter{})
+		rcode, err := ts.ServeDNS(context.Background(), w, msg)
+		if err != nil || rcode != tc.rcode || w.Msg.Rcode != tc.rcode {
+			t.Errorf("%s: want %s, got %d (err %v)", tc.policy, dns.RcodeToString[tc.rcode], rcode, err)
+			continue
+		}
+		var ede *dns.EDNS0_EDE
+		for _, o := range w.Msg.IsEdns0().Option {
+			if e, ok := o.(*dns.EDNS0_EDE); ok {
+				ede = e
+			}
+		}
+		if ede == nil || ede.InfoCode != dns.ExtendedErrorCodeOther || ede.ExtraText != "lookup budget exhausted" {
+			t.Errorf("%s: want the extended error of the exhausted budget, got %v", tc.policy, w.Msg)
+		}
+		if got := testutil.ToFloat64(InternalErrors.WithLabelValues("", "lookup_budget")) - before; got != 1 {
+			t.Errorf("%s: want the failure counted once, got %v", tc.policy, got)
+		}
+
+		// Genuine misses are answered as such.
+		ts.maxLookups = 0
+		msg = new(dns.Msg)
+		msg.SetQuestion("missing.example.com", dns.TypeA)
+		w = dnstest.NewRecorder(&test.ResponseWriter{})
+		if rcode, err := ts.ServeDNS(context.Background(), w, msg); err != nil || rcode != dns.RcodeNameError {
+			t.Errorf("%s: want NXDOMAIN for a missing name, got %d (err %v)", tc.policy, rcode, err)
+		}
+	}
+}
+
+func TestServeDNSAnswerCache(t *testing.T) {
+	tn := &Tailnet{
+		Peers: []tailcfg.NodeView{(&tailcfg.Node{
+			ID:           1,
+			ComputedName: "web",
+			Addresses:    []netip.Prefix{netip.MustParsePrefix("100.64.0.1/32")},
+		}).View()},
+	}
+	ts := &Tailscale{
+		zone:    "example.com.",
+		static:  map[string]map[string][]string{"www": {"CNAME": {"www.example.org."}}},
+		answers: newAnswerCache(10),
+	}
+	u := &fakeUpstream{lookup: func(ctx context.Context, state request.Request, name string, typ uint16) (*dns.Msg, error) {
+		resp := new(dns.Msg)
+		resp.SetQuestion(name, typ)
+		resp.Answer = append(resp.Answer, test.A(name+" 300 IN A 192.0.2.1"))
+		return resp, nil
+	}}
+	ts.upstream = u
+	ts.ready.Store(true)
+	ts.processTailnet(tn)
+
+	query := func(qname string) (int, *dns.Msg) {
+		var msg dns.Msg
+		msg.SetQuestion(qname, dns.TypeA)
+		w := dnstest.NewRecorder(&test.ResponseWriter{})
+		rcode, err := ts.ServeDNS(context.Background(), w, &msg)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return rcode, w.Msg
+	}
+
+	if _, resp := query("web.example.com."); len(resp.Answer) != 1 || resp.Answer[0].(*dns.A).A.String() != "100.64.0.1" {
+		t.Fatalf("want the address of web, got %v", resp.Answer)
+	}
+	if rcode, resp := query("gone.example.com."); rcode != dns.RcodeNameError || len(resp.Ns) != 1 {
+		t.Fatalf("want NXDOMAIN with the SOA record, got rcode %d with %v", rcode, resp.Ns)
+	}
+
+	// Answers come from the cache, whatever the case of the query, until the records change.
+	ts.load().entries["web"]["A"] = []string{"100.64.0.9"}
+	ts.load().addrs = ts.addrIndex(ts.load().entries)
+	_, resp := query("WEB.example.com.")
+	if len(resp.Answer) != 1 || resp.Answer[0].(*dns.A).A.String() != "100.64.0.1" {
+		t.Errorf("want the cached address of web, got %v", resp.Answer)
+	} else if resp.Answer[0].Header().Name != "WEB.example.com." {
+		t.Errorf("want the case of the query echoed, got %s", resp.Answer[0].Header().Name)
+	}
+	if rcode, resp := query("gone.example.com."); rcode != dns.RcodeNameError || len(resp.Ns) != 1 {
+		t.Errorf("want the cached NXDOMAIN with the SOA record, got rcode %d with %v", rcode, resp.Ns)
+	}
+
+	tn.Peers = append(tn.Peers, (&tailcfg.Node{
+		ID:           2,
+		ComputedName: "gone",
+		Addresses:    []netip.Prefix{netip.MustParsePrefix("100.64.0.2/32")},
+	}).View())
+	ts.processTailnet(tn)
+	if rcode, resp := query("gone.example.com."); rcode != dns.RcodeSuccess || len(resp.Answer) != 1 {
+		t.Errorf("want the address of the new node once the records changed, got rcode %d with %v", rcode, resp.Answer)
+	}
+
+	// Answers with records looked up upstream aren't cached.
+	for range 2 {
+		if _, resp := query("www.example.com."); len(resp.Answer) != 2 {
+			t.Errorf("want the CNAME record and its target, got %v", resp.Answer)
+		}
+	}
+	if len(u.lookups) != 2 {
+		t.Errorf("want the CNAME target looked up for every query, got lookups %v", u.lookups)
+	}
+}
+
+func TestServeDNSAnswerCompositions(t *testing.T) {
+	tn := &Tailnet{
+		Peers: []tailcfg.NodeView{
+			(&tailcfg.Node{ID: 1, ComputedName: "web", Addresses: []netip.Prefix{netip.MustParsePrefix("100.64.0.1/32")}}).View(),
+			(&tailcfg.Node{ID: 2, ComputedName: "db", Addresses: []netip.Prefix{netip.MustParsePrefix("100.64.0.2/32")}}).View(),
+		},
+	}
+	ts := &Tailscale{
+		zone: "example.com.",
+		static: map[string]map[string][]string{
+			"app":   {"CNAME": {"web.example.com."}},
+			"chain": {"CNAME": {"app.example.com."}},
+			"pool":  {"CNAME": {"web.example.com.", "db.example.com."}},
+			"ext":   {"CNAME": {"www.example.org."}},
+		},
+	}
+	ts.upstream = &fakeUpstream{lookup: func(ctx context.Context, state request.Request, name string, typ uint16) (*dns.Msg, error) {
+		resp := new(dns.Msg)
+		resp.SetQuestion(name, typ)
+		resp.Answer = append(resp.Answer, test.A(name+" 300 IN A 192.0.2.1"))
+		return resp, nil
+	}}
+	ts.ready.Store(true)
+	ts.processTailnet(tn)
+
+	kinds := []string{compositionCNAME, compositionCNAMEChain, compositionMultiTarget, compositionFlattened}
+	tests := []struct {
+		qname string
+		want  []string
+	}{
+		{"web.example.com.", nil},
+		{"app.example.com.", []string{compositionCNAME}},
+		{"chain.example.com.", []string{compositionCNAME, compositionCNAMEChain}},
+		{"pool.example.com.", []string{compositionCNAME, compositionMultiTarget}},
+		{"ext.example.com.", []string{compositionCNAME, compositionFlattened}},
+	}
+	for _, tc := range tests {
+		before := map[string]float64{}
+		for _, kind := range kinds {
+			before[kind] = testutil.ToFloat64(AnswerCompositions.WithLabelValues("", kind))
+		}
+		var msg dns.Msg
+		msg.SetQuestion(tc.qname, dns.TypeA)
+		if _, err := ts.ServeDNS(context.Background(), dnstest.NewRecorder(&test.ResponseWriter{}), &msg); err != nil {
+			t.Fatalf("%s: unexpected error: %v", tc.qname, err)
+		}
+		var got []string
+		for _, kind := range kinds {
+			if testutil.ToFloat64(AnswerCompositions.WithLabelValues("", kind)) > before[kind] {
+				got = append(got, kind)
+			}
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: compositions = %v, want %v", tc.qname, got, tc.want)
+		}
+	}
+}
+
+func TestServeDNSConcurrentUpdates(t *testing.T) {
+	netMap := func(addr string) *Tailnet {
+		return &Tailnet{Peers: []tailcfg.NodeView{(&tailcfg.Node{
+			ID:           1,
+			ComputedName: "web",
+			Addresses:    []netip.Prefix{netip.MustParsePrefix(addr + "/32")},
+		}).View()}}
+	}
+	ts := &Tailscale{zone: "example.com."}
+	ts.ready.Store(true)
+	ts.processTailnet(netMap("100.64.0.1"))
+
+	// Queries don't wait for updates, and always see the records of one network map or the other.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := range 200 {
+			ts.processTailnet(netMap(fmt.Sprintf("100.64.0.%d", 1+i%2)))
+		}
+	}()
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		var msg dns.Msg
+		msg.SetQuestion("web.example.com.", dns.TypeA)
+		w := dnstest.NewRecorder(&test.ResponseWriter{})
+		if _, err := ts.ServeDNS(context.Background(), w, &msg); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(w.Msg.Answer) != 1 {
+			t.Fatalf("want the address of web, got %v", w.Msg.Answer)
+		}
+		if addr := w.Msg.Answer[0].(*dns.A).A.String(); addr != "100.64.0.1" && addr != "100.64.0.2" {
+			t.Fatalf("want an address of web, got %s", addr)
+		}
+	}
+}
+
+func TestServeDNSWildcard(t *testing.T) {
+	tests := []struct {
+		mode  string
+		qname string
+		qtype uint16
+		rcode int
+		found bool
+	}{
+		{"", "sub.test1.example.com", dns.TypeA, dns.RcodeNameError, false},
+		{"on", "sub.test1.example.com", dns.TypeA, dns.RcodeSuccess, true},
+		{"off", "test1.example.com", dns.TypeA, dns.RcodeSuccess, true},
+		{"off", "sub.test1.example.com", dns.TypeA, dns.RcodeNameError, false},
+		{"off", "sub.test2.example.com", dns.TypeA, dns.RcodeNameError, false},
+		{"off", "sub.test1.example.com", dns.TypeTXT, dns.RcodeNameError, false},
+		{"off", "_ssh._tcp.test1.example.com", dns.TypeSRV, dns.RcodeSuccess, true},
+		{"off", "_tcp.test1.example.com", dns.TypeSRV, dns.RcodeSuccess, false},
+		{"off", "_ftp._tcp.test1.example.com", dns.TypeSRV, dns.RcodeNameError, false},
+		{"tag:dns-wildcard", "sub.test1.example.com", dns.TypeAAAA, dns.RcodeSuccess, true},
+		{"tag:dns-wildcard", "sub.test2-1.example.com", dns.TypeAAAA, dns.RcodeNameError, false},
+		{"tag:dns-wildcard", "test2-1.example.com", dns.TypeAAAA, dns.RcodeSuccess, true},
+	}
+	for _, tc := range tests {
+		ts := newTS()
+		ts.wildcard = tc.mode
+		ts.load().entries["test1"]["TXT"] = []string{"tag:dns-wildcard"}
+		ts.load().entries["test1"]["SRV"] = []string{"_ssh._tcp 22"}
+
+		msg := new(dns.Msg)
+		msg.SetQuestion(tc.qname, tc.qtype)
+		w := dnstest.NewRecorder(&test.ResponseWriter{})
+		rcode, err := ts.ServeDNS(context.Background(), w, msg)
+		if err != nil || rcode != tc.rcode {
+			t.Errorf("wildcard %s, %s: want rcode %d, got %d (err %v)", tc.mode, tc.qname, tc.rcode, rcode, err)
+			continue
+		}
+		if found := len(w.Msg.Answer) > 0; found != tc.found {
+			t.Errorf("wildcard %s, %s: want answers %t, got %v", tc.mode, tc.qname, tc.found, w.Msg.Answer)
+		}
+	}
+}
+
+func TestServeDNSCNAMEChain(t *testing.T) {
+	ts := newTS()
+	ts.wildcard = wildcardOn
+	// Loops like these are removed when the records are built, but are served safely regardless.
+	ts.load().entries["loop"] = map[string][]string{"CNAME": {"loop.example.com"}}
+	ts.load().entries["ping"] = map[string][]string{"CNAME": {"pong.example.com"}}
+	ts.load().entries["pong"] = map[string][]string{"CNAME": {"ping.example.com"}}
+	ts.load().entries["c1"] = map[string][]string{"CNAME": {"c2.example.com"}}
+	ts.load().entries["c2"] = map[string][]string{"CNAME": {"c3.example.com"}}
+	ts.load().entries["c3"] = map[string][]string{"CNAME": {"test1.example.com"}}
+
+	tests := []struct {
+		qname    string
+		maxChain int
+		answers  int
+	}{
+		{"loop.example.com", 0, 1},
+		{"ping.example.com", 0, 2},
+		{"sub.ping.example.com", 0, 2},
+		{"c1.example.com", 0, 4},
+		{"c1.example.com", 2, 2},
+	}
+	for _, tc := range tests {
+		ts.maxCNAMEChain = tc.maxChain
+		msg := new(dns.Msg)
+		msg.SetQuestion(tc.qname, dns.TypeA)
+		w := dnstest.NewRecorder(&test.ResponseWriter{})
+		if _, err := ts.ServeDNS(context.Background(), w, msg); err != nil {
+			t.Errorf("%s: unexpected error: %v", tc.qname, err)
+			continue
+		}
+		if len(w.Msg.Answer) != tc.answers {
+			t.Errorf("%s with chain limit %d: want %d answers, got %v", tc.qname, tc.maxChain, tc.answers, w.Msg.Answer)
+		}
+	}
+}
+
+func TestServeDNSSRV(t *testing.T) {
+	ts := newTS()
+	ts.load().entries["test1"]["SRV"] = []string{"_https._tcp 443", "_ssh._tcp 22"}
+
+	tests := []struct {
+		qname string
+		rcode int
+		port  uint16
+	}{
+		{"_ssh._tcp.test1.example.com.", dns.RcodeSuccess, 22},
+		{"_HTTPS._TCP.test1.example.com.", dns.RcodeSuccess, 443},
+		{"_ftp._tcp.test1.example.com.", dns.RcodeSuccess, 0},
+		{"test1.example.com.", dns.RcodeSuccess, 0},
+		{"_ssh._tcp.test5.example.com.", dns.RcodeNameError, 0},
+	}
+	for _, tc := range tests {
+		msg := new(dns.Msg)
+		msg.SetQuestion(tc.qname, dns.TypeSRV)
+		w := dnstest.NewRecorder(&test.ResponseWriter{})
+		rcode, err := ts.ServeDNS(context.Background(), w, msg)
+		if err != nil || rcode != tc.rcode {
+			t.Errorf("%s: want rcode %d, got %d (err %v)", tc.qname, tc.rcode, rcode, err)
+			continue
+		}
+		if tc.port == 0 {
+			if len(w.Msg.Answer) != 0 {
+				t.Errorf("%s: want no answers, got %v", tc.qname, w.Msg.Answer)
+			}
+			continue
+		}
+		if len(w.Msg.Answer) != 1 {
+			t.Fatalf("%s: want 1 answer, got %v", tc.qname, w.Msg.Answer)
+		}
+		if srv, ok := w.Msg.Answer[0].(*dns.SRV); !ok || srv.Port != tc.port || srv.Target != "test1.example.com." {
+			t.Errorf("%s: want SRV to test1.example.com. port %d, got %s", tc.qname, tc.port, w.Msg.Answer[0])
+		}
+	}
+}
+
+func TestServeDNSSVCB(t *testing.T) {
+	ts := newTS()
+	ts.wildcard = wildcardOn
+	ts.load().entries["test1"]["ALPN"] = []string{"h2", "http/1.1"}
+
+	query := func(remote, qname string, qtype uint16) *dns.Msg {
+		msg := new(dns.Msg)
+		msg.SetQuestion(qname, qtype)
+		w := dnstest.NewRecorder(&test.ResponseWriter{RemoteIP: remote})
+		if rcode, err := ts.ServeDNS(context.Background(), w, msg); err != nil || rcode != dns.RcodeSuccess {
+			t.Fatalf("%s: want NOERROR, got rcode %d (err %v)", qname, rcode, err)
+		}
+		return w.Msg
+	}
+
+	resp := query("100.64.0.1", "sub.test1.example.com", dns.TypeHTTPS)
+	if len(resp.Answer) != 1 {
+		t.Fatalf("want 1 answer, got %v", resp.Answer)
+	}
+	https, ok := resp.Answer[0].(*dns.HTTPS)
+	if !ok || https.Priority != 1 || https.Target != "." || https.Hdr.Name != "sub.test1.example.com" {
+		t.Fatalf("want HTTPS record in service mode for the owner, got %s", resp.Answer[0])
+	}
+	if got, want := svcbParams(&https.SVCB), `alpn="h2,http/1.1" ipv4hint="127.0.0.1" ipv6hint="::1"`; got != want {
+		t.Errorf("want parameters %s, got %s", want, got)
+	}
+
+	// SVCB queries get the same record, and CNAMEs are followed to the nodes they point to.
+	resp = query("100.64.0.1", "test2.example.com", dns.TypeSVCB)
+	var svcb int
+	for _, rr := range resp.Answer {
+		if rr, ok := rr.(*dns.SVCB); ok {
+			svcb++
+			if got, want := svcbParams(rr), `ipv4hint="127.0.0.1" ipv6hint="::1"`; got != want {
+				t.Errorf("want parameters %s, got %s", want, got)
+			}
+		}
+	}
+	if svcb != 2 || len(resp.Answer) != 4 {
+		t.Errorf("want 2 CNAMEs and 2 SVCB records, got %v", resp.Answer)
+	}
+
+	// Internal addresses are removed from the hints for clients rebind_protection applies to.
+	ts.rebindProtection = true
+	resp = query("203.0.113.1", "test1.example.com", dns.TypeHTTPS)
+	if len(resp.Answer) != 1 {
+		t.Fatalf("want 1 answer for external client, got %v", resp.Answer)
+	}
+	if got, want := svcbParams(&resp.Answer[0].(*dns.HTTPS).SVCB), `alpn="h2,http/1.1"`; got != want {
+		t.Errorf("external client: want parameters %s, got %s", want, got)
+	}
+}
+
+// svcbParams formats the parameters of svcb in presentation format.
+func svcbParams(svcb *dns.SVCB) string {
+	params := make([]string, len(svcb.Value))
+	for i, kv := range svcb.Value {
+		params[i] = kv.Key().String() + "=" + strconv.Quote(kv.String())
+	}
+	return strings.Join(params, " ")
+}
+
+func TestGlue(t *testing.T) {
+	ts := newTS()
+	ts.zone = "example.com."
+	ts.ns = []string{"test1.example.com.", "ns.example.net."}
+	ts.glue = true
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeNS)
+	w := dnstest.NewRecorder(&test.ResponseWriter{})
+	if _, err := ts.ServeDNS(context.Background(), w, msg); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(w.Msg.Answer) != 2 || len(w.Msg.Extra) != 2 {
+		t.Fatalf("want 2 NS records with the A and AAAA record of test1, got %v and %v", w.Msg.Answer, w.Msg.Extra)
+	}
+	for _, rr := range w.Msg.Extra {
+		if rr.Header().Name != "test1.example.com." {
+			t.Errorf("unexpected glue %s", rr)
+		}
+	}
+
+	hdr := func(rrtype uint16) dns.RR_Header {
+		return dns.RR_Header{Name: "_https._tcp.example.com.", Rrtype: rrtype, Class: dns.ClassINET}
+	}
+	var answer dns.Msg
+	answer.Answer = []dns.RR{
+		&dns.SRV{Hdr: hdr(dns.TypeSRV), Target: "test2-1.example.com."},
+		&dns.SRV{Hdr: hdr(dns.TypeSRV), Target: "TEST2-1.example.com."},
+		&dns.HTTPS{SVCB: dns.SVCB{Hdr: dns.RR_Header{Name: "test2-2.example.com.", Rrtype: dns.TypeHTTPS}, Target: "."}},
+		// Addresses found through CNAMEs aren't glue.
+		&dns.SRV{Hdr: hdr(dns.TypeSRV), Target: "test2.example.com."},
+	}
+	ts.addGlue(context.Background(), ts.load(), &answer, "example.com.")
+	if len(answer.Extra) != 4 {
+		t.Fatalf("want A and AAAA records of test2-1 and test2-2, got %v", answer.Extra)
+	}
+
+	ts.glue = false
+	answer.Extra = nil
+	ts.addGlue(context.Background(), ts.load(), &answer, "example.com.")
+	if len(answer.Extra) != 0 {
+		t.Errorf("want no glue when disabled, got %v", answer.Extra)
+	}
+}
+
+func TestServeDNSVersion(t *testing.T) {
+	ts := newTS()
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("version.example.com.", dns.TypeTXT)
+	msg.Question[0].Qclass = dns.ClassCHAOS
+	w := dnstest.NewRecorder(&test.ResponseWriter{})
+	rcode, err := ts.ServeDNS(context.Background(), w, msg)
+	if err != nil || rcode != dns.RcodeSuccess {
+		t.Fatalf("expected NOERROR, got rcode %d, err %v", rcode, err)
+	}
+	if len(w.Msg.Answer) != 1 {
+		t.Fatalf("expected 1 answer, got %d", len(w.Msg.Answer))
+	}
+	txt, ok := w.Msg.Answer[0].(*dns.TXT)
+	if !ok || txt.Hdr.Class != dns.ClassCHAOS {
+		t.Fatalf("expected CH TXT record, got %s", w.Msg.Answer[0])
+	}
+	if !reflect.DeepEqual(txt.Txt, []string{version, commit}) {
+		t.Errorf("expected %q, got %q", []string{version, commit}, txt.Txt)
+	}
+
+	ts.configHash = "0123abcd"
+	msg.SetQuestion("config.example.com.", dns.TypeTXT)
+	msg.Question[0].Qclass = dns.ClassCHAOS
+	w = dnstest.NewRecorder(&test.ResponseWriter{})
+	if rcode, _ = ts.ServeDNS(context.Background(), w, msg); rcode != dns.RcodeSuccess || len(w.Msg.Answer) != 1 {
+		t.Fatalf("expected config hash, got rcode %d", rcode)
+	}
+	if txt := w.Msg.Answer[0].(*dns.TXT); !reflect.DeepEqual(txt.Txt, []string{"0123abcd"}) {
+		t.Errorf("expected config hash, got %q", txt.Txt)
+	}
+
+	// Neither is published in the IN class.
+	msg.Question[0].Qclass = dns.ClassINET
+	w = dnstest.NewRecorder(&test.ResponseWriter{})
+	if rcode, _ = ts.ServeDNS(context.Background(), w, msg); rcode != dns.RcodeNameError {
+		t.Errorf("expected NXDOMAIN for IN TXT, got rcode %d", rcode)
 	}
 }
 
-func TestServeDNSFallback(t *testing.T) {
-	clog.D.Set()
+func TestServeDNSZones(t *testing.T) {
 	ts := newTS()
-	ts.fall.SetZonesFromArgs(nil)
+	ts.zone = "example.com."
+	ts.zones = []string{"example.com.", "ts.internal."}
 
-	test3 := net.ParseIP("100.100.100.100")
+	msg := new(dns.Msg)
+	msg.SetQuestion("test2.ts.internal.", dns.TypeA)
+	w := dnstest.NewRecorder(&test.ResponseWriter{})
+	rcode, err := ts.ServeDNS(context.Background(), w, msg)
+	if err != nil || rcode != dns.RcodeSuccess {
+		t.Fatalf("expected NOERROR, got rcode %d, err %v", rcode, err)
+	}
+	if len(w.Msg.Answer) != 4 {
+		t.Fatalf("expected 4 answers, got %d", len(w.Msg.Answer))
+	}
+	for _, rr := range w.Msg.Answer {
+		if !dns.IsSubDomain("ts.internal.", rr.Header().Name) {
+			t.Errorf("answer %s not in the zone of the query", rr)
+		}
+		if cname, ok := rr.(*dns.CNAME); ok && !dns.IsSubDomain("ts.internal.", cname.Target) {
+			t.Errorf("CNAME target %s not in the zone of the query", cname.Target)
+		}
+	}
 
-	// No match, no next plugin.
-	var msg dns.Msg
-	msg.SetQuestion("test3.example.com", dns.TypeA)
-	resp, err := ts.ServeDNS(context.Background(), dnstest.NewRecorder(&test.ResponseWriter{}), &msg)
-	if err == nil {
-		t.Fatal("expected error, got none")
+	// The apex of every zone exists.
+	msg.SetQuestion("ts.internal.", dns.TypeA)
+	w = dnstest.NewRecorder(&test.ResponseWriter{})
+	if rcode, _ = ts.ServeDNS(context.Background(), w, msg); rcode != dns.RcodeSuccess {
+		t.Errorf("expected NOERROR for apex, got rcode %d", rcode)
 	}
-	if want, got := dns.RcodeServerFailure, resp; got != want {
-		t.Fatalf("want response code %d, got %d", want, got)
+}
+
+func TestMoveName(t *testing.T) {
+	tests := []struct {
+		name, from, to, want string
+	}{
+		{"test1.example.com.", "example.com.", "ts.internal.", "test1.ts.internal."},
+		{"example.com.", "example.com.", "ts.internal.", "ts.internal."},
+		{"sub.test1.example.com.", "example.com", "ts.internal", "sub.test1.ts.internal."},
+		{"other.example.org.", "example.com.", "ts.internal.", "other.example.org."},
+	}
+	for _, tc := range tests {
+		if got := moveName(tc.name, tc.from, tc.to); got != tc.want {
+			t.Errorf("moveName(%q, %q, %q) = %q, want %q", tc.name, tc.from, tc.to, got, tc.want)
+		}
+	}
+}
+
+func TestTransfer(t *testing.T) {
+	ts := newTS()
+	ts.zone = "example.com."
+	ts.zones = []string{"example.com.", "ts.internal."}
+	ts.load().serial = 1234
+
+	if _, err := ts.Transfer("example.org.", 0); err != transfer.ErrNotAuthoritative {
+		t.Fatalf("want ErrNotAuthoritative for other zone, got %v", err)
+	}
+	if _, err := ts.Transfer("sub.example.com.", 0); err != transfer.ErrNotAuthoritative {
+		t.Fatalf("want ErrNotAuthoritative for name in zone, got %v", err)
 	}
 
-	ts.next = plugin.HandlerFunc(func(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
-		msg := dns.Msg{}
-		msg.SetReply(r)
-		msg.Answer = append(msg.Answer, &dns.A{
-			Hdr: dns.RR_Header{Name: "test3.example.com", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
-			A:   test3,
-		})
-		if err := w.WriteMsg(&msg); err != nil {
-			return dns.RcodeServerFailure, err
+	ch, err := ts.Transfer("ts.internal.", 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var rrs []dns.RR
+	for batch := range ch {
+		rrs = append(rrs, batch...)
+	}
+	// SOA, NS, A, AAAA, SVCB and HTTPS of test1, test2-1 and test2-2, the two CNAMEs of test2, and the
+	// closing SOA.
+	if len(rrs) != 17 {
+		t.Fatalf("want 17 records, got %d: %v", len(rrs), rrs)
+	}
+	if _, ok := rrs[0].(*dns.SOA); !ok {
+		t.Errorf("want transfer to start with SOA, got %s", rrs[0])
+	}
+	if _, ok := rrs[len(rrs)-1].(*dns.SOA); !ok {
+		t.Errorf("want transfer to end with SOA, got %s", rrs[len(rrs)-1])
+	}
+	for _, rr := range rrs {
+		if !dns.IsSubDomain("ts.internal.", rr.Header().Name) {
+			t.Errorf("record %s outside of the transferred zone", rr)
 		}
-		return dns.RcodeSuccess, nil
-	})
+		if cname, ok := rr.(*dns.CNAME); ok && cname.Target != "test2-1.ts.internal." && cname.Target != "test2-2.ts.internal." {
+			t.Errorf("unexpected CNAME target %s", cname.Target)
+		}
+	}
 
-	// Match, next plugin configured.
-	msg.SetQuestion("test1.example.com", dns.TypeA)
-	w := dnstest.NewRecorder(&test.ResponseWriter{})
-	resp, err = ts.ServeDNS(context.Background(), w, &msg)
-	if want, got := dns.RcodeSuccess, resp; got != want {
-		t.Fatalf("want response code %d, got %d", want, got)
+	// IXFR for the current serial only gets the SOA.
+	ch, _ = ts.Transfer("example.com.", 1234)
+	rrs = nil
+	for batch := range ch {
+		rrs = append(rrs, batch...)
 	}
-	if want, got := net.ParseIP("127.0.0.1"), w.Msg.Answer[0].(*dns.A).A; !got.Equal(want) {
-		t.Errorf("want %s, got: %s", want, got)
+	if len(rrs) != 1 {
+		t.Errorf("want only the SOA for an up to date serial, got %v", rrs)
+	}
+}
+
+func TestTransferPeers(t *testing.T) {
+	ts := newTS()
+	ts.transferPeers = []string{"secondary", "tag:dns"}
+	ts.whoIsFunc = func(ctx context.Context, remoteAddr string) (*apitype.WhoIsResponse, error) {
+		switch remoteAddr {
+		case "100.64.0.1:53":
+			return &apitype.WhoIsResponse{Node: &tailcfg.Node{ComputedName: "Secondary"}}, nil
+		case "100.64.0.2:53":
+			return &apitype.WhoIsResponse{Node: &tailcfg.Node{ComputedName: "resolver", Tags: []string{"tag:dns"}}}, nil
+		case "100.64.0.3:53":
+			return &apitype.WhoIsResponse{Node: &tailcfg.Node{ComputedName: "laptop", Tags: []string{"tag:dev"}}}, nil
+		}
+		return nil, errors.New("no such node")
 	}
 
-	// No match, next plugin configured.
-	msg.SetQuestion("test3.example.com", dns.TypeA)
-	w = dnstest.NewRecorder(&test.ResponseWriter{})
-	ts.ServeDNS(context.Background(), w, &msg)
+	tests := []struct {
+		remoteAddr string
+		want       bool
+	}{
+		{"100.64.0.1:53", true},
+		{"100.64.0.2:53", true},
+		{"100.64.0.3:53", false},
+		{"203.0.113.1:53", false},
+	}
+	for _, tc := range tests {
+		if got := ts.transferAllowed(context.Background(), tc.remoteAddr); got != tc.want {
+			t.Errorf("%s: got %t, want %t", tc.remoteAddr, got, tc.want)
+		}
+	}
 
-	if w.Msg == nil {
-		t.Fatal("no answer")
+	// Transfer requests from the test client, which isn't a tailnet node, are refused.
+	msg := new(dns.Msg)
+	msg.SetAxfr("example.com.")
+	rcode, err := ts.ServeDNS(context.Background(), dnstest.NewRecorder(&test.ResponseWriter{}), msg)
+	if err != nil || rcode != dns.RcodeRefused {
+		t.Errorf("want REFUSED, got rcode %d, err %v", rcode, err)
 	}
-	if want, got := 1, len(w.Msg.Answer); want != got {
-		t.Fatalf("want %d answer, got: %d", want, got)
+
+	// Without transfer peers they're passed on to the transfer plugin.
+	ts.transferPeers = nil
+	if _, err := ts.ServeDNS(context.Background(), dnstest.NewRecorder(&test.ResponseWriter{}), msg); err == nil {
+		t.Error("want the request passed on to the next plugin")
 	}
-	if got := w.Msg.Answer[0].(*dns.A).A; !got.Equal(test3) {
-		t.Errorf("want %s, got: %s", test3, got)
+}
+
+func TestEnumerationDetector(t *testing.T) {
+	d := newEnumerationDetector(3, time.Minute)
+	client := netip.MustParseAddr("100.64.0.5")
+	other := netip.MustParseAddr("100.64.0.6")
+	now := time.Now()
+
+	// Repeated queries for the same name don't count.
+	for i := 0; i < 10; i++ {
+		if d.observe(client, "test1.example.com.", now) {
+			t.Fatal("flagged client querying a single name")
+		}
+	}
+	if d.observe(client, "test2.example.com.", now) {
+		t.Fatal("flagged client below the threshold")
+	}
+	if d.observe(other, "test3.example.com.", now) {
+		t.Fatal("flagged client for names queried by another client")
+	}
+	if !d.observe(client, "test3.example.com.", now) {
+		t.Fatal("client reaching the threshold not flagged")
+	}
+	// Clients are only flagged once per window.
+	if d.observe(client, "test4.example.com.", now.Add(time.Second)) {
+		t.Error("client flagged twice within a window")
+	}
+
+	// A new window starts from scratch.
+	later := now.Add(2 * time.Minute)
+	if d.observe(client, "test1.example.com.", later) || d.observe(client, "test2.example.com.", later) {
+		t.Error("flagged client below the threshold in a new window")
+	}
+
+	// Clients that keep querying aren't dropped to make room for a flood of others.
+	for i := range 2 * maxTrackedClients {
+		flood := netip.AddrFrom4([4]byte{10, byte(i >> 16), byte(i >> 8), byte(i)})
+		d.observe(flood, "test1.example.com.", later)
+		if i%100 == 0 {
+			d.observe(client, "test1.example.com.", later)
+		}
+	}
+	if !d.observe(client, "test3.example.com.", later) {
+		t.Error("client reaching the threshold not flagged after a flood of other clients")
 	}
 }
 
-func TestServeDNSNoFallback(t *testing.T) {
-	clog.D.Set()
+func TestResolveTXT(t *testing.T) {
 	ts := newTS()
+	ts.load().entries["test1"]["TXT"] = []string{"tag:web", "tag:prod"}
 
-	// No match
-	var msg dns.Msg
-	msg.SetQuestion("test3.example.com", dns.TypeA)
-	resp, err := ts.ServeDNS(context.Background(), dnstest.NewRecorder(&test.ResponseWriter{}), &msg)
-	if err != nil {
-		t.Fatal("unexpected error")
+	msg := dns.Msg{}
+	ts.resolveTXT(context.Background(), ts.load(), "test1.example.com.", &msg)
+	if len(msg.Answer) != 1 {
+		t.Fatalf("expected 1 answer, got %d", len(msg.Answer))
 	}
-	if want, got := dns.RcodeNameError, resp; got != want {
-		t.Fatalf("want response code %d, got %d", want, got)
+	if txt, ok := msg.Answer[0].(*dns.TXT); !ok || !reflect.DeepEqual(txt.Txt, []string{"tag:web", "tag:prod"}) {
+		t.Errorf("expected TXT with tags, got %s", msg.Answer[0])
 	}
 
-	// Match
-	msg.SetQuestion("test1.example.com", dns.TypeA)
-	w := dnstest.NewRecorder(&test.ResponseWriter{})
-	resp, err = ts.ServeDNS(context.Background(), w, &msg)
-	if want, got := dns.RcodeSuccess, resp; got != want {
-		t.Fatalf("want response code %d, got %d", want, got)
+	// CNAMEs are followed to the tags of the target.
+	ts.load().entries["test2-1"]["TXT"] = []string{"tag:web"}
+	msg = dns.Msg{}
+	ts.resolveTXT(context.Background(), ts.load(), "test2.example.com.", &msg)
+	var cnames, txts int
+	for _, rr := range msg.Answer {
+		switch rr.(type) {
+		case *dns.CNAME:
+			cnames++
+		case *dns.TXT:
+			txts++
+		}
 	}
-	if want, got := net.ParseIP("127.0.0.1"), w.Msg.Answer[0].(*dns.A).A; !got.Equal(want) {
-		t.Errorf("want %s, got: %s", want, got)
+	if cnames != 2 || txts != 1 {
+		t.Errorf("expected 2 CNAME and 1 TXT records, got %d and %d", cnames, txts)
+	}
+
+	// Nodes without tags have no TXT record.
+	msg = dns.Msg{}
+	ts.resolveTXT(context.Background(), ts.load(), "test2-2.example.com.", &msg)
+	if len(msg.Answer) != 0 {
+		t.Errorf("expected no answers, got %v", msg.Answer)
+	}
+}
+
+func TestReverseAddr(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"5.0.64.100.in-addr.arpa.", "100.64.0.5"},
+		{"5.0.64.100.IN-ADDR.ARPA.", "100.64.0.5"},
+		{"5.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.e.1.a.c.5.1.1.a.7.d.f.ip6.arpa.", "fd7a:115c:a1e0::5"},
+		// Not tailnet addresses.
+		{"1.0.168.192.in-addr.arpa.", ""},
+		{"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa.", ""},
+		// Partial and malformed names.
+		{"0.64.100.in-addr.arpa.", ""},
+		{"256.0.64.100.in-addr.arpa.", ""},
+		{"50.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.e.1.a.c.5.1.1.a.7.d.f.ip6.arpa.", ""},
+		{"test1.example.com.", ""},
+	}
+	for _, tc := range tests {
+		addr, ok := reverseAddr(tc.name)
+		if tc.want == "" {
+			if ok {
+				t.Errorf("%s: expected no address, got %s", tc.name, addr)
+			}
+			continue
+		}
+		if !ok || addr != netip.MustParseAddr(tc.want) {
+			t.Errorf("%s: expected %s, got %s (%t)", tc.name, tc.want, addr, ok)
+		}
+	}
+}
+
+func TestServeDNSPTR(t *testing.T) {
+	ts := newTS()
+	ts.load().entries["node"] = map[string][]string{"A": {"100.64.0.5"}, "AAAA": {"fd7a:115c:a1e0::5"}}
+	ts.load().addrs = ts.addrIndex(ts.load().entries)
+	ts.load().reverse = ts.reverseIndex(ts.load().entries)
+
+	tests := []struct {
+		qname  string
+		qtype  uint16
+		rcode  int
+		target string
+	}{
+		{"5.0.64.100.in-addr.arpa.", dns.TypePTR, dns.RcodeSuccess, "node.example.com."},
+		{"5.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.e.1.a.c.5.1.1.a.7.d.f.ip6.arpa.", dns.TypePTR, dns.RcodeSuccess, "node.example.com."},
+		{"5.0.64.100.in-addr.arpa.", dns.TypeA, dns.RcodeSuccess, ""},
+		{"6.0.64.100.in-addr.arpa.", dns.TypePTR, dns.RcodeNameError, ""},
+	}
+	for _, tc := range tests {
+		msg := new(dns.Msg)
+		msg.SetQuestion(tc.qname, tc.qtype)
+		w := dnstest.NewRecorder(&test.ResponseWriter{})
+		rcode, err := ts.ServeDNS(context.Background(), w, msg)
+		if err != nil || rcode != tc.rcode {
+			t.Errorf("%s: expected rcode %d, got %d (err %v)", tc.qname, tc.rcode, rcode, err)
+			continue
+		}
+		if tc.target == "" {
+			if len(w.Msg.Answer) != 0 {
+				t.Errorf("%s: expected no answers, got %v", tc.qname, w.Msg.Answer)
+			}
+			continue
+		}
+		if len(w.Msg.Answer) != 1 {
+			t.Fatalf("%s: expected 1 answer, got %d", tc.qname, len(w.Msg.Answer))
+		}
+		if ptr, ok := w.Msg.Answer[0].(*dns.PTR); !ok || ptr.Ptr != tc.target {
+			t.Errorf("%s: expected PTR to %s, got %s", tc.qname, tc.target, w.Msg.Answer[0])
+		}
 	}
+}
 
+func TestBuildVersion(t *testing.T) {
+	if v, c := buildVersion("v1.2.3", "abc"); v != "v1.2.3" || c != "abc" {
+		t.Errorf("link time values not kept, got %q, %q", v, c)
+	}
+	if v, c := buildVersion("", ""); v == "" || c == "" {
+		t.Errorf("expected defaults, got %q, %q", v, c)
+	}
 }
 
 func TestResolveA(t *testing.T) {
@@ -129,9 +2668,9 @@ func TestResolveA(t *testing.T) {
 	ts := newTS()
 	msg := dns.Msg{}
 
-	domain := "test1.example.com"
+	domain := "test1.example.com."
 
-	ts.resolveA(domain, &msg)
+	ts.resolveA(context.Background(), ts.load(), domain, &msg)
 
 	testEquals(t, "answer count", 1, len(msg.Answer))
 	testEquals(t, "query name", domain, msg.Answer[0].Header().Name)
@@ -149,9 +2688,9 @@ func TestResolveAAAA(t *testing.T) {
 	ts := newTS()
 	msg := dns.Msg{}
 
-	domain := "test1.example.com"
+	domain := "test1.example.com."
 
-	ts.resolveAAAA(domain, &msg)
+	ts.resolveAAAA(context.Background(), ts.load(), domain, &msg)
 
 	testEquals(t, "answer count", 1, len(msg.Answer))
 	testEquals(t, "query name", domain, msg.Answer[0].Header().Name)
@@ -168,9 +2707,9 @@ func TestResolveCNAME(t *testing.T) {
 	clog.D.Set()
 	ts := newTS()
 	msg := dns.Msg{}
-	domain := "test2.example.com"
+	domain := "test2.example.com."
 
-	ts.resolveCNAME(domain, &msg, TypeAll)
+	ts.resolveCNAME(context.Background(), ts.load(), domain, &msg, TypeAll)
 
 	testEquals(t, "answer count", 6, len(msg.Answer))
 
@@ -195,7 +2734,7 @@ func TestResolveCNAME(t *testing.T) {
 	sort.Strings(cnames)
 	sort.Strings(as)
 	sort.Strings(aaaas)
-	testEquals(t, "CNAME record", []string{"test2-1.example.com", "test2-2.example.com"}, cnames)
+	testEquals(t, "CNAME record", []string{"test2-1.example.com.", "test2-2.example.com."}, cnames)
 	testEquals(t, "A record", []string{"127.0.0.1", "127.0.0.1"}, as)
 	testEquals(t, "AAAA record", []string{"::1", "::1"}, aaaas)
 
@@ -205,9 +2744,9 @@ func TestResolveAIsCNAME(t *testing.T) {
 	clog.D.Set()
 	ts := newTS()
 	msg := dns.Msg{}
-	domain := "test2.example.com"
+	domain := "test2.example.com."
 
-	ts.resolveA(domain, &msg)
+	ts.resolveA(context.Background(), ts.load(), domain, &msg)
 
 	testEquals(t, "answer count", 4, len(msg.Answer))
 
@@ -229,7 +2768,7 @@ func TestResolveAIsCNAME(t *testing.T) {
 
 	sort.Strings(cnames)
 	sort.Strings(as)
-	testEquals(t, "CNAME record", []string{"test2-1.example.com", "test2-2.example.com"}, cnames)
+	testEquals(t, "CNAME record", []string{"test2-1.example.com.", "test2-2.example.com."}, cnames)
 	testEquals(t, "A record", []string{"127.0.0.1", "127.0.0.1"}, as)
 }
 
@@ -237,9 +2776,9 @@ func TestResolveAAAAIsCNAME(t *testing.T) {
 	clog.D.Set()
 	ts := newTS()
 	msg := dns.Msg{}
-	domain := "test2.example.com"
+	domain := "test2.example.com."
 
-	ts.resolveAAAA(domain, &msg)
+	ts.resolveAAAA(context.Background(), ts.load(), domain, &msg)
 
 	testEquals(t, "answer count", 4, len(msg.Answer))
 
@@ -261,13 +2800,15 @@ func TestResolveAAAAIsCNAME(t *testing.T) {
 
 	sort.Strings(cnames)
 	sort.Strings(aaaas)
-	testEquals(t, "CNAME record", []string{"test2-1.example.com", "test2-2.example.com"}, cnames)
+	testEquals(t, "CNAME record", []string{"test2-1.example.com.", "test2-2.example.com."}, cnames)
 	testEquals(t, "AAAA record", []string{"::1", "::1"}, aaaas)
 }
 
 func TestSubdomainResolution(t *testing.T) {
 	clog.D.Set()
 	ts := newTS()
+	// Names below hosts only get their records with wildcards, which are off by default.
+	ts.wildcard = wildcardOn
 
 	testCases := []struct {
 		name      string
@@ -279,41 +2820,41 @@ func TestSubdomainResolution(t *testing.T) {
 	}{
 		{
 			name:     "simple subdomain A record",
-			query:    "sub.test1.example.com",
+			query:    "sub.test1.example.com.",
 			qtype:    dns.TypeA,
 			expectIP: "127.0.0.1",
 			rcode:    dns.RcodeSuccess,
 		},
 		{
 			name:     "deep subdomain A record",
-			query:    "a.b.c.d.test1.example.com",
+			query:    "a.b.c.d.test1.example.com.",
 			qtype:    dns.TypeA,
 			expectIP: "127.0.0.1",
 			rcode:    dns.RcodeSuccess,
 		},
 		{
 			name:     "subdomain AAAA record",
-			query:    "sub.test1.example.com",
+			query:    "sub.test1.example.com.",
 			qtype:    dns.TypeAAAA,
 			expectIP: "::1",
 			rcode:    dns.RcodeSuccess,
 		},
 		{
 			name:     "deep subdomain AAAA record",
-			query:    "deep.sub.test1.example.com",
+			query:    "deep.sub.test1.example.com.",
 			qtype:    dns.TypeAAAA,
 			expectIP: "::1",
 			rcode:    dns.RcodeSuccess,
 		},
 		{
 			name:  "subdomain of nonexistent host",
-			query: "sub.nonexistent.example.com",
+			query: "sub.nonexistent.example.com.",
 			qtype: dns.TypeA,
 			rcode: dns.RcodeNameError,
 		},
 		{
 			name:  "subdomain of existing host CNAME",
-			query: "something.test2.example.com",
+			query: "something.test2.example.com.",
 			qtype: dns.TypeA,
 			rcode: dns.RcodeSuccess,
 			checkFunc: func(t *testing.T, msg *dns.Msg) {
@@ -336,7 +2877,7 @@ func TestSubdomainResolution(t *testing.T) {
 		},
 		{
 			name:  "CNAME request on subdomain",
-			query: "sub.sub.test2.example.com",
+			query: "sub.sub.test2.example.com.",
 			qtype: dns.TypeCNAME,
 			rcode: dns.RcodeSuccess,
 			checkFunc: func(t *testing.T, msg *dns.Msg) {
@@ -412,6 +2953,337 @@ func TestSubdomainResolution(t *testing.T) {
 	}
 }
 
+func TestTTLJitter(t *testing.T) {
+	ts := newTS()
+	if got := ts.ttl(); got != defaultTTL {
+		t.Fatalf("want TTL %d without jitter, got %d", defaultTTL, got)
+	}
+
+	ts.ttlJitter = 10
+	for i := 0; i < 1000; i++ {
+		if got := ts.ttl(); got < defaultTTL-10 || got > defaultTTL+10 {
+			t.Fatalf("TTL %d outside of jitter range [%d, %d]", got, defaultTTL-10, defaultTTL+10)
+		}
+	}
+	ts.recordTTL, ts.ttlJitter = 300, 0
+	if got := ts.ttl(); got != 300 {
+		t.Errorf("want configured TTL 300, got %d", got)
+	}
+	if got := ts.negTTL(); got != 300 {
+		t.Errorf("want negative TTL to default to the TTL, got %d", got)
+	}
+	ts.negativeTTL = 30
+	if got := ts.negTTL(); got != 30 {
+		t.Errorf("want negative TTL 30, got %d", got)
+	}
+}
+
+func TestLogName(t *testing.T) {
+	ts := newTS()
+	name := "secret.test1.example.com."
+
+	if got := ts.logName(name); got != name {
+		t.Errorf("privacy off: want %s, got %s", name, got)
+	}
+
+	ts.privacy = privacyHash
+	ts.privacyKey = []byte("0123456789abcdef")
+	hashed := ts.logName(name)
+	if strings.Contains(hashed, "secret") {
+		t.Errorf("privacy hash: name leaked in %s", hashed)
+	}
+	if got := ts.logName("SECRET.test1.example.com"); got != hashed {
+		t.Errorf("privacy hash: want stable digest %s, got %s", hashed, got)
+	}
+	ts.privacyKey = []byte("fedcba9876543210")
+	if got := ts.logName(name); got == hashed {
+		t.Errorf("privacy hash: want digest keyed by the privacy key, got %s with both keys", got)
+	}
+
+	ts.privacy = privacyTruncate
+	if got, want := ts.logName(name), "*.example.com."; got != want {
+		t.Errorf("privacy truncate: want %s, got %s", want, got)
+	}
+	if got, want := ts.logName("test1"), "*"; got != want {
+		t.Errorf("privacy truncate: want %s, got %s", want, got)
+	}
+}
+
+func TestLogAddr(t *testing.T) {
+	ts := newTS()
+	addr := netip.MustParseAddr("100.64.0.5")
+
+	if got, want := ts.logAddr(addr), "100.64.0.5"; got != want {
+		t.Errorf("privacy off: want %s, got %s", want, got)
+	}
+
+	ts.privacy = privacyHash
+	ts.privacyKey = []byte("0123456789abcdef")
+	if got := ts.logAddr(addr); !strings.HasPrefix(got, "hmac:") || got == ts.logAddr(netip.MustParseAddr("100.64.0.6")) {
+		t.Errorf("privacy hash: want a digest telling clients apart, got %s", got)
+	}
+
+	ts.privacy = privacyTruncate
+	for _, tc := range []struct{ addr, want string }{
+		{"100.64.0.5", "100.64.0.0/24"},
+		{"::ffff:100.64.0.5", "100.64.0.0/24"},
+		{"fd7a:115c:a1e0::5", "fd7a:115c:a1e0::/48"},
+	} {
+		if got := ts.logAddr(netip.MustParseAddr(tc.addr)); got != tc.want {
+			t.Errorf("privacy truncate: want %s for %s, got %s", tc.want, tc.addr, got)
+		}
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	ts := newTS()
+
+	withECS := func(addr string, bits uint8) *dns.Msg {
+		msg := new(dns.Msg)
+		msg.SetQuestion("test1.example.com.", dns.TypeA)
+		msg.SetEdns0(4096, false)
+		ip := net.ParseIP(addr)
+		family := uint16(1)
+		if ip.To4() == nil {
+			family = 2
+		}
+		msg.IsEdns0().Option = append(msg.IsEdns0().Option, &dns.EDNS0_SUBNET{
+			Code: dns.EDNS0SUBNET, Family: family, SourceNetmask: bits, Address: ip,
+		})
+		return msg
+	}
+
+	// Untrusted source: the client subnet option is ignored.
+	state := request.Request{W: &test.ResponseWriter{}, Req: withECS("100.64.0.7", 32)}
+	testEquals(t, "untrusted client", "10.240.0.1", ts.clientIP(state).String())
+
+	ts.trustedProxies = []netip.Prefix{netip.MustParsePrefix("10.240.0.0/16")}
+
+	state = request.Request{W: &test.ResponseWriter{}, Req: withECS("100.64.0.7", 32)}
+	testEquals(t, "trusted client", "100.64.0.7", ts.clientIP(state).String())
+
+	state = request.Request{W: &test.ResponseWriter{}, Req: withECS("fd7a:115c:a1e0::7", 128)}
+	testEquals(t, "trusted v6 client", "fd7a:115c:a1e0::7", ts.clientIP(state).String())
+
+	// A truncated subnet doesn't identify a single client.
+	state = request.Request{W: &test.ResponseWriter{}, Req: withECS("100.64.0.0", 24)}
+	testEquals(t, "trusted client subnet", "10.240.0.1", ts.clientIP(state).String())
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("test1.example.com.", dns.TypeA)
+	state = request.Request{W: &test.ResponseWriter{}, Req: msg}
+	testEquals(t, "trusted without ECS", "10.240.0.1", ts.clientIP(state).String())
+}
+
+// proxyHeader returns a PROXY protocol v2 header of the PROXY command for a query from client to
+// 100.64.0.1:53, with a TLV the parser must skip.
+func proxyHeader(client netip.AddrPort) []byte {
+	family, dst := byte(0x11), netip.MustParseAddr("100.64.0.1").AsSlice()
+	if client.Addr().Is6() {
+		family, dst = 0x21, netip.MustParseAddr("fd7a:115c:a1e0::1").AsSlice()
+	}
+	var addrs []byte
+	addrs = append(addrs, client.Addr().AsSlice()...)
+	addrs = append(addrs, dst...)
+	addrs = binary.BigEndian.AppendUint16(addrs, client.Port())
+	addrs = binary.BigEndian.AppendUint16(addrs, 53)
+	addrs = append(addrs, 0x04, 0, 1, 0) // PP2_TYPE_NOOP
+	hdr := append([]byte{}, proxySignature...)
+	hdr = append(hdr, 0x21, family)
+	hdr = binary.BigEndian.AppendUint16(hdr, uint16(len(addrs)))
+	return append(hdr, addrs...)
+}
+
+func TestParseProxyHeader(t *testing.T) {
+	for _, client := range []netip.AddrPort{netip.MustParseAddrPort("100.64.0.5:40000"), netip.MustParseAddrPort("[fd7a:115c:a1e0::5]:40000")} {
+		hdr := proxyHeader(client)
+		got, n, err := parseProxyHeader(append(hdr, "query"...))
+		if err != nil || got != client || n != len(hdr) {
+			t.Errorf("want %s and %d bytes, got %s, %d, %v", client, len(hdr), got, n, err)
+		}
+		if _, _, err := parseProxyHeader(hdr[:len(hdr)-1]); err == nil {
+			t.Errorf("want an error for a truncated header of %s", client)
+		}
+	}
+
+	// The proxy's own health checks carry no client.
+	local := append(append([]byte{}, proxySignature...), 0x20, 0, 0, 0)
+	if got, n, err := parseProxyHeader(local); err != nil || got.IsValid() || n != len(local) {
+		t.Errorf("LOCAL: want no client and %d bytes, got %s, %d, %v", len(local), got, n, err)
+	}
+	if _, _, err := parseProxyHeader([]byte("not a header at all")); !errors.Is(err, errNoProxyHeader) {
+		t.Errorf("want errNoProxyHeader for data without a header, got %v", err)
+	}
+}
+
+func TestProxyProtocol(t *testing.T) {
+	trusted := func(addr netip.Addr) bool { return addr.IsLoopback() }
+	client := netip.MustParseAddrPort("100.64.0.5:40000")
+
+	// Datagrams are answered to the proxy, and read as coming from the client.
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen: %v", err)
+	}
+	defer pc.Close()
+	ppc := proxyPacketConn{PacketConn: pc, trusted: trusted}
+	proxy, err := net.Dial("udp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("unable to dial: %v", err)
+	}
+	defer proxy.Close()
+	proxy.Write(append(proxyHeader(client), "query"...))
+	buf := make([]byte, 512)
+	n, addr, err := ppc.ReadFrom(buf)
+	if err != nil || string(buf[:n]) != "query" || addr.String() != client.String() {
+		t.Fatalf("want query from %s, got %q from %v: %v", client, buf[:n], addr, err)
+	}
+	if _, err := ppc.WriteTo([]byte("answer"), addr); err != nil {
+		t.Fatalf("unable to answer: %v", err)
+	}
+	proxy.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if n, err := proxy.Read(buf); err != nil || string(buf[:n]) != "answer" {
+		t.Errorf("want the answer sent to the proxy, got %q: %v", buf[:n], err)
+	}
+
+	// Connections are read as coming from the client once their header is read.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Write(append(proxyHeader(client), "query"...))
+	}()
+	conn, err := proxyListener{Listener: ln, trusted: trusted}.Accept()
+	if err != nil {
+		t.Fatalf("unable to accept: %v", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	data, err := io.ReadAll(conn)
+	if err != nil || string(data) != "query" || conn.RemoteAddr().String() != client.String() {
+		t.Errorf("want query from %s, got %q from %s: %v", client, data, conn.RemoteAddr(), err)
+	}
+}
+
+func TestSplitName(t *testing.T) {
+	ts := newTS()
+
+	testCases := []struct {
+		name, prefix, host string
+	}{
+		{"test1.example.com", "", "test1"},
+		{"test1.example.com.", "", "test1"},
+		{"sub.test1.example.com", "sub", "test1"},
+		{"a.b.c.test1.example.com.", "a.b.c", "test1"},
+		{"example.com", "", ""},
+	}
+	for _, tc := range testCases {
+		prefix, host := ts.splitName(ts.load(), tc.name)
+		if prefix != tc.prefix || host != tc.host {
+			t.Errorf("splitName(%s) = %q, %q, want %q, %q", tc.name, prefix, host, tc.prefix, tc.host)
+		}
+	}
+}
+
+// TestResolveAAllocs holds simple A answers to their allocation target: less than 2 allocations, with
+// the blocks records are carved from amortized over the answers built from them.
+func TestResolveAAllocs(t *testing.T) {
+	clog.D.Clear()
+	ts := newTS()
+	msg := dns.Msg{Answer: make([]dns.RR, 0, 1)}
+	ctx := context.Background()
+	allocs := testing.AllocsPerRun(1000, func() {
+		msg.Answer = msg.Answer[:0]
+		ts.resolveA(ctx, ts.load(), "test1.example.com.", &msg)
+	})
+	if allocs >= 2 {
+		t.Errorf("want less than 2 allocations per A answer, got %.2f", allocs)
+	}
+}
+
+// discardWriter is a ResponseWriter that packs messages like a real server would, then drops them.
+type discardWriter struct {
+	test.ResponseWriter
+}
+
+func (w *discardWriter) WriteMsg(m *dns.Msg) error {
+	_, err := m.Pack()
+	return err
+}
+
+func BenchmarkResolveA(b *testing.B) {
+	ts := newTS()
+	msg := dns.Msg{}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		msg.Answer = msg.Answer[:0]
+		ts.resolveA(context.Background(), ts.load(), "test1.example.com.", &msg)
+	}
+}
+
+func BenchmarkServeDNSA(b *testing.B) {
+	ts := newTS()
+	var msg dns.Msg
+	msg.SetQuestion("test1.example.com.", dns.TypeA)
+	w := &discardWriter{}
+	ctx := context.Background()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		ts.ServeDNS(ctx, w, &msg)
+	}
+}
+
+func BenchmarkServeDNSCNAME(b *testing.B) {
+	ts := newTS()
+	var msg dns.Msg
+	msg.SetQuestion("test2.example.com.", dns.TypeA)
+	w := &discardWriter{}
+	ctx := context.Background()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		ts.ServeDNS(ctx, w, &msg)
+	}
+}
+
+// BenchmarkServeDNSSynthetic measures the serve path against a synthetic tailnet of -peers nodes,
+// cycling through the names so lookups don't all hit the same entry.
+func BenchmarkServeDNSSynthetic(b *testing.B) {
+	ts, names := syntheticTailscale(*syntheticPeers)
+	w := &discardWriter{}
+	ctx := context.Background()
+
+	queries := []struct {
+		name   string
+		qtype  uint16
+		prefix string
+	}{
+		{"A", dns.TypeA, ""},
+		{"AAAA", dns.TypeAAAA, ""},
+		{"TXT", dns.TypeTXT, ""},
+		{"Subdomain", dns.TypeA, "www."},
+		{"NXDOMAIN", dns.TypeA, "missing-"},
+	}
+	for _, q := range queries {
+		msgs := make([]*dns.Msg, len(names))
+		for i, name := range names {
+			msgs[i] = new(dns.Msg).SetQuestion(q.prefix+name, q.qtype)
+		}
+		b.Run(q.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				ts.ServeDNS(ctx, w, msgs[i%len(msgs)])
+			}
+		})
+	}
+}
+
 func testEquals(t *testing.T, msg string, expected interface{}, received interface{}) {
 	if !reflect.DeepEqual(expected, received) {
 		t.Errorf("Expected %s %s: received %s", msg, expected, received)
@@ -1,59 +1,847 @@
 package tailscale
 
 import (
+	"net/netip"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
 	"github.com/coredns/caddy"
 	"github.com/coredns/coredns/core/dnsserver"
 	"github.com/coredns/coredns/plugin"
-	"github.com/miekg/dns"
 )
 
 // init registers this plugin.
 func init() { plugin.Register("tailscale", setup) }
 
-// setup is the function that gets called when the config parser see the token "example". Setup is responsible
-// for parsing any extra options the example plugin may have. The first token this function sees is "example".
+// setup is the function that gets called when the config parser see the token "tailscale". Setup is responsible
+// for parsing any extra options the tailscale plugin may have. The first token this function sees is "tailscale".
 func setup(c *caddy.Controller) error {
-	ts := &Tailscale{}
+	cfg, err := parse(c)
+	if err != nil {
+		return plugin.Error("tailscale", err)
+	}
+	ts, err := New(cfg)
+	if err != nil {
+		return plugin.Error("tailscale", err)
+	}
+	ts.encrypted = encryptedTransport(dnsserver.GetConfig(c).Transport)
+
+	// The plugin is started once the servers are set up, and stopped before a reload sets up the new
+	// instance, which needs the same tsnet node and addresses. If the reload fails, it's started again.
+	c.OnStartup(func() error {
+		registerMetrics(c)
+		return nil
+	})
+	c.OnStartup(ts.startup)
+	c.OnRestart(ts.shutdown)
+	c.OnRestartFailed(ts.startup)
+	c.OnShutdown(ts.shutdown)
+
+	// Add the Plugin to CoreDNS, so Servers can use it in their plugin chain.
+	dnsserver.GetConfig(c).AddPlugin(func(next plugin.Handler) plugin.Handler {
+		ts.next = next
+		return ts
+	})
+
+	// All OK, return a nil error.
+	return nil
+}
+
+// parse parses the tailscale block of the Corefile into a Config. Values are only checked for syntax
+// here, validation happens in New so that it is shared with programmatically built configurations.
+func parse(c *caddy.Controller) (Config, error) {
+	var opts []Option
 	for c.Next() {
 		args := c.RemainingArgs()
-		if len(args) != 1 {
-			return plugin.Error("tailscale", c.ArgErr())
+		if len(args) == 0 {
+			return Config{}, c.ArgErr()
 		}
-		ts.zone = dns.CanonicalName(args[0])
+		opts = append(opts, WithZones(args...))
 
 		for c.NextBlock() {
 			switch c.Val() {
 			case "authkey":
 				args := c.RemainingArgs()
 				if len(args) != 1 {
-					return plugin.Error("tailscale", c.ArgErr())
+					return Config{}, c.ArgErr()
+				}
+				opts = append(opts, WithAuthKey(args[0]))
+			case "tsnet":
+				args := c.RemainingArgs()
+				if len(args)%2 != 0 {
+					return Config{}, c.ArgErr()
+				}
+				var dir, listen string
+				for i := 0; i < len(args); i += 2 {
+					switch args[i] {
+					case "authkey":
+						opts = append(opts, WithAuthKey(args[i+1]))
+					case "hostname":
+						opts = append(opts, WithHostname(args[i+1]))
+					case "dir":
+						dir = args[i+1]
+					case "listen":
+						listen = args[i+1]
+					default:
+						return Config{}, c.Errf("unknown tsnet option %q", args[i])
+					}
+				}
+				opts = append(opts, WithTSNet(dir, listen))
+			case "max_staleness":
+				args := c.RemainingArgs()
+				if len(args) != 1 {
+					return Config{}, c.ArgErr()
+				}
+				d, err := time.ParseDuration(args[0])
+				if err != nil {
+					return Config{}, c.Errf("invalid max_staleness %q: %v", args[0], err)
+				}
+				opts = append(opts, WithMaxStaleness(d))
+			case "poll_interval":
+				args := c.RemainingArgs()
+				if len(args) != 1 {
+					return Config{}, c.ArgErr()
+				}
+				d, err := time.ParseDuration(args[0])
+				if err != nil {
+					return Config{}, c.Errf("invalid poll_interval %q: %v", args[0], err)
 				}
-				ts.authkey = args[0]
+				opts = append(opts, WithPollInterval(d))
+			case "api_key":
+				args := c.RemainingArgs()
+				if len(args) != 1 {
+					return Config{}, c.ArgErr()
+				}
+				opts = append(opts, WithAPIKey(args[0]))
+			case "oauth":
+				args := c.RemainingArgs()
+				if len(args) != 2 {
+					return Config{}, c.ArgErr()
+				}
+				opts = append(opts, WithOAuth(args[0], args[1]))
+			case "tailnet":
+				args := c.RemainingArgs()
+				if len(args) < 1 || len(args) > 2 {
+					return Config{}, c.ArgErr()
+				}
+				interval := DefaultAPIInterval
+				if len(args) == 2 {
+					d, err := time.ParseDuration(args[1])
+					if err != nil {
+						return Config{}, c.Errf("invalid tailnet poll interval %q: %v", args[1], err)
+					}
+					interval = d
+				}
+				opts = append(opts, WithTailnet(args[0], interval))
+			case "headscale":
+				args := c.RemainingArgs()
+				if len(args) < 2 || len(args) > 3 {
+					return Config{}, c.ArgErr()
+				}
+				interval := DefaultHeadscaleInterval
+				if len(args) == 3 {
+					d, err := time.ParseDuration(args[2])
+					if err != nil {
+						return Config{}, c.Errf("invalid headscale poll interval %q: %v", args[2], err)
+					}
+					interval = d
+				}
+				opts = append(opts, WithHeadscale(args[0], args[1], interval))
 			case "hostname":
 				args := c.RemainingArgs()
 				if len(args) != 1 {
-					return plugin.Error("tailscale", c.ArgErr())
+					return Config{}, c.ArgErr()
+				}
+				opts = append(opts, WithHostname(args[0]))
+			case "ttl":
+				args := c.RemainingArgs()
+				if len(args) < 1 || len(args) > 2 {
+					return Config{}, c.ArgErr()
+				}
+				ttl, err := strconv.ParseUint(args[0], 10, 32)
+				if err != nil {
+					return Config{}, c.Errf("invalid ttl %q: %v", args[0], err)
+				}
+				negative := ttl
+				if len(args) == 2 {
+					if negative, err = strconv.ParseUint(args[1], 10, 32); err != nil {
+						return Config{}, c.Errf("invalid negative ttl %q: %v", args[1], err)
+					}
+				}
+				opts = append(opts, WithTTL(uint32(ttl), uint32(negative)))
+			case "ttl_jitter":
+				args := c.RemainingArgs()
+				if len(args) != 1 {
+					return Config{}, c.ArgErr()
+				}
+				jitter, err := strconv.ParseUint(args[0], 10, 32)
+				if err != nil {
+					return Config{}, c.Errf("invalid ttl_jitter %q: %v", args[0], err)
+				}
+				opts = append(opts, WithTTLJitter(uint32(jitter)))
+			case "privacy":
+				args := c.RemainingArgs()
+				switch {
+				case len(args) == 1:
+					opts = append(opts, WithPrivacy(args[0]))
+				case len(args) == 2 && args[0] == "hash":
+					opts = append(opts, WithPrivacy(args[0]), WithPrivacyKey(args[1]))
+				default:
+					return Config{}, c.ArgErr()
+				}
+			case "long_names":
+				args := c.RemainingArgs()
+				if len(args) != 1 {
+					return Config{}, c.ArgErr()
+				}
+				opts = append(opts, WithLongNames(args[0]))
+			case "trusted_proxies":
+				args := c.RemainingArgs()
+				if len(args) == 0 {
+					return Config{}, c.ArgErr()
+				}
+				for _, arg := range args {
+					pfx, err := parsePrefix(arg)
+					if err != nil {
+						return Config{}, c.Errf("invalid trusted proxy %q: %v", arg, err)
+					}
+					opts = append(opts, WithTrustedProxies(pfx))
+				}
+			case "max_inflight":
+				args := c.RemainingArgs()
+				if len(args) < 1 || len(args) > 2 {
+					return Config{}, c.ArgErr()
+				}
+				max, err := strconv.Atoi(args[0])
+				if err != nil {
+					return Config{}, c.Errf("invalid max_inflight %q: %v", args[0], err)
+				}
+				action := DefaultShedAction
+				if len(args) == 2 {
+					action = args[1]
+				}
+				opts = append(opts, WithMaxInflight(max, action))
+			case "answer_cache":
+				args := c.RemainingArgs()
+				if len(args) > 1 {
+					return Config{}, c.ArgErr()
+				}
+				var size int
+				if len(args) == 1 {
+					var err error
+					if size, err = strconv.Atoi(args[0]); err != nil || size <= 0 {
+						return Config{}, c.Errf("invalid answer_cache size %q", args[0])
+					}
+				}
+				opts = append(opts, WithAnswerCache(size))
+			case "query_log":
+				args := c.RemainingArgs()
+				if len(args) > 1 {
+					return Config{}, c.ArgErr()
+				}
+				var perSecond int
+				if len(args) == 1 {
+					var err error
+					if perSecond, err = strconv.Atoi(args[0]); err != nil || perSecond <= 0 {
+						return Config{}, c.Errf("invalid query_log rate %q", args[0])
+					}
+				}
+				opts = append(opts, WithQueryLog(perSecond))
+			case "answer_order":
+				args := c.RemainingArgs()
+				if len(args) != 1 && len(args) != 2 {
+					return Config{}, c.ArgErr()
+				}
+				var seed uint64
+				if len(args) == 2 {
+					var err error
+					if seed, err = strconv.ParseUint(args[1], 10, 64); err != nil || seed == 0 {
+						return Config{}, c.Errf("invalid answer_order seed %q", args[1])
+					}
+				}
+				opts = append(opts, WithAnswerOrder(args[0], seed))
+			case "health_check":
+				args := c.RemainingArgs()
+				if len(args) == 0 || len(args) > 4 || (args[0] == healthCheckOnline) != (len(args) == 1) {
+					return Config{}, c.ArgErr()
+				}
+				var port uint64
+				var interval time.Duration
+				var failures int
+				var err error
+				if len(args) > 1 {
+					if port, err = strconv.ParseUint(args[1], 10, 16); err != nil || port == 0 {
+						return Config{}, c.Errf("invalid health_check port %q", args[1])
+					}
+				}
+				if len(args) > 2 {
+					if interval, err = time.ParseDuration(args[2]); err != nil || interval <= 0 {
+						return Config{}, c.Errf("invalid health_check interval %q", args[2])
+					}
+				}
+				if len(args) > 3 {
+					if failures, err = strconv.Atoi(args[3]); err != nil || failures <= 0 {
+						return Config{}, c.Errf("invalid health_check failures %q", args[3])
+					}
+				}
+				opts = append(opts, WithHealthCheck(args[0], uint16(port), interval, failures))
+			case "max_lookups":
+				args := c.RemainingArgs()
+				if len(args) != 1 {
+					return Config{}, c.ArgErr()
+				}
+				max, err := strconv.Atoi(args[0])
+				if err != nil {
+					return Config{}, c.Errf("invalid max_lookups %q: %v", args[0], err)
+				}
+				opts = append(opts, WithMaxLookups(max))
+			case "max_cname_chain":
+				args := c.RemainingArgs()
+				if len(args) != 1 {
+					return Config{}, c.ArgErr()
+				}
+				max, err := strconv.Atoi(args[0])
+				if err != nil {
+					return Config{}, c.Errf("invalid max_cname_chain %q: %v", args[0], err)
 				}
-				ts.hostname = args[0]
+				opts = append(opts, WithMaxCNAMEChain(max))
+			case "upstream":
+				if c.NextArg() {
+					return Config{}, c.ArgErr()
+				}
+				opts = append(opts, WithUpstream())
+			case "record":
+				args := c.RemainingArgs()
+				if len(args) < 2 {
+					return Config{}, c.ArgErr()
+				}
+				opts = append(opts, WithRecord(recordLine(args)))
+			case "precedence":
+				args := c.RemainingArgs()
+				if len(args) == 0 {
+					return Config{}, c.ArgErr()
+				}
+				opts = append(opts, WithPrecedence(args...))
+			case "nsid":
+				args := c.RemainingArgs()
+				switch len(args) {
+				case 0:
+					// Like the nsid plugin, default to the hostname of the machine.
+					hostname, err := os.Hostname()
+					if err != nil {
+						return Config{}, c.Errf("unable to determine hostname for nsid: %v", err)
+					}
+					opts = append(opts, WithNSID(hostname))
+				case 1:
+					opts = append(opts, WithNSID(args[0]))
+				default:
+					return Config{}, c.ArgErr()
+				}
+			case "dnssec":
+				opts = append(opts, WithDNSSEC(c.RemainingArgs()...))
+			case "padding":
+				args := c.RemainingArgs()
+				switch len(args) {
+				case 0:
+					opts = append(opts, WithPadding(DefaultPaddingBlock))
+				case 1:
+					block, err := strconv.Atoi(args[0])
+					if err != nil || block == 0 {
+						return Config{}, c.Errf("invalid padding block %q", args[0])
+					}
+					opts = append(opts, WithPadding(block))
+				default:
+					return Config{}, c.ArgErr()
+				}
+			case "magicdns":
+				args := c.RemainingArgs()
+				switch len(args) {
+				case 0:
+					opts = append(opts, WithMagicDNS(""))
+				case 1:
+					opts = append(opts, WithMagicDNS(args[0]))
+				default:
+					return Config{}, c.ArgErr()
+				}
+			case "magicdns_overlap":
+				args := c.RemainingArgs()
+				if len(args) != 1 {
+					return Config{}, c.ArgErr()
+				}
+				opts = append(opts, WithMagicDNSOverlap(args[0]))
+			case "cookies":
+				args := c.RemainingArgs()
+				switch len(args) {
+				case 0:
+					opts = append(opts, WithCookies(""))
+				case 1:
+					opts = append(opts, WithCookies(args[0]))
+				default:
+					return Config{}, c.ArgErr()
+				}
+			case "tag_enumeration":
+				if c.NextArg() {
+					return Config{}, c.ArgErr()
+				}
+				opts = append(opts, WithTagEnumeration())
+			case "passthrough_unknown_types":
+				if c.NextArg() {
+					return Config{}, c.ArgErr()
+				}
+				opts = append(opts, WithPassthroughUnknownTypes())
+			case "expose_metadata":
+				if c.NextArg() {
+					return Config{}, c.ArgErr()
+				}
+				opts = append(opts, WithExposeMetadata())
+			case "rebind_marker":
+				if c.NextArg() {
+					return Config{}, c.ArgErr()
+				}
+				opts = append(opts, WithRebindMarker())
+			case "stats":
+				if c.NextArg() {
+					return Config{}, c.ArgErr()
+				}
+				opts = append(opts, WithStats())
+			case "rebind_protection":
+				var allow []netip.Prefix
+				for _, arg := range c.RemainingArgs() {
+					pfx, err := parsePrefix(arg)
+					if err != nil {
+						return Config{}, c.Errf("invalid rebind_protection range %q: %v", arg, err)
+					}
+					allow = append(allow, pfx)
+				}
+				opts = append(opts, WithRebindProtection(allow...))
+			case "filter_aaaa":
+				args := c.RemainingArgs()
+				if len(args) == 0 {
+					return Config{}, c.ArgErr()
+				}
+				var ranges []netip.Prefix
+				var tags []string
+				for _, arg := range args {
+					if strings.HasPrefix(arg, tagPrefix) {
+						tags = append(tags, arg)
+						continue
+					}
+					pfx, err := parsePrefix(arg)
+					if err != nil {
+						return Config{}, c.Errf("invalid filter_aaaa range %q: %v", arg, err)
+					}
+					ranges = append(ranges, pfx)
+				}
+				opts = append(opts, WithFilterAAAA(ranges, tags...))
+			case "prefer_family":
+				args := c.RemainingArgs()
+				if len(args) != 1 {
+					return Config{}, c.ArgErr()
+				}
+				opts = append(opts, WithPreferFamily(args[0]))
+			case "ipv4", "ipv6":
+				family := c.Val()
+				args := c.RemainingArgs()
+				if len(args) != 1 {
+					return Config{}, c.ArgErr()
+				}
+				if family == familyIPv4 {
+					opts = append(opts, WithIPv4(args[0]))
+				} else {
+					opts = append(opts, WithIPv6(args[0]))
+				}
+			case "any":
+				args := c.RemainingArgs()
+				if len(args) != 1 {
+					return Config{}, c.ArgErr()
+				}
+				opts = append(opts, WithAny(args[0]))
+			case "answer_hook":
+				names := c.RemainingArgs()
+				if len(names) == 0 {
+					return Config{}, c.ArgErr()
+				}
+				opts = append(opts, WithAnswerHooks(names...))
+			case "internal_errors":
+				args := c.RemainingArgs()
+				if len(args) != 1 {
+					return Config{}, c.ArgErr()
+				}
+				opts = append(opts, WithInternalErrors(args[0]))
+			case "enumeration_detect":
+				args := c.RemainingArgs()
+				if len(args) > 2 {
+					return Config{}, c.ArgErr()
+				}
+				threshold, window := DefaultEnumerationThreshold, DefaultEnumerationWindow
+				if len(args) > 0 {
+					n, err := strconv.Atoi(args[0])
+					if err != nil {
+						return Config{}, c.Errf("invalid enumeration_detect threshold %q: %v", args[0], err)
+					}
+					threshold = n
+				}
+				if len(args) > 1 {
+					d, err := time.ParseDuration(args[1])
+					if err != nil {
+						return Config{}, c.Errf("invalid enumeration_detect window %q: %v", args[1], err)
+					}
+					window = d
+				}
+				opts = append(opts, WithEnumerationDetect(threshold, window))
+			case "ns":
+				args := c.RemainingArgs()
+				if len(args) == 0 {
+					return Config{}, c.ArgErr()
+				}
+				opts = append(opts, WithNameServers(args...))
+			case "soa":
+				args := c.RemainingArgs()
+				if len(args) != 1 && len(args) != 4 {
+					return Config{}, c.ArgErr()
+				}
+				timers := []uint32{DefaultSOARefresh, DefaultSOARetry, DefaultSOAExpire}
+				for i, arg := range args[1:] {
+					d, err := time.ParseDuration(arg)
+					if err != nil {
+						return Config{}, c.Errf("invalid SOA timer %q: %v", arg, err)
+					}
+					timers[i] = uint32(d.Seconds())
+				}
+				opts = append(opts, WithSOA(args[0], timers[0], timers[1], timers[2]))
+			case "srv":
+				args := c.RemainingArgs()
+				switch {
+				case len(args) == 1 && args[0] == "hostinfo":
+					opts = append(opts, WithSRVHostinfo())
+				case len(args) == 4 || len(args) == 5:
+					port, err := strconv.ParseUint(args[3], 10, 16)
+					if err != nil {
+						return Config{}, c.Errf("invalid srv port %q: %v", args[3], err)
+					}
+					m := ServiceMapping{Tag: args[0], Service: args[1], Proto: args[2], Port: uint16(port)}
+					if len(args) == 5 {
+						ttl, err := strconv.ParseUint(args[4], 10, 32)
+						if err != nil || ttl == 0 {
+							return Config{}, c.Errf("invalid srv ttl %q", args[4])
+						}
+						m.TTL = uint32(ttl)
+					}
+					opts = append(opts, WithService(m))
+				default:
+					return Config{}, c.ArgErr()
+				}
+			case "backend":
+				// Backends may be separated by commas as well, e.g. "localapi, api".
+				var backends []string
+				for _, arg := range c.RemainingArgs() {
+					for _, b := range strings.Split(arg, ",") {
+						if b != "" {
+							backends = append(backends, b)
+						}
+					}
+				}
+				if len(backends) == 0 {
+					return Config{}, c.ArgErr()
+				}
+				opts = append(opts, WithBackends(backends...))
+			case "record_netmaps":
+				args := c.RemainingArgs()
+				if len(args) != 1 {
+					return Config{}, c.ArgErr()
+				}
+				opts = append(opts, WithRecordNetMaps(args[0]))
+			case "store":
+				args := c.RemainingArgs()
+				if len(args) != 2 {
+					return Config{}, c.ArgErr()
+				}
+				opts = append(opts, WithStore(args[0], args[1]))
+			case "export":
+				args := c.RemainingArgs()
+				if len(args) < 2 {
+					return Config{}, c.ArgErr()
+				}
+				opts = append(opts, WithExport(args[0], args[1], args[2:]...))
+			case "wildcard":
+				args := c.RemainingArgs()
+				if len(args) != 1 {
+					return Config{}, c.ArgErr()
+				}
+				opts = append(opts, WithWildcard(args[0]))
+			case "include_tags":
+				args := c.RemainingArgs()
+				if len(args) == 0 {
+					return Config{}, c.ArgErr()
+				}
+				opts = append(opts, WithIncludeTags(args...))
+			case "exclude_tags":
+				args := c.RemainingArgs()
+				if len(args) == 0 {
+					return Config{}, c.ArgErr()
+				}
+				opts = append(opts, WithExcludeTags(args...))
+			case "profile":
+				p, err := parseProfile(c)
+				if err != nil {
+					return Config{}, err
+				}
+				opts = append(opts, WithProfile(p))
+			case "view":
+				v, err := parseView(c)
+				if err != nil {
+					return Config{}, err
+				}
+				opts = append(opts, WithView(v))
+			case "view_grants":
+				args := c.RemainingArgs()
+				if len(args) > 1 {
+					return Config{}, c.ArgErr()
+				}
+				capability := ""
+				if len(args) == 1 {
+					capability = args[0]
+				}
+				opts = append(opts, WithViewGrants(capability))
+			case "offline_nodes":
+				args := c.RemainingArgs()
+				if len(args) < 1 || len(args) > 2 {
+					return Config{}, c.ArgErr()
+				}
+				ttl := uint64(DefaultOfflineTTL)
+				if len(args) == 2 {
+					if args[0] != offlineFlag {
+						return Config{}, c.Errf("offline_nodes %s takes no ttl", args[0])
+					}
+					var err error
+					if ttl, err = strconv.ParseUint(args[1], 10, 32); err != nil || ttl == 0 {
+						return Config{}, c.Errf("invalid offline_nodes ttl %q", args[1])
+					}
+				}
+				opts = append(opts, WithOfflineNodes(args[0], uint32(ttl)))
+			case "adaptive_ttl":
+				args := c.RemainingArgs()
+				if len(args) > 2 {
+					return Config{}, c.ArgErr()
+				}
+				minTTL, window := uint64(DefaultAdaptiveTTLMin), DefaultAdaptiveTTLWindow
+				if len(args) > 0 {
+					var err error
+					if minTTL, err = strconv.ParseUint(args[0], 10, 32); err != nil {
+						return Config{}, c.Errf("invalid adaptive_ttl minimum %q: %v", args[0], err)
+					}
+				}
+				if len(args) > 1 {
+					var err error
+					if window, err = time.ParseDuration(args[1]); err != nil {
+						return Config{}, c.Errf("invalid adaptive_ttl window %q: %v", args[1], err)
+					}
+				}
+				opts = append(opts, WithAdaptiveTTL(uint32(minTTL), window))
+			case "hostname_collisions":
+				args := c.RemainingArgs()
+				if len(args) != 1 {
+					return Config{}, c.ArgErr()
+				}
+				opts = append(opts, WithHostnameCollisions(args[0]))
+			case "subzone":
+				args := c.RemainingArgs()
+				if len(args) < 1 || len(args) > 2 {
+					return Config{}, c.ArgErr()
+				}
+				label := ""
+				if len(args) == 2 {
+					label = args[1]
+				}
+				opts = append(opts, WithSubzone(args[0], label))
+			case "user_subzones":
+				if c.NextArg() {
+					return Config{}, c.ArgErr()
+				}
+				opts = append(opts, WithUserSubzones())
+			case "alpn":
+				args := c.RemainingArgs()
+				if len(args) < 2 {
+					return Config{}, c.ArgErr()
+				}
+				opts = append(opts, WithALPN(args[0], args[1:]...))
+			case "glue":
+				if c.NextArg() {
+					return Config{}, c.ArgErr()
+				}
+				opts = append(opts, WithGlue())
+			case "ptr_target":
+				args := c.RemainingArgs()
+				if len(args) != 1 {
+					return Config{}, c.ArgErr()
+				}
+				opts = append(opts, WithPTRTarget(args[0]))
+			case "transfer_peers":
+				args := c.RemainingArgs()
+				if len(args) == 0 {
+					return Config{}, c.ArgErr()
+				}
+				opts = append(opts, WithTransferPeers(args...))
+			case "topology_records":
+				if c.NextArg() {
+					return Config{}, c.ArgErr()
+				}
+				opts = append(opts, WithTopologyRecords())
+			case "app_connectors":
+				args := c.RemainingArgs()
+				switch len(args) {
+				case 0:
+					opts = append(opts, WithAppConnectors(""))
+				case 1:
+					opts = append(opts, WithAppConnectors(args[0]))
+				default:
+					return Config{}, c.ArgErr()
+				}
+			case "endpoints":
+				args := c.RemainingArgs()
+				switch len(args) {
+				case 0:
+					opts = append(opts, WithEndpoints(""))
+				case 1:
+					opts = append(opts, WithEndpoints(args[0]))
+				default:
+					return Config{}, c.ArgErr()
+				}
+			case "agent":
+				args := c.RemainingArgs()
+				if len(args) < 1 || len(args) > 2 {
+					return Config{}, c.ArgErr()
+				}
+				expiry := DefaultAgentExpiry
+				if len(args) == 2 {
+					d, err := time.ParseDuration(args[1])
+					if err != nil {
+						return Config{}, c.Errf("invalid agent expiry %q: %v", args[1], err)
+					}
+					expiry = d
+				}
+				opts = append(opts, WithAgent(args[0], expiry))
+			case "debug":
+				args := c.RemainingArgs()
+				if len(args) < 1 || len(args) > 2 {
+					return Config{}, c.ArgErr()
+				}
+				events := DefaultSyncEvents
+				if len(args) == 2 {
+					n, err := strconv.Atoi(args[1])
+					if err != nil {
+						return Config{}, c.Errf("invalid debug event count %q: %v", args[1], err)
+					}
+					events = n
+				}
+				opts = append(opts, WithDebug(args[0], events))
 			case "fallthrough":
-				ts.fall.SetZonesFromArgs(c.RemainingArgs())
+				// Zones may be followed by the types fallthrough is restricted to.
+				zones := c.RemainingArgs()
+				var types []string
+				if i := slices.Index(zones, "types"); i >= 0 {
+					zones, types = zones[:i], zones[i+1:]
+					if len(types) == 0 {
+						return Config{}, c.ArgErr()
+					}
+				}
+				opts = append(opts, WithFallthrough(zones...), WithFallthroughTypes(types...))
 
 			default:
-				return plugin.Error("tailscale", c.ArgErr())
+				return Config{}, c.ArgErr()
 			}
 		}
 	}
+	return NewConfig(opts...), nil
+}
 
-	// Add the Plugin to CoreDNS, so Servers can use it in their plugin chain.
-	dnsserver.GetConfig(c).AddPlugin(func(next plugin.Handler) plugin.Handler {
-		ts.next = next
-		if err := ts.start(); err != nil {
-			log.Error(err)
-			return nil
+// parseProfile parses a profile directive with its block of policies:
+//
+//	profile NAME [TAG...] {
+//	    ttl SECONDS
+//	    online_only
+//	}
+//
+// The dispenser only tracks the block of the plugin, so the nested block is read token by token.
+func parseProfile(c *caddy.Controller) (Profile, error) {
+	args := c.RemainingArgs()
+	if len(args) == 0 {
+		return Profile{}, c.ArgErr()
+	}
+	p := Profile{Name: args[0], Tags: args[1:]}
+	// RemainingArgs stops in front of an opening brace on the same line.
+	if !c.NextArg() {
+		return p, nil
+	}
+	for c.Next() {
+		switch c.Val() {
+		case "}":
+			return p, nil
+		case "ttl":
+			args := c.RemainingArgs()
+			if len(args) != 1 {
+				return Profile{}, c.ArgErr()
+			}
+			ttl, err := strconv.ParseUint(args[0], 10, 32)
+			if err != nil || ttl == 0 {
+				return Profile{}, c.Errf("invalid profile ttl %q", args[0])
+			}
+			p.TTL = uint32(ttl)
+		case "online_only":
+			if c.NextArg() {
+				return Profile{}, c.ArgErr()
+			}
+			p.OnlineOnly = true
+		default:
+			return Profile{}, c.Errf("unknown profile option %q", c.Val())
 		}
-		return ts
-	})
+	}
+	return Profile{}, c.EOFErr()
+}
 
-	// All OK, return a nil error.
-	return nil
+// parseView parses a view directive with its block:
+//
+//	view NAME [CLIENT...] {
+//	    show MACHINE...
+//	}
+func parseView(c *caddy.Controller) (View, error) {
+	args := c.RemainingArgs()
+	if len(args) == 0 {
+		return View{}, c.ArgErr()
+	}
+	v := View{Name: args[0], Clients: args[1:]}
+	if !c.NextArg() || c.Val() != "{" {
+		return View{}, c.Errf("view %s needs a block with the machines it shows", v.Name)
+	}
+	for c.Next() {
+		switch c.Val() {
+		case "}":
+			return v, nil
+		case "show":
+			args := c.RemainingArgs()
+			if len(args) == 0 {
+				return View{}, c.ArgErr()
+			}
+			v.Show = append(v.Show, args...)
+		default:
+			return View{}, c.Errf("unknown view option %q", c.Val())
+		}
+	}
+	return View{}, c.EOFErr()
+}
+
+// parsePrefix parses a CIDR prefix, or a single address which is treated as a full-length prefix.
+func parsePrefix(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		pfx, err := netip.ParsePrefix(s)
+		return pfx.Masked(), err
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
 }
@@ -0,0 +1,507 @@
+package tailscale
+
+import (
+	"errors"
+	"net/netip"
+	"strings"
+	"testing"
+
+	"github.com/coredns/caddy"
+	"github.com/google/go-cmp/cmp"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestSetup(t *testing.T) {
+	tests := []struct {
+		name      string
+		input     string
+		shouldErr bool
+	}{
+		{"zone only", `tailscale example.com`, false},
+		{"missing zone", `tailscale`, true},
+		{"unknown option", "tailscale example.com {\n bogus\n}", true},
+		{"tsnet", "tailscale example.com {\n tsnet\n}", false},
+		{"tsnet with options", "tailscale example.com {\n tsnet authkey tskey-auth-abc hostname dns dir /var/lib/coredns listen :53\n}", false},
+		{"tsnet unknown option", "tailscale example.com {\n tsnet port 53\n}", true},
+		{"tsnet missing value", "tailscale example.com {\n tsnet authkey\n}", true},
+		{"tsnet listen with host", "tailscale example.com {\n tsnet listen 100.64.0.1:53\n}", true},
+		{"tsnet and api_key", "tailscale example.com {\n tsnet\n api_key tskey-api-abc\n}", true},
+		{"poll_interval", "tailscale example.com {\n poll_interval 10m\n}", false},
+		{"poll_interval invalid", "tailscale example.com {\n poll_interval often\n}", true},
+		{"poll_interval negative", "tailscale example.com {\n poll_interval -1m\n}", true},
+		{"poll_interval with api_key", "tailscale example.com {\n api_key tskey-api-abc\n poll_interval 10m\n}", true},
+		{"api_key", "tailscale example.com {\n api_key tskey-api-abc\n}", false},
+		{"oauth", "tailscale example.com {\n oauth k123 tskey-client-abc\n tailnet example.org 5m\n}", false},
+		{"oauth missing secret", "tailscale example.com {\n oauth k123\n}", true},
+		{"api_key and oauth", "tailscale example.com {\n api_key tskey-api-abc\n oauth k123 tskey-client-abc\n}", true},
+		{"api_key and authkey", "tailscale example.com {\n api_key tskey-api-abc\n authkey tskey-auth-abc\n}", true},
+		{"api_key and agent", "tailscale example.com {\n api_key tskey-api-abc\n agent :8443\n}", true},
+		{"tailnet invalid interval", "tailscale example.com {\n api_key tskey-api-abc\n tailnet example.org often\n}", true},
+		{"tailnet zero interval", "tailscale example.com {\n api_key tskey-api-abc\n tailnet example.org 0s\n}", true},
+		{"headscale", "tailscale example.com {\n headscale https://hs.example.org key\n}", false},
+		{"headscale interval", "tailscale example.com {\n headscale http://hs.example.org:8080/ key 30s\n}", false},
+		{"headscale missing key", "tailscale example.com {\n headscale https://hs.example.org\n}", true},
+		{"headscale invalid url", "tailscale example.com {\n headscale hs.example.org key\n}", true},
+		{"headscale invalid interval", "tailscale example.com {\n headscale https://hs.example.org key often\n}", true},
+		{"headscale and agent", "tailscale example.com {\n headscale https://hs.example.org key\n agent :8443\n}", true},
+		{"user_subzones", "tailscale example.com {\n user_subzones\n}", false},
+		{"user_subzones with args", "tailscale example.com {\n user_subzones alice\n}", true},
+		{"ttl", "tailscale example.com {\n ttl 300\n}", false},
+		{"ttl with negative ttl", "tailscale example.com {\n ttl 300 30\n}", false},
+		{"ttl zero", "tailscale example.com {\n ttl 0\n}", true},
+		{"ttl not a number", "tailscale example.com {\n ttl long\n}", true},
+		{"ttl too many args", "tailscale example.com {\n ttl 300 30 10\n}", true},
+		{"ttl_jitter with ttl", "tailscale example.com {\n ttl 300\n ttl_jitter 100\n}", false},
+		{"ttl_jitter", "tailscale example.com {\n ttl_jitter 10\n}", false},
+		{"ttl_jitter missing value", "tailscale example.com {\n ttl_jitter\n}", true},
+		{"ttl_jitter not a number", "tailscale example.com {\n ttl_jitter ten\n}", true},
+		{"ttl_jitter too large", "tailscale example.com {\n ttl_jitter 60\n}", true},
+		{"privacy hash", "tailscale example.com {\n privacy hash\n}", false},
+		{"privacy hash with key", "tailscale example.com {\n privacy hash 000102030405060708090a0b0c0d0e0f\n}", false},
+		{"privacy hash short key", "tailscale example.com {\n privacy hash 0001\n}", true},
+		{"privacy hash key not hex", "tailscale example.com {\n privacy hash secret\n}", true},
+		{"privacy truncate", "tailscale example.com {\n privacy truncate\n}", false},
+		{"privacy truncate with key", "tailscale example.com {\n privacy truncate 000102030405060708090a0b0c0d0e0f\n}", true},
+		{"privacy unknown mode", "tailscale example.com {\n privacy redact\n}", true},
+		{"trusted_proxies", "tailscale example.com {\n trusted_proxies 10.0.0.0/8 192.0.2.1 2001:db8::/32\n}", false},
+		{"trusted_proxies missing value", "tailscale example.com {\n trusted_proxies\n}", true},
+		{"max_inflight", "tailscale example.com {\n max_inflight 1000\n}", false},
+		{"max_inflight fallthrough", "tailscale example.com {\n max_inflight 1000 fallthrough\n}", false},
+		{"max_inflight unknown action", "tailscale example.com {\n max_inflight 1000 drop\n}", true},
+		{"answer_cache", "tailscale example.com {\n answer_cache\n}", false},
+		{"answer_cache size", "tailscale example.com {\n answer_cache 500\n}", false},
+		{"answer_cache zero size", "tailscale example.com {\n answer_cache 0\n}", true},
+		{"answer_cache extra argument", "tailscale example.com {\n answer_cache 500 1000\n}", true},
+		{"answer_cache with ttl_jitter", "tailscale example.com {\n ttl_jitter 5\n answer_cache\n}", true},
+		{"long_names truncate", "tailscale example.com {\n long_names truncate\n}", false},
+		{"long_names unknown", "tailscale example.com {\n long_names drop\n}", true},
+		{"long_names no args", "tailscale example.com {\n long_names\n}", true},
+		{"multiple zones", "tailscale example.com ts.internal", false},
+		{"duplicate zones", "tailscale example.com EXAMPLE.com.", true},
+		{"enumeration_detect", "tailscale example.com {\n enumeration_detect\n}", false},
+		{"enumeration_detect with args", "tailscale example.com {\n enumeration_detect 500 5m\n}", false},
+		{"enumeration_detect zero threshold", "tailscale example.com {\n enumeration_detect 0\n}", true},
+		{"enumeration_detect invalid window", "tailscale example.com {\n enumeration_detect 500 soon\n}", true},
+		{"ns", "tailscale example.com {\n ns ns1.example.com ns2.example.net\n}", false},
+		{"ns without names", "tailscale example.com {\n ns\n}", true},
+		{"soa", "tailscale example.com {\n soa dns@example.com\n}", false},
+		{"soa with timers", "tailscale example.com {\n soa dns.example.com 1h 15m 336h\n}", false},
+		{"soa invalid timer", "tailscale example.com {\n soa dns.example.com 1h 15m forever\n}", true},
+		{"soa zero timer", "tailscale example.com {\n soa dns.example.com 0s 15m 336h\n}", true},
+		{"soa missing timers", "tailscale example.com {\n soa dns.example.com 1h\n}", true},
+		{"srv", "tailscale example.com {\n srv tag:web https tcp 443\n srv tag:dns domain udp 53\n}", false},
+		{"srv hostinfo", "tailscale example.com {\n srv hostinfo\n}", false},
+		{"srv invalid tag", "tailscale example.com {\n srv web https tcp 443\n}", true},
+		{"srv invalid service", "tailscale example.com {\n srv tag:web _https tcp 443\n}", true},
+		{"srv invalid proto", "tailscale example.com {\n srv tag:web https sctp 443\n}", true},
+		{"srv invalid port", "tailscale example.com {\n srv tag:web https tcp 65536\n}", true},
+		{"filter_aaaa", "tailscale example.com {\n filter_aaaa 192.0.2.0/24 2001:db8::1 tag:legacy\n}", false},
+		{"filter_aaaa missing args", "tailscale example.com {\n filter_aaaa\n}", true},
+		{"filter_aaaa invalid range", "tailscale example.com {\n filter_aaaa 192.0.2.0/33\n}", true},
+		{"filter_aaaa invalid tag", "tailscale example.com {\n filter_aaaa tag:\n}", true},
+		{"fallthrough types", "tailscale example.com {\n fallthrough types MX txt\n}", false},
+		{"fallthrough zones and types", "tailscale example.com {\n fallthrough example.com types MX\n}", false},
+		{"fallthrough types missing", "tailscale example.com {\n fallthrough types\n}", true},
+		{"fallthrough types unknown", "tailscale example.com {\n fallthrough types BOGUS\n}", true},
+		{"passthrough_unknown_types", "tailscale example.com {\n passthrough_unknown_types\n}", false},
+		{"passthrough_unknown_types args", "tailscale example.com {\n passthrough_unknown_types MX\n}", true},
+		{"answer_order shuffle", "tailscale example.com {\n answer_order shuffle\n}", false},
+		{"answer_order seeded shuffle", "tailscale example.com {\n answer_order shuffle 42\n}", false},
+		{"answer_order round_robin", "tailscale example.com {\n answer_order round_robin\n}", false},
+		{"answer_order unknown", "tailscale example.com {\n answer_order random\n}", true},
+		{"answer_order invalid seed", "tailscale example.com {\n answer_order shuffle x\n}", true},
+		{"answer_order seed without shuffle", "tailscale example.com {\n answer_order round_robin 42\n}", true},
+		{"health_check online", "tailscale example.com {\n health_check online\n}", false},
+		{"health_check tcp", "tailscale example.com {\n health_check tcp 443\n}", false},
+		{"health_check https with interval and failures", "tailscale example.com {\n health_check https 443 5s 2\n}", false},
+		{"health_check online with port", "tailscale example.com {\n health_check online 443\n}", true},
+		{"health_check tcp without port", "tailscale example.com {\n health_check tcp\n}", true},
+		{"health_check icmp", "tailscale example.com {\n health_check icmp 1\n}", true},
+		{"health_check invalid interval", "tailscale example.com {\n health_check tcp 443 0s\n}", true},
+		{"health_check invalid failures", "tailscale example.com {\n health_check tcp 443 5s 0\n}", true},
+		{"query_log", "tailscale example.com {\n query_log\n}", false},
+		{"query_log rate", "tailscale example.com {\n query_log 20\n}", false},
+		{"query_log invalid rate", "tailscale example.com {\n query_log 0\n}", true},
+		{"query_log extra args", "tailscale example.com {\n query_log 20 stdout\n}", true},
+		{"answer_hook no names", "tailscale example.com {\n answer_hook\n}", true},
+		{"answer_hook unknown", "tailscale example.com {\n answer_hook audit\n}", true},
+		{"export", "tailscale example.com {\n export memory ts.example.org\n}", false},
+		{"export missing zone", "tailscale example.com {\n export memory\n}", true},
+		{"export unknown provider", "tailscale example.com {\n export route53 ts.example.org\n}", true},
+		{"export invalid arguments", "tailscale example.com {\n export memory ts.example.org key\n}", true},
+		{"any all", "tailscale example.com {\n any all\n}", false},
+		{"any hinfo", "tailscale example.com {\n any hinfo\n}", false},
+		{"any unknown", "tailscale example.com {\n any refuse\n}", true},
+		{"any no args", "tailscale example.com {\n any\n}", true},
+		{"internal_errors negative", "tailscale example.com {\n internal_errors negative\n}", false},
+		{"internal_errors servfail", "tailscale example.com {\n internal_errors servfail\n}", false},
+		{"internal_errors unknown", "tailscale example.com {\n internal_errors nxdomain\n}", true},
+		{"internal_errors no args", "tailscale example.com {\n internal_errors\n}", true},
+		{"prefer_family ipv6", "tailscale example.com {\n prefer_family ipv6\n}", false},
+		{"ipv4 only", "tailscale example.com {\n ipv4 only\n}", false},
+		{"ipv6 off", "tailscale example.com {\n ipv6 off\n}", false},
+		{"ipv4 unknown mode", "tailscale example.com {\n ipv4 on\n}", true},
+		{"ipv4 and ipv6 only", "tailscale example.com {\n ipv4 only\n ipv6 only\n}", true},
+		{"ipv4 and ipv6 off", "tailscale example.com {\n ipv4 off\n ipv6 off\n}", true},
+		{"expose_metadata", "tailscale example.com {\n expose_metadata\n}", false},
+		{"expose_metadata args", "tailscale example.com {\n expose_metadata os\n}", true},
+		{"prefer_family unknown", "tailscale example.com {\n prefer_family inet6\n}", true},
+		{"srv ttl", "tailscale example.com {\n srv tag:web https tcp 443 300\n}", false},
+		{"srv invalid ttl", "tailscale example.com {\n srv tag:web https tcp 443 0\n}", true},
+		{"srv ttl below jitter", "tailscale example.com {\n ttl_jitter 20\n srv tag:web https tcp 443 10\n}", true},
+		{"srv missing args", "tailscale example.com {\n srv tag:web https tcp\n}", true},
+		{"backend fallback", "tailscale example.com {\n backend localapi, api\n api_key tskey-api-123\n agent :8443\n}", false},
+		{"backend api only", "tailscale example.com {\n backend api\n api_key tskey-api-123\n}", false},
+		{"backend api first", "tailscale example.com {\n backend api localapi\n api_key tskey-api-123\n}", true},
+		{"backend api without key", "tailscale example.com {\n backend localapi api\n}", true},
+		{"backend localapi with key", "tailscale example.com {\n backend localapi\n api_key tskey-api-123\n}", true},
+		{"backend unknown", "tailscale example.com {\n backend consul\n}", true},
+		{"backend headscale without server", "tailscale example.com {\n backend headscale\n}", true},
+		{"backend headscale fallback", "tailscale example.com {\n backend localapi, headscale\n headscale https://hs.example.org key\n agent :8443\n}", false},
+		{"backend api and headscale", "tailscale example.com {\n api_key tskey-api-123\n headscale https://hs.example.org key\n}", true},
+		{"store", "tailscale example.com {\n store bolt /var/lib/coredns/tailscale.db\n}", false},
+		{"store missing path", "tailscale example.com {\n store bolt\n}", true},
+		{"record_netmaps", "tailscale example.com {\n record_netmaps /tmp/netmaps.jsonl\n}", false},
+		{"record_netmaps missing path", "tailscale example.com {\n record_netmaps\n}", true},
+		{"store unknown backend", "tailscale example.com {\n store redis localhost:6379\n}", true},
+		{"max_lookups", "tailscale example.com {\n max_lookups 100\n}", false},
+		{"max_lookups zero", "tailscale example.com {\n max_lookups 0\n}", true},
+		{"max_lookups invalid", "tailscale example.com {\n max_lookups many\n}", true},
+		{"max_cname_chain", "tailscale example.com {\n max_cname_chain 4\n}", false},
+		{"max_cname_chain negative", "tailscale example.com {\n max_cname_chain -1\n}", true},
+		{"upstream", "tailscale example.com {\n upstream\n}", false},
+		{"upstream with argument", "tailscale example.com {\n upstream 8.8.8.8\n}", true},
+		{"tag_enumeration", "tailscale example.com {\n tag_enumeration\n}", false},
+		{"tag_enumeration with argument", "tailscale example.com {\n tag_enumeration prod\n}", true},
+		{"wildcard on", "tailscale example.com {\n wildcard on\n}", false},
+		{"wildcard off", "tailscale example.com {\n wildcard off\n}", false},
+		{"wildcard tag", "tailscale example.com {\n wildcard tag:dns-wildcard\n}", false},
+		{"wildcard invalid", "tailscale example.com {\n wildcard some\n}", true},
+		{"include_tags", "tailscale example.com {\n include_tags tag:prod tag:infra\n}", false},
+		{"exclude_tags", "tailscale example.com {\n exclude_tags tag:ci\n exclude_tags tag:personal\n}", false},
+		{"include_tags missing tags", "tailscale example.com {\n include_tags\n}", true},
+		{"exclude_tags invalid tag", "tailscale example.com {\n exclude_tags ci\n}", true},
+		{"profile", "tailscale example.com {\n profile ephemeral {\n  ttl 5\n  online_only\n }\n profile ci tag:ci tag:runner {\n  ttl 30\n }\n ttl 60\n}", false},
+		{"profile without block", "tailscale example.com {\n profile ephemeral\n}", false},
+		{"profile missing name", "tailscale example.com {\n profile {\n  ttl 5\n }\n}", true},
+		{"profile invalid tag", "tailscale example.com {\n profile ci ci {\n  ttl 5\n }\n}", true},
+		{"profile invalid ttl", "tailscale example.com {\n profile ephemeral {\n  ttl 0\n }\n}", true},
+		{"profile unknown option", "tailscale example.com {\n profile ephemeral {\n  wildcard off\n }\n}", true},
+		{"profile duplicate", "tailscale example.com {\n profile ephemeral\n profile ephemeral\n}", true},
+		{"profile ttl below jitter", "tailscale example.com {\n ttl_jitter 10\n profile ephemeral {\n  ttl 5\n }\n}", true},
+		{"view", "tailscale example.com {\n view ci {\n  show tag:ci self\n }\n view eng alice@example.com bob@ tag:dev {\n  show tag:dev web\n  show alice@example.com\n }\n view guests * {\n  show www\n }\n}", false},
+		{"view without block", "tailscale example.com {\n view ci\n}", true},
+		{"view missing name", "tailscale example.com {\n view {\n  show *\n }\n}", true},
+		{"view invalid client", "tailscale example.com {\n view ci ci {\n  show *\n }\n}", true},
+		{"view shows nothing", "tailscale example.com {\n view ci {\n }\n}", true},
+		{"view invalid machine", "tailscale example.com {\n view ci {\n  show web.example.com\n }\n}", true},
+		{"view unknown option", "tailscale example.com {\n view ci {\n  ttl 5\n }\n}", true},
+		{"view duplicate", "tailscale example.com {\n view ci {\n  show *\n }\n view ci {\n  show *\n }\n}", true},
+		{"view reserved name", "tailscale example.com {\n view grant * {\n  show *\n }\n}", true},
+		{"view with api", "tailscale example.com {\n api_key tskey-api-abc\n tailnet example.org\n view ci {\n  show *\n }\n}", true},
+		{"view_grants", "tailscale example.com {\n view_grants\n}", false},
+		{"view_grants capability", "tailscale example.com {\n view_grants example.com/cap/dns-view\n}", false},
+		{"view_grants invalid capability", "tailscale example.com {\n view_grants dns-view\n}", true},
+		{"view_grants extra argument", "tailscale example.com {\n view_grants example.com/cap/a example.com/cap/b\n}", true},
+		{"subzone", "tailscale example.com {\n subzone tag:k8s\n subzone tag:production prod\n}", false},
+		{"subzone invalid tag", "tailscale example.com {\n subzone k8s\n}", true},
+		{"subzone invalid label", "tailscale example.com {\n subzone tag:k8s k8s.cluster\n}", true},
+		{"alpn", "tailscale example.com {\n alpn tag:web h2 http/1.1\n alpn tag:quic h3\n}", false},
+		{"alpn missing protocols", "tailscale example.com {\n alpn tag:web\n}", true},
+		{"alpn invalid tag", "tailscale example.com {\n alpn web h2\n}", true},
+		{"record", "tailscale example.com {\n record grafana 300 IN CNAME monitoring\n record www CNAME www.example.org.\n record status TXT \"all systems go\"\n}", false},
+		{"record absolute", "tailscale example.com {\n record nas.example.com. A 192.168.1.10\n}", false},
+		{"record unsupported type", "tailscale example.com {\n record mail MX 10 mx.example.org.\n}", true},
+		{"record outside zone", "tailscale example.com {\n record nas.example.org. A 192.168.1.10\n}", true},
+		{"record too deep", "tailscale example.com {\n record a.nas A 192.168.1.10\n}", true},
+		{"record cname and address", "tailscale example.com {\n record nas CNAME storage\n record nas A 192.168.1.10\n}", true},
+		{"record ttl too large", "tailscale example.com {\n record nas 2147483648 A 192.168.1.10\n}", true},
+		{"record ttl below jitter", "tailscale example.com {\n ttl_jitter 20\n record nas 10 A 192.168.1.10\n}", true},
+		{"record ttls differ", "tailscale example.com {\n record nas 10 A 192.168.1.10\n record nas A 192.168.1.11\n}", true},
+		{"record invalid", "tailscale example.com {\n record nas A 192.168.1\n}", true},
+		{"glue", "tailscale example.com {\n glue\n}", false},
+		{"glue with args", "tailscale example.com {\n glue yes\n}", true},
+		{"ptr_target magicdns", "tailscale example.com {\n ptr_target magicdns\n}", false},
+		{"ptr_target unknown", "tailscale example.com {\n ptr_target fqdn\n}", true},
+		{"ptr_target missing", "tailscale example.com {\n ptr_target\n}", true},
+		{"transfer_peers", "tailscale example.com {\n transfer_peers secondary tag:dns\n}", false},
+		{"transfer_peers missing", "tailscale example.com {\n transfer_peers\n}", true},
+		{"transfer_peers empty tag", "tailscale example.com {\n transfer_peers tag:\n}", true},
+		{"transfer_peers fqdn", "tailscale example.com {\n transfer_peers secondary.example.com\n}", true},
+		{"agent", "tailscale example.com {\n agent :8443\n}", false},
+		{"agent with expiry", "tailscale example.com {\n agent :8443 1h\n}", false},
+		{"agent invalid expiry", "tailscale example.com {\n agent :8443 soon\n}", true},
+		{"agent negative expiry", "tailscale example.com {\n agent :8443 -1m\n}", true},
+		{"debug", "tailscale example.com {\n debug localhost:8054\n}", false},
+		{"offline_nodes omit", "tailscale example.com {\n offline_nodes omit\n}", false},
+		{"offline_nodes flag", "tailscale example.com {\n offline_nodes flag\n}", false},
+		{"offline_nodes flag ttl", "tailscale example.com {\n offline_nodes flag 10\n}", false},
+		{"offline_nodes unknown", "tailscale example.com {\n offline_nodes hide\n}", true},
+		{"offline_nodes ttl without flag", "tailscale example.com {\n offline_nodes omit 10\n}", true},
+		{"offline_nodes ttl below jitter", "tailscale example.com {\n ttl_jitter 10\n offline_nodes flag\n}", true},
+		{"adaptive_ttl", "tailscale example.com {\n adaptive_ttl\n}", false},
+		{"adaptive_ttl minimum and window", "tailscale example.com {\n adaptive_ttl 5 30m\n}", false},
+		{"adaptive_ttl zero minimum", "tailscale example.com {\n adaptive_ttl 0\n}", true},
+		{"adaptive_ttl invalid window", "tailscale example.com {\n adaptive_ttl 5 soon\n}", true},
+		{"adaptive_ttl zero window", "tailscale example.com {\n adaptive_ttl 5 0s\n}", true},
+		{"adaptive_ttl minimum below jitter", "tailscale example.com {\n ttl_jitter 10\n adaptive_ttl 5\n}", true},
+		{"adaptive_ttl extra argument", "tailscale example.com {\n adaptive_ttl 5 1h 2h\n}", true},
+		{"hostname_collisions", "tailscale example.com {\n hostname_collisions newest\n}", false},
+		{"hostname_collisions unknown", "tailscale example.com {\n hostname_collisions last\n}", true},
+		{"hostname_collisions no args", "tailscale example.com {\n hostname_collisions\n}", true},
+		{"max_staleness", "tailscale example.com {\n max_staleness 5m\n}", false},
+		{"max_staleness invalid", "tailscale example.com {\n max_staleness soon\n}", true},
+		{"max_staleness negative", "tailscale example.com {\n max_staleness -5m\n}", true},
+		{"debug with events", "tailscale example.com {\n debug localhost:8054 500\n}", false},
+		{"debug without address", "tailscale example.com {\n debug\n}", true},
+		{"debug invalid events", "tailscale example.com {\n debug localhost:8054 many\n}", true},
+		{"debug negative events", "tailscale example.com {\n debug localhost:8054 -1\n}", true},
+		{"max_inflight negative", "tailscale example.com {\n max_inflight -1\n}", true},
+		{"precedence", "tailscale example.com {\n precedence device tag manual\n}", false},
+		{"precedence incomplete", "tailscale example.com {\n precedence device tag\n}", true},
+		{"precedence duplicate", "tailscale example.com {\n precedence device device tag\n}", true},
+		{"precedence unknown source", "tailscale example.com {\n precedence device tag api\n}", true},
+		{"nsid", "tailscale example.com {\n nsid\n}", false},
+		{"nsid with id", "tailscale example.com {\n nsid dns-1\n}", false},
+		{"nsid too many args", "tailscale example.com {\n nsid dns 1\n}", true},
+		{"cookies", "tailscale example.com {\n cookies\n}", false},
+		{"cookies with secret", "tailscale example.com {\n cookies 000102030405060708090a0b0c0d0e0f\n}", false},
+		{"cookies short secret", "tailscale example.com {\n cookies 0001020304050607\n}", true},
+		{"dnssec", "tailscale example.com {\n dnssec\n}", false},
+		{"dnssec missing key", "tailscale example.com {\n dnssec /nonexistent/Kexample.com.+013+12345\n}", true},
+		{"padding", "tailscale example.com {\n padding\n}", false},
+		{"padding block", "tailscale example.com {\n padding 128\n}", false},
+		{"padding zero", "tailscale example.com {\n padding 0\n}", true},
+		{"padding negative", "tailscale example.com {\n padding -1\n}", true},
+		{"padding too large", "tailscale example.com {\n padding 70000\n}", true},
+		{"padding extra args", "tailscale example.com {\n padding 128 256\n}", true},
+		{"magicdns", "tailscale example.com {\n magicdns\n}", false},
+		{"magicdns resolver", "tailscale example.com {\n magicdns 127.0.0.1:5353\n}", false},
+		{"magicdns resolver without port", "tailscale example.com {\n magicdns 100.100.100.100\n}", true},
+		{"magicdns extra args", "tailscale example.com {\n magicdns 127.0.0.1:53 127.0.0.2:53\n}", true},
+		{"magicdns_overlap adjust", "tailscale example.com {\n magicdns_overlap adjust\n}", false},
+		{"magicdns_overlap unknown", "tailscale example.com {\n magicdns_overlap ignore\n}", true},
+		{"magicdns_overlap no args", "tailscale example.com {\n magicdns_overlap\n}", true},
+		{"app_connectors", "tailscale example.com {\n app_connectors\n}", false},
+		{"app_connectors label", "tailscale example.com {\n app_connectors saas\n}", false},
+		{"app_connectors endpoints label", "tailscale example.com {\n endpoints saas\n app_connectors saas\n}", true},
+		{"app_connectors extra args", "tailscale example.com {\n app_connectors a b\n}", true},
+		{"topology_records", "tailscale example.com {\n topology_records\n}", false},
+		{"topology_records extra args", "tailscale example.com {\n topology_records yes\n}", true},
+		{"topology_records routes label taken", "tailscale example.com {\n app_connectors routes\n topology_records\n}", true},
+		{"endpoints", "tailscale example.com {\n endpoints\n}", false},
+		{"endpoints label", "tailscale example.com {\n endpoints public\n}", false},
+		{"endpoints invalid label", "tailscale example.com {\n endpoints pub.lic\n}", true},
+		{"endpoints lan label", "tailscale example.com {\n endpoints lan\n}", true},
+		{"endpoints subzone label", "tailscale example.com {\n subzone tag:ext\n endpoints\n}", true},
+		{"endpoints extra args", "tailscale example.com {\n endpoints a b\n}", true},
+		{"cookies invalid secret", "tailscale example.com {\n cookies not-hex\n}", true},
+		{"rebind_marker", "tailscale example.com {\n rebind_marker\n}", false},
+		{"rebind_marker with args", "tailscale example.com {\n rebind_marker yes\n}", true},
+		{"stats", "tailscale example.com {\n stats\n}", false},
+		{"stats with args", "tailscale example.com {\n stats all\n}", true},
+		{"rebind_protection", "tailscale example.com {\n rebind_protection\n}", false},
+		{"rebind_protection with ranges", "tailscale example.com {\n rebind_protection 192.168.0.0/16 10.1.2.3\n}", false},
+		{"rebind_protection invalid range", "tailscale example.com {\n rebind_protection 192.168.0.0/40\n}", true},
+		{"trusted_proxies invalid", "tailscale example.com {\n trusted_proxies 10.0.0.0/33\n}", true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			c := caddy.NewTestController("dns", tc.input)
+			err := setup(c)
+			if tc.shouldErr && err == nil {
+				t.Fatalf("expected error for input %q, got none", tc.input)
+			}
+			if !tc.shouldErr && err != nil {
+				t.Fatalf("unexpected error for input %q: %v", tc.input, err)
+			}
+		})
+	}
+}
+
+func TestParse(t *testing.T) {
+	c := caddy.NewTestController("dns", `tailscale example.com {
+		authkey tskey-abc
+		ttl_jitter 5
+		privacy hash
+		trusted_proxies 10.0.0.0/8
+		fallthrough other.example.com
+	}`)
+	cfg, err := parse(c)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	want := NewConfig(
+		WithZone("example.com"),
+		WithAuthKey("tskey-abc"),
+		WithTTLJitter(5),
+		WithPrivacy("hash"),
+		WithTrustedProxies(netip.MustParsePrefix("10.0.0.0/8")),
+		WithFallthrough("other.example.com"),
+	)
+	if !cmp.Equal(cfg, want, cmp.Comparer(func(a, b netip.Prefix) bool { return a == b })) {
+		t.Errorf("parse() = %+v, want %+v", cfg, want)
+	}
+}
+
+func TestNew(t *testing.T) {
+	ts, err := New(NewConfig(WithZone("Example.COM")))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	testEquals(t, "zone", "example.com.", ts.zone)
+
+	ts, err = New(NewConfig(WithZones("example.com", "TS.internal")))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	testEquals(t, "zone", "example.com.", ts.zone)
+	testEquals(t, "zones", "example.com. ts.internal.", strings.Join(ts.zones, " "))
+	testEquals(t, "hostname", DefaultHostname, ts.hostname)
+	testEquals(t, "privacy", privacyOff, ts.privacy)
+	if ts.api != nil {
+		t.Error("API backend configured without credentials")
+	}
+
+	ts, err = New(NewConfig(WithZone("example.com"), WithOAuth("k123", "tskey-client-abc")))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if ts.api == nil || ts.api.tailnet != DefaultTailnet || ts.apiInterval != DefaultAPIInterval {
+		t.Errorf("want API backend for tailnet %q every %s, got %+v", DefaultTailnet, DefaultAPIInterval, ts.api)
+	}
+
+	t.Setenv("TEST_TS_AUTHKEY", "tskey-auth-abc")
+	ts, err = New(NewConfig(WithZone("example.com"), WithAuthKey("env:TEST_TS_AUTHKEY")))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !ts.embedded || ts.authkey != "tskey-auth-abc" {
+		t.Errorf("want embedded node with the auth key from the environment, got %t, %q", ts.embedded, ts.authkey)
+	}
+
+	invalid := []Config{
+		NewConfig(WithZone("example.com"), WithAuthKey("env:TEST_TS_UNSET")),
+		NewConfig(WithZone("example.com"), WithTSNet("", ":53"), WithHostname("")),
+		NewConfig(WithZone("example.com"), WithTSNet("", "53")),
+		NewConfig(),
+		NewConfig(WithZone("example.com"), WithTTLJitter(defaultTTL)),
+		NewConfig(WithZone("example.com"), WithPrivacy("redact")),
+		NewConfig(WithZone("example.com"), WithAuthKey("tskey-abc"), WithHostname("")),
+	}
+	for _, cfg := range invalid {
+		if _, err := New(cfg); err == nil {
+			t.Errorf("New(%+v): expected error, got none", cfg)
+		}
+	}
+}
+
+func TestParseRecords(t *testing.T) {
+	entries, ttls, err := parseRecords([]string{
+		"grafana 300 IN CNAME monitoring",
+		"nas.example.com. A 192.168.1.10",
+		"NAS AAAA fd00::10",
+		recordLine([]string{"status", "TXT", "all systems go", "v=1"}),
+	}, "example.com.")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := map[string]map[string][]string{
+		"grafana": {"CNAME": {"monitoring.example.com."}},
+		"nas":     {"A": {"192.168.1.10"}, "AAAA": {"fd00::10"}},
+		"status":  {"TXT": {"all systems go", "v=1"}},
+	}
+	if !cmp.Equal(entries, want) {
+		t.Errorf("parseRecords() = %v, want %v", entries, want)
+	}
+	if want := map[string]map[string]uint32{"grafana": {"CNAME": 300}}; !cmp.Equal(ttls, want) {
+		t.Errorf("parseRecords() TTLs = %v, want %v", ttls, want)
+	}
+
+	// The records of an RRset share their TTL.
+	if _, _, err := parseRecords([]string{"nas 300 A 192.168.1.10", "nas 600 A 192.168.1.11"}, "example.com."); err == nil {
+		t.Error("want an error for records of an RRset with different TTLs")
+	}
+}
+
+func TestConfigHash(t *testing.T) {
+	a := NewConfig(WithZone("example.com"), WithTTL(300, 30))
+	b := NewConfig(WithTTL(300, 30), WithZone("example.com"))
+	if a.Hash() != b.Hash() {
+		t.Errorf("want equal hashes for the same configuration, got %s and %s", a.Hash(), b.Hash())
+	}
+	if c := NewConfig(WithZone("example.com"), WithTTL(300, 60)); c.Hash() == a.Hash() {
+		t.Error("want different hashes for different configurations")
+	}
+	if len(a.Hash()) != 64 {
+		t.Errorf("want a hex encoded SHA-256 hash, got %q", a.Hash())
+	}
+	// Secrets aren't part of the digest, which would let them be guessed.
+	secret := NewConfig(WithZone("example.com"), WithAPIKey("tskey-api-one"))
+	if other := NewConfig(WithZone("example.com"), WithAPIKey("tskey-api-two")); secret.Hash() != other.Hash() {
+		t.Error("want the same hash for configurations that only differ in secrets")
+	}
+}
+
+func TestDiffConfigs(t *testing.T) {
+	old := NewConfig(WithZone("example.com"), WithAPIKey("tskey-api-old"), WithExcludeTags("tag:test"))
+	cur := NewConfig(WithZones("example.com", "example.net"), WithAPIKey("tskey-api-new"))
+	want := []settingChange{
+		{"api_key", "[redacted]", "[redacted]"},
+		{"exclude_tags", `["tag:test"]`, "unset"},
+		{"zones", `["example.com"]`, `["example.com","example.net"]`},
+	}
+	if diff := cmp.Diff(want, diffConfigs(old, cur)); diff != "" {
+		t.Errorf("changes mismatch (-want +got):\n%s", diff)
+	}
+	if changes := diffConfigs(old, old); len(changes) != 0 {
+		t.Errorf("want no changes for the same configuration, got %v", changes)
+	}
+
+	// The arguments of the export provider hold its credentials.
+	old = NewConfig(WithZone("example.com"), WithExport("route53", "ts.example.org", "secret-old"))
+	cur = NewConfig(WithZone("example.com"), WithExport("route53", "ts.example.org", "secret-new"))
+	want = []settingChange{{"export_args", "[redacted]", "[redacted]"}}
+	if diff := cmp.Diff(want, diffConfigs(old, cur)); diff != "" {
+		t.Errorf("export changes mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestLogReload(t *testing.T) {
+	before := testutil.ToFloat64(ReloadCount.WithLabelValues("reload.example."))
+	first, _ := New(NewConfig(WithZone("reload.example.")))
+	first.logReload()
+	if got := testutil.ToFloat64(ReloadCount.WithLabelValues("reload.example.")) - before; got != 0 {
+		t.Errorf("want no reload counted on the first start, got %v", got)
+	}
+	second, _ := New(NewConfig(WithZone("reload.example."), WithTTL(30, 30)))
+	second.logReload()
+	if got := testutil.ToFloat64(ReloadCount.WithLabelValues("reload.example.")) - before; got != 1 {
+		t.Errorf("want 1 reload counted, got %v", got)
+	}
+}
+
+func TestRegisterMetrics(t *testing.T) {
+	// Registering again, as on reload or for another server block, mustn't panic.
+	for i := 0; i < 2; i++ {
+		registerMetrics(caddy.NewTestController("dns", "tailscale example.com"))
+	}
+	var already prometheus.AlreadyRegisteredError
+	if err := prometheus.Register(NodeCount); !errors.As(err, &already) {
+		t.Errorf("want the metrics registered, got %v", err)
+	}
+
+	// The metrics of an instance are dropped when it shuts down, those of others are kept.
+	NodeCount.WithLabelValues("", "gone.example.").Set(3)
+	NodeCount.WithLabelValues("", "kept.example.").Set(4)
+	deleteZoneMetrics("gone.example.")
+	if got := testutil.ToFloat64(NodeCount.WithLabelValues("", "kept.example.")); got != 4 {
+		t.Errorf("want the nodes of another zone kept, got %v", got)
+	}
+	if got := testutil.ToFloat64(NodeCount.WithLabelValues("", "gone.example.")); got != 0 {
+		t.Errorf("want the nodes of the zone dropped, got %v", got)
+	}
+}
@@ -0,0 +1,86 @@
+package tailscale
+
+import (
+	"encoding/json"
+	"maps"
+	"net/http"
+	"slices"
+	"time"
+)
+
+// debugRecordsPath is the path of the debug endpoint listing the records served.
+const debugRecordsPath = "/tailscale/records"
+
+// sourceStore marks records loaded from the store, which are served until the first sync.
+const sourceStore = "store"
+
+// Snapshot is a copy of the records the plugin serves at one point in time.
+type Snapshot struct {
+	// Zone is the primary zone, the one Names are in.
+	Zone string `json:"zone"`
+	// Serial is the serial of the SOA record.
+	Serial uint32 `json:"serial"`
+	// Names lists the names with records, sorted.
+	Names []NameSnapshot `json:"names"`
+}
+
+// NameSnapshot is a name with its records, as served in the primary zone.
+type NameSnapshot struct {
+	// Name is the fully qualified name in the primary zone.
+	Name string `json:"name"`
+	// Source is where the records come from: "manual" for static records, "tag" for records derived
+	// from tags, "device" for nodes, or "store" for records loaded from the store.
+	Source string `json:"source"`
+	// Updated is when the records of the name last changed.
+	Updated time.Time `json:"updated"`
+	// Records maps record types to their values.
+	Records map[string][]string `json:"records"`
+}
+
+// Snapshot returns a copy of the records currently served, to inspect what the plugin answers
+// without going through DNS. Names below the names of nodes, which get their records too unless
+// wildcards are off, are left out, and so are the records of other zones, which are the same.
+func (t *Tailscale) Snapshot() Snapshot {
+	d := t.load()
+	s := Snapshot{Zone: t.zone, Serial: d.serial, Names: make([]NameSnapshot, 0, len(d.entries))}
+	for _, name := range slices.Sorted(maps.Keys(d.entries)) {
+		records := make(map[string][]string, len(d.entries[name]))
+		for rrtype, values := range d.entries[name] {
+			records[rrtype] = slices.Clone(values)
+		}
+		s.Names = append(s.Names, NameSnapshot{
+			Name:    name + "." + t.zone,
+			Source:  d.sources[name],
+			Updated: d.updated[name],
+			Records: records,
+		})
+	}
+	return s
+}
+
+// updateTimes returns when the records of each name in entries last changed, keeping the times in
+// times for names whose records are the same as in old.
+func updateTimes(old, entries map[string]map[string][]string, times map[string]time.Time, now time.Time) map[string]time.Time {
+	updated := make(map[string]time.Time, len(entries))
+	for name, records := range entries {
+		if prev, ok := old[name]; ok && !times[name].IsZero() && maps.EqualFunc(prev, records, slices.Equal) {
+			updated[name] = times[name]
+			continue
+		}
+		updated[name] = now
+	}
+	return updated
+}
+
+// serveRecords writes a snapshot of the records served as JSON. Names honour privacy like the
+// sync events.
+func (t *Tailscale) serveRecords(w http.ResponseWriter, r *http.Request) {
+	s := t.Snapshot()
+	for i := range s.Names {
+		s.Names[i].Name = t.logName(s.Names[i].Name)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(s); err != nil {
+		log.Warningf("Unable to write records: %v", err)
+	}
+}
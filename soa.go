@@ -0,0 +1,105 @@
+package tailscale
+
+import (
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Default SOA timers, in seconds. They only matter to secondary servers transferring the zones.
+const (
+	DefaultSOARefresh = 7200
+	DefaultSOARetry   = 1800
+	DefaultSOAExpire  = 1209600
+)
+
+// soaMbox converts a SOA mailbox given as an email address to a domain name. Domain names and the
+// empty string are returned unchanged.
+func soaMbox(mbox string) string {
+	if mbox == "" {
+		return ""
+	}
+	return dns.CanonicalName(strings.Replace(mbox, "@", ".", 1))
+}
+
+// nameServers returns the name servers of the zones, in the primary zone. Without configured name
+// servers the plugin's own node is the name server.
+func (t *Tailscale) nameServers() []string {
+	if len(t.ns) > 0 {
+		return t.ns
+	}
+	hostname := t.hostname
+	if hostname == "" {
+		hostname = DefaultHostname
+	}
+	return []string{dns.Fqdn(hostname + "." + dns.Fqdn(t.zone))}
+}
+
+// soaSerial returns the SOA serial, which is the time records last changed.
+func (t *Tailscale) soaSerial(d *zoneData) uint32 {
+	if d.serial == 0 {
+		return uint32(time.Now().Unix())
+	}
+	return d.serial
+}
+
+// soa returns the SOA record of zone. Its TTL and minimum are the negative TTL, so that resolvers
+// cache negative answers carrying it for that long (RFC 2308).
+func (t *Tailscale) soa(d *zoneData, zone string) *dns.SOA {
+	zone = dns.Fqdn(zone)
+	mbox := t.soaMbox
+	if mbox == "" {
+		mbox = "hostmaster." + dns.Fqdn(t.zone)
+	}
+	refresh, retry, expire := t.soaRefresh, t.soaRetry, t.soaExpire
+	if refresh == 0 {
+		refresh, retry, expire = DefaultSOARefresh, DefaultSOARetry, DefaultSOAExpire
+	}
+	return &dns.SOA{
+		Hdr:     dns.RR_Header{Name: zone, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: t.negTTL()},
+		Ns:      moveName(t.nameServers()[0], t.zone, zone),
+		Mbox:    moveName(mbox, t.zone, zone),
+		Serial:  t.soaSerial(d),
+		Refresh: refresh,
+		Retry:   retry,
+		Expire:  expire,
+		Minttl:  t.negTTL(),
+	}
+}
+
+// nsRecords returns the NS records of zone.
+func (t *Tailscale) nsRecords(zone string) []dns.RR {
+	zone = dns.Fqdn(zone)
+	ttl := t.ttl()
+	var rrs []dns.RR
+	for _, ns := range t.nameServers() {
+		rrs = append(rrs, &dns.NS{
+			Hdr: dns.RR_Header{Name: zone, Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: ttl},
+			Ns:  moveName(ns, t.zone, zone),
+		})
+	}
+	return rrs
+}
+
+// resolveApex adds the records of the apex of zone for qtype to msg.
+func (t *Tailscale) resolveApex(d *zoneData, zone string, qtype uint16, msg *dns.Msg) {
+	switch qtype {
+	case dns.TypeSOA:
+		msg.Answer = append(msg.Answer, t.soa(d, zone))
+	case dns.TypeNS:
+		msg.Answer = append(msg.Answer, t.nsRecords(zone)...)
+	case dns.TypeDNSKEY:
+		if t.dnssec != nil {
+			msg.Answer = append(msg.Answer, t.dnssec.dnskeys(dns.Fqdn(zone), t.ttl())...)
+		}
+	case dns.TypeANY:
+		if t.anyPolicy != anyAll {
+			msg.Answer = append(msg.Answer, t.hinfoRecord(dns.Fqdn(zone)))
+			return
+		}
+		for _, qtype := range []uint16{dns.TypeSOA, dns.TypeNS, dns.TypeDNSKEY} {
+			t.resolveApex(d, zone, qtype, msg)
+		}
+	}
+}
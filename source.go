@@ -0,0 +1,255 @@
+package tailscale
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"tailscale.com/client/tailscale"
+	"tailscale.com/ipn"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/netmap"
+)
+
+// Tailnet is what a Source knows about the tailnet: its nodes, and the settings of the tailnet the
+// records depend on. Backends converting from a model of their own leave out what they don't have.
+type Tailnet struct {
+	// SelfNode is the node CoreDNS runs on, invalid for backends that aren't a member of the tailnet.
+	SelfNode tailcfg.NodeView
+	// Peers are the other nodes of the tailnet.
+	Peers []tailcfg.NodeView
+	// Domain is the MagicDNS domain of the tailnet, e.g. tail1234.ts.net.
+	Domain string
+	// DNS is the DNS configuration of the tailnet, which overlaps with the zones are looked for in.
+	DNS tailcfg.DNSConfig
+	// UserProfiles are the users owning the nodes, by ID.
+	UserProfiles map[tailcfg.UserID]tailcfg.UserProfile
+}
+
+// netMapTailnet returns the tailnet described by nm, a network map of the LocalAPI.
+func netMapTailnet(nm *netmap.NetworkMap) *Tailnet {
+	return &Tailnet{
+		SelfNode:     nm.SelfNode,
+		Peers:        nm.Peers,
+		Domain:       nm.Domain,
+		DNS:          nm.DNS,
+		UserProfiles: nm.UserProfiles,
+	}
+}
+
+// Source is a backend the records are built from. Backends describe the tailnet as a Tailnet,
+// converting to one from their own model, so the records of all of them are built the same way by
+// processTailnet.
+//
+// Sources return nodes rather than records: most of what's served depends on more than the records of
+// a node, and is derived from all nodes at once. Tags select the nodes published and give records of
+// their own, users give subzones, online state and capabilities give TTLs and views, and hostnames
+// several nodes share are resolved against each other. A backend that isn't a tailnet builds a
+// tailcfg.Node for each of its machines, with what it knows of them, as headscaleTailnet does.
+// Records that belong to no machine are static records of the Corefile instead, see Config.Records.
+type Source interface {
+	// Name returns the name of the backend, used in logs and as the backend label of metrics.
+	Name() string
+	// Fetch returns the current state of the tailnet.
+	Fetch(ctx context.Context) (*Tailnet, error)
+	// Watch calls update with the current state of the tailnet, and again on every change, until
+	// reading fails or ctx is done. Backends that can't push changes return errors.ErrUnsupported
+	// right away, and are polled with Fetch instead.
+	Watch(ctx context.Context, update func(*Tailnet)) error
+}
+
+// localAPISource watches the network map of a tailscaled or tsnet node on its IPN Bus.
+type localAPISource struct {
+	lc *tailscale.LocalClient
+}
+
+func (s *localAPISource) Name() string { return backendLocalAPI }
+
+// Fetch returns the tailnet of the network map the IPN Bus starts a watch with.
+func (s *localAPISource) Fetch(ctx context.Context) (*Tailnet, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var tn *Tailnet
+	err := s.Watch(ctx, func(n *Tailnet) {
+		tn = n
+		cancel()
+	})
+	if tn != nil {
+		return tn, nil
+	}
+	return nil, err
+}
+
+func (s *localAPISource) Watch(ctx context.Context, update func(*Tailnet)) error {
+	watcher, err := s.lc.WatchIPNBus(ctx, ipn.NotifyInitialNetMap)
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+	for {
+		n, err := watcher.Next()
+		if err != nil {
+			return err
+		}
+		if n.NetMap != nil {
+			update(netMapTailnet(n.NetMap))
+		}
+	}
+}
+
+// apiSource polls the device list of the Tailscale API.
+type apiSource struct {
+	client *apiClient
+	// logName formats device names for logs, see Tailscale.logName.
+	logName func(string) string
+}
+
+func (s *apiSource) Name() string { return backendAPI }
+
+func (s *apiSource) Fetch(ctx context.Context) (*Tailnet, error) {
+	ctx, cancel := context.WithTimeout(ctx, apiTimeout)
+	defer cancel()
+	devices, err := s.client.devices(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return devicesTailnet(devices, s.logName), nil
+}
+
+// Watch isn't supported, the API has no way to push changes of the device list.
+func (s *apiSource) Watch(context.Context, func(*Tailnet)) error {
+	return errors.ErrUnsupported
+}
+
+// polledSource returns the backend polled instead of watching the LocalAPI, or as fallback for it,
+// nil if neither the Tailscale API nor Headscale is configured.
+func (t *Tailscale) polledSource() Source {
+	switch {
+	case t.api != nil:
+		return &apiSource{client: t.api, logName: t.logName}
+	case t.headscale != nil:
+		return &headscaleSource{client: t.headscale, logName: t.logName}
+	}
+	return nil
+}
+
+// sync keeps the records up to date from t.source until ctx is done, watching it, or polling it
+// every API interval if it can't push changes.
+func (t *Tailscale) sync(ctx context.Context) {
+	if t.watch(ctx) {
+		return
+	}
+	t.poll(ctx, t.source, t.apiInterval)
+}
+
+// watch watches t.source and updates the records for any tailnet it sends. It returns once ctx
+// is done, or right away with false if the source can't be watched. If it is unable to read from the
+// source, it watches again with exponential backoff, starting over once a watch delivered updates
+// again. Meanwhile, the fallback source is polled every API interval if configured.
+func (t *Tailscale) watch(ctx context.Context) bool {
+	backoff := minWatchBackoff
+	var lastPoll time.Time
+	for ctx.Err() == nil {
+		updated, err := t.watchOnce(ctx)
+		if errors.Is(err, errors.ErrUnsupported) {
+			return false
+		}
+		if ctx.Err() != nil {
+			return true
+		}
+		if updated {
+			backoff = minWatchBackoff
+		}
+		if err == nil {
+			// The poll interval passed, watch again right away to fetch the full netmap.
+			continue
+		}
+
+		t.health.lost(time.Now())
+		RefreshFailures.WithLabelValues("", t.zone, t.source.Name()).Inc()
+		t.events.add(syncEvent{Time: time.Now(), Kind: eventError, Detail: err.Error()})
+		log.Infof("Unable to watch the %s backend, retrying in %s: %v", t.source.Name(), backoff, err)
+		if t.fallback != nil && time.Since(lastPoll) >= t.apiInterval {
+			lastPoll = time.Now()
+			if err := t.pollOnce(ctx, t.fallback); err != nil {
+				log.Warningf("Unable to poll the %s backend as fallback: %v", t.fallback.Name(), err)
+			} else {
+				setActiveBackend(t.fallback.Name())
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return true
+		case <-time.After(backoff):
+		}
+		backoff = min(2*backoff, maxWatchBackoff)
+	}
+	return true
+}
+
+// watchOnce watches t.source, starting with the current netmap, until reading from it fails. If a
+// poll interval is configured, it also stops once the interval passed and returns no error, so that
+// updates missed for whatever reason don't linger. It reports whether any netmap was received.
+func (t *Tailscale) watchOnce(ctx context.Context) (updated bool, err error) {
+	watchCtx := ctx
+	if t.pollInterval > 0 {
+		var cancel context.CancelFunc
+		watchCtx, cancel = context.WithTimeout(ctx, t.pollInterval)
+		defer cancel()
+	}
+
+	start := time.Now()
+	name := t.source.Name()
+	err = t.source.Watch(watchCtx, func(tn *Tailnet) {
+		t.recorder.record(tn)
+		t.processTailnet(tn)
+		setActiveBackend(name)
+		if !updated {
+			RefreshDuration.WithLabelValues("", t.zone, name).Observe(time.Since(start).Seconds())
+		}
+		t.health.refreshed(time.Now(), true)
+		updated = true
+	})
+	if err != nil && ctx.Err() == nil && watchCtx.Err() != nil {
+		return updated, nil
+	}
+	return updated, err
+}
+
+// poll updates the records from src every interval, until ctx is done. Failed polls keep the records
+// of the last successful one.
+func (t *Tailscale) poll(ctx context.Context, src Source, interval time.Duration) {
+	setActiveBackend(src.Name())
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := t.pollOnce(ctx, src); err != nil && ctx.Err() == nil {
+			log.Warningf("Unable to poll the %s backend, retrying in %s: %v", src.Name(), interval, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// pollOnce updates the records from the tailnet src fetches. Errors are also recorded as sync
+// events.
+func (t *Tailscale) pollOnce(ctx context.Context, src Source) error {
+	start := time.Now()
+	tn, err := src.Fetch(ctx)
+	if err != nil {
+		if ctx.Err() == nil {
+			RefreshFailures.WithLabelValues("", t.zone, src.Name()).Inc()
+			t.events.add(syncEvent{Time: time.Now(), Kind: eventError, Detail: err.Error()})
+		}
+		return err
+	}
+	t.recorder.record(tn)
+	t.processTailnet(tn)
+	RefreshDuration.WithLabelValues("", t.zone, src.Name()).Observe(time.Since(start).Seconds())
+	t.health.refreshed(time.Now(), false)
+	return nil
+}
@@ -0,0 +1,125 @@
+package tailscale
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	clog "github.com/coredns/coredns/plugin/pkg/log"
+	"github.com/miekg/dns"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/views"
+)
+
+// wellKnownServices maps the ports nodes advertise services on to service names from the IANA
+// registry (RFC 6335). Advertisements only carry the port and process name, so services on other
+// ports aren't published.
+var wellKnownServices = map[uint16]string{
+	21:   "ftp",
+	22:   "ssh",
+	25:   "smtp",
+	53:   "domain",
+	80:   "http",
+	143:  "imap",
+	443:  "https",
+	445:  "microsoft-ds",
+	3306: "mysql",
+	3389: "ms-wbt-server",
+	5432: "postgresql",
+	5900: "rfb",
+	6379: "redis",
+	8080: "http-alt",
+}
+
+// ServiceMapping publishes an SRV record _<Service>._<Proto>.<host>.<zone> pointing to Port on every
+// node with Tag. TTL, if set, is the TTL of the record, overriding the TTL of the zone and of profiles.
+type ServiceMapping struct {
+	Tag     string `json:"tag" yaml:"tag"`
+	Service string `json:"service" yaml:"service"`
+	Proto   string `json:"proto" yaml:"proto"`
+	Port    uint16 `json:"port" yaml:"port"`
+	TTL     uint32 `json:"ttl,omitempty" yaml:"ttl,omitempty"`
+}
+
+// validate reports whether the mapping is usable.
+func (m ServiceMapping) validate() error {
+	if !strings.HasPrefix(m.Tag, tagPrefix) || len(m.Tag) == len(tagPrefix) {
+		return fmt.Errorf("invalid service tag %q", m.Tag)
+	}
+	// Service names are at most 15 letters, digits and hyphens (RFC 6335, section 5.1).
+	if m.Service == "" || len(m.Service) > 15 || strings.Trim(m.Service, "abcdefghijklmnopqrstuvwxyz0123456789-") != "" {
+		return fmt.Errorf("invalid service name %q", m.Service)
+	}
+	if m.Proto != "tcp" && m.Proto != "udp" {
+		return fmt.Errorf("invalid service protocol %q", m.Proto)
+	}
+	if m.Port == 0 {
+		return fmt.Errorf("invalid port for service %s", m.Service)
+	}
+	return nil
+}
+
+// srvEntry formats an SRV entry: the labels of the SRV name in front of the host, and the port.
+func srvEntry(service, proto string, port uint16) string {
+	return fmt.Sprintf("_%s._%s %d", service, proto, port)
+}
+
+// parseSRVEntry parses an entry formatted by srvEntry.
+func parseSRVEntry(entry string) (prefix string, port uint16, ok bool) {
+	prefix, p, ok := strings.Cut(entry, " ")
+	if !ok {
+		return "", 0, false
+	}
+	n, err := strconv.ParseUint(p, 10, 16)
+	if err != nil {
+		return "", 0, false
+	}
+	return prefix, uint16(n), true
+}
+
+// nodeServices returns the SRV entries of node: the services mapped to its tags, and, if enabled, the
+// services it advertises on well-known ports.
+func (t *Tailscale) nodeServices(node tailcfg.NodeView) []string {
+	var entries []string
+	for _, m := range t.services {
+		if views.SliceContains(node.Tags(), m.Tag) {
+			entries = append(entries, srvEntry(m.Service, m.Proto, m.Port))
+		}
+	}
+	if t.srvHostinfo && node.Hostinfo().Valid() {
+		for _, svc := range node.Hostinfo().Services().All() {
+			if svc.Proto != tailcfg.TCP && svc.Proto != tailcfg.UDP {
+				continue
+			}
+			if name, ok := wellKnownServices[svc.Port]; ok {
+				entries = append(entries, srvEntry(name, string(svc.Proto), svc.Port))
+			}
+		}
+	}
+	slices.Sort(entries)
+	return slices.Compact(entries)
+}
+
+// resolveSRV adds the SRV records of domainName, which point to the node's name, to msg.
+func (t *Tailscale) resolveSRV(d *zoneData, domainName string, msg *dns.Msg) {
+	if clog.D.Value() {
+		log.Debugf("Resolving SRV record for %s in zone %s", t.logName(domainName), t.zone)
+	}
+
+	prefix, name := t.splitName(d, domainName)
+	if prefix == "" {
+		return
+	}
+	for _, entry := range d.entries[name]["SRV"] {
+		owner, port, ok := parseSRVEntry(entry)
+		if !ok || !strings.EqualFold(owner, prefix) {
+			continue
+		}
+		msg.Answer = append(msg.Answer, &dns.SRV{
+			Hdr:    dns.RR_Header{Name: domainName, Rrtype: dns.TypeSRV, Class: dns.ClassINET, Ttl: t.rrsetTTL(d, owner+"."+name, "SRV")},
+			Port:   port,
+			Target: dns.Fqdn(name + "." + t.zone),
+		})
+	}
+}
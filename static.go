@@ -0,0 +1,89 @@
+package tailscale
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// staticTypes are the types of records that can be configured statically.
+var staticTypes = []uint16{dns.TypeA, dns.TypeAAAA, dns.TypeCNAME, dns.TypeTXT}
+
+// parseRecords parses static records, given as zone file lines with names relative to zone, into
+// the entries of the manual source. Records must be directly below the zone, and are served for
+// subdomains of their name like the records of nodes. The TTLs given in the lines are returned by
+// name and type; records without one, or with a TTL of 0, get the TTL of the zone.
+func parseRecords(lines []string, zone string) (map[string]map[string][]string, map[string]map[string]uint32, error) {
+	zone = dns.Fqdn(zone)
+	entries := map[string]map[string][]string{}
+	ttls := map[string]map[string]uint32{}
+	for _, line := range lines {
+		zp := dns.NewZoneParser(strings.NewReader(line), zone, "")
+		// Records without a TTL get 0, so they're told apart from records with one.
+		zp.SetDefaultTTL(0)
+		rr, ok := zp.Next()
+		if err := zp.Err(); err != nil {
+			return nil, nil, fmt.Errorf("invalid record %q: %v", line, err)
+		}
+		if !ok {
+			return nil, nil, fmt.Errorf("invalid record %q", line)
+		}
+		if _, more := zp.Next(); more {
+			return nil, nil, fmt.Errorf("invalid record %q: more than one record", line)
+		}
+
+		hdr := rr.Header()
+		if !slices.Contains(staticTypes, hdr.Rrtype) {
+			return nil, nil, fmt.Errorf("unsupported record type %s in %q", dns.TypeToString[hdr.Rrtype], line)
+		}
+		if !dns.IsSubDomain(zone, hdr.Name) || dns.CountLabel(hdr.Name) != dns.CountLabel(zone)+1 {
+			return nil, nil, fmt.Errorf("record %q must be directly below %s", line, zone)
+		}
+		host := strings.ToLower(dns.SplitDomainName(hdr.Name)[0])
+		rrtype := dns.TypeToString[hdr.Rrtype]
+		if _, ok := entries[host][rrtype]; ok && ttls[host][rrtype] != hdr.Ttl {
+			// The records of an RRset share their TTL (RFC 2181, section 5.2).
+			return nil, nil, fmt.Errorf("%s records of %s have different TTLs", rrtype, host)
+		}
+		addTTL(ttls, host, rrtype, hdr.Ttl)
+
+		entry, ok := entries[host]
+		if !ok {
+			entry = map[string][]string{}
+			entries[host] = entry
+		}
+		switch rr := rr.(type) {
+		case *dns.A:
+			entry["A"] = append(entry["A"], rr.A.String())
+		case *dns.AAAA:
+			entry["AAAA"] = append(entry["AAAA"], rr.AAAA.String())
+		case *dns.CNAME:
+			entry["CNAME"] = append(entry["CNAME"], rr.Target)
+		case *dns.TXT:
+			// Tags are published as a single TXT record, and so are static ones.
+			if _, ok := entry["TXT"]; ok {
+				return nil, nil, fmt.Errorf("more than one TXT record for %s", host)
+			}
+			entry["TXT"] = rr.Txt
+		}
+		if _, ok := entry["CNAME"]; ok && len(entry) > 1 {
+			return nil, nil, fmt.Errorf("%s has a CNAME record and other records", host)
+		}
+	}
+	return entries, ttls, nil
+}
+
+// recordLine joins the arguments of a record directive into a zone file line, quoting arguments that
+// were quoted in the Corefile.
+func recordLine(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		if arg == "" || strings.ContainsAny(arg, " \t;\"") {
+			arg = `"` + strings.ReplaceAll(arg, `"`, `\"`) + `"`
+		}
+		quoted[i] = arg
+	}
+	return strings.Join(quoted, " ")
+}
@@ -0,0 +1,60 @@
+package tailscale
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// statsLabel is the label below the zone at which the statistics TXT record is published.
+const statsLabel = "_stats"
+
+// isStatsName reports whether domainName is the name of the statistics TXT record.
+func (t *Tailscale) isStatsName(d *zoneData, domainName string) bool {
+	if !t.stats {
+		return false
+	}
+	prefix, name := t.splitName(d, domainName)
+	return prefix == "" && strings.EqualFold(name, statsLabel)
+}
+
+// statsText returns the strings of the statistics TXT record at now: the number of hosts in the zone,
+// the number of names including aliases and subzones, the number of records, the SOA serial, the
+// seconds since the last sync with the tailnet and how old the records are, see syncHealth.
+func (t *Tailscale) statsText(d *zoneData, now time.Time) []string {
+	var hosts, records int
+	for name, byType := range d.entries {
+		if !strings.Contains(name, ".") {
+			hosts++
+		}
+		for _, values := range byType {
+			records += len(values)
+		}
+	}
+	lastSync := "never"
+	if !d.lastSync.IsZero() {
+		lastSync = strconv.Itoa(int(now.Sub(d.lastSync).Seconds()))
+	}
+	return []string{
+		"hosts=" + strconv.Itoa(hosts),
+		"names=" + strconv.Itoa(len(d.entries)),
+		"records=" + strconv.Itoa(records),
+		"serial=" + strconv.FormatUint(uint64(d.serial), 10),
+		"last_sync_age=" + lastSync,
+		"data_age=" + strconv.Itoa(int(t.health.age(now).Seconds())),
+	}
+}
+
+// resolveStats adds the statistics TXT record to msg if domainName is its name. The record changes
+// with every query, so it isn't cached.
+func (t *Tailscale) resolveStats(d *zoneData, domainName string, msg *dns.Msg) {
+	if !t.isStatsName(d, domainName) {
+		return
+	}
+	msg.Answer = append(msg.Answer, &dns.TXT{
+		Hdr: dns.RR_Header{Name: domainName, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 0},
+		Txt: t.statsText(d, time.Now()),
+	})
+}
@@ -0,0 +1,168 @@
+package tailscale
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Record store backends.
+const (
+	// storeBolt keeps the records in a bbolt database file.
+	storeBolt = "bolt"
+)
+
+// storeTimeout bounds how long opening a store waits for another process holding it.
+const storeTimeout = 5 * time.Second
+
+// entryStore keeps a durable copy of the served records, so that a restarted instance serves the
+// records it last knew about until it is in sync with the tailnet again.
+type entryStore interface {
+	// load returns the stored records of zone and their SOA serial. It returns nil entries if nothing
+	// is stored for zone.
+	load(zone string) (entries map[string]map[string][]string, serial uint32, err error)
+	// save replaces the stored records with entries, atomically.
+	save(zone string, entries map[string]map[string][]string, serial uint32) error
+	close() error
+}
+
+// openStore opens the store of backend at path.
+func openStore(backend, path string) (entryStore, error) {
+	switch backend {
+	case storeBolt:
+		return openBoltStore(path)
+	}
+	return nil, fmt.Errorf("unknown store %q", backend)
+}
+
+// Buckets and keys of the bolt store. Records are stored one host per key, as JSON.
+var (
+	boltRecords = []byte("records")
+	boltMeta    = []byte("meta")
+	boltZone    = []byte("zone")
+	boltSerial  = []byte("serial")
+)
+
+// boltStore is an entryStore backed by a bbolt database file.
+type boltStore struct {
+	db *bolt.DB
+}
+
+func openBoltStore(path string) (*boltStore, error) {
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: storeTimeout})
+	if err != nil {
+		return nil, err
+	}
+	return &boltStore{db: db}, nil
+}
+
+func (s *boltStore) load(zone string) (map[string]map[string][]string, uint32, error) {
+	var entries map[string]map[string][]string
+	var serial uint32
+	err := s.db.View(func(tx *bolt.Tx) error {
+		meta, records := tx.Bucket(boltMeta), tx.Bucket(boltRecords)
+		// Records of another zone have CNAME targets in that zone, so they aren't used.
+		if meta == nil || records == nil || string(meta.Get(boltZone)) != zone {
+			return nil
+		}
+		if b := meta.Get(boltSerial); len(b) == 4 {
+			serial = binary.BigEndian.Uint32(b)
+		}
+		entries = map[string]map[string][]string{}
+		return records.ForEach(func(k, v []byte) error {
+			var records map[string][]string
+			if err := json.Unmarshal(v, &records); err != nil {
+				return fmt.Errorf("records of %s: %w", k, err)
+			}
+			entries[string(k)] = records
+			return nil
+		})
+	})
+	return entries, serial, err
+}
+
+func (s *boltStore) save(zone string, entries map[string]map[string][]string, serial uint32) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.DeleteBucket(boltRecords); err != nil && !errors.Is(err, bolt.ErrBucketNotFound) {
+			return err
+		}
+		records, err := tx.CreateBucket(boltRecords)
+		if err != nil {
+			return err
+		}
+		for name, entry := range entries {
+			v, err := json.Marshal(entry)
+			if err != nil {
+				return err
+			}
+			if err := records.Put([]byte(name), v); err != nil {
+				return err
+			}
+		}
+
+		meta, err := tx.CreateBucketIfNotExists(boltMeta)
+		if err != nil {
+			return err
+		}
+		if err := meta.Put(boltZone, []byte(zone)); err != nil {
+			return err
+		}
+		return meta.Put(boltSerial, binary.BigEndian.AppendUint32(nil, serial))
+	})
+}
+
+func (s *boltStore) close() error {
+	return s.db.Close()
+}
+
+// loadStore serves the records in the store until the first sync. It does nothing without a store.
+func (t *Tailscale) loadStore() {
+	if t.store == nil {
+		return
+	}
+	entries, serial, err := t.store.load(t.zone)
+	if err != nil {
+		log.Warningf("Unable to load records from the store, starting without them: %v", err)
+		return
+	}
+	if entries == nil {
+		return
+	}
+
+	reverse, tags, addrs := t.reverseIndex(entries), t.tagIndex(entries), t.addrIndex(entries)
+	sources := map[string]string{}
+	for name := range entries {
+		sources[name] = sourceStore
+	}
+	now := time.Now()
+	t.mu.Lock()
+	t.update(func(d *zoneData) {
+		d.entries = entries
+		d.addrs = addrs
+		d.sources = sources
+		d.updated = updateTimes(nil, entries, nil, now)
+		d.reverse = reverse
+		d.tags = tags
+		d.serial = serial
+	})
+	t.mu.Unlock()
+	t.answers.flush()
+	t.synced.Store(true)
+	log.Infof("Loaded %d entries from the store", len(entries))
+}
+
+// saveStore writes the current records to the store. It does nothing without a store.
+func (t *Tailscale) saveStore() {
+	if t.store == nil {
+		return
+	}
+	d := t.load()
+	if err := t.store.save(t.zone, d.entries, d.serial); err != nil {
+		t.events.add(syncEvent{Time: time.Now(), Kind: eventError, Detail: err.Error()})
+		log.Warningf("Unable to save records to the store: %v", err)
+	}
+}
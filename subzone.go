@@ -0,0 +1,149 @@
+package tailscale
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	clog "github.com/coredns/coredns/plugin/pkg/log"
+	"github.com/miekg/dns"
+	"tailscale.com/tailcfg"
+)
+
+// subzoneLabel returns the label of the subzone of tag, the tag's name unless configured otherwise.
+func subzoneLabel(tag, label string) string {
+	if label == "" {
+		label = strings.TrimPrefix(tag, tagPrefix)
+	}
+	return strings.ToLower(label)
+}
+
+// validateSubzones checks the tags and labels of tag subzones.
+func validateSubzones(subzones map[string]string) error {
+	for tag, label := range subzones {
+		if !strings.HasPrefix(tag, tagPrefix) || len(tag) == len(tagPrefix) {
+			return fmt.Errorf("invalid subzone tag %q", tag)
+		}
+		label = subzoneLabel(tag, label)
+		if n, ok := dns.IsDomainName(label); !ok || n != 1 || strings.Contains(label, ".") || len(label) > maxLabelLen {
+			return fmt.Errorf("invalid subzone label %q for %s", label, tag)
+		}
+	}
+	return nil
+}
+
+// validateLabel checks label, the label of the subzone of directive, against the labels already used
+// below the zone: lan, those of tag subzones, and taken.
+func validateLabel(directive, label string, subzones map[string]string, taken ...string) error {
+	if n, ok := dns.IsDomainName(label); !ok || n != 1 || strings.Contains(label, ".") || len(label) > maxLabelLen {
+		return fmt.Errorf("invalid %s label %q", directive, label)
+	}
+	if strings.EqualFold(label, lanLabel) {
+		return fmt.Errorf("%s label %q is used for LAN addresses", directive, label)
+	}
+	for tag, l := range subzones {
+		if strings.EqualFold(label, subzoneLabel(tag, l)) {
+			return fmt.Errorf("%s label %q is used by the subzone of %s", directive, label, tag)
+		}
+	}
+	for _, l := range taken {
+		if strings.EqualFold(label, l) {
+			return fmt.Errorf("%s label %q is already used", directive, label)
+		}
+	}
+	return nil
+}
+
+// subzoneNames returns the names n is published at in subzones, sorted: its hostname in the subzones
+// of its tags, e.g. web.prod, and with user_subzones its name in the subzone of its user, given by
+// userNames.
+func (t *Tailscale) subzoneNames(n namedNode, userNames map[tailcfg.NodeView]string) []string {
+	var names []string
+	for _, tag := range n.node.Tags().All() {
+		if label, ok := t.subzones[tag]; ok && !slices.Contains(names, n.hostname+"."+label) {
+			names = append(names, n.hostname+"."+label)
+		}
+	}
+	if name, ok := userNames[n.node]; ok && !slices.Contains(names, name) {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// hostLabel returns name lowercased, with characters other than letters, digits and hyphens replaced
+// by hyphens, and at most maxLabelLen bytes long. It returns "" if nothing is left.
+func hostLabel(name string) string {
+	label := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '-' {
+			return r
+		}
+		return '-'
+	}, strings.ToLower(name))
+	if len(label) > maxLabelLen {
+		label = label[:maxLabelLen]
+	}
+	return strings.Trim(label, "-")
+}
+
+// userLabel returns the label of the subzone of the user with the login name login: the part before
+// the @ of an email address, see hostLabel.
+func userLabel(login string) string {
+	name, _, _ := strings.Cut(login, "@")
+	return hostLabel(name)
+}
+
+// userSubzone returns the label of the subzone of the user node belongs to, with user_subzones, or
+// "" if it isn't published in one. Tagged nodes belong to the tailnet rather than to the user who
+// added them, and users whose label is taken by another subzone aren't published either.
+func (t *Tailscale) userSubzone(tn *Tailnet, node tailcfg.NodeView) string {
+	if !t.userSubzones || node.IsTagged() {
+		return ""
+	}
+	profile, ok := tn.UserProfiles[node.User()]
+	if !ok {
+		return ""
+	}
+	label := userLabel(profile.LoginName)
+	if label == "" || t.subzoneLabels[label] || label == lanLabel || label == t.endpointLabel {
+		if clog.D.Value() {
+			log.Debugf("Not publishing user %s in a subzone, its label %q is empty or taken", t.logName(profile.LoginName), t.logName(label))
+		}
+		return ""
+	}
+	return label
+}
+
+// userSubzoneNames returns the names the nodes of published are given in the subzones of their users,
+// with user_subzones: the hostname the machine reports, rather than the name that's unique in the
+// tailnet, so that the machines of different users can have the same name, e.g. laptop.alice and
+// laptop.bob next to laptop and laptop-1. Nodes without a reported hostname keep theirs. Machines of
+// one user sharing a hostname are resolved like any others, and added to collisions.
+func (t *Tailscale) userSubzoneNames(tn *Tailnet, published []namedNode, collisions map[string][]string) map[tailcfg.NodeView]string {
+	if !t.userSubzones {
+		return nil
+	}
+	var named []namedNode
+	for _, n := range published {
+		label := t.userSubzone(tn, n.node)
+		if label == "" {
+			continue
+		}
+		host := n.hostname
+		if n.node.Hostinfo().Valid() {
+			if reported, ok := t.fitName(hostLabel(n.node.Hostinfo().Hostname())); ok && reported != "" {
+				host = reported
+			}
+		}
+		named = append(named, namedNode{n.node, host + "." + label})
+	}
+	named, userCollisions := t.resolveCollisions(named)
+	maps.Copy(collisions, userCollisions)
+
+	names := make(map[tailcfg.NodeView]string, len(named))
+	for _, n := range named {
+		names[n.node] = n.hostname
+	}
+	return names
+}
@@ -0,0 +1,145 @@
+package tailscale
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+
+	clog "github.com/coredns/coredns/plugin/pkg/log"
+	"github.com/miekg/dns"
+	"tailscale.com/tailcfg"
+)
+
+// validateALPN checks the protocols configured for each tag.
+func validateALPN(alpn map[string][]string) error {
+	for tag, protocols := range alpn {
+		if !strings.HasPrefix(tag, tagPrefix) || len(tag) == len(tagPrefix) {
+			return fmt.Errorf("invalid alpn tag %q", tag)
+		}
+		if len(protocols) == 0 {
+			return fmt.Errorf("no alpn protocols for %s", tag)
+		}
+		for _, p := range protocols {
+			// Protocol IDs are length-prefixed with a single byte (RFC 7301, section 3.1).
+			if p == "" || len(p) > 255 {
+				return errors.New("alpn protocol IDs must be 1 to 255 bytes long")
+			}
+		}
+	}
+	return nil
+}
+
+// nodeALPN returns the ALPN protocols configured for the tags of node, in the order of its tags.
+func (t *Tailscale) nodeALPN(node tailcfg.NodeView) []string {
+	var protocols []string
+	for _, tag := range node.Tags().All() {
+		for _, p := range t.alpn[tag] {
+			if !slices.Contains(protocols, p) {
+				protocols = append(protocols, p)
+			}
+		}
+	}
+	return protocols
+}
+
+// svcbRecord returns the SVCB or HTTPS record of a node, as rrtype, owned by name. The record is in
+// ServiceMode and points to the owner itself, with the node's addresses as hints and the ALPN
+// protocols configured for its tags. It returns nil if the node has no addresses. addrs are the
+// parsed addresses of records.
+func svcbRecord(name string, rrtype uint16, ttl uint32, records map[string][]string, addrs hostAddrs) dns.RR {
+	if len(records["A"]) == 0 && len(records["AAAA"]) == 0 {
+		return nil
+	}
+	svcb := dns.SVCB{
+		Hdr:      dns.RR_Header{Name: name, Rrtype: rrtype, Class: dns.ClassINET, Ttl: ttl},
+		Priority: 1,
+		Target:   ".",
+	}
+	// Parameters must be in ascending order of their keys.
+	if alpn := records["ALPN"]; len(alpn) > 0 {
+		svcb.Value = append(svcb.Value, &dns.SVCBAlpn{Alpn: alpn})
+	}
+	if hint := addrHints(addrs.v4); len(hint) > 0 {
+		svcb.Value = append(svcb.Value, &dns.SVCBIPv4Hint{Hint: hint})
+	}
+	if hint := addrHints(addrs.v6); len(hint) > 0 {
+		svcb.Value = append(svcb.Value, &dns.SVCBIPv6Hint{Hint: hint})
+	}
+	if rrtype == dns.TypeHTTPS {
+		return &dns.HTTPS{SVCB: svcb}
+	}
+	return &svcb
+}
+
+// addrHints returns addrs as an address hint.
+func addrHints(addrs []netip.Addr) []net.IP {
+	var hint []net.IP
+	for _, addr := range addrs {
+		hint = append(hint, addr.AsSlice())
+	}
+	return hint
+}
+
+// resolveSVCB adds the SVCB or HTTPS record, as qtype, of domainName to msg. Like addresses, it is
+// served for subdomains of the node's name too.
+func (t *Tailscale) resolveSVCB(ctx context.Context, d *zoneData, domainName string, qtype uint16, msg *dns.Msg) {
+	debug := clog.D.Value()
+	if debug {
+		log.Debugf("Resolving %s record for %s in zone %s", dns.TypeToString[qtype], t.logName(domainName), t.zone)
+	}
+	if !t.spendLookup(ctx, domainName) {
+		return
+	}
+
+	prefix, name := t.splitName(d, domainName)
+	if !t.wildcardAllowed(d, prefix, name) {
+		if debug {
+			log.Debugf("No wildcard records for names below %s", t.logName(name))
+		}
+		return
+	}
+	rr := svcbRecord(domainName, qtype, t.hostTTL(d, name), d.entries[name], d.addrs[name])
+	if rr == nil {
+		log.Debugf("No addresses for %s record, so trying CNAME", dns.TypeToString[qtype])
+		lookupType := TypeSVCB
+		if qtype == dns.TypeHTTPS {
+			lookupType = TypeHTTPS
+		}
+		t.resolveCNAME(ctx, d, domainName, msg, lookupType)
+		return
+	}
+	msg.Answer = append(msg.Answer, rr)
+}
+
+// stripInternalHints removes the internal addresses from the address hints of svcb, and the hints
+// left empty.
+func stripInternalHints(svcb *dns.SVCB) {
+	values := svcb.Value[:0]
+	for _, kv := range svcb.Value {
+		var hint *[]net.IP
+		switch kv := kv.(type) {
+		case *dns.SVCBIPv4Hint:
+			hint = &kv.Hint
+		case *dns.SVCBIPv6Hint:
+			hint = &kv.Hint
+		}
+		if hint != nil {
+			ips := (*hint)[:0]
+			for _, ip := range *hint {
+				if addr, ok := netip.AddrFromSlice(ip); !ok || !isInternalAddr(addr.Unmap()) {
+					ips = append(ips, ip)
+				}
+			}
+			*hint = ips
+			if len(ips) == 0 {
+				continue
+			}
+		}
+		values = append(values, kv)
+	}
+	svcb.Value = values
+}
@@ -0,0 +1,39 @@
+package tailscale
+
+import (
+	"fmt"
+	"strings"
+
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/views"
+)
+
+// validateTagFilter checks the tags of an include_tags or exclude_tags directive, named by option.
+func validateTagFilter(option string, tags []string) error {
+	for _, tag := range tags {
+		if !strings.HasPrefix(tag, tagPrefix) || len(tag) == len(tagPrefix) {
+			return fmt.Errorf("invalid %s tag %q", option, tag)
+		}
+	}
+	return nil
+}
+
+// publishNode reports whether node gets records: it must have one of the included tags, if any are
+// configured, and none of the excluded ones. Exclusion wins over inclusion.
+func (t *Tailscale) publishNode(node tailcfg.NodeView) bool {
+	tags := node.Tags()
+	for _, tag := range t.excludeTags {
+		if views.SliceContains(tags, tag) {
+			return false
+		}
+	}
+	if len(t.includeTags) == 0 {
+		return true
+	}
+	for _, tag := range t.includeTags {
+		if views.SliceContains(tags, tag) {
+			return true
+		}
+	}
+	return false
+}
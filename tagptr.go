@@ -0,0 +1,90 @@
+package tailscale
+
+import (
+	"slices"
+	"strings"
+
+	clog "github.com/coredns/coredns/plugin/pkg/log"
+	"github.com/miekg/dns"
+)
+
+// tagEnumerationLabel is the label in front of a tag's name at which the nodes with the tag are
+// enumerated, as in _tag.prod.<zone>.
+const tagEnumerationLabel = "_tag"
+
+// tagIndex maps the names of the tags in entries, without the tag: prefix and lowercased, to the
+// sorted names of the nodes with the tag. Like PTR targets, names in tag subzones are left out.
+func (t *Tailscale) tagIndex(entries map[string]map[string][]string) map[string][]string {
+	index := map[string][]string{}
+	for name, records := range entries {
+		if strings.Contains(name, ".") {
+			continue
+		}
+		fqdn := dns.Fqdn(name + "." + t.zone)
+		for _, value := range records["TXT"] {
+			if tag, ok := strings.CutPrefix(value, tagPrefix); ok && tag != "" {
+				tag = strings.ToLower(tag)
+				index[tag] = append(index[tag], fqdn)
+			}
+		}
+	}
+	for _, names := range index {
+		slices.Sort(names)
+	}
+	return index
+}
+
+// enumeratedTag returns the tag that domainName enumerates the nodes of, if it is of the form
+// _tag.<tag>.<zone>.
+func (t *Tailscale) enumeratedTag(domainName string) (string, bool) {
+	zone := dns.Fqdn(t.zone)
+	fqdn := dns.Fqdn(domainName)
+	if !dns.IsSubDomain(zone, fqdn) || dns.CountLabel(fqdn) != dns.CountLabel(zone)+2 {
+		return "", false
+	}
+	labels := dns.SplitDomainName(fqdn)
+	if !strings.EqualFold(labels[0], tagEnumerationLabel) {
+		return "", false
+	}
+	return strings.ToLower(labels[1]), true
+}
+
+// tagEnumerationExists reports whether domainName is the enumeration name of a tag with nodes, or one
+// of the empty non-terminals above them.
+func (t *Tailscale) tagEnumerationExists(d *zoneData, domainName string) bool {
+	if !t.tagEnumeration {
+		return false
+	}
+	if strings.EqualFold(dns.Fqdn(domainName), dns.Fqdn(tagEnumerationLabel+"."+t.zone)) {
+		return len(d.tags) > 0
+	}
+	if tag, ok := t.enumeratedTag(domainName); ok {
+		return len(d.tags[tag]) > 0
+	}
+	if tag, ok := t.enumeratedTag(tagEnumerationLabel + "." + domainName); ok {
+		return len(d.tags[tag]) > 0
+	}
+	return false
+}
+
+// resolveTagPTR adds a PTR record for every node with the tag that domainName enumerates to msg.
+func (t *Tailscale) resolveTagPTR(d *zoneData, domainName string, msg *dns.Msg) {
+	if !t.tagEnumeration {
+		return
+	}
+	tag, ok := t.enumeratedTag(domainName)
+	if !ok {
+		return
+	}
+	if clog.D.Value() {
+		log.Debugf("Resolving PTR records for %s in zone %s", t.logName(domainName), t.zone)
+	}
+
+	ttl := t.ttl()
+	for _, target := range d.tags[tag] {
+		msg.Answer = append(msg.Answer, &dns.PTR{
+			Hdr: dns.RR_Header{Name: domainName, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: ttl},
+			Ptr: target,
+		})
+	}
+}
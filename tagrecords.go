@@ -0,0 +1,117 @@
+package tailscale
+
+import (
+	"maps"
+	"net/netip"
+	"slices"
+	"strings"
+)
+
+// tagRecordPrefix starts the tags nodes advertise additional records of their name with, e.g.
+// tag:cdns-a-203-0-113-7 for an A record of 203.0.113.7, or tag:cdns-txt-v1 for a TXT string v1.
+// Tags only allow letters, digits and hyphens, so the dots of addresses are written as hyphens.
+const tagRecordPrefix = "tag:cdns-"
+
+// Kinds of problems with the records advertised through tags.
+const (
+	// tagRecordInvalid tags don't encode a record.
+	tagRecordInvalid = "invalid"
+	// tagRecordCollision addresses are advertised by more than one node, or are the address of another.
+	tagRecordCollision = "collision"
+)
+
+// tagRecords returns the records tags advertise, by type, and the tags with the record prefix that
+// don't encode a valid record.
+func tagRecords(tags []string) (records map[string][]string, invalid []string) {
+	for _, tag := range tags {
+		spec, ok := strings.CutPrefix(tag, tagRecordPrefix)
+		if !ok {
+			continue
+		}
+		rrtype, value, _ := strings.Cut(spec, "-")
+		switch strings.ToLower(rrtype) {
+		case "a":
+			addr, err := netip.ParseAddr(strings.ReplaceAll(value, "-", "."))
+			if err != nil || !addr.Is4() {
+				invalid = append(invalid, tag)
+				continue
+			}
+			records = addRecord(records, "A", addr.String())
+		case "txt":
+			if value == "" {
+				invalid = append(invalid, tag)
+				continue
+			}
+			records = addRecord(records, "TXT", value)
+		default:
+			invalid = append(invalid, tag)
+		}
+	}
+	return records, invalid
+}
+
+// addRecord adds value to the rrtype records of records, allocating it if needed.
+func addRecord(records map[string][]string, rrtype, value string) map[string][]string {
+	if records == nil {
+		records = map[string][]string{}
+	}
+	if !slices.Contains(records[rrtype], value) {
+		records[rrtype] = append(records[rrtype], value)
+	}
+	return records
+}
+
+// tagRecordCollisions returns the addresses in claimed, advertised through tags, that more than one
+// node in devices has, with the names of the nodes, sorted.
+func tagRecordCollisions(claimed map[string]bool, devices map[string]map[string][]string) map[string][]string {
+	owners := map[string][]string{}
+	for name, records := range devices {
+		if strings.Contains(name, ".") {
+			// Names in tag subzones are aliases.
+			continue
+		}
+		for _, addr := range records["A"] {
+			if claimed[addr] {
+				owners[addr] = append(owners[addr], name)
+			}
+		}
+	}
+	collisions := map[string][]string{}
+	for addr, names := range owners {
+		if len(names) > 1 {
+			slices.Sort(names)
+			collisions[addr] = names
+		}
+	}
+	return collisions
+}
+
+// reportTagRecords logs the problems with the records advertised through tags, when they differ from
+// the last ones, and exports their number by kind. invalid maps node names to their invalid record
+// tags, and collisions addresses to the nodes sharing them.
+func (t *Tailscale) reportTagRecords(invalid, collisions map[string][]string) {
+	t.mu.Lock()
+	changed := !maps.EqualFunc(invalid, t.invalidTagRecords, slices.Equal) || !maps.EqualFunc(collisions, t.collidingTagRecords, slices.Equal)
+	t.invalidTagRecords, t.collidingTagRecords = invalid, collisions
+	t.mu.Unlock()
+
+	var invalidTags int
+	for _, tags := range invalid {
+		invalidTags += len(tags)
+	}
+	TagRecordIssues.WithLabelValues("", t.zone, tagRecordInvalid).Set(float64(invalidTags))
+	TagRecordIssues.WithLabelValues("", t.zone, tagRecordCollision).Set(float64(len(collisions)))
+	if !changed {
+		return
+	}
+	for _, name := range slices.Sorted(maps.Keys(invalid)) {
+		log.Warningf("Ignoring invalid record tags of %s: %s", t.logName(name), strings.Join(invalid[name], ", "))
+	}
+	for _, addr := range slices.Sorted(maps.Keys(collisions)) {
+		names := make([]string, len(collisions[addr]))
+		for i, name := range collisions[addr] {
+			names[i] = t.logName(name)
+		}
+		log.Warningf("Address %s advertised through tags is used by more than one node: %s", addr, strings.Join(names, ", "))
+	}
+}
@@ -2,61 +2,531 @@ package tailscale
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"maps"
+	"net/http"
+	"net/netip"
+	"slices"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/coredns/coredns/plugin"
 	"github.com/coredns/coredns/plugin/pkg/fall"
+	"github.com/miekg/dns"
 	"tailscale.com/client/tailscale"
-	"tailscale.com/ipn"
+	"tailscale.com/client/tailscale/apitype"
 	"tailscale.com/tailcfg"
 	"tailscale.com/tsnet"
-	"tailscale.com/types/netmap"
+	"tailscale.com/types/views"
+)
+
+// Backoff between attempts to read from the IPN Bus.
+const (
+	minWatchBackoff = time.Second
+	maxWatchBackoff = time.Minute
+)
+
+const (
+	// tagV4Only restricts a node to A records.
+	tagV4Only = "tag:dns-v4only"
+	// tagV6Only restricts a node to AAAA records.
+	tagV6Only = "tag:dns-v6only"
 )
 
 type Tailscale struct {
+	// cfg is the configuration the instance was created from, and configHash its digest.
+	cfg        Config
+	configHash string
+
 	next plugin.Handler
-	zone string
+	// zone is the primary zone, in which records are built. zones lists it along with any further
+	// zones the same records are served in.
+	zone  string
+	zones []string
+
 	fall fall.F
+	// fallTypes are the query types fallthrough is restricted to, nil for all types.
+	fallTypes map[uint16]bool
+	// passUnknownTypes passes queries for types without records on to the next plugin, see knownType.
+	passUnknownTypes bool
+
+	// embedded runs a tsnet node, with its state in stateDir, instead of using the local tailscaled.
+	// tailnetListen is the address DNS is served on in the tailnet by that node, empty disables it.
+	embedded      bool
+	authkey       string
+	hostname      string
+	stateDir      string
+	tailnetListen string
+	srv           *tsnet.Server
+	lc            *tailscale.LocalClient
+	// pollInterval is how often the full netmap is fetched again while watching the IPN Bus, 0 only
+	// does so when reconnecting.
+	pollInterval time.Duration
+
+	// api polls the device list from the Tailscale API every apiInterval instead of watching a local
+	// tailscaled or tsnet node, nil if not configured. With apiFallback, the node is watched and the API
+	// only polled while that fails.
+	api         *apiClient
+	apiInterval time.Duration
+	apiFallback bool
+	// headscale polls the nodes of a Headscale server instead of the API, nil if not configured. It
+	// shares the interval and fallback settings of the API.
+	headscale *headscaleClient
+
+	// source is the backend the records are synced from while running, the API or the node. fallback
+	// is polled while source can't be watched, nil without one.
+	source   Source
+	fallback Source
+
+	// store keeps a durable copy of the records in storePath with storeBackend, nil if not configured.
+	// It is open while the plugin is running.
+	storeBackend string
+	storePath    string
+	store        entryStore
+
+	// recorder appends the network maps received to recordPath, nil if not configured. It is open
+	// while the plugin is running.
+	recordPath string
+	recorder   *netmapRecorder
+
+	// recordTTL is the TTL of records and negativeTTL the one of negative answers, 0 means defaultTTL.
+	recordTTL   uint32
+	negativeTTL uint32
+
+	// ttlJitter is the maximum number of seconds added to or removed from the TTL of each answer.
+	ttlJitter uint32
+
+	// privacy controls how query names are written to logs, see privacyOff and friends.
+	privacy int
+	// privacyKey is the key names are hashed with in privacyHash mode.
+	privacyKey []byte
+
+	// trustedProxies lists the ranges of proxies allowed to report the real client address via EDNS0.
+	trustedProxies []netip.Prefix
+
+	// maxInflight is the number of concurrent queries above which queries are shed, 0 disables shedding.
+	maxInflight     int64
+	shedFallthrough bool
+	inflight        atomic.Int64
+
+	// droppedCNAMEs are the owners of the CNAME records last found invalid or looping.
+	cnameMu       sync.Mutex
+	droppedCNAMEs []string
+
+	// upstream looks up CNAME targets outside the zone, nil leaves them to the client.
+	upstream upstreamLookup
+
+	// maxLookups is the number of lookups a single query may take, 0 for DefaultMaxLookups, and
+	// maxCNAMEChain the number of CNAME records followed in a row, 0 for DefaultMaxCNAMEChain.
+	maxLookups    int
+	maxCNAMEChain int
+
+	// enumeration flags clients that look like they are enumerating the zone, nil disables detection.
+	enumeration *enumerationDetector
+
+	// nsid is the server identifier returned to clients requesting NSID, empty disables NSID.
+	nsid string
+
+	// cookieSecret is the secret server cookies are derived from, nil disables DNS cookies.
+	cookieSecret []byte
+
+	// magicDNS passes queries for MagicDNS names on to magicDNSResolver, the resolver of the node.
+	magicDNS         bool
+	magicDNSResolver string
+	// overlapAdjust stops passing queries on to MagicDNS for domains split DNS routes to this node.
+	overlapAdjust bool
+
+	// dnssec signs responses to clients that set the DO bit, nil disables DNSSEC.
+	dnssec *dnssecSigner
+
+	// padding is the block size responses are padded to, 0 disables padding. Padding only applies
+	// when encrypted is set, for the servers of encrypted transports.
+	padding   int
+	encrypted bool
+
+	// rebindMarker publishes the _dns-rebind-ok TXT record. rebindProtection strips internal addresses
+	// from answers to clients outside the tailnet and rebindAllow.
+	rebindMarker     bool
+	rebindProtection bool
+	rebindAllow      []netip.Prefix
+
+	// stats publishes the _stats TXT record, see statsText.
+	stats bool
+
+	// filterAAAA and filterAAAATags are the client ranges and the tags of the nodes whose answers
+	// don't carry AAAA records, see filtersAAAA.
+	filterAAAA     []netip.Prefix
+	filterAAAATags []string
+
+	// preferIPv6 lists AAAA records before A records, see preferAAAA.
+	preferIPv6 bool
+	// omitA and omitAAAA leave the addresses of that family out of the records of nodes, see ipv4 and
+	// ipv6.
+	omitA    bool
+	omitAAAA bool
+
+	// anyPolicy is how ANY queries are answered, see Config.Any.
+	anyPolicy string
+
+	// internalErrors is how queries failed internally are answered, see Config.InternalErrors.
+	internalErrors string
+
+	// answerHooks are the answer hooks run on every response before it's written.
+	answerHooks []namedAnswerHook
+
+	// exporter mirrors the records to exportZone at the external DNS provider registered as
+	// exporterName, see runExport. exportPending holds a request for an export. Nil if not exporting.
+	exporter      ExportProvider
+	exporterName  string
+	exportZone    string
+	exportPending chan struct{}
+
+	// ipv4Disabled is set while no node of the tailnet has an IPv4 address. Guarded by mu.
+	ipv4Disabled bool
+
+	// tagEnumeration publishes PTR records for the nodes of each tag at _tag.<tag>.<zone>, see
+	// zoneData.tags.
+	tagEnumeration bool
+	// exposeMetadata publishes the _meta TXT record of every node, see nodeMetadata.
+	exposeMetadata bool
+
+	// transferPeers are the tailnet nodes and tags allowed to transfer the zones, empty allows any.
+	transferPeers []string
+
+	// agentAddr is the address of the HTTPS endpoint companion agents register LAN addresses at, empty
+	// disables it. Registrations are published for agentExpiry unless refreshed.
+	agentAddr   string
+	agentExpiry time.Duration
+	agentSrv    *http.Server
+	lan         lanRegistry
+	// whoIsFunc replaces the LocalAPI lookup of the node behind a tailnet address in tests.
+	whoIsFunc func(ctx context.Context, remoteAddr string) (*apitype.WhoIsResponse, error)
+	// whoIsCache keeps the identities of clients looked up for every query, see identify.
+	whoIsCache whoIsCache
+
+	// answers caches answers until the records change, nil if answer_cache is disabled.
+	answers *answerCache
+	// order permutes the records of answers, nil to keep their order.
+	order *answerOrder
+
+	// healthCheck is the health_check mode, empty if disabled, and reach the addresses it found
+	// unreachable, left out of answers by dropUnreachable.
+	healthCheck         string
+	healthCheckPort     uint16
+	healthCheckInterval time.Duration
+	healthCheckFailures int
+	reach               reachability
+
+	// queryLog writes a line for every query answered, nil if query_log is disabled.
+	queryLog *queryLog
+
+	// views are the views clients are answered with, and viewCapability the app capability views
+	// are granted with in the policy file, empty if they aren't. See clientView.
+	views          []View
+	viewCapability string
+
+	// debugAddr is the address of the debug HTTP endpoint, empty disables it.
+	debugAddr string
+	debugSrv  *http.Server
+
+	// events keeps the most recent sync events for the debug endpoint.
+	events *eventRing
+
+	// ns lists the name servers of the zones, and soaMbox the SOA mailbox. Empty values are derived
+	// from the primary zone. The SOA timers are the defaults if soaRefresh is 0.
+	ns                              []string
+	soaMbox                         string
+	soaRefresh, soaRetry, soaExpire uint32
 
-	authkey  string
-	hostname string
-	srv      *tsnet.Server
-	lc       *tailscale.LocalClient
+	// services are the SRV records published for tags. srvHostinfo also publishes the services nodes
+	// advertise on well-known ports.
+	services    []ServiceMapping
+	srvHostinfo bool
 
-	mu      sync.RWMutex
+	// subzones maps tags to the label of the subzone their nodes are also published in, and
+	// subzoneLabels lists those labels.
+	subzones      map[string]string
+	subzoneLabels map[string]bool
+	// userSubzones also publishes the nodes of each user in a subzone named after the user, see
+	// userSubzone. userLabels lists the labels of those subzones, which change with the users of
+	// the tailnet.
+	userSubzones bool
+	// appConnectorLabel is the label of the subzone the apps of app connectors are published in, empty
+	// if they aren't.
+	appConnectorLabel string
+	// topology publishes the exit nodes, subnet routers and the routers of each route, see
+	// topologyRecords.
+	topology bool
+	// endpointLabel is the label of the subzone the public endpoints of nodes are published in, empty
+	// if they aren't.
+	endpointLabel string
+
+	// wildcard is the wildcard mode, "on", "off" or a tag. Empty is the same as "on".
+	wildcard string
+
+	// includeTags and excludeTags restrict the nodes that are published by their tags.
+	includeTags []string
+	excludeTags []string
+
+	// profiles are the record policies applied to nodes by their tags.
+	profiles []Profile
+
+	// offlineNodes is the policy for nodes reported offline, see Config.OfflineNodes. With "flag",
+	// the records of offline nodes get at most offlineTTL.
+	offlineNodes string
+	offlineTTL   uint32
+
+	// flaps follows how often nodes go offline for adaptive_ttl, nil if it's disabled, and
+	// adaptiveTTLMin is the lowest TTL their records are shortened to.
+	flaps          *flapTracker
+	adaptiveTTLMin uint32
+
+	// alpn maps tags to the ALPN protocols advertised in the SVCB and HTTPS records of their nodes.
+	alpn map[string][]string
+
+	// glue adds the addresses of the targets of answers to the additional section.
+	glue bool
+
+	// ptrMagicDNS answers PTR queries with the MagicDNS name of nodes rather than their name in the
+	// primary zone.
+	ptrMagicDNS bool
+
+	// truncateNames shortens names that are too long to publish instead of skipping them.
+	truncateNames bool
+
+	// static are the records configured in the Corefile, the manual source, and staticTTLs the TTLs
+	// given with them by name and type.
+	static     map[string]map[string][]string
+	staticTTLs map[string]map[string]uint32
+
+	// precedence lists record sources from highest to lowest precedence, see mergeSources.
+	precedence []string
+
+	// lifecycle serializes startup and shutdown. running is set between them, and bg runs the
+	// background work meanwhile.
+	lifecycle sync.Mutex
+	running   bool
+	bg        *background
+
+	// health tracks how current the records are, and ready is set once the records of the tailnet
+	// were fetched for the first time and passed the self-test. The plugin is unhealthy while the
+	// records are older than maxStaleness, if set. synced is set once there are records of the
+	// tailnet at all, fetched or loaded from the store.
+	health       syncHealth
+	ready        atomic.Bool
+	synced       atomic.Bool
+	maxStaleness time.Duration
+
+	// lastTailnet is the tailnet the records were last built from, handed over to the instance
+	// replacing this one on reload, see handOff.
+	lastTailnet atomic.Pointer[Tailnet]
+
+	// data holds the records served, which queries read without locking. mu serializes its updates,
+	// and guards the problems with the records last reported below.
+	data atomic.Pointer[zoneData]
+	mu   sync.Mutex
+
+	// overlaps are the collisions of the zones with the DNS settings of the tailnet.
+	overlaps []overlap
+
+	// invalidTagRecords and collidingTagRecords are the problems with the records advertised through
+	// tags last reported, see reportTagRecords.
+	invalidTagRecords   map[string][]string
+	collidingTagRecords map[string][]string
+
+	// collisionPolicy is the policy for hostnames more than one node has, see
+	// Config.HostnameCollisions. collidingHosts holds those hostnames, with the names of their nodes.
+	collisionPolicy string
+	collidingHosts  map[string][]string
+}
+
+// zoneData is a snapshot of the records served, and of what's derived from them. Snapshots are never
+// modified once published: updates replace them with a modified copy, see update. A query loads the
+// current snapshot once, and answers from it alone.
+type zoneData struct {
 	entries map[string]map[string][]string
+	// addrs holds the parsed addresses of the A and AAAA records in entries, by name.
+	addrs map[string]hostAddrs
+	// serial is the SOA serial, the time records last changed.
+	serial uint32
+	// lastSync is when the records were last synced with the tailnet, zero before the first sync.
+	lastSync time.Time
+	// reverse maps node addresses to the names they are published under, for PTR queries.
+	reverse map[netip.Addr]string
+	// tags maps the tags of nodes to their names, for tag enumeration.
+	tags map[string][]string
+	// userLabels are the labels of the subzones of users, see userSubzones.
+	userLabels map[string]bool
+	// meta maps the names of nodes in entries, including those in subzones, to the strings of their
+	// metadata TXT record, with expose_metadata.
+	meta map[string][]string
+	// owners maps the names of nodes in entries, including those in subzones, to the identity of
+	// their node, for views.
+	owners map[string]nodeOwner
+	// sources holds the source of the records of each name in entries, and updated when they last
+	// changed, for snapshots.
+	sources map[string]string
+	updated map[string]time.Time
+	// endpoints holds the records of the public endpoints of nodes, by hostname, and endpointAddrs
+	// their parsed addresses. They're kept apart from entries, as they're only served in the subzone
+	// of endpointLabel.
+	endpoints     map[string]map[string][]string
+	endpointAddrs map[string]hostAddrs
+	// profileTTLs maps the names of the nodes with a profile TTL to it.
+	profileTTLs map[string]uint32
+	// offline holds the names of the nodes flagged offline, see Config.OfflineNodes.
+	offline map[string]bool
+	// flapScores maps the names of the nodes whose records get shorter TTLs with adaptive_ttl to their
+	// score, see flapScore.
+	flapScores map[string]int
+	// ttlOverrides maps the owners of records served with a TTL of their own, relative to the primary
+	// zone, to the TTL by type. See rrsetBaseTTL.
+	ttlOverrides map[string]map[string]uint32
+	// magicDomain is the MagicDNS domain of the tailnet, once known from the network map.
+	magicDomain string
+	// loopDomains are the domains that aren't passed on to MagicDNS because of overlaps.
+	loopDomains []string
+}
+
+// emptyData is the snapshot of an instance that has no records yet.
+var emptyData = &zoneData{}
+
+// load returns the current snapshot of the records.
+func (t *Tailscale) load() *zoneData {
+	if d := t.data.Load(); d != nil {
+		return d
+	}
+	return emptyData
+}
+
+// update publishes a copy of the current snapshot of the records, modified by f. The copy shares
+// the maps of the snapshot, which f must replace rather than modify. Must be called with t.mu held.
+func (t *Tailscale) update(f func(d *zoneData)) {
+	d := *t.load()
+	f(&d)
+	t.data.Store(&d)
 }
 
 // Name implements the Handler interface.
 func (t *Tailscale) Name() string { return "tailscale" }
 
+// Ready implements the ready.Readiness interface. The plugin is ready once the records of the tailnet
+// were fetched and are answered for, see SelfTest, so queries aren't answered with NXDOMAIN while it
+// starts. Records loaded from the store don't count, as they may be outdated.
+func (t *Tailscale) Ready() bool { return t.ready.Load() }
+
+// startup starts the plugin and its endpoints. It is registered as a startup callback, and as the
+// callback for failed restarts, so it does nothing if the plugin is already running.
+func (t *Tailscale) startup() error {
+	t.lifecycle.Lock()
+	defer t.lifecycle.Unlock()
+	if t.running {
+		return nil
+	}
+	if err := t.start(); err != nil {
+		return err
+	}
+	if err := t.startDebug(); err != nil {
+		t.stop()
+		return err
+	}
+	if err := t.startAgent(); err != nil {
+		t.stopDebug()
+		t.stop()
+		return err
+	}
+	ConfigInfo.WithLabelValues(t.zone, t.configHash).Set(1)
+	t.health.start(time.Now())
+	t.logReload()
+	t.running = true
+	return nil
+}
+
+// shutdown stops the plugin and its endpoints, releasing the tsnet node and listening sockets. It
+// runs before a reload starts the new instance, since that instance needs the same tsnet state
+// directory and addresses, and again when the old instance shuts down, so it does nothing if the
+// plugin isn't running. Once it returns, the records are no longer updated.
+func (t *Tailscale) shutdown() error {
+	t.lifecycle.Lock()
+	defer t.lifecycle.Unlock()
+	if !t.running {
+		return nil
+	}
+	t.running = false
+	ConfigInfo.DeleteLabelValues(t.zone, t.configHash)
+	deleteZoneMetrics(t.zone)
+	t.health.stop()
+	err := errors.Join(t.stopAgent(), t.stopDebug(), t.stop())
+	t.handOff()
+	return err
+}
+
 // start connects the Tailscale plugin to a tailscale daemon and populates DNS entries for nodes in the tailnet.
-// DNS entries are automatically kept up to date with any node changes.
+// DNS entries are automatically kept up to date with any node changes, until stop is called.
+//
+// In embedded mode, this function joins the Tailnet with a tsnet node, using t.authkey if the node
+// isn't logged in yet, instead of connecting to the local tailscaled instance. If the API is the only backend, the device
+// list is polled from the Tailscale API instead, without connecting to the tailnet at all.
 //
-// If t.authkey is non-empty, this function uses that key to connect to the Tailnet using a tsnet server
-// instead of connecting to the local tailscaled instance.
+// If a store is configured, the records it holds are served until the first update. On reload, the
+// records of the previous instance are served instead, see takeOver.
 func (t *Tailscale) start() error {
-	if t.authkey != "" {
-		hostname := t.hostname
-		if t.hostname == "" {
-			hostname = "coredns"
+	t.bg = newBackground()
+	if t.storeBackend != "" {
+		store, err := openStore(t.storeBackend, t.storePath)
+		if err != nil {
+			return fmt.Errorf("unable to open store %s: %w", t.storePath, err)
+		}
+		t.store = store
+		t.loadStore()
+	}
+	t.takeOver()
+	if t.exporter != nil {
+		t.bg.Go("export", func(ctx context.Context) error {
+			t.runExport(ctx)
+			return nil
+		})
+	}
+	if t.recordPath != "" {
+		recorder, err := openNetmapRecorder(t.recordPath)
+		if err != nil {
+			t.stop()
+			return fmt.Errorf("unable to open network map recording %s: %w", t.recordPath, err)
 		}
-		// authkey was provided, so startup a local tsnet server
+		t.recorder = recorder
+	}
+
+	if polled := t.polledSource(); polled != nil && !t.apiFallback {
+		t.source = polled
+		t.bg.Go("poll_"+polled.Name(), func(ctx context.Context) error {
+			t.sync(ctx)
+			return nil
+		})
+		t.startHealthChecks()
+		t.startQueryLog()
+		return nil
+	}
+
+	if t.embedded {
+		// Without an auth key, tsnet falls back to TS_AUTHKEY, or logs a login URL.
 		t.srv = &tsnet.Server{
-			Hostname:     hostname,
+			Hostname:     t.hostname,
+			Dir:          t.stateDir,
 			AuthKey:      t.authkey,
 			Logf:         log.Debugf,
 			RunWebClient: true,
 		}
 		err := t.srv.Start()
 		if err != nil {
+			t.stop()
 			return err
 		}
 		t.lc, err = t.srv.LocalClient()
 		if err != nil {
+			t.stop()
 			return err
 		}
 	} else {
@@ -64,46 +534,128 @@ func (t *Tailscale) start() error {
 		t.lc = &tailscale.LocalClient{}
 	}
 
-	go t.watchIPNBus()
+	t.source = &localAPISource{lc: t.lc}
+	t.fallback = t.polledSource()
+	t.bg.Go("watch_ipn_bus", func(ctx context.Context) error {
+		t.sync(ctx)
+		return nil
+	})
+	if t.srv != nil && t.tailnetListen != "" {
+		t.bg.Go("serve_tailnet", func(ctx context.Context) error {
+			t.serveTailnet(ctx)
+			return nil
+		})
+	}
+	t.startHealthChecks()
+	t.startQueryLog()
 	return nil
 }
 
-// watchIPNBus watches the Tailscale IPN Bus and updates DNS entries for any netmap update.
-// This function does not return. If it is unable to read from the IPN Bus, it will continue to retry.
-func (t *Tailscale) watchIPNBus() {
-	for {
-		watcher, err := t.lc.WatchIPNBus(context.Background(), ipn.NotifyInitialNetMap)
-		if err != nil {
-			log.Info("unable to read from Tailscale event bus, retrying in 1 minute")
-			time.Sleep(1 * time.Minute)
+// startHealthChecks starts probing the addresses of the nodes, with a health check probing them.
+func (t *Tailscale) startHealthChecks() {
+	if t.healthCheck != healthCheckTCP && t.healthCheck != healthCheckHTTPS {
+		return
+	}
+	t.bg.Go("health_check", func(ctx context.Context) error {
+		t.runHealthChecks(ctx)
+		return nil
+	})
+}
+
+// startQueryLog starts writing the lines of the query log, if enabled.
+func (t *Tailscale) startQueryLog() {
+	if t.queryLog == nil {
+		return
+	}
+	t.bg.Go("query_log", func(ctx context.Context) error {
+		t.runQueryLog(ctx)
+		return nil
+	})
+}
+
+// stop stops the background work, waiting for a netmap being processed, and closes the tsnet node,
+// the store and the recording. The endpoints must have been stopped before.
+func (t *Tailscale) stop() error {
+	if t.bg != nil {
+		t.bg.stop()
+		t.bg = nil
+	}
+	var errs []error
+	if t.srv != nil {
+		errs = append(errs, t.srv.Close())
+		t.srv = nil
+	}
+	if t.store != nil {
+		errs = append(errs, t.store.close())
+		t.store = nil
+	}
+	if t.recorder != nil {
+		errs = append(errs, t.recorder.close())
+		t.recorder = nil
+	}
+	return errors.Join(errs...)
+}
+
+// tailnetHasIPv4 reports whether any of nodes has an IPv4 address, or none has an address at all.
+// Exit nodes of VPN providers and nodes shared from other tailnets don't tell about this tailnet.
+func tailnetHasIPv4(nodes []tailcfg.NodeView) bool {
+	var addresses bool
+	for _, node := range nodes {
+		if node.IsWireGuardOnly() || !node.Sharer().IsZero() {
 			continue
 		}
-		defer watcher.Close()
-
-		for {
-			n, err := watcher.Next()
-			if err != nil {
-				// If we're unable to read, then close watcher and reconnect
-				watcher.Close()
-				break
+		for _, pfx := range node.Addresses().All() {
+			if pfx.Addr().Is4() {
+				return true
 			}
-			t.processNetMap(n.NetMap)
+			addresses = true
 		}
 	}
+	return !addresses
 }
 
-func (t *Tailscale) processNetMap(nm *netmap.NetworkMap) {
-	if nm == nil {
+func (t *Tailscale) processTailnet(tn *Tailnet) {
+	if tn == nil {
 		return
 	}
+	t.lastTailnet.Store(tn)
 
-	log.Debugf("Self tags: %+v", nm.SelfNode.Tags().AsSlice())
-	nodes := []tailcfg.NodeView{nm.SelfNode}
-	nodes = append(nodes, nm.Peers...)
+	// Tailnets built from the API have no self node.
+	var nodes []tailcfg.NodeView
+	if tn.SelfNode.Valid() {
+		log.Debugf("Self tags: %+v", tn.SelfNode.Tags().AsSlice())
+		nodes = append(nodes, tn.SelfNode)
+	}
+	nodes = append(nodes, tn.Peers...)
+
+	// In tailnets with IPv4 disabled, nodes only have IPv6 addresses. Pinning a node to IPv4 would
+	// leave it without any addresses then, so the pin is ignored.
+	ipv4Disabled := !tailnetHasIPv4(nodes)
 
-	entries := map[string]map[string][]string{}
+	// Records are collected per source, and merged according to the configured precedence afterwards.
+	devices := map[string]map[string][]string{}
+	tags := map[string]map[string][]string{}
+	// magicNames maps published addresses to the MagicDNS name of their node, for ptr_target magicdns.
+	magicNames := map[netip.Addr]string{}
+	profileTTLs := map[string]uint32{}
+	offlineHosts := map[string]bool{}
+	serviceTTLs := map[string]map[string]uint32{}
+	invalidTagRecords := map[string][]string{}
+	claimedAddrs := map[string]bool{}
+	endpoints := map[string]map[string][]string{}
+	userLabels := map[string]bool{}
+	owners := map[string]nodeOwner{}
+	meta := map[string][]string{}
+	// online and ephemeral hold the state of nodes for adaptive_ttl, and nodeNames the names each
+	// node is published at.
+	online := map[string]bool{}
+	ephemeral := map[string]bool{}
+	nodeNames := map[string][]string{}
+	var connectors []appConnector
+	var topology []topologyNode
 	var validNodes int
 
+	var published []namedNode
 	for _, node := range nodes {
 		if node.IsWireGuardOnly() {
 			// IsWireGuardOnly identifies a node as a Mullvad exit node.
@@ -114,46 +666,288 @@ func (t *Tailscale) processNetMap(nm *netmap.NetworkMap) {
 			// TODO: possibly make it configurable to include shared nodes and figure out what hostname to use.
 			continue
 		}
+		if !t.publishNode(node) {
+			continue
+		}
+		profile, hasProfile := t.nodeProfile(node)
+		if nodeOffline(node) && (t.offlineNodes == offlineOmit || hasProfile && profile.OnlineOnly) {
+			continue
+		}
 
 		validNodes++
-		hostname := node.ComputedName()
-		entry, ok := entries[hostname]
+		// Names are case-insensitive, so nodes whose names only differ in case collide.
+		hostname, ok := t.fitName(strings.ToLower(node.ComputedName()))
 		if !ok {
-			entry = map[string][]string{}
+			continue
 		}
+		published = append(published, namedNode{node, hostname})
+	}
+	published, collisions := t.resolveCollisions(published)
+	userNames := t.userSubzoneNames(tn, published, collisions)
+
+	for _, n := range published {
+		node, hostname := n.node, n.hostname
+		// names are the names of the node in subzones, published along with its hostname.
+		names := t.subzoneNames(n, userNames)
+		profile, hasProfile := t.nodeProfile(node)
+		offline := nodeOffline(node)
+		entry := map[string][]string{}
+
+		// Nodes can pin themselves to a single address family through tags, regardless of global settings.
+		v4 := !views.SliceContains(node.Tags(), tagV6Only)
+		v6 := !views.SliceContains(node.Tags(), tagV4Only) || ipv4Disabled
 
 		// Currently entry["A"/"AAAA"] will have max one element
 		for _, pfx := range node.Addresses().AsSlice() {
 
 			addr := pfx.Addr()
-			if addr.Is4() {
+			if addr.Is4() && v4 {
 				entry["A"] = append(entry["A"], addr.String())
-			} else if addr.Is6() {
+			} else if addr.Is6() && v6 {
 				entry["AAAA"] = append(entry["AAAA"], addr.String())
+			} else {
+				continue
+			}
+			if t.ptrMagicDNS && node.Name() != "" {
+				magicNames[addr] = dns.Fqdn(node.Name())
 			}
 		}
 
 		// Process Tags looking for cname- prefixed ones
 		if node.Tags().Len() > 0 {
+			// The tags of a node are published as a single TXT record, one string per tag.
+			entry["TXT"] = node.Tags().AsSlice()
+
 			for _, raw := range node.Tags().AsSlice() {
 				if tag, ok := strings.CutPrefix(raw, "tag:cname-"); ok {
-					if _, ok := entries[tag]; !ok {
-						entries[tag] = map[string][]string{}
+					if tag, ok = t.fitName(strings.ToLower(tag)); !ok {
+						continue
+					}
+					if _, ok := tags[tag]; !ok {
+						tags[tag] = map[string][]string{}
 					}
-					entries[tag]["CNAME"] = append(entries[tag]["CNAME"], fmt.Sprintf("%s.%s", hostname, t.zone))
+					tags[tag]["CNAME"] = append(tags[tag]["CNAME"], fmt.Sprintf("%s.%s", hostname, t.zone))
+				}
+			}
+
+			// Records advertised through tags are added to the node's own.
+			records, invalid := tagRecords(node.Tags().AsSlice())
+			if len(invalid) > 0 {
+				invalidTagRecords[hostname] = invalid
+			}
+			for _, addr := range records["A"] {
+				if !slices.Contains(entry["A"], addr) {
+					entry["A"] = append(entry["A"], addr)
 				}
+				claimedAddrs[addr] = true
 			}
+			entry["TXT"] = append(entry["TXT"], records["TXT"]...)
 		}
+		t.omitFamilies(entry)
 
-		entries[hostname] = entry
+		if alpn := t.nodeALPN(node); len(alpn) > 0 {
+			entry["ALPN"] = alpn
+		}
+		if srv := t.nodeServices(node); len(srv) > 0 {
+			entry["SRV"] = srv
+			t.serviceTTLs(serviceTTLs, node, append([]string{hostname}, names...)...)
+		}
+
+		if merged, ok := devices[hostname]; ok {
+			// Only nodes merged by hostname_collisions share a hostname.
+			mergeRecords(merged, entry)
+			entry = merged
+		}
+		devices[hostname] = entry
+		if t.appConnectorLabel != "" && isAppConnector(node) {
+			connectors = append(connectors, appConnector{hostname, node.Tags().AsSlice()})
+		}
+		if t.topology {
+			if routes, exitNode := subnetRoutes(node), isExitNode(node); exitNode || len(routes) > 0 {
+				topology = append(topology, topologyNode{hostname, exitNode, routes})
+			}
+		}
+		if t.endpointLabel != "" {
+			if ep := publicEndpoints(node); ep != nil {
+				t.omitFamilies(ep)
+				if len(ep) > 0 {
+					endpoints[hostname] = ep
+				}
+			}
+		}
+		owner := nodeOwner{host: hostname, id: string(node.StableID()), tags: node.Tags().AsSlice()}
+		if profile, ok := tn.UserProfiles[node.User()]; ok && !node.IsTagged() {
+			owner.login = profile.LoginName
+		}
+		for _, pfx := range node.Addresses().All() {
+			owner.addrs = append(owner.addrs, pfx.Addr())
+		}
+		owners[hostname] = owner
+		if t.exposeMetadata {
+			meta[hostname] = nodeMetadata(node)
+		}
+		online[hostname] = !offline
+		ephemeral[hostname] = nodeEphemeral(node)
+		nodeNames[hostname] = []string{hostname}
+		for _, name := range names {
+			if merged, ok := devices[name]; ok && !maps.EqualFunc(merged, entry, slices.Equal) {
+				// Machines of a user merged by hostname_collisions share their name in its subzone.
+				shared := map[string][]string{}
+				mergeRecords(shared, merged)
+				mergeRecords(shared, entry)
+				devices[name] = shared
+			} else {
+				devices[name] = entry
+			}
+			owners[name] = owner
+			if t.exposeMetadata {
+				meta[name] = meta[hostname]
+			}
+			nodeNames[hostname] = append(nodeNames[hostname], name)
+		}
+		if name, ok := userNames[node]; ok {
+			_, label, _ := strings.Cut(name, ".")
+			userLabels[label] = true
+		}
+		if offline && t.offlineNodes == offlineFlag {
+			offlineHosts[hostname] = true
+			for _, name := range names {
+				offlineHosts[name] = true
+			}
+		}
+		if hasProfile && profile.TTL != 0 {
+			profileTTLs[hostname] = profile.TTL
+			for _, name := range names {
+				profileTTLs[name] = profile.TTL
+			}
+		}
+	}
+
+	// Apps are published like the aliases of tags, as they're derived from the policy too.
+	for name, records := range t.appConnectorRecords(tn.SelfNode, connectors, devices) {
+		tags[name] = records
+	}
+	for name, records := range t.topologyRecords(topology, devices) {
+		tags[name] = records
+	}
+
+	entries, sources, conflicts := t.mergeSources(map[string]map[string]map[string][]string{
+		sourceManual: t.static,
+		sourceTag:    tags,
+		sourceDevice: devices,
+	})
+
+	t.dropInvalidCNAMEs(entries)
+	ttlOverrides := mergeTTLs(t.staticTTLs, serviceTTLs, sources)
+	// Names of offline nodes taken by other sources aren't flagged.
+	maps.DeleteFunc(offlineHosts, func(name string, _ bool) bool { return sources[name] != sourceDevice })
+	maps.DeleteFunc(meta, func(name string, _ []string) bool { return sources[name] != sourceDevice })
+
+	reverse := t.reverseIndex(entries)
+	tagIndex := t.tagIndex(entries)
+	addrs, endpointAddrs := t.addrIndex(entries), t.addrIndex(endpoints)
+	for addr, name := range magicNames {
+		if _, ok := reverse[addr]; ok {
+			reverse[addr] = name
+		}
+	}
+
+	now := time.Now()
+	var flapScores map[string]int
+	if t.flaps != nil {
+		flapScores = map[string]int{}
+		flaps := t.flaps.observe(online, now)
+		for host, names := range nodeNames {
+			if score := flapScore(ephemeral[host], flaps[host]); score > 0 {
+				for _, name := range names {
+					flapScores[name] = score
+				}
+			}
+		}
 	}
 
 	t.mu.Lock()
-	t.entries = entries
+	old := t.load()
+	events := t.diffEntries(old.entries, entries, now)
+	t.update(func(d *zoneData) {
+		d.entries = entries
+		d.addrs = addrs
+		d.sources = sources
+		d.updated = updateTimes(old.entries, entries, old.updated, now)
+		d.reverse = reverse
+		d.tags = tagIndex
+		d.profileTTLs = profileTTLs
+		d.ttlOverrides = ttlOverrides
+		d.offline = offlineHosts
+		d.flapScores = flapScores
+		d.endpoints = endpoints
+		d.endpointAddrs = endpointAddrs
+		d.userLabels = userLabels
+		d.owners = owners
+		d.meta = meta
+		d.lastSync = now
+		if tn.Domain != "" {
+			d.magicDomain = dns.CanonicalName(tn.Domain)
+		}
+		if len(events) > 0 {
+			// The SOA serial is the time of the last change, and must increase with every change.
+			d.serial = max(old.serial+1, uint32(now.Unix()))
+		}
+	})
+	// The LAN addresses of nodes no longer published are dropped with them.
+	t.lan.retain(func(host string) bool { _, ok := owners[host]; return ok })
+	if t.healthCheck == healthCheckOnline {
+		t.setUnreachable(offlineAddrs(online, owners))
+	}
+	t.synced.Store(true)
+	if ipv4Disabled != t.ipv4Disabled {
+		if ipv4Disabled {
+			log.Info("No node has an IPv4 address, IPv4 is disabled in the tailnet; answering A queries with NODATA")
+		} else {
+			log.Info("Nodes have IPv4 addresses again")
+		}
+		t.ipv4Disabled = ipv4Disabled
+	}
 	t.mu.Unlock()
 	log.Debugf("updated %d Tailscale entries", len(entries))
 
+	changes := map[string]int{eventAdd: 0, eventRemove: 0, eventChange: 0}
+	for _, e := range events {
+		t.events.add(e)
+		changes[e.Kind]++
+	}
+	if len(events) > 0 {
+		// Clients may have changed along with the records, e.g. their tags.
+		t.whoIsCache.flush()
+		t.saveStore()
+	}
+	if len(events) > 0 || old.lastSync.IsZero() {
+		t.requestExport()
+	}
+	for kind, n := range changes {
+		SyncChanges.WithLabelValues("", t.zone, kind).Set(float64(n))
+	}
+	LastSync.WithLabelValues("", t.zone).Set(float64(now.Unix()))
+
 	// Update node count metric
 	// Use an empty string as server label as this is a global metric
-	NodeCount.WithLabelValues("").Set(float64(validNodes))
+	NodeCount.WithLabelValues("", t.zone).Set(float64(validNodes))
+	ConflictCount.WithLabelValues("", t.zone).Set(float64(conflicts))
+
+	t.checkOverlaps(tn)
+	t.reportCollisions(collisions)
+	t.reportTagRecords(invalidTagRecords, tagRecordCollisions(claimedAddrs, devices))
+	// Answers may change with every network map, without any change of the records: TTLs depend on
+	// whether nodes are online, and on how often they went offline.
+	t.answers.flush()
+
+	// Readiness isn't checked again once reported, so a configuration that doesn't answer for the
+	// records must be caught before. The self-test is repeated with every update until it passes.
+	if !t.ready.Load() {
+		if err := t.SelfTest(context.Background()); err != nil {
+			log.Errorf("Self-test failed, not ready: %v", err)
+			return
+		}
+		t.ready.Store(true)
+	}
 }
@@ -1,12 +1,38 @@
 package tailscale
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"net/netip"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/coredns/coredns/plugin/metadata"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
 	"github.com/google/go-cmp/cmp"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"tailscale.com/client/tailscale"
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/ipn"
 	"tailscale.com/tailcfg"
-	"tailscale.com/types/netmap"
+	"tailscale.com/types/dnstype"
+	"tailscale.com/types/opt"
 )
 
 func TestProcessNetMap(t *testing.T) {
@@ -21,7 +47,7 @@ func TestProcessNetMap(t *testing.T) {
 		Tags: []string{"tag:cname-app"},
 	}).View()
 
-	nm := &netmap.NetworkMap{
+	tn := &Tailnet{
 		SelfNode: self,
 		Peers: []tailcfg.NodeView{
 			(&tailcfg.Node{
@@ -32,6 +58,22 @@ func TestProcessNetMap(t *testing.T) {
 				},
 				Tags: []string{"tag:cname-app"},
 			}).View(),
+			(&tailcfg.Node{
+				ComputedName: "v6host",
+				Addresses: []netip.Prefix{
+					netip.MustParsePrefix("100.0.0.5/24"),
+					netip.MustParsePrefix("fd7a:115c:a1e0::5/128"),
+				},
+				Tags: []string{"tag:dns-v6only"},
+			}).View(),
+			(&tailcfg.Node{
+				ComputedName: "v4host",
+				Addresses: []netip.Prefix{
+					netip.MustParsePrefix("100.0.0.6/24"),
+					netip.MustParsePrefix("fd7a:115c:a1e0::6/128"),
+				},
+				Tags: []string{"tag:dns-v4only"},
+			}).View(),
 			(&tailcfg.Node{
 				// shared node should be excluded
 				ComputedName: "shared",
@@ -59,33 +101,2375 @@ func TestProcessNetMap(t *testing.T) {
 		"self": {
 			"A":    {"100.0.0.1"},
 			"AAAA": {"fd7a:115c:a1e0::1"},
+			"TXT":  {"tag:cname-app"},
 		},
 		"peer": {
 			"A":    {"100.0.0.2"},
 			"AAAA": {"fd7a:115c:a1e0::2"},
+			"TXT":  {"tag:cname-app"},
+		},
+		"v6host": {
+			"AAAA": {"fd7a:115c:a1e0::5"},
+			"TXT":  {"tag:dns-v6only"},
+		},
+		"v4host": {
+			"A":   {"100.0.0.6"},
+			"TXT": {"tag:dns-v4only"},
 		},
 		"app": {
 			"CNAME": {"self.example.com.", "peer.example.com."},
 		},
 	}
 
-	ts.processNetMap(nm)
-	if !cmp.Equal(ts.entries, want) {
-		t.Errorf("ts.entries = %v, want %v", ts.entries, want)
+	ts.processTailnet(tn)
+	if !cmp.Equal(ts.load().entries, want) {
+		t.Errorf("ts.entries = %v, want %v", ts.load().entries, want)
 	}
 
 	// now process another netmap with only self, and make sure peer is removed
-	ts.processNetMap(&netmap.NetworkMap{SelfNode: self})
+	ts.processTailnet(&Tailnet{SelfNode: self})
 	want = map[string]map[string][]string{
 		"self": {
 			"A":    {"100.0.0.1"},
 			"AAAA": {"fd7a:115c:a1e0::1"},
+			"TXT":  {"tag:cname-app"},
 		},
 		"app": {
 			"CNAME": {"self.example.com."},
 		},
 	}
-	if !cmp.Equal(ts.entries, want) {
-		t.Errorf("ts.entries = %v, want %v", ts.entries, want)
+	if !cmp.Equal(ts.load().entries, want) {
+		t.Errorf("ts.entries = %v, want %v", ts.load().entries, want)
+	}
+}
+
+func TestProcessNetMapConflicts(t *testing.T) {
+	tn := &Tailnet{
+		SelfNode: (&tailcfg.Node{
+			ComputedName: "self",
+			Addresses:    []netip.Prefix{netip.MustParsePrefix("100.0.0.1/32")},
+			Tags:         []string{"tag:cname-app"},
+		}).View(),
+		Peers: []tailcfg.NodeView{
+			(&tailcfg.Node{
+				// device whose hostname collides with the cname-app tag
+				ComputedName: "app",
+				Addresses:    []netip.Prefix{netip.MustParsePrefix("100.0.0.2/32")},
+			}).View(),
+		},
+	}
+
+	// By default tag records take precedence over device records.
+	ts := &Tailscale{zone: "example.com."}
+	ts.processTailnet(tn)
+	want := map[string]map[string][]string{
+		"self": {"A": {"100.0.0.1"}, "TXT": {"tag:cname-app"}},
+		"app":  {"CNAME": {"self.example.com."}},
+	}
+	if !cmp.Equal(ts.load().entries, want) {
+		t.Errorf("ts.entries = %v, want %v", ts.load().entries, want)
+	}
+
+	ts = &Tailscale{zone: "example.com.", precedence: []string{sourceDevice, sourceTag, sourceManual}}
+	ts.processTailnet(tn)
+	want = map[string]map[string][]string{
+		"self": {"A": {"100.0.0.1"}, "TXT": {"tag:cname-app"}},
+		"app":  {"A": {"100.0.0.2"}},
+	}
+	if !cmp.Equal(ts.load().entries, want) {
+		t.Errorf("ts.entries = %v, want %v", ts.load().entries, want)
+	}
+
+	// Static records override both, unless configured otherwise.
+	static, ttls, err := parseRecords([]string{"app 300 IN CNAME self", "grafana A 192.0.2.1"}, "example.com.")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	ts = &Tailscale{zone: "example.com.", static: static, staticTTLs: ttls}
+	ts.processTailnet(tn)
+	want = map[string]map[string][]string{
+		"self":    {"A": {"100.0.0.1"}, "TXT": {"tag:cname-app"}},
+		"app":     {"CNAME": {"self.example.com."}},
+		"grafana": {"A": {"192.0.2.1"}},
+	}
+	if !cmp.Equal(ts.load().entries, want) {
+		t.Errorf("ts.entries = %v, want %v", ts.load().entries, want)
+	}
+	if got := ts.load().ttlOverrides["app"]; !cmp.Equal(got, map[string]uint32{"CNAME": 300}) {
+		t.Errorf("want the TTL of the static record for app, got %v", got)
+	}
+	ts = &Tailscale{zone: "example.com.", static: static, staticTTLs: ttls, precedence: []string{sourceDevice, sourceTag, sourceManual}}
+	ts.processTailnet(tn)
+	if got := ts.load().entries["app"]; !cmp.Equal(got, map[string][]string{"A": {"100.0.0.2"}}) {
+		t.Errorf("want device records for app, got %v", got)
+	}
+	// The TTL of a static record goes with it.
+	if got := ts.load().ttlOverrides["app"]; got != nil {
+		t.Errorf("want no TTL override for the device records of app, got %v", got)
+	}
+}
+
+func TestTagRecords(t *testing.T) {
+	records, invalid := tagRecords([]string{
+		"tag:web",
+		"tag:cdns-a-203-0-113-7",
+		"tag:cdns-a-198-51-100-1",
+		"tag:cdns-txt-v1",
+		"tag:cdns-a-203-0-113",
+		"tag:cdns-a-2001-db8--1",
+		"tag:cdns-txt",
+		"tag:cdns-mx-mail",
+	})
+	want := map[string][]string{"A": {"203.0.113.7", "198.51.100.1"}, "TXT": {"v1"}}
+	if !cmp.Equal(records, want) {
+		t.Errorf("want records %v, got %v", want, records)
+	}
+	wantInvalid := []string{"tag:cdns-a-203-0-113", "tag:cdns-a-2001-db8--1", "tag:cdns-txt", "tag:cdns-mx-mail"}
+	if !cmp.Equal(invalid, wantInvalid) {
+		t.Errorf("want invalid tags %v, got %v", wantInvalid, invalid)
+	}
+}
+
+func TestProcessNetMapTagRecords(t *testing.T) {
+	node := func(name, addr string, tags ...string) tailcfg.NodeView {
+		return (&tailcfg.Node{
+			ComputedName: name,
+			Addresses:    []netip.Prefix{netip.MustParsePrefix(addr + "/32")},
+			Tags:         tags,
+		}).View()
+	}
+	ts := &Tailscale{zone: "example.com."}
+	ts.processTailnet(&Tailnet{
+		SelfNode: node("web", "100.64.0.1", "tag:cdns-a-203-0-113-7", "tag:cdns-txt-v1", "tag:cdns-a-300-0-0-1"),
+		Peers: []tailcfg.NodeView{
+			// The address of another node, and one advertised by another node too, collide.
+			node("db", "100.64.0.2", "tag:cdns-a-100-64-0-1", "tag:cdns-a-203-0-113-7"),
+			node("mail", "100.64.0.3"),
+		},
+	})
+
+	want := map[string]map[string][]string{
+		"web": {
+			"A":   {"100.64.0.1", "203.0.113.7"},
+			"TXT": {"tag:cdns-a-203-0-113-7", "tag:cdns-txt-v1", "tag:cdns-a-300-0-0-1", "v1"},
+		},
+		"db": {
+			"A":   {"100.64.0.2", "100.64.0.1", "203.0.113.7"},
+			"TXT": {"tag:cdns-a-100-64-0-1", "tag:cdns-a-203-0-113-7"},
+		},
+		"mail": {"A": {"100.64.0.3"}},
+	}
+	if !cmp.Equal(ts.load().entries, want) {
+		t.Errorf("unexpected entries: %s", cmp.Diff(want, ts.load().entries))
+	}
+	wantCollisions := map[string][]string{"100.64.0.1": {"db", "web"}, "203.0.113.7": {"db", "web"}}
+	if !cmp.Equal(ts.collidingTagRecords, wantCollisions) {
+		t.Errorf("want collisions %v, got %v", wantCollisions, ts.collidingTagRecords)
+	}
+	if got := testutil.ToFloat64(TagRecordIssues.WithLabelValues("", ts.zone, tagRecordInvalid)); got != 1 {
+		t.Errorf("want 1 invalid record tag, got %v", got)
+	}
+	if got := testutil.ToFloat64(TagRecordIssues.WithLabelValues("", ts.zone, tagRecordCollision)); got != 2 {
+		t.Errorf("want 2 colliding addresses, got %v", got)
+	}
+}
+
+func TestProcessNetMapCNAMELoops(t *testing.T) {
+	static, _, err := parseRecords([]string{
+		"web CNAME app",
+		"self CNAME self.example.com.",
+		"docs CNAME docs.example.org.",
+	}, "example.com.")
+	if err != nil {
+		t.Fatalf("unable to parse records: %v", err)
+	}
+	ts := &Tailscale{zone: "example.com.", static: static}
+	ts.processTailnet(&Tailnet{
+		Peers: []tailcfg.NodeView{
+			(&tailcfg.Node{
+				ComputedName: "web",
+				Addresses:    []netip.Prefix{netip.MustParsePrefix("100.64.0.1/32")},
+				Tags:         []string{"tag:cname-app"},
+			}).View(),
+		},
+	})
+
+	// The static record for web wins over the node, so app and web point to each other. The loop is
+	// broken at the first of them, which has no records left.
+	want := map[string]map[string][]string{
+		"web":  {"CNAME": {"app.example.com."}},
+		"docs": {"CNAME": {"docs.example.org."}},
+	}
+	if !cmp.Equal(ts.load().entries, want) {
+		t.Errorf("unexpected entries: %s", cmp.Diff(want, ts.load().entries))
+	}
+	if !slices.Equal(ts.droppedCNAMEs, []string{"app", "self"}) {
+		t.Errorf("want the CNAME records of app and self dropped, got %v", ts.droppedCNAMEs)
+	}
+	if got := static["self"]["CNAME"]; len(got) != 1 {
+		t.Errorf("want the static records left alone, got %v", got)
+	}
+}
+
+func TestProcessNetMapEvents(t *testing.T) {
+	node := func(name, addr string) tailcfg.NodeView {
+		return (&tailcfg.Node{ComputedName: name, Addresses: []netip.Prefix{netip.MustParsePrefix(addr)}}).View()
+	}
+	ts := &Tailscale{zone: "example.com.", events: newEventRing(3)}
+
+	ts.processTailnet(&Tailnet{SelfNode: node("self", "100.0.0.1/32"), Peers: []tailcfg.NodeView{node("gone", "100.0.0.2/32")}})
+	ts.processTailnet(&Tailnet{SelfNode: node("self", "100.0.0.3/32"), Peers: []tailcfg.NodeView{node("new", "100.0.0.2/32")}})
+
+	// The ring only holds the last three events, so the events of the first sync have been dropped.
+	var got []string
+	for _, e := range ts.events.snapshot() {
+		got = append(got, e.Kind+" "+e.Name)
+	}
+	want := []string{"add new", "change self", "remove gone"}
+	if !cmp.Equal(got, want) {
+		t.Errorf("events = %v, want %v", got, want)
+	}
+
+	rec := httptest.NewRecorder()
+	ts.debugMux().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, debugEventsPath, nil))
+	var events []syncEvent
+	if err := json.NewDecoder(rec.Body).Decode(&events); err != nil {
+		t.Fatalf("unable to decode events: %v", err)
+	}
+	if len(events) != len(want) {
+		t.Errorf("debug endpoint returned %d events, want %d", len(events), len(want))
+	}
+}
+
+func TestProcessNetMapAddrs(t *testing.T) {
+	ts := &Tailscale{zone: "example.com."}
+	node := &tailcfg.Node{
+		ComputedName: "web",
+		Addresses:    []netip.Prefix{netip.MustParsePrefix("100.0.0.1/32"), netip.MustParsePrefix("fd7a:115c:a1e0::1/128")},
+	}
+	ts.processTailnet(&Tailnet{SelfNode: node.View()})
+
+	want := map[string]hostAddrs{
+		"web": {v4: []netip.Addr{netip.MustParseAddr("100.0.0.1")}, v6: []netip.Addr{netip.MustParseAddr("fd7a:115c:a1e0::1")}},
+	}
+	if got := ts.load().addrs; !cmp.Equal(got, want, cmp.AllowUnexported(hostAddrs{}), cmp.Comparer(func(a, b netip.Addr) bool { return a == b })) {
+		t.Errorf("addrs = %v, want %v", got, want)
+	}
+
+	// Values that aren't addresses are never served, and names without addresses aren't indexed.
+	addrs := ts.addrIndex(map[string]map[string][]string{
+		"bad": {"A": {"100.0.0.2", "not-an-address"}},
+		"app": {"CNAME": {"web.example.com."}},
+	})
+	if got := addrs["bad"].v4; len(got) != 1 || got[0] != netip.MustParseAddr("100.0.0.2") {
+		t.Errorf("addrs of bad = %v, want [100.0.0.2]", got)
+	}
+	if _, ok := addrs["app"]; ok {
+		t.Errorf("want no addresses for app, got %v", addrs["app"])
+	}
+}
+
+// memExport is an export provider keeping the records of a single zone in memory.
+type memExport struct {
+	recs  []ExportRecord
+	calls int
+}
+
+func init() {
+	RegisterExportProvider("memory", func(args []string) (ExportProvider, error) {
+		if len(args) > 0 {
+			return nil, fmt.Errorf("unexpected arguments %v", args)
+		}
+		return &memExport{}, nil
+	})
+}
+
+func (m *memExport) GetRecords(context.Context, string) ([]ExportRecord, error) {
+	return slices.Clone(m.recs), nil
+}
+
+func (m *memExport) SetRecords(_ context.Context, _ string, recs []ExportRecord) ([]ExportRecord, error) {
+	m.calls++
+	m.recs = slices.DeleteFunc(m.recs, func(r ExportRecord) bool {
+		return slices.ContainsFunc(recs, func(s ExportRecord) bool { return s.Name == r.Name && s.Type == r.Type })
+	})
+	m.recs = append(m.recs, recs...)
+	return recs, nil
+}
+
+func (m *memExport) DeleteRecords(_ context.Context, _ string, recs []ExportRecord) ([]ExportRecord, error) {
+	m.calls++
+	m.recs = slices.DeleteFunc(m.recs, func(r ExportRecord) bool { return slices.Contains(recs, r) })
+	return recs, nil
+}
+
+func TestExport(t *testing.T) {
+	ts, err := New(NewConfig(WithZone("example.com"), WithRecord("app CNAME web"), WithExport("memory", "ts.example.org")))
+	if err != nil {
+		t.Fatalf("unable to configure the instance: %v", err)
+	}
+	provider := ts.exporter.(*memExport)
+	provider.recs = []ExportRecord{
+		{Name: "@", Type: "SOA", Value: "ns1.example.net. hostmaster.example.org. 1 7200 1800 86400 300", TTL: time.Hour},
+		{Name: "@", Type: "NS", Value: "ns1.example.net.", TTL: time.Hour},
+		{Name: "gone", Type: "A", Value: "100.0.0.9", TTL: time.Minute},
+		{Name: "web", Type: "A", Value: "100.0.0.9", TTL: time.Minute},
+	}
+
+	node := &tailcfg.Node{ComputedName: "web", Addresses: []netip.Prefix{netip.MustParsePrefix("100.0.0.1/32")}}
+	ts.processTailnet(&Tailnet{SelfNode: node.View()})
+	if len(ts.exportPending) != 1 {
+		t.Fatal("want an export requested by the first sync")
+	}
+	if err := ts.export(context.Background()); err != nil {
+		t.Fatalf("unable to export: %v", err)
+	}
+
+	// The SOA and NS records of the zone at the provider are left alone, records the zone doesn't have
+	// are deleted.
+	got := map[string]string{}
+	for _, r := range provider.recs {
+		got[r.Name+" "+r.Type] = r.Value
+	}
+	want := map[string]string{
+		"@ SOA":     "ns1.example.net. hostmaster.example.org. 1 7200 1800 86400 300",
+		"@ NS":      "ns1.example.net.",
+		"web A":     "100.0.0.1",
+		"web HTTPS": `1 . ipv4hint="100.0.0.1"`,
+		"web SVCB":  `1 . ipv4hint="100.0.0.1"`,
+		"app CNAME": "web.ts.example.org.",
+	}
+	if !cmp.Equal(got, want) {
+		t.Errorf("unexpected records at the provider: %s", cmp.Diff(want, got))
+	}
+
+	// Exporting the same records again changes nothing.
+	calls := provider.calls
+	if err := ts.export(context.Background()); err != nil {
+		t.Fatalf("unable to export: %v", err)
+	}
+	if provider.calls != calls {
+		t.Errorf("want no changes exported, got %d calls", provider.calls-calls)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	node := func(name, addr string, tags ...string) tailcfg.NodeView {
+		return (&tailcfg.Node{ComputedName: name, Addresses: []netip.Prefix{netip.MustParsePrefix(addr)}, Tags: tags}).View()
+	}
+	ts, err := New(NewConfig(WithZone("example.com"), WithRecord("grafana CNAME web")))
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	ts.processTailnet(&Tailnet{SelfNode: node("web", "100.0.0.1/32", "tag:cname-app"), Peers: []tailcfg.NodeView{node("db", "100.0.0.2/32")}})
+	first := ts.Snapshot()
+	time.Sleep(time.Millisecond)
+	ts.processTailnet(&Tailnet{SelfNode: node("web", "100.0.0.1/32", "tag:cname-app"), Peers: []tailcfg.NodeView{node("db", "100.0.0.3/32")}})
+	s := ts.Snapshot()
+
+	var got []string
+	for _, n := range s.Names {
+		got = append(got, n.Name+" "+n.Source)
+	}
+	want := []string{"app.example.com. tag", "db.example.com. device", "grafana.example.com. manual", "web.example.com. device"}
+	if !cmp.Equal(got, want) {
+		t.Errorf("names = %v, want %v", got, want)
+	}
+	if s.Zone != "example.com." || !cmp.Equal(s.Names[1].Records, map[string][]string{"A": {"100.0.0.3"}}) {
+		t.Errorf("unexpected snapshot: %+v", s)
+	}
+	// Only the records that changed have a new update time.
+	if !s.Names[1].Updated.After(first.Names[1].Updated) {
+		t.Errorf("want a later update time for db, got %s and %s", first.Names[1].Updated, s.Names[1].Updated)
+	}
+	if !s.Names[3].Updated.Equal(first.Names[3].Updated) {
+		t.Errorf("want the update time of web kept, got %s and %s", first.Names[3].Updated, s.Names[3].Updated)
+	}
+
+	// Snapshots are copies.
+	s.Names[1].Records["A"][0] = "192.0.2.1"
+	if got := ts.load().entries["db"]["A"][0]; got != "100.0.0.3" {
+		t.Errorf("snapshot shares records with the plugin, got %s", got)
+	}
+
+	rec := httptest.NewRecorder()
+	ts.debugMux().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, debugRecordsPath, nil))
+	var served Snapshot
+	if err := json.NewDecoder(rec.Body).Decode(&served); err != nil {
+		t.Fatalf("unable to decode records: %v", err)
+	}
+	if len(served.Names) != len(want) || served.Names[0].Name != "app.example.com." {
+		t.Errorf("debug endpoint returned %+v", served)
+	}
+}
+
+func TestProcessNetMapLongNames(t *testing.T) {
+	long := strings.Repeat("a", 70)
+	tn := &Tailnet{
+		SelfNode: (&tailcfg.Node{
+			ComputedName: long,
+			Addresses:    []netip.Prefix{netip.MustParsePrefix("100.0.0.1/32")},
+			Tags:         []string{"tag:cname-" + strings.Repeat("b", 62) + "-c"},
+		}).View(),
+	}
+
+	// Long names are skipped by default.
+	ts := &Tailscale{zone: "example.com."}
+	ts.processTailnet(tn)
+	if len(ts.load().entries) != 0 {
+		t.Errorf("ts.entries = %v, want none", ts.load().entries)
+	}
+
+	ts = &Tailscale{zone: "example.com.", truncateNames: true}
+	ts.processTailnet(tn)
+	short := strings.Repeat("a", 63)
+	want := map[string]map[string][]string{
+		short: {"A": {"100.0.0.1"}, "TXT": {tn.SelfNode.Tags().At(0)}},
+		// The hyphen left at the end by truncation is removed.
+		strings.Repeat("b", 62): {"CNAME": {short + ".example.com."}},
+	}
+	if !cmp.Equal(ts.load().entries, want) {
+		t.Errorf("ts.entries = %v, want %v", ts.load().entries, want)
+	}
+
+	// Names are shortened further if the zone leaves less than a full label.
+	ts = &Tailscale{zone: strings.Repeat("z.", 100), truncateNames: true}
+	if label, ok := ts.fitName(long); !ok || len(label) != maxNameLen-201 {
+		t.Errorf("fitName() = %q, %t, want a %d byte label", label, ok, maxNameLen-201)
+	}
+}
+
+func TestProcessNetMapMagicDNSNames(t *testing.T) {
+	tn := &Tailnet{
+		SelfNode: (&tailcfg.Node{
+			Name:         "self.tail1234.ts.net.",
+			ComputedName: "self",
+			Addresses:    []netip.Prefix{netip.MustParsePrefix("100.64.0.1/32")},
+		}).View(),
+		Peers: []tailcfg.NodeView{
+			(&tailcfg.Node{
+				Name:         "peer.tail1234.ts.net.",
+				ComputedName: "peer",
+				Addresses: []netip.Prefix{
+					netip.MustParsePrefix("100.64.0.2/32"),
+					netip.MustParsePrefix("fd7a:115c:a1e0::2/128"),
+				},
+				Tags: []string{tagV4Only},
+			}).View(),
+		},
+	}
+
+	ts := &Tailscale{zone: "example.com."}
+	ts.processTailnet(tn)
+	if got := ts.load().reverse[netip.MustParseAddr("100.64.0.2")]; got != "peer.example.com." {
+		t.Errorf("ptr_target zone: got %q, want peer.example.com.", got)
+	}
+
+	ts = &Tailscale{zone: "example.com.", ptrMagicDNS: true}
+	ts.processTailnet(tn)
+	want := map[netip.Addr]string{
+		netip.MustParseAddr("100.64.0.1"): "self.tail1234.ts.net.",
+		netip.MustParseAddr("100.64.0.2"): "peer.tail1234.ts.net.",
+	}
+	if !cmp.Equal(ts.load().reverse, want, cmp.Comparer(func(a, b netip.Addr) bool { return a == b })) {
+		t.Errorf("ptr_target magicdns: got %v, want %v", ts.load().reverse, want)
+	}
+}
+
+func TestProcessNetMapFamilies(t *testing.T) {
+	tn := &Tailnet{
+		Peers: []tailcfg.NodeView{
+			(&tailcfg.Node{
+				ComputedName: "peer",
+				Addresses: []netip.Prefix{
+					netip.MustParsePrefix("100.64.0.2/32"),
+					netip.MustParsePrefix("fd7a:115c:a1e0::2/128"),
+				},
+				Tags: []string{"tag:cdns-a-192-0-2-2"},
+			}).View(),
+		},
+	}
+
+	tests := []struct {
+		name       string
+		ipv4, ipv6 string
+		want       map[string][]string
+	}{
+		{"both", "", "", map[string][]string{"A": {"100.64.0.2", "192.0.2.2"}, "AAAA": {"fd7a:115c:a1e0::2"}}},
+		{"ipv4 only", familyOnly, "", map[string][]string{"A": {"100.64.0.2", "192.0.2.2"}}},
+		{"ipv6 off", "", familyOff, map[string][]string{"A": {"100.64.0.2", "192.0.2.2"}}},
+		{"ipv6 only", "", familyOnly, map[string][]string{"AAAA": {"fd7a:115c:a1e0::2"}}},
+		{"ipv4 off", familyOff, "", map[string][]string{"AAAA": {"fd7a:115c:a1e0::2"}}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ts, err := New(NewConfig(WithZone("example.com"), WithIPv4(tc.ipv4), WithIPv6(tc.ipv6)))
+			if err != nil {
+				t.Fatalf("New() error = %v", err)
+			}
+			ts.processTailnet(tn)
+			tc.want["TXT"] = []string{"tag:cdns-a-192-0-2-2"}
+			if diff := cmp.Diff(tc.want, ts.load().entries["peer"]); diff != "" {
+				t.Errorf("records mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestCheckOverlaps(t *testing.T) {
+	self := (&tailcfg.Node{
+		ComputedName: "self",
+		Addresses:    []netip.Prefix{netip.MustParsePrefix("100.64.0.1/32")},
+	}).View()
+	here := []*dnstype.Resolver{{Addr: "100.64.0.1"}}
+	elsewhere := []*dnstype.Resolver{{Addr: "192.0.2.53:53"}}
+
+	testCases := []struct {
+		name     string
+		zones    []string
+		magicDNS bool
+		domain   string
+		dns      tailcfg.DNSConfig
+		want     []overlap
+	}{
+		{
+			name:  "routed here",
+			zones: []string{"example.com."},
+			dns: tailcfg.DNSConfig{
+				Domains: []string{"example.com"},
+				Routes:  map[string][]*dnstype.Resolver{"example.com": here, "corp.example.com": elsewhere},
+			},
+		},
+		{
+			name:   "magicdns domain",
+			zones:  []string{"tail1234.ts.net.", "svc.tail1234.ts.net."},
+			domain: "tail1234.ts.net",
+			want: []overlap{
+				{"svc.tail1234.ts.net.", overlapMagicDNS, "tail1234.ts.net."},
+				{"tail1234.ts.net.", overlapMagicDNS, "tail1234.ts.net."},
+			},
+		},
+		{
+			name:  "search domain",
+			zones: []string{"example.com.", "example.org."},
+			dns:   tailcfg.DNSConfig{Domains: []string{"Example.com"}},
+			want:  []overlap{{"example.com.", overlapSearchDomain, "example.com."}},
+		},
+		{
+			name:  "routed elsewhere",
+			zones: []string{"lab.example.com."},
+			dns: tailcfg.DNSConfig{
+				Routes: map[string][]*dnstype.Resolver{"com": here, "example.com": elsewhere},
+			},
+			want: []overlap{{"lab.example.com.", overlapRoute, "example.com."}},
+		},
+		{
+			name:  "routed to magicdns",
+			zones: []string{"example.com."},
+			dns:   tailcfg.DNSConfig{Routes: map[string][]*dnstype.Resolver{"example.com": nil}},
+		},
+		{
+			name:     "loop",
+			zones:    []string{"example.com."},
+			magicDNS: true,
+			dns: tailcfg.DNSConfig{
+				Routes: map[string][]*dnstype.Resolver{"tail5678.ts.net": {{Addr: "100.64.0.1:53"}}, "tail9999.ts.net": elsewhere},
+			},
+			want: []overlap{{"", overlapLoop, "tail5678.ts.net."}},
+		},
+		{
+			name:  "no loop without magicdns",
+			zones: []string{"example.com."},
+			dns:   tailcfg.DNSConfig{Routes: map[string][]*dnstype.Resolver{"tail5678.ts.net": here}},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ts := &Tailscale{zone: tc.zones[0], zones: tc.zones, magicDNS: tc.magicDNS}
+			got := ts.findOverlaps(&Tailnet{SelfNode: self, Domain: tc.domain, DNS: tc.dns})
+			if diff := cmp.Diff(tc.want, got, cmp.AllowUnexported(overlap{})); diff != "" {
+				t.Errorf("overlaps mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+
+	// Network maps from the API have no DNS settings to compare with.
+	ts := &Tailscale{zone: "tail1234.ts.net.", zones: []string{"tail1234.ts.net."}}
+	if got := ts.findOverlaps(&Tailnet{Domain: "tail1234.ts.net"}); got != nil {
+		t.Errorf("want no overlaps without a self node, got %v", got)
+	}
+}
+
+func TestCheckOverlapsAdjust(t *testing.T) {
+	tn := &Tailnet{
+		SelfNode: (&tailcfg.Node{
+			ComputedName: "self",
+			Addresses:    []netip.Prefix{netip.MustParsePrefix("100.64.0.1/32")},
+		}).View(),
+		Domain: "tail1234.ts.net",
+		DNS: tailcfg.DNSConfig{
+			Routes: map[string][]*dnstype.Resolver{"tail5678.ts.net": {{Addr: "100.64.0.1"}}},
+		},
+	}
+
+	ts := &Tailscale{zone: "example.com.", zones: []string{"example.com."}, magicDNS: true}
+	ts.checkOverlaps(tn)
+	if ts.loopDomain(ts.load(), "host.tail5678.ts.net.") {
+		t.Error("warn: want queries passed on to MagicDNS")
+	}
+	if got := testutil.ToFloat64(MagicDNSOverlaps.WithLabelValues("", "", overlapLoop)); got != 1 {
+		t.Errorf("want the loop in the overlaps metric, got %v", got)
+	}
+
+	ts.overlapAdjust = true
+	ts.checkOverlaps(tn)
+	if !ts.loopDomain(ts.load(), "Host.tail5678.ts.net.") || ts.loopDomain(ts.load(), "host.tail1234.ts.net.") {
+		t.Errorf("adjust: want only tail5678.ts.net. kept from MagicDNS, got %v", ts.load().loopDomains)
+	}
+
+	tn.DNS = tailcfg.DNSConfig{}
+	ts.checkOverlaps(tn)
+	if ts.loopDomain(ts.load(), "host.tail5678.ts.net.") {
+		t.Error("want queries passed on to MagicDNS once the route is gone")
+	}
+	if got := testutil.CollectAndCount(MagicDNSOverlaps); got != 0 {
+		t.Errorf("want no overlaps in the metric, got %d", got)
+	}
+}
+
+func TestProcessNetMapEndpoints(t *testing.T) {
+	tn := &Tailnet{
+		SelfNode: (&tailcfg.Node{
+			ComputedName: "self",
+			Addresses:    []netip.Prefix{netip.MustParsePrefix("100.64.0.1/32")},
+			Endpoints: []netip.AddrPort{
+				netip.MustParseAddrPort("198.51.100.7:41641"),
+				netip.MustParseAddrPort("198.51.100.7:3478"),
+				netip.MustParseAddrPort("192.168.1.5:41641"),
+				netip.MustParseAddrPort("[2001:db8::7]:41641"),
+				netip.MustParseAddrPort("[fe80::1]:41641"),
+				netip.MustParseAddrPort("[::ffff:203.0.113.1]:41641"),
+			},
+		}).View(),
+		Peers: []tailcfg.NodeView{
+			(&tailcfg.Node{
+				ComputedName: "peer",
+				Addresses:    []netip.Prefix{netip.MustParsePrefix("100.64.0.2/32")},
+				Endpoints: []netip.AddrPort{
+					netip.MustParseAddrPort("10.0.0.2:41641"),
+					netip.MustParseAddrPort("100.70.0.2:41641"),
+				},
+			}).View(),
+		},
+	}
+
+	ts := &Tailscale{zone: "example.com."}
+	ts.processTailnet(tn)
+	if len(ts.load().endpoints) != 0 {
+		t.Errorf("want no endpoints unless enabled, got %v", ts.load().endpoints)
+	}
+
+	ts = &Tailscale{zone: "example.com.", endpointLabel: "ext"}
+	ts.processTailnet(tn)
+	want := map[string]map[string][]string{
+		"self": {"A": {"198.51.100.7", "203.0.113.1"}, "AAAA": {"2001:db8::7"}},
+	}
+	if diff := cmp.Diff(want, ts.load().endpoints); diff != "" {
+		t.Errorf("endpoints mismatch (-want +got):\n%s", diff)
+	}
+	if _, ok := ts.load().entries["self.ext"]; ok {
+		t.Error("want endpoints kept out of the entries")
+	}
+}
+
+func TestProcessNetMapUserSubzones(t *testing.T) {
+	hostinfo := func(hostname string) tailcfg.HostinfoView {
+		return (&tailcfg.Hostinfo{Hostname: hostname}).View()
+	}
+	tn := &Tailnet{
+		UserProfiles: map[tailcfg.UserID]tailcfg.UserProfile{
+			1: {ID: 1, LoginName: "alice@example.com"},
+			2: {ID: 2, LoginName: "bob@example.com"},
+		},
+		Peers: []tailcfg.NodeView{
+			(&tailcfg.Node{
+				ID:           1,
+				ComputedName: "laptop",
+				User:         1,
+				Addresses:    []netip.Prefix{netip.MustParsePrefix("100.64.0.1/32")},
+				Hostinfo:     hostinfo("Laptop"),
+			}).View(),
+			(&tailcfg.Node{
+				ID:           2,
+				ComputedName: "laptop-1",
+				User:         2,
+				Addresses:    []netip.Prefix{netip.MustParsePrefix("100.64.0.2/32")},
+				Hostinfo:     hostinfo("laptop"),
+			}).View(),
+			// Machines of one user reporting the same hostname collide in its subzone.
+			(&tailcfg.Node{
+				ID:           3,
+				ComputedName: "phone",
+				User:         1,
+				Addresses:    []netip.Prefix{netip.MustParsePrefix("100.64.0.3/32")},
+				Hostinfo:     hostinfo("phone"),
+			}).View(),
+			(&tailcfg.Node{
+				ID:           4,
+				ComputedName: "phone-1",
+				User:         1,
+				Addresses:    []netip.Prefix{netip.MustParsePrefix("100.64.0.4/32")},
+				Hostinfo:     hostinfo("phone"),
+			}).View(),
+			(&tailcfg.Node{
+				ID:           5,
+				ComputedName: "tablet",
+				User:         2,
+				Addresses:    []netip.Prefix{netip.MustParsePrefix("100.64.0.5/32")},
+			}).View(),
+		},
+	}
+
+	ts, err := New(NewConfig(WithZone("example.com"), WithUserSubzones()))
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	ts.processTailnet(tn)
+	want := map[string]map[string][]string{
+		"laptop":       {"A": {"100.64.0.1"}},
+		"laptop-1":     {"A": {"100.64.0.2"}},
+		"phone":        {"A": {"100.64.0.3"}},
+		"phone-1":      {"A": {"100.64.0.4"}},
+		"tablet":       {"A": {"100.64.0.5"}},
+		"laptop.alice": {"A": {"100.64.0.1"}},
+		"laptop.bob":   {"A": {"100.64.0.2"}},
+		"phone.alice":  {"A": {"100.64.0.3", "100.64.0.4"}},
+		"tablet.bob":   {"A": {"100.64.0.5"}},
+	}
+	if diff := cmp.Diff(want, ts.load().entries); diff != "" {
+		t.Errorf("entries mismatch (-want +got):\n%s", diff)
+	}
+	if _, ok := ts.collidingHosts["phone.alice"]; !ok {
+		t.Errorf("want the phones of alice reported as a collision, got %v", ts.collidingHosts)
+	}
+}
+
+func TestProcessNetMapAppConnectors(t *testing.T) {
+	connector := (&tailcfg.Hostinfo{AppConnector: opt.NewBool(true)}).View()
+	tn := &Tailnet{
+		SelfNode: (&tailcfg.Node{
+			ComputedName: "self",
+			Addresses:    []netip.Prefix{netip.MustParsePrefix("100.64.0.1/32")},
+			CapMap: tailcfg.NodeCapMap{appConnectorsCap: {
+				`{"name": "GitHub", "connectors": ["tag:connector"], "domains": ["github.com", "*.GitHub.com"]}`,
+				`{"name": "wiki", "connectors": ["*"], "domains": ["wiki.example.org"]}`,
+				`{"name": "unserved", "connectors": ["tag:nobody"], "domains": ["example.net"]}`,
+			}},
+		}).View(),
+		Peers: []tailcfg.NodeView{
+			(&tailcfg.Node{
+				ComputedName: "conn1",
+				Addresses:    []netip.Prefix{netip.MustParsePrefix("100.64.0.2/32"), netip.MustParsePrefix("fd7a:115c:a1e0::2/128")},
+				Tags:         []string{"tag:connector"},
+				Hostinfo:     connector,
+			}).View(),
+			(&tailcfg.Node{
+				ComputedName: "conn2",
+				Addresses:    []netip.Prefix{netip.MustParsePrefix("100.64.0.3/32")},
+				Hostinfo:     connector,
+			}).View(),
+			(&tailcfg.Node{
+				ComputedName: "other",
+				Addresses:    []netip.Prefix{netip.MustParsePrefix("100.64.0.4/32")},
+				Tags:         []string{"tag:connector"},
+			}).View(),
+		},
+	}
+
+	ts, err := New(NewConfig(WithZone("example.com"), WithAppConnectors("")))
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	ts.processTailnet(tn)
+	want := map[string]map[string][]string{
+		"github.apps": {"A": {"100.64.0.2"}, "AAAA": {"fd7a:115c:a1e0::2"}, "TXT": {"*.github.com", "github.com"}},
+		"wiki.apps":   {"A": {"100.64.0.2", "100.64.0.3"}, "AAAA": {"fd7a:115c:a1e0::2"}, "TXT": {"wiki.example.org"}},
+	}
+	got := map[string]map[string][]string{}
+	for name, records := range ts.load().entries {
+		if strings.HasSuffix(name, ".apps") {
+			got[name] = records
+		}
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("app records mismatch (-want +got):\n%s", diff)
+	}
+
+	var msg dns.Msg
+	msg.SetQuestion("github.apps.example.com.", dns.TypeA)
+	w := dnstest.NewRecorder(&test.ResponseWriter{})
+	if _, err := ts.ServeDNS(context.Background(), w, &msg); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(w.Msg.Answer) != 1 || w.Msg.Answer[0].(*dns.A).A.String() != "100.64.0.2" {
+		t.Errorf("want the address of conn1, got %v", w.Msg.Answer)
+	}
+
+	// Views hide the connectors they don't show.
+	ts.views = []View{{Name: "conn2", Clients: []string{"*"}, Show: []string{"conn2"}}}
+	ts.whoIsFunc = func(ctx context.Context, remoteAddr string) (*apitype.WhoIsResponse, error) {
+		return &apitype.WhoIsResponse{Node: &tailcfg.Node{ComputedName: "client"}}, nil
+	}
+	query := func(qname string) (int, *dns.Msg) {
+		var msg dns.Msg
+		msg.SetQuestion(qname, dns.TypeA)
+		w := dnstest.NewRecorder(&test.ResponseWriter{RemoteIP: "100.64.0.9"})
+		rcode, err := ts.ServeDNS(context.Background(), w, &msg)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return rcode, w.Msg
+	}
+	if rcode, resp := query("github.apps.example.com."); rcode != dns.RcodeNameError || len(resp.Answer) != 0 {
+		t.Errorf("want no app without a connector shown by the view, got rcode %d with %v", rcode, resp.Answer)
+	}
+	if _, resp := query("wiki.apps.example.com."); len(resp.Answer) != 1 || resp.Answer[0].(*dns.A).A.String() != "100.64.0.3" {
+		t.Errorf("want the address of conn2 only, got %v", resp.Answer)
+	}
+
+	// Without the directive, apps aren't published.
+	ts = &Tailscale{zone: "example.com."}
+	ts.processTailnet(tn)
+	if _, ok := ts.load().entries["github.apps"]; ok {
+		t.Error("want no app records unless enabled")
+	}
+}
+
+func TestProcessNetMapTopology(t *testing.T) {
+	tn := &Tailnet{
+		Peers: []tailcfg.NodeView{
+			(&tailcfg.Node{
+				ComputedName: "gateway",
+				Addresses:    []netip.Prefix{netip.MustParsePrefix("100.64.0.1/32")},
+				AllowedIPs:   []netip.Prefix{netip.MustParsePrefix("100.64.0.1/32"), netip.MustParsePrefix("0.0.0.0/0"), netip.MustParsePrefix("::/0")},
+			}).View(),
+			(&tailcfg.Node{
+				ComputedName: "router1",
+				Addresses:    []netip.Prefix{netip.MustParsePrefix("100.64.0.2/32"), netip.MustParsePrefix("fd7a:115c:a1e0::2/128")},
+				AllowedIPs:   []netip.Prefix{netip.MustParsePrefix("100.64.0.2/32"), netip.MustParsePrefix("fd7a:115c:a1e0::2/128"), netip.MustParsePrefix("10.0.0.0/24"), netip.MustParsePrefix("fd00::/64")},
+			}).View(),
+			(&tailcfg.Node{
+				ComputedName: "router2",
+				Addresses:    []netip.Prefix{netip.MustParsePrefix("100.64.0.3/32")},
+				AllowedIPs:   []netip.Prefix{netip.MustParsePrefix("100.64.0.3/32"), netip.MustParsePrefix("10.0.0.0/24")},
+			}).View(),
+			(&tailcfg.Node{
+				ComputedName: "laptop",
+				Addresses:    []netip.Prefix{netip.MustParsePrefix("100.64.0.4/32")},
+				AllowedIPs:   []netip.Prefix{netip.MustParsePrefix("100.64.0.4/32")},
+			}).View(),
+		},
+	}
+
+	ts, err := New(NewConfig(WithZone("example.com"), WithTopologyRecords()))
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	ts.processTailnet(tn)
+	want := map[string]map[string][]string{
+		"exit-nodes":         {"A": {"100.64.0.1"}, "TXT": {"gateway.example.com."}},
+		"routers":            {"A": {"100.64.0.2", "100.64.0.3"}, "AAAA": {"fd7a:115c:a1e0::2"}, "TXT": {"router1.example.com.", "router2.example.com."}},
+		"10-0-0-0-24.routes": {"A": {"100.64.0.2", "100.64.0.3"}, "AAAA": {"fd7a:115c:a1e0::2"}, "TXT": {"10.0.0.0/24"}},
+		"fd00---64.routes":   {"A": {"100.64.0.2"}, "AAAA": {"fd7a:115c:a1e0::2"}, "TXT": {"fd00::/64"}},
+	}
+	got := map[string]map[string][]string{}
+	for name, records := range ts.load().entries {
+		if _, ok := want[name]; ok || strings.HasSuffix(name, ".routes") {
+			got[name] = records
+		}
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("topology records mismatch (-want +got):\n%s", diff)
+	}
+
+	var msg dns.Msg
+	msg.SetQuestion("10-0-0-0-24.routes.example.com.", dns.TypeA)
+	w := dnstest.NewRecorder(&test.ResponseWriter{})
+	if _, err := ts.ServeDNS(context.Background(), w, &msg); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(w.Msg.Answer) != 2 {
+		t.Errorf("want the addresses of both routers, got %v", w.Msg.Answer)
+	}
+
+	// Views hide the exit nodes and routers they don't show, their addresses and their names.
+	ts.views = []View{{Name: "router1", Clients: []string{"*"}, Show: []string{"router1"}}}
+	ts.whoIsFunc = func(ctx context.Context, remoteAddr string) (*apitype.WhoIsResponse, error) {
+		return &apitype.WhoIsResponse{Node: &tailcfg.Node{ComputedName: "client"}}, nil
+	}
+	query := func(qname string, qtype uint16) (int, *dns.Msg) {
+		var msg dns.Msg
+		msg.SetQuestion(qname, qtype)
+		w := dnstest.NewRecorder(&test.ResponseWriter{RemoteIP: "100.64.0.9"})
+		rcode, err := ts.ServeDNS(context.Background(), w, &msg)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return rcode, w.Msg
+	}
+	if rcode, resp := query("exit-nodes.example.com.", dns.TypeA); rcode != dns.RcodeNameError || len(resp.Answer) != 0 {
+		t.Errorf("want no exit nodes for the view, got rcode %d with %v", rcode, resp.Answer)
+	}
+	if _, resp := query("routers.example.com.", dns.TypeA); len(resp.Answer) != 1 || resp.Answer[0].(*dns.A).A.String() != "100.64.0.2" {
+		t.Errorf("want the address of router1 only, got %v", resp.Answer)
+	}
+	if _, resp := query("routers.example.com.", dns.TypeTXT); len(resp.Answer) != 1 || resp.Answer[0].(*dns.TXT).Txt[0] != "router1.example.com." {
+		t.Errorf("want the name of router1 only, got %v", resp.Answer)
+	}
+
+	// Without the directive, the topology isn't published.
+	ts = &Tailscale{zone: "example.com."}
+	ts.processTailnet(tn)
+	if _, ok := ts.load().entries["routers"]; ok {
+		t.Error("want no topology records unless enabled")
+	}
+}
+
+func TestProcessNetMapMetadata(t *testing.T) {
+	online := false
+	lastSeen := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	tn := &Tailnet{
+		Peers: []tailcfg.NodeView{
+			(&tailcfg.Node{
+				ComputedName: "gateway",
+				Addresses:    []netip.Prefix{netip.MustParsePrefix("100.64.0.1/32")},
+				AllowedIPs:   []netip.Prefix{netip.MustParsePrefix("100.64.0.1/32"), netip.MustParsePrefix("0.0.0.0/0")},
+				Hostinfo:     (&tailcfg.Hostinfo{OS: "linux", IPNVersion: "1.76.1"}).View(),
+				Online:       &online,
+				LastSeen:     &lastSeen,
+			}).View(),
+			(&tailcfg.Node{
+				ComputedName: "laptop",
+				Addresses:    []netip.Prefix{netip.MustParsePrefix("100.64.0.2/32")},
+			}).View(),
+		},
+	}
+
+	ts, err := New(NewConfig(WithZone("example.com"), WithExposeMetadata()))
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	ts.processTailnet(tn)
+
+	tests := []struct {
+		qname string
+		want  []string
+	}{
+		{"_meta.gateway.example.com.", []string{"os=linux", "version=1.76.1", "online=false", "last_seen=2024-05-01T12:00:00Z", "exit_node=true"}},
+		{"_meta.laptop.example.com.", []string{"exit_node=false"}},
+	}
+	for _, tc := range tests {
+		var msg dns.Msg
+		msg.SetQuestion(tc.qname, dns.TypeTXT)
+		w := dnstest.NewRecorder(&test.ResponseWriter{})
+		if _, err := ts.ServeDNS(context.Background(), w, &msg); err != nil {
+			t.Fatalf("%s: unexpected error: %v", tc.qname, err)
+		}
+		if len(w.Msg.Answer) != 1 {
+			t.Fatalf("%s: want one TXT record, got %v", tc.qname, w.Msg.Answer)
+		}
+		if diff := cmp.Diff(tc.want, w.Msg.Answer[0].(*dns.TXT).Txt); diff != "" {
+			t.Errorf("%s: metadata mismatch (-want +got):\n%s", tc.qname, diff)
+		}
+	}
+
+	// Without the directive, names below a machine get its own records.
+	ts = &Tailscale{zone: "example.com."}
+	ts.processTailnet(tn)
+	var msg dns.Msg
+	msg.SetQuestion("_meta.gateway.example.com.", dns.TypeTXT)
+	w := dnstest.NewRecorder(&test.ResponseWriter{})
+	if _, err := ts.ServeDNS(context.Background(), w, &msg); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(w.Msg.Answer) != 0 {
+		t.Errorf("want no metadata unless enabled, got %v", w.Msg.Answer)
+	}
+}
+
+func TestProcessNetMapIPv6Only(t *testing.T) {
+	node := func(name string, addrs ...string) tailcfg.NodeView {
+		n := &tailcfg.Node{ComputedName: name, Tags: []string{tagV4Only}}
+		for _, addr := range addrs {
+			n.Addresses = append(n.Addresses, netip.PrefixFrom(netip.MustParseAddr(addr), netip.MustParseAddr(addr).BitLen()))
+		}
+		return n.View()
+	}
+
+	// Without IPv4 in the tailnet, the IPv4 pin is ignored rather than leaving the node without records.
+	ts := &Tailscale{zone: "example.com."}
+	ts.processTailnet(&Tailnet{
+		SelfNode: node("self", "fd7a:115c:a1e0::1"),
+		Peers:    []tailcfg.NodeView{node("peer", "fd7a:115c:a1e0::2")},
+	})
+	if !ts.ipv4Disabled {
+		t.Error("want IPv4 detected as disabled")
+	}
+	want := map[string]map[string][]string{
+		"self": {"AAAA": {"fd7a:115c:a1e0::1"}, "TXT": {tagV4Only}},
+		"peer": {"AAAA": {"fd7a:115c:a1e0::2"}, "TXT": {tagV4Only}},
+	}
+	if !cmp.Equal(ts.load().entries, want) {
+		t.Errorf("unexpected entries: %s", cmp.Diff(want, ts.load().entries))
+	}
+
+	for qtype, answers := range map[uint16]int{dns.TypeA: 0, dns.TypeAAAA: 1} {
+		msg := new(dns.Msg)
+		msg.SetQuestion("peer.example.com.", qtype)
+		w := dnstest.NewRecorder(&test.ResponseWriter{})
+		rcode, err := ts.ServeDNS(context.Background(), w, msg)
+		if err != nil || rcode != dns.RcodeSuccess || len(w.Msg.Answer) != answers {
+			t.Errorf("%s: want NOERROR with %d answers, got rcode %d (err %v), %v", dns.TypeToString[qtype], answers, rcode, err, w.Msg.Answer)
+		}
+	}
+
+	// Once a node has an IPv4 address, the pin applies again.
+	ts.processTailnet(&Tailnet{
+		SelfNode: node("self", "100.64.0.1", "fd7a:115c:a1e0::1"),
+		Peers:    []tailcfg.NodeView{node("peer", "fd7a:115c:a1e0::2")},
+	})
+	if ts.ipv4Disabled {
+		t.Error("want IPv4 detected as enabled")
+	}
+	if _, ok := ts.load().entries["peer"]["AAAA"]; ok {
+		t.Errorf("want the IPv4 pin of peer honoured, got %v", ts.load().entries["peer"])
+	}
+}
+
+func TestWatchIPNBusPollInterval(t *testing.T) {
+	// A fake LocalAPI sending a netmap with a new node name on every watch.
+	var watches atomic.Int32
+	localAPI := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/localapi/v0/watch-ipn-bus" {
+			http.NotFound(w, r)
+			return
+		}
+		n := watches.Add(1)
+		tn := &Tailnet{SelfNode: (&tailcfg.Node{
+			ComputedName: fmt.Sprintf("node%d", n),
+			Addresses:    []netip.Prefix{netip.MustParsePrefix("100.64.0.1/32")},
+		}).View()}
+		json.NewEncoder(w).Encode(ipn.Notify{NetMap: tn})
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer localAPI.Close()
+
+	ts := &Tailscale{zone: "example.com.", pollInterval: 50 * time.Millisecond}
+	ts.source = &localAPISource{lc: &tailscale.LocalClient{
+		Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "tcp", localAPI.Listener.Addr().String())
+		},
+		OmitAuth: true,
+	}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		ts.watch(ctx)
+		close(done)
+	}()
+	for deadline := time.Now().Add(5 * time.Second); watches.Load() < 3; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("want the netmap to be fetched again every poll interval, got %d watches", watches.Load())
+		}
+	}
+	cancel()
+	<-done
+
+	if _, ok := ts.load().entries["node1"]; ok || len(ts.load().entries) != 1 {
+		t.Errorf("want the records of the latest netmap, got %v", ts.load().entries)
+	}
+}
+
+func TestProcessNetMapServices(t *testing.T) {
+	tn := &Tailnet{
+		SelfNode: (&tailcfg.Node{
+			ComputedName: "web",
+			Addresses:    []netip.Prefix{netip.MustParsePrefix("100.64.0.1/32")},
+			Tags:         []string{"tag:web"},
+			Hostinfo: (&tailcfg.Hostinfo{Services: []tailcfg.Service{
+				{Proto: tailcfg.TCP, Port: 22, Description: "sshd"},
+				{Proto: tailcfg.TCP, Port: 443, Description: "nginx"},
+				{Proto: tailcfg.TCP, Port: 9000, Description: "unknown"},
+				{Proto: tailcfg.PeerAPI4, Port: 12345},
+			}}).View(),
+		}).View(),
+	}
+
+	ts := &Tailscale{
+		zone:     "example.com.",
+		services: []ServiceMapping{{Tag: "tag:web", Service: "https", Proto: "tcp", Port: 443}},
+	}
+	ts.processTailnet(tn)
+	if got, want := ts.load().entries["web"]["SRV"], []string{"_https._tcp 443"}; !cmp.Equal(got, want) {
+		t.Errorf("tag services: got %v, want %v", got, want)
+	}
+
+	ts.srvHostinfo = true
+	ts.processTailnet(tn)
+	if got, want := ts.load().entries["web"]["SRV"], []string{"_https._tcp 443", "_ssh._tcp 22"}; !cmp.Equal(got, want) {
+		t.Errorf("hostinfo services: got %v, want %v", got, want)
+	}
+}
+
+func TestProcessNetMapSubzones(t *testing.T) {
+	ts := &Tailscale{
+		zone:          "example.com.",
+		subzones:      map[string]string{"tag:k8s": "k8s", "tag:prod": "prod"},
+		subzoneLabels: map[string]bool{"k8s": true, "prod": true},
+	}
+	ts.processTailnet(&Tailnet{
+		Peers: []tailcfg.NodeView{
+			(&tailcfg.Node{
+				ComputedName: "node1",
+				Addresses:    []netip.Prefix{netip.MustParsePrefix("100.64.0.1/32")},
+				Tags:         []string{"tag:prod", "tag:k8s"},
+			}).View(),
+			(&tailcfg.Node{
+				ComputedName: "laptop",
+				Addresses:    []netip.Prefix{netip.MustParsePrefix("100.64.0.2/32")},
+			}).View(),
+		},
+	})
+
+	for _, name := range []string{"node1", "node1.k8s", "node1.prod", "laptop"} {
+		if _, ok := ts.load().entries[name]; !ok {
+			t.Errorf("want entry for %s, got %v", name, ts.load().entries)
+		}
+	}
+	if len(ts.load().entries) != 4 {
+		t.Errorf("want 4 entries, got %v", ts.load().entries)
+	}
+	if got := ts.load().reverse[netip.MustParseAddr("100.64.0.1")]; got != "node1.example.com." {
+		t.Errorf("want PTR to the name in the zone, got %s", got)
+	}
+}
+
+func TestProcessNetMapTagFilter(t *testing.T) {
+	node := func(name string, tags ...string) tailcfg.NodeView {
+		return (&tailcfg.Node{
+			ComputedName: name,
+			Addresses:    []netip.Prefix{netip.MustParsePrefix("100.64.0.1/32")},
+			Tags:         tags,
+		}).View()
+	}
+	tn := &Tailnet{
+		SelfNode: node("dns", "tag:infra"),
+		Peers: []tailcfg.NodeView{
+			node("web", "tag:prod"),
+			node("runner", "tag:prod", "tag:ci"),
+			node("laptop"),
+		},
+	}
+
+	tests := []struct {
+		name    string
+		include []string
+		exclude []string
+		want    []string
+	}{
+		{"no filter", nil, nil, []string{"dns", "laptop", "runner", "web"}},
+		{"include", []string{"tag:prod", "tag:infra"}, nil, []string{"dns", "runner", "web"}},
+		{"exclude", nil, []string{"tag:ci"}, []string{"dns", "laptop", "web"}},
+		{"exclude wins", []string{"tag:prod"}, []string{"tag:ci"}, []string{"web"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := &Tailscale{zone: "example.com.", includeTags: tt.include, excludeTags: tt.exclude}
+			ts.processTailnet(tn)
+			got := slices.Sorted(maps.Keys(ts.load().entries))
+			if !cmp.Equal(got, tt.want) {
+				t.Errorf("want entries %v, got %v", tt.want, got)
+			}
+			if n := testutil.ToFloat64(NodeCount.WithLabelValues("", ts.zone)); int(n) != len(tt.want) {
+				t.Errorf("want %d nodes counted, got %v", len(tt.want), n)
+			}
+		})
+	}
+}
+
+func TestProcessNetMapProfiles(t *testing.T) {
+	online, offline := true, false
+	node := func(name string, connected *bool, tags ...string) tailcfg.NodeView {
+		return (&tailcfg.Node{
+			ComputedName: name,
+			Addresses:    []netip.Prefix{netip.MustParsePrefix("100.64.0.1/32")},
+			Tags:         tags,
+			Online:       connected,
+		}).View()
+	}
+	ts := &Tailscale{
+		zone:      "example.com.",
+		recordTTL: 60,
+		profiles: []Profile{
+			{Name: "ephemeral", TTL: 5, OnlineOnly: true},
+			{Name: "ci", Tags: []string{"tag:ci", "tag:runner"}, TTL: 30},
+			{Name: "kiosk", OnlineOnly: true},
+		},
+	}
+	ts.processTailnet(&Tailnet{
+		SelfNode: node("dns", nil, "tag:infra"),
+		Peers: []tailcfg.NodeView{
+			node("preview-1", &online, "tag:ephemeral"),
+			node("preview-2", &offline, "tag:ephemeral"),
+			// Without presence information, a node counts as connected.
+			node("preview-3", nil, "tag:ephemeral"),
+			node("runner", &offline, "tag:runner"),
+			// The first configured profile of a node applies, regardless of the order of its tags.
+			node("build", &online, "tag:runner", "tag:ephemeral"),
+			node("lobby", &offline, "tag:kiosk"),
+			node("laptop", &offline),
+		},
+	})
+
+	want := []string{"build", "dns", "laptop", "preview-1", "preview-3", "runner"}
+	if got := slices.Sorted(maps.Keys(ts.load().entries)); !cmp.Equal(got, want) {
+		t.Errorf("want entries %v, got %v", want, got)
+	}
+
+	for name, ttl := range map[string]uint32{"preview-1": 5, "build": 5, "runner": 30, "laptop": 60, "dns": 60} {
+		var msg dns.Msg
+		msg.SetQuestion(name+".example.com.", dns.TypeA)
+		w := dnstest.NewRecorder(&test.ResponseWriter{})
+		if _, err := ts.ServeDNS(context.Background(), w, &msg); err != nil {
+			t.Fatalf("%s: unexpected error: %v", name, err)
+		}
+		if len(w.Msg.Answer) != 1 || w.Msg.Answer[0].Header().Ttl != ttl {
+			t.Errorf("%s: want an answer with TTL %d, got %v", name, ttl, w.Msg.Answer)
+		}
+	}
+
+	// Zone transfers use the TTLs of the profiles as well.
+	for _, rrs := range ts.zoneRRsets(ts.load(), "example.com.") {
+		if rrs[0].Header().Name == "preview-1.example.com." && rrs[0].Header().Ttl != 5 {
+			t.Errorf("want transferred records of preview-1 with TTL 5, got %v", rrs)
+		}
+	}
+}
+
+func TestProcessNetMapOfflineNodes(t *testing.T) {
+	online, offline := true, false
+	node := func(name string, connected *bool) tailcfg.NodeView {
+		return (&tailcfg.Node{
+			ComputedName: name,
+			Addresses:    []netip.Prefix{netip.MustParsePrefix("100.64.0.1/32")},
+			Online:       connected,
+		}).View()
+	}
+	tn := &Tailnet{
+		SelfNode: node("dns", nil),
+		Peers:    []tailcfg.NodeView{node("up", &online), node("down", &offline)},
+	}
+
+	ttls := func(ts *Tailscale) map[string]uint32 {
+		got := map[string]uint32{}
+		for name := range ts.load().entries {
+			var msg dns.Msg
+			msg.SetQuestion(name+".example.com.", dns.TypeA)
+			w := dnstest.NewRecorder(&test.ResponseWriter{})
+			if _, err := ts.ServeDNS(context.Background(), w, &msg); err != nil {
+				t.Fatalf("%s: unexpected error: %v", name, err)
+			}
+			if len(w.Msg.Answer) == 1 {
+				got[name] = w.Msg.Answer[0].Header().Ttl
+			}
+		}
+		return got
+	}
+
+	tests := []struct {
+		policy string
+		want   map[string]uint32
+	}{
+		{offlineServe, map[string]uint32{"dns": 60, "up": 60, "down": 60}},
+		{offlineOmit, map[string]uint32{"dns": 60, "up": 60}},
+		{offlineFlag, map[string]uint32{"dns": 60, "up": 60, "down": 5}},
+	}
+	for _, tc := range tests {
+		ts := &Tailscale{zone: "example.com.", recordTTL: 60, offlineNodes: tc.policy, offlineTTL: 5}
+		ts.processTailnet(tn)
+		if got := ttls(ts); !cmp.Equal(got, tc.want) {
+			t.Errorf("%s: want TTLs %v, got %v", tc.policy, tc.want, got)
+		}
+	}
+
+	// Nodes coming back online are served with their usual TTL again.
+	ts := &Tailscale{zone: "example.com.", recordTTL: 60, offlineNodes: offlineFlag, offlineTTL: 5}
+	ts.processTailnet(tn)
+	ts.processTailnet(&Tailnet{
+		SelfNode: tn.SelfNode,
+		Peers:    []tailcfg.NodeView{node("up", &online), node("down", &online)},
+	})
+	if got := ttls(ts)["down"]; got != 60 {
+		t.Errorf("want TTL 60 for a node back online, got %d", got)
+	}
+}
+
+func TestProcessNetMapAdaptiveTTL(t *testing.T) {
+	online, offline := true, false
+	node := func(name string, connected *bool, ephemeral bool) tailcfg.NodeView {
+		n := &tailcfg.Node{
+			ComputedName: name,
+			Addresses:    []netip.Prefix{netip.MustParsePrefix("100.64.0.1/32")},
+			Online:       connected,
+		}
+		if ephemeral {
+			n.CapMap = tailcfg.NodeCapMap{nodeAttrEphemeral: nil}
+		}
+		return n.View()
+	}
+	ts := &Tailscale{zone: "example.com.", recordTTL: 60, adaptiveTTLMin: 10, flaps: &flapTracker{window: time.Hour}}
+	ttl := func(name string) uint32 {
+		return ts.hostBaseTTL(ts.load(), name)
+	}
+
+	// The laptop goes offline twice, the runner is ephemeral and the server stays up.
+	for _, laptop := range []*bool{&online, &offline, &online, &offline, &online} {
+		ts.processTailnet(&Tailnet{Peers: []tailcfg.NodeView{
+			node("laptop", laptop, false),
+			node("runner", &online, true),
+			node("server", &online, false),
+		}})
+	}
+	for name, want := range map[string]uint32{"laptop": 15, "runner": 30, "server": 60} {
+		if got := ttl(name); got != want {
+			t.Errorf("%s: want TTL %d, got %d", name, want, got)
+		}
+	}
+
+	// Nodes missing from the network map went offline too, and the TTL never drops below the minimum.
+	for range 3 {
+		ts.processTailnet(&Tailnet{Peers: []tailcfg.NodeView{node("server", &online, false)}})
+		ts.processTailnet(&Tailnet{Peers: []tailcfg.NodeView{
+			node("laptop", &online, false),
+			node("server", &online, false),
+		}})
+	}
+	if got := ttl("laptop"); got != 10 {
+		t.Errorf("want the minimum TTL 10 for a flapping node, got %d", got)
+	}
+
+	// Going offline is forgotten once it's older than the window.
+	flaps := ts.flaps.observe(map[string]bool{"laptop": true, "server": true}, time.Now().Add(2*time.Hour))
+	if len(flaps) != 0 {
+		t.Errorf("want no flaps after the window, got %v", flaps)
+	}
+}
+
+func TestProcessNetMapHostnameCollisions(t *testing.T) {
+	online, offline := true, false
+	created := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	tn := &Tailnet{
+		Peers: []tailcfg.NodeView{
+			(&tailcfg.Node{
+				ID:           1,
+				Name:         "web.tail1234.ts.net.",
+				ComputedName: "web",
+				Addresses:    []netip.Prefix{netip.MustParsePrefix("100.64.0.1/32")},
+				Tags:         []string{"tag:a"},
+				Online:       &online,
+				Created:      created,
+			}).View(),
+			(&tailcfg.Node{
+				ID:           2,
+				Name:         "web-1.tail1234.ts.net.",
+				ComputedName: "WEB",
+				Addresses:    []netip.Prefix{netip.MustParsePrefix("100.64.0.2/32")},
+				Tags:         []string{"tag:a", "tag:b"},
+				Online:       &offline,
+				Created:      created.Add(time.Hour),
+			}).View(),
+			(&tailcfg.Node{
+				ID:           3,
+				ComputedName: "db",
+				Addresses:    []netip.Prefix{netip.MustParsePrefix("100.64.0.3/32")},
+			}).View(),
+		},
+	}
+
+	tests := []struct {
+		policy string
+		want   map[string][]string
+	}{
+		{collisionMerge, map[string][]string{"A": {"100.64.0.1", "100.64.0.2"}, "TXT": {"tag:a", "tag:b"}}},
+		{collisionOnline, map[string][]string{"A": {"100.64.0.1"}, "TXT": {"tag:a"}}},
+		{collisionNewest, map[string][]string{"A": {"100.64.0.2"}, "TXT": {"tag:a", "tag:b"}}},
+		{collisionError, nil},
+	}
+	for _, tc := range tests {
+		ts := &Tailscale{zone: "example.com.", collisionPolicy: tc.policy}
+		ts.processTailnet(tn)
+		if got := ts.load().entries["web"]; !cmp.Equal(got, tc.want) {
+			t.Errorf("%s: want records %v, got %v", tc.policy, tc.want, got)
+		}
+		if _, ok := ts.load().entries["db"]; !ok {
+			t.Errorf("%s: want records of db", tc.policy)
+		}
+		if want := map[string][]string{"web": {"web-1.tail1234.ts.net", "web.tail1234.ts.net"}}; !cmp.Equal(ts.collidingHosts, want) {
+			t.Errorf("%s: want collisions %v, got %v", tc.policy, want, ts.collidingHosts)
+		}
+		if got := testutil.ToFloat64(HostnameCollisions.WithLabelValues("", ts.zone)); got != 1 {
+			t.Errorf("%s: want 1 hostname collision, got %v", tc.policy, got)
+		}
+	}
+}
+
+func TestProcessNetMapTTLOverrides(t *testing.T) {
+	static, ttls, err := parseRecords([]string{"grafana 600 A 192.0.2.1", "nas A 192.0.2.2"}, "example.com.")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	ts := &Tailscale{
+		zone:       "example.com.",
+		recordTTL:  60,
+		static:     static,
+		staticTTLs: ttls,
+		profiles:   []Profile{{Name: "ci", Tags: []string{"tag:runner"}, TTL: 30}},
+		services: []ServiceMapping{
+			{Tag: "tag:runner", Service: "ssh", Proto: "tcp", Port: 22, TTL: 10},
+			{Tag: "tag:runner", Service: "https", Proto: "tcp", Port: 443},
+		},
+	}
+	ts.processTailnet(&Tailnet{
+		SelfNode: (&tailcfg.Node{
+			ComputedName: "runner",
+			Addresses:    []netip.Prefix{netip.MustParsePrefix("100.64.0.1/32")},
+			Tags:         []string{"tag:runner"},
+		}).View(),
+	})
+
+	// Record TTLs take precedence over the TTL of the profile, which takes precedence over the one of
+	// the zone.
+	tests := []struct {
+		qname string
+		qtype uint16
+		ttl   uint32
+	}{
+		{"grafana.example.com.", dns.TypeA, 600},
+		{"nas.example.com.", dns.TypeA, 60},
+		{"runner.example.com.", dns.TypeA, 30},
+		{"_ssh._tcp.runner.example.com.", dns.TypeSRV, 10},
+		{"_https._tcp.runner.example.com.", dns.TypeSRV, 30},
+	}
+	for _, tc := range tests {
+		var msg dns.Msg
+		msg.SetQuestion(tc.qname, tc.qtype)
+		w := dnstest.NewRecorder(&test.ResponseWriter{})
+		if _, err := ts.ServeDNS(context.Background(), w, &msg); err != nil {
+			t.Fatalf("%s: unexpected error: %v", tc.qname, err)
+		}
+		if len(w.Msg.Answer) != 1 || w.Msg.Answer[0].Header().Ttl != tc.ttl {
+			t.Errorf("%s: want an answer with TTL %d, got %v", tc.qname, tc.ttl, w.Msg.Answer)
+		}
+	}
+
+	for _, rrs := range ts.zoneRRsets(ts.load(), "example.com.") {
+		hdr := rrs[0].Header()
+		if (hdr.Name == "grafana.example.com." && hdr.Ttl != 600) || (hdr.Name == "_ssh._tcp.runner.example.com." && hdr.Ttl != 10) {
+			t.Errorf("want transferred records with their own TTL, got %v", rrs)
+		}
+	}
+}
+
+func TestProcessNetMapALPN(t *testing.T) {
+	ts := &Tailscale{
+		zone: "example.com.",
+		alpn: map[string][]string{
+			"tag:web":  {"h2", "http/1.1"},
+			"tag:quic": {"h3", "h2"},
+		},
+	}
+	ts.processTailnet(&Tailnet{
+		Peers: []tailcfg.NodeView{
+			(&tailcfg.Node{
+				ComputedName: "web",
+				Addresses:    []netip.Prefix{netip.MustParsePrefix("100.64.0.1/32")},
+				Tags:         []string{"tag:quic", "tag:web"},
+			}).View(),
+			(&tailcfg.Node{
+				ComputedName: "db",
+				Addresses:    []netip.Prefix{netip.MustParsePrefix("100.64.0.2/32")},
+				Tags:         []string{"tag:db"},
+			}).View(),
+		},
+	})
+	if got, want := ts.load().entries["web"]["ALPN"], []string{"h3", "h2", "http/1.1"}; !cmp.Equal(got, want) {
+		t.Errorf("want ALPN %v, got %v", want, got)
+	}
+	if got, ok := ts.load().entries["db"]["ALPN"]; ok {
+		t.Errorf("want no ALPN for node without ALPN tags, got %v", got)
+	}
+}
+
+func TestStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "records.db")
+	tn := &Tailnet{
+		SelfNode: (&tailcfg.Node{
+			ComputedName: "self",
+			Addresses:    []netip.Prefix{netip.MustParsePrefix("100.64.0.1/32")},
+			Tags:         []string{"tag:cname-app"},
+		}).View(),
+	}
+
+	ts := &Tailscale{zone: "example.com."}
+	store, err := openStore(storeBolt, path)
+	if err != nil {
+		t.Fatalf("unable to open store: %v", err)
+	}
+	ts.store = store
+	if ts.Ready() {
+		t.Error("want the instance not ready before it syncs")
+	}
+	ts.processTailnet(tn)
+	if !ts.Ready() {
+		t.Error("want the instance ready once it synced")
+	}
+	if err := store.close(); err != nil {
+		t.Fatalf("unable to close store: %v", err)
+	}
+
+	// A new instance serves the stored records before it syncs.
+	restarted := &Tailscale{zone: "example.com."}
+	if restarted.store, err = openStore(storeBolt, path); err != nil {
+		t.Fatalf("unable to reopen store: %v", err)
+	}
+	defer restarted.store.close()
+	restarted.loadStore()
+	if !cmp.Equal(restarted.load().entries, ts.load().entries) {
+		t.Errorf("loaded entries differ: %s", cmp.Diff(ts.load().entries, restarted.load().entries))
+	}
+	if restarted.Ready() {
+		t.Error("want the instance serving stored records not ready until it syncs")
+	}
+	if restarted.load().serial != ts.load().serial || restarted.load().serial == 0 {
+		t.Errorf("want serial %d, got %d", ts.load().serial, restarted.load().serial)
+	}
+	if got := restarted.load().reverse[netip.MustParseAddr("100.64.0.1")]; got != "self.example.com." {
+		t.Errorf("want reverse entry for self, got %q", got)
+	}
+
+	// Records stored for another zone aren't loaded.
+	other := &Tailscale{zone: "example.org.", store: restarted.store}
+	other.loadStore()
+	if other.load().entries != nil {
+		t.Errorf("want no entries for another zone, got %v", other.load().entries)
+	}
+}
+
+func TestReplayNetMaps(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "netmaps.jsonl")
+	recorder, err := openNetmapRecorder(path)
+	if err != nil {
+		t.Fatalf("unable to open recording: %v", err)
+	}
+	self := &tailcfg.Node{
+		ComputedName: "self",
+		Addresses:    []netip.Prefix{netip.MustParsePrefix("100.64.0.1/32")},
+	}
+	peer := &tailcfg.Node{
+		ComputedName: "peer",
+		Addresses:    []netip.Prefix{netip.MustParsePrefix("100.64.0.2/32"), netip.MustParsePrefix("fd7a:115c:a1e0::2/128")},
+		Tags:         []string{"tag:cname-app"},
+	}
+	netmaps := []*Tailnet{
+		{SelfNode: self.View()},
+		{SelfNode: self.View(), Peers: []tailcfg.NodeView{peer.View()}},
+		{SelfNode: self.View()},
+	}
+
+	ts := &Tailscale{zone: "example.com.", recorder: recorder}
+	var want []map[string]map[string][]string
+	for _, tn := range netmaps {
+		ts.recorder.record(tn)
+		ts.processTailnet(tn)
+		want = append(want, ts.load().entries)
+	}
+	if err := recorder.close(); err != nil {
+		t.Fatalf("unable to close recording: %v", err)
+	}
+
+	recording, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("unable to read recording: %v", err)
+	}
+	// Replaying the recording goes through the same records, one network map at a time.
+	replayed := &Tailscale{zone: "example.com."}
+	var steps int
+	err = replayed.replayNetMaps(bytes.NewReader(recording), func(i int) {
+		steps++
+		if !cmp.Equal(replayed.load().entries, want[i]) {
+			t.Errorf("network map %d: entries differ: %s", i, cmp.Diff(want[i], replayed.load().entries))
+		}
+	})
+	if err != nil {
+		t.Fatalf("unable to replay: %v", err)
+	}
+	if steps != len(netmaps) {
+		t.Errorf("want %d network maps replayed, got %d", len(netmaps), steps)
+	}
+
+	if err := replayed.replayNetMaps(strings.NewReader("{}\nnot json\n"), nil); err == nil {
+		t.Error("want an error for an invalid recording")
+	}
+}
+
+func TestSyntheticNetMap(t *testing.T) {
+	ts, names := syntheticTailscale(1000)
+	if again, _ := syntheticTailscale(1000); !cmp.Equal(ts.load().entries, again.load().entries) {
+		t.Fatal("synthetic tailnets with the same seed differ")
+	}
+	// About one in a hundred peers isn't published.
+	if len(names) < 970 || len(names) == 1000 {
+		t.Errorf("got %d published nodes out of 1000", len(names))
+	}
+	for _, name := range names {
+		if _, ok := dns.IsDomainName(name); !ok {
+			t.Errorf("invalid name %q", name)
+		}
+	}
+}
+
+func BenchmarkProcessNetMapSynthetic(b *testing.B) {
+	tn := syntheticTailnet(*syntheticPeers, 1)
+	ts := &Tailscale{zone: "example.com."}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		ts.processTailnet(tn)
+	}
+}
+
+func TestWatchIPNBusAPIFallback(t *testing.T) {
+	var polls atomic.Int32
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		polls.Add(1)
+		w.Write([]byte(`{"devices": [{"name": "web.tail1234.ts.net", "addresses": ["100.64.0.1"]}]}`))
+	}))
+	defer api.Close()
+
+	// tailscaled is down.
+	ts := &Tailscale{zone: "example.com.", apiInterval: time.Hour}
+	ts.source = &localAPISource{lc: &tailscale.LocalClient{
+		Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return nil, errors.New("connection refused")
+		},
+	}}
+	ts.fallback = &apiSource{client: &apiClient{baseURL: api.URL, tailnet: "-", http: api.Client(), apiKey: "key"}, logName: ts.logName}
+	failures := testutil.ToFloat64(RefreshFailures.WithLabelValues("", ts.zone, backendLocalAPI))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		ts.watch(ctx)
+		close(done)
+	}()
+	for deadline := time.Now().Add(5 * time.Second); polls.Load() == 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("want the API to be polled while the LocalAPI is down")
+		}
+	}
+	cancel()
+	<-done
+
+	if _, ok := ts.load().entries["web"]; !ok {
+		t.Errorf("want the records of the API, got %v", ts.load().entries)
+	}
+	if got := testutil.ToFloat64(ActiveBackend.WithLabelValues("", backendAPI)); got != 1 {
+		t.Errorf("want the API reported as active backend, got %v", got)
+	}
+	if polls.Load() != 1 {
+		t.Errorf("want a single poll within the API interval, got %d", polls.Load())
+	}
+	if got := testutil.ToFloat64(RefreshFailures.WithLabelValues("", ts.zone, backendLocalAPI)) - failures; got < 1 {
+		t.Errorf("want the failures of the LocalAPI counted, got %v", got)
+	}
+	if age := ts.health.age(time.Now()); age <= 0 || age > 5*time.Second {
+		t.Errorf("want the records as old as the poll, got %s", age)
+	}
+}
+
+func TestSyncHealth(t *testing.T) {
+	now := time.Now()
+	var a, b syncHealth
+	a.start(now.Add(-time.Minute))
+	b.start(now.Add(-time.Hour))
+	defer a.stop()
+
+	if got := a.age(now); got != time.Minute {
+		t.Errorf("want records as old as the start, got %s", got)
+	}
+	if got := maxDataAge(); got < time.Hour.Seconds() {
+		t.Errorf("want the age of the oldest instance, got %v", got)
+	}
+	b.stop()
+	if got := maxDataAge(); got >= time.Hour.Seconds() {
+		t.Errorf("want stopped instances left out, got %v", got)
+	}
+
+	// Records are current while changes are pushed, and age once they no longer are.
+	a.refreshed(now.Add(-time.Second), true)
+	if got := a.age(now); got != 0 {
+		t.Errorf("want current records while live, got %s", got)
+	}
+	a.lost(now.Add(-time.Second))
+	if got := a.age(now); got != time.Second {
+		t.Errorf("want records as old as the loss, got %s", got)
+	}
+	a.lost(now)
+	if got := a.age(now); got != time.Second {
+		t.Errorf("want records as old as the first loss, got %s", got)
+	}
+}
+
+func TestHealth(t *testing.T) {
+	ts := &Tailscale{zone: "example.com."}
+	ts.health.start(time.Now().Add(-time.Hour))
+	defer ts.health.stop()
+	if err := ts.Health(); err != nil {
+		t.Errorf("want healthy without max_staleness, got %v", err)
+	}
+
+	ts.maxStaleness = time.Minute
+	check := func(want int) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		ts.debugMux().ServeHTTP(w, httptest.NewRequest(http.MethodGet, debugHealthPath, nil))
+		if w.Code != want {
+			t.Errorf("want status %d, got %d: %s", want, w.Code, w.Body)
+		}
+	}
+	check(http.StatusServiceUnavailable)
+	ts.health.refreshed(time.Now().Add(-30*time.Second), false)
+	check(http.StatusOK)
+	// Records pushed by the LocalAPI are current however long ago they last changed, until the
+	// connection is lost.
+	ts.health.refreshed(time.Now().Add(-time.Hour), true)
+	check(http.StatusOK)
+	ts.health.lost(time.Now().Add(-2 * time.Minute))
+	check(http.StatusServiceUnavailable)
+}
+
+func TestSelfTest(t *testing.T) {
+	tn := &Tailnet{
+		SelfNode: (&tailcfg.Node{
+			ComputedName: "self",
+			Addresses:    []netip.Prefix{netip.MustParsePrefix("fd7a:115c:a1e0::1/128")},
+		}).View(),
+	}
+	// Loopback clients don't get AAAA records, so the only name doesn't round-trip.
+	ts := &Tailscale{zone: "example.com.", zones: []string{"example.com.", "example.net."}, filterAAAA: []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")}}
+	ts.processTailnet(tn)
+	if ts.Ready() {
+		t.Error("want the instance not ready while the self-test fails")
+	}
+	err := ts.SelfTest(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "AAAA self.example.net.: no AAAA record") {
+		t.Errorf("want the failures of both zones, got %v", err)
+	}
+
+	check := func(want int) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		ts.debugMux().ServeHTTP(w, httptest.NewRequest(http.MethodGet, debugSelfTestPath, nil))
+		if w.Code != want {
+			t.Errorf("want status %d, got %d: %s", want, w.Code, w.Body)
+		}
+	}
+	check(http.StatusServiceUnavailable)
+
+	// The self-test is repeated with the next update.
+	ts.filterAAAA = nil
+	check(http.StatusOK)
+	ts.processTailnet(tn)
+	if !ts.Ready() {
+		t.Error("want the instance ready once the self-test passes")
+	}
+}
+
+func TestAPIBackend(t *testing.T) {
+	var tokens int
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /api/v2/oauth/token", func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("client_id") != "k123" || r.FormValue("client_secret") != "secret" {
+			http.Error(w, "invalid client", http.StatusUnauthorized)
+			return
+		}
+		tokens++
+		w.Write([]byte(`{"access_token": "token", "expires_in": 3600}`))
+	})
+	mux.HandleFunc("GET /api/v2/tailnet/example.org/devices", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`{"devices": [
+			{"id": "92960230385", "nodeId": "nTCdb4CNTRL", "name": "web.tail1234.ts.net", "addresses": ["100.64.0.1", "fd7a:115c:a1e0::1"], "tags": ["tag:cname-app"]},
+			{"nodeId": "nKXjBs6CNTRL", "name": "laptop.tail1234.ts.net", "addresses": ["100.64.0.2", "fd7a:115c:a1e0::2"], "isEphemeral": true},
+			{"name": "shared.other.ts.net", "addresses": ["100.64.0.3"], "isExternal": true}
+		]}`))
+	})
+	api := httptest.NewServer(mux)
+	defer api.Close()
+
+	ts := &Tailscale{zone: "example.com."}
+	ts.api = &apiClient{baseURL: api.URL, tailnet: "example.org", http: api.Client(), clientID: "k123", clientSecret: "secret"}
+
+	for range 2 {
+		devices, err := ts.api.devices(context.Background())
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		ts.processTailnet(devicesTailnet(devices, ts.logName))
+	}
+	if tokens != 1 {
+		t.Errorf("want the OAuth token to be reused, got %d tokens", tokens)
+	}
+
+	want := map[string]map[string][]string{
+		"web": {
+			"A":    {"100.64.0.1"},
+			"AAAA": {"fd7a:115c:a1e0::1"},
+			"TXT":  {"tag:cname-app"},
+		},
+		"laptop": {
+			"A":    {"100.64.0.2"},
+			"AAAA": {"fd7a:115c:a1e0::2"},
+		},
+		"app": {
+			"CNAME": {"web.example.com."},
+		},
+	}
+	if !cmp.Equal(ts.load().entries, want) {
+		t.Errorf("ts.entries = %v, want %v", ts.load().entries, want)
+	}
+
+	// Ephemeral devices are marked for adaptive_ttl.
+	devices, err := ts.api.devices(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	tn := devicesTailnet(devices, ts.logName)
+	if nodeEphemeral(tn.Peers[0]) || !nodeEphemeral(tn.Peers[1]) {
+		t.Error("want only laptop marked ephemeral")
+	}
+
+	// Node IDs are those of the devices, wherever they are in the list.
+	if got := tn.Peers[0].ID(); got != 92960230385 {
+		t.Errorf("want the node ID of the device, got %d", got)
+	}
+	reordered := devicesTailnet([]apiDevice{devices[1], devices[0]}, ts.logName)
+	if reordered.Peers[0].ID() != tn.Peers[1].ID() || reordered.Peers[1].ID() != tn.Peers[0].ID() {
+		t.Error("want node IDs to stay the same when the device list is reordered")
+	}
+
+	ts.api.clientSecret = "wrong"
+	ts.api.token = ""
+	if _, err := ts.api.devices(context.Background()); err == nil {
+		t.Error("want error for invalid client credentials")
+	}
+}
+
+func TestHeadscaleBackend(t *testing.T) {
+	nodes := `[
+		{"id": "1", "name": "web-1", "givenName": "web", "ipAddresses": ["100.64.0.1", "fd7a:115c:a1e0::1"], "forcedTags": ["tag:prod"], "user": {"id": "1", "name": "alice"}, "online": true},
+		{"id": "2", "name": "laptop", "ipAddresses": ["100.64.0.2"], "user": {"id": "1", "name": "alice"}},
+		{"id": "3", "name": "phone", "ipAddresses": ["100.64.0.3"], "user": {"id": "2", "name": "Bob@Example.com"}}
+	]`
+	var legacy bool
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/v1/node", func(w http.ResponseWriter, r *http.Request) {
+		if legacy {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer key" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`{"nodes": ` + nodes + `}`))
+	})
+	// Headscale before 0.23 lists machines of namespaces.
+	mux.HandleFunc("GET /api/v1/machine", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"machines": [{"id": "1", "name": "old", "ipAddresses": ["100.64.0.4"], "namespace": {"name": "carol"}}]}`))
+	})
+	hs := httptest.NewServer(mux)
+	defer hs.Close()
+
+	ts := &Tailscale{zone: "example.com.", userSubzones: true}
+	src := &headscaleSource{client: &headscaleClient{baseURL: hs.URL, apiKey: "key", http: hs.Client()}, logName: ts.logName}
+	if err := ts.pollOnce(context.Background(), src); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	want := map[string]map[string][]string{
+		"web": {
+			"A":    {"100.64.0.1"},
+			"AAAA": {"fd7a:115c:a1e0::1"},
+			"TXT":  {"tag:prod"},
+		},
+		"laptop":       {"A": {"100.64.0.2"}},
+		"laptop.alice": {"A": {"100.64.0.2"}},
+		"phone":        {"A": {"100.64.0.3"}},
+		"phone.bob":    {"A": {"100.64.0.3"}},
+	}
+	if !cmp.Equal(ts.load().entries, want) {
+		t.Errorf("ts.entries = %v, want %v", ts.load().entries, want)
+	}
+	if prefix, host := ts.splitName(ts.load(), "laptop.alice.example.com."); prefix != "" || host != "laptop.alice" {
+		t.Errorf("want laptop.alice.example.com. in the subzone of alice, got %q in %q", prefix, host)
+	}
+	if !ts.nameExists(ts.load(), "bob.example.com.") {
+		t.Error("want the subzone of a user to exist")
+	}
+
+	legacy = true
+	if err := ts.pollOnce(context.Background(), src); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := ts.load().entries["old.carol"]; !ok {
+		t.Errorf("want the machines of older servers published, got %v", ts.load().entries)
+	}
+
+	src.client.apiKey = "wrong"
+	legacy = false
+	if err := ts.pollOnce(context.Background(), src); err == nil {
+		t.Error("want error for an invalid API key")
+	}
+}
+
+func TestAPIQuota(t *testing.T) {
+	limited := false
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if limited {
+			w.Header().Set("Retry-After", "120")
+			http.Error(w, "rate limited", http.StatusTooManyRequests)
+			return
+		}
+		w.Header().Set("X-RateLimit-Limit", "100")
+		w.Header().Set("X-RateLimit-Remaining", "42")
+		w.Header().Set("X-RateLimit-Reset", "30")
+		w.Write([]byte(`{"devices": []}`))
+	}))
+	defer api.Close()
+
+	c := &apiClient{baseURL: api.URL, tailnet: "quota.example", http: api.Client(), apiKey: "key"}
+	start := time.Now().Unix()
+	if _, err := c.devices(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := testutil.ToFloat64(APIQuotaLimit.WithLabelValues("", "quota.example")); got != 100 {
+		t.Errorf("want a limit of 100, got %v", got)
+	}
+	if got := testutil.ToFloat64(APIQuotaRemaining.WithLabelValues("", "quota.example")); got != 42 {
+		t.Errorf("want 42 requests remaining, got %v", got)
+	}
+	if got := int64(testutil.ToFloat64(APIQuotaReset.WithLabelValues("", "quota.example"))); got < start+30 || got > time.Now().Unix()+30 {
+		t.Errorf("want the reset 30 seconds from now, got %d", got-start)
+	}
+
+	// Rate limited requests leave no quota until the time to retry.
+	limited = true
+	if _, err := c.devices(context.Background()); err == nil {
+		t.Fatal("want an error when rate limited")
+	}
+	if got := testutil.ToFloat64(APIQuotaRemaining.WithLabelValues("", "quota.example")); got != 0 {
+		t.Errorf("want no requests remaining, got %v", got)
+	}
+	if got := int64(testutil.ToFloat64(APIQuotaReset.WithLabelValues("", "quota.example"))); got < start+120 || got > time.Now().Unix()+120 {
+		t.Errorf("want the reset 120 seconds from now, got %d", got-start)
+	}
+	for code, want := range map[string]float64{"200": 1, "429": 1} {
+		if got := testutil.ToFloat64(APIRequests.WithLabelValues("", "quota.example", code)); got != want {
+			t.Errorf("want %v requests with status %s, got %v", want, code, got)
+		}
+	}
+
+	// Reset times may be Unix times too.
+	h := http.Header{"Ratelimit-Reset": {"1900000000"}}
+	c.recordQuota(h, http.StatusOK, time.Now())
+	if got := testutil.ToFloat64(APIQuotaReset.WithLabelValues("", "quota.example")); got != 1900000000 {
+		t.Errorf("want the reset at 1900000000, got %v", got)
+	}
+}
+
+func TestAgentRegistration(t *testing.T) {
+	ts := &Tailscale{zone: "example.com.", agentExpiry: time.Minute}
+	ts.update(func(d *zoneData) {
+		d.owners = map[string]nodeOwner{"node": {host: "node", id: "n1"}}
+		d.sources = map[string]string{"node": sourceDevice}
+	})
+	ts.whoIsFunc = func(ctx context.Context, remoteAddr string) (*apitype.WhoIsResponse, error) {
+		switch remoteAddr {
+		case "100.64.0.5:1234":
+			return &apitype.WhoIsResponse{Node: &tailcfg.Node{StableID: "n1", ComputedName: "node"}}, nil
+		case "100.64.0.7:1234":
+			return &apitype.WhoIsResponse{Node: &tailcfg.Node{StableID: "n2", ComputedName: "hidden"}}, nil
+		}
+		return nil, errors.New("no such node")
+	}
+
+	register := func(method, remoteAddr, body string) int {
+		req := httptest.NewRequest(method, agentPath, strings.NewReader(body))
+		req.RemoteAddr = remoteAddr
+		rec := httptest.NewRecorder()
+		ts.serveAgent(rec, req)
+		return rec.Code
+	}
+
+	tests := []struct {
+		name       string
+		method     string
+		remoteAddr string
+		body       string
+		want       int
+	}{
+		{"wrong method", http.MethodGet, "100.64.0.5:1234", "", http.StatusMethodNotAllowed},
+		{"unknown node", http.MethodPost, "100.64.0.6:1234", `{"addresses": ["192.168.1.10"]}`, http.StatusForbidden},
+		{"unpublished node", http.MethodPost, "100.64.0.7:1234", `{"addresses": ["192.168.1.10"]}`, http.StatusForbidden},
+		{"malformed", http.MethodPost, "100.64.0.5:1234", `{"addresses": ["192.168.1"]}`, http.StatusBadRequest},
+		{"tailnet address", http.MethodPost, "100.64.0.5:1234", `{"addresses": ["100.64.0.5"]}`, http.StatusBadRequest},
+		{"valid", http.MethodPost, "100.64.0.5:1234", `{"addresses": ["192.168.1.10", "fd00::10"]}`, http.StatusNoContent},
+	}
+	for _, tc := range tests {
+		if got := register(tc.method, tc.remoteAddr, tc.body); got != tc.want {
+			t.Errorf("%s: got status %d, want %d", tc.name, got, tc.want)
+		}
+	}
+
+	msg := dns.Msg{}
+	if !ts.resolveLAN(ts.load(), "lan.node.example.com.", &msg, false) || len(msg.Answer) != 1 {
+		t.Fatalf("expected the registered A record, got %v", msg.Answer)
+	}
+	if a, ok := msg.Answer[0].(*dns.A); !ok || a.A.String() != "192.168.1.10" {
+		t.Errorf("expected A record for 192.168.1.10, got %s", msg.Answer[0])
+	}
+	msg = dns.Msg{}
+	if !ts.resolveLAN(ts.load(), "lan.node.example.com.", &msg, true) || len(msg.Answer) != 1 {
+		t.Errorf("expected the registered AAAA record, got %v", msg.Answer)
+	}
+	if ts.resolveLAN(ts.load(), "www.node.example.com.", &dns.Msg{}, false) {
+		t.Error("expected no LAN records outside of lan.<host>")
+	}
+	if got := ts.lan.addrs("node", false, time.Now().Add(2*time.Minute)); got != nil {
+		t.Errorf("expected registration to expire, got %v", got)
+	}
+
+	// Registering no addresses removes the registration.
+	register(http.MethodPost, "100.64.0.5:1234", `{"addresses": []}`)
+	if ts.resolveLAN(ts.load(), "lan.node.example.com.", &dns.Msg{}, false) {
+		t.Error("expected registration to be removed")
+	}
+
+	// Expired registrations are removed with the next one.
+	now := time.Now()
+	ts.lan.set("gone", []netip.Addr{netip.MustParseAddr("192.168.1.20")}, now.Add(-2*time.Minute), now.Add(-time.Minute))
+	register(http.MethodPost, "100.64.0.5:1234", `{"addresses": ["192.168.1.10"]}`)
+	if _, ok := ts.lan.nodes["gone"]; ok {
+		t.Error("expected the expired registration to be removed")
+	}
+
+	// The addresses of nodes no longer published aren't served, and are removed with the next netmap.
+	ts.update(func(d *zoneData) {
+		d.owners = nil
+		d.sources = nil
+	})
+	if ts.resolveLAN(ts.load(), "lan.node.example.com.", &dns.Msg{}, false) {
+		t.Error("expected no LAN records of an unpublished node")
+	}
+	ts.processTailnet(&Tailnet{})
+	if _, ok := ts.lan.nodes["node"]; ok {
+		t.Error("expected the registration of the unpublished node to be removed")
+	}
+}
+
+func TestReloadCycles(t *testing.T) {
+	// Reserve a fixed address, so that each cycle has to rebind the one released by the previous one.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	// The store is locked while open, so it has to be released by every cycle too.
+	store := filepath.Join(t.TempDir(), "records.db")
+	ts, err := New(NewConfig(WithZone("example.com"), WithDebug(addr, 10), WithStore(storeBolt, store)))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Other tests may have left instances running, whose goroutines are counted too.
+	running := map[string]float64{}
+	for _, task := range []string{"watch_ipn_bus", "debug_endpoint"} {
+		running[task] = testutil.ToFloat64(Goroutines.WithLabelValues(task))
+	}
+
+	var baseline int
+	for i := 0; i < 50; i++ {
+		// Startup and shutdown callbacks run more than once during a reload.
+		for j := 0; j < 2; j++ {
+			if err := ts.startup(); err != nil {
+				t.Fatalf("cycle %d: startup failed: %v", i, err)
+			}
+		}
+		resp, err := http.Get("http://" + addr + debugEventsPath)
+		if err != nil {
+			t.Fatalf("cycle %d: debug endpoint not reachable: %v", i, err)
+		}
+		resp.Body.Close()
+		for j := 0; j < 2; j++ {
+			if err := ts.shutdown(); err != nil {
+				t.Fatalf("cycle %d: shutdown failed: %v", i, err)
+			}
+		}
+		if ts.bg != nil || ts.debugSrv != nil || ts.store != nil {
+			t.Fatalf("cycle %d: plugin still running after shutdown", i)
+		}
+		for task, n := range running {
+			if got := testutil.ToFloat64(Goroutines.WithLabelValues(task)); got != n {
+				t.Fatalf("cycle %d: %v %s goroutines running after shutdown, want %v", i, got, task, n)
+			}
+		}
+		http.DefaultClient.CloseIdleConnections()
+		if i == 0 {
+			baseline = runtime.NumGoroutine()
+		}
+	}
+
+	// Give goroutines of closed connections a moment to exit before looking for leaks.
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > baseline && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > baseline {
+		t.Errorf("%d goroutines after reload cycles, want at most %d", n, baseline)
+	}
+}
+
+func TestReloadTakeOver(t *testing.T) {
+	node := &tailcfg.Node{ComputedName: "web", Addresses: []netip.Prefix{netip.MustParsePrefix("100.64.0.1/32")}}
+	old, err := New(NewConfig(WithZone("takeover.example")))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	old.processTailnet(&Tailnet{SelfNode: node.View()})
+	old.handOff()
+
+	// The instance replacing it serves the records of the tailnet before its first sync, with its own
+	// configuration.
+	cur, err := New(NewConfig(WithZone("takeover.example"), WithTTL(30, 30)))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	cur.takeOver()
+	if got := cur.load().entries["web"]["A"]; !cmp.Equal(got, []string{"100.64.0.1"}) {
+		t.Errorf("want the records of the previous instance, got %v", cur.load().entries)
+	}
+	if !cur.synced.Load() {
+		t.Error("want the taken over records to count as synced")
+	}
+
+	// A network map is only taken over once, and not by an instance reading another tailnet.
+	again, _ := New(NewConfig(WithZone("takeover.example")))
+	again.takeOver()
+	if len(again.load().entries) != 0 {
+		t.Errorf("want the network map taken over only once, got %v", again.load().entries)
+	}
+	cur.handOff()
+	other, _ := New(NewConfig(WithZone("takeover.example"), WithHeadscale("https://headscale.example.org", "key", time.Minute)))
+	other.takeOver()
+	if len(other.load().entries) != 0 {
+		t.Errorf("want no records taken over from another tailnet, got %v", other.load().entries)
+	}
+}
+
+// fakeSource is a Source serving a tailnet from memory. Without watch, it can only be polled.
+type fakeSource struct {
+	tn      *Tailnet
+	watch   bool
+	fetches atomic.Int32
+}
+
+func (s *fakeSource) Name() string { return "fake" }
+
+func (s *fakeSource) Fetch(context.Context) (*Tailnet, error) {
+	s.fetches.Add(1)
+	return s.tn, nil
+}
+
+func (s *fakeSource) Watch(ctx context.Context, update func(*Tailnet)) error {
+	if !s.watch {
+		return errors.ErrUnsupported
+	}
+	update(s.tn)
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestSyncSource(t *testing.T) {
+	tn := &Tailnet{SelfNode: (&tailcfg.Node{
+		ComputedName: "web",
+		Addresses:    []netip.Prefix{netip.MustParsePrefix("100.64.0.1/32")},
+	}).View()}
+
+	for _, watch := range []bool{true, false} {
+		src := &fakeSource{tn: tn, watch: watch}
+		ts := &Tailscale{zone: "example.com.", apiInterval: time.Hour, source: src}
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			ts.sync(ctx)
+			close(done)
+		}()
+		for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+			_, ok := ts.load().entries["web"]
+			if ok {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("watch %v: want the records of the source", watch)
+			}
+		}
+		cancel()
+		<-done
+
+		if got := testutil.ToFloat64(ActiveBackend.WithLabelValues("", "fake")); got != 1 {
+			t.Errorf("watch %v: want the source reported as active backend, got %v", watch, got)
+		}
+		if got, want := src.fetches.Load(), int32(1); watch && got != 0 || !watch && got != want {
+			t.Errorf("watch %v: got %d fetches", watch, got)
+		}
+	}
+}
+
+func TestProcessNetMapHealthCheckOnline(t *testing.T) {
+	online, offline := true, false
+	tn := &Tailnet{
+		Peers: []tailcfg.NodeView{
+			(&tailcfg.Node{
+				ComputedName: "web1",
+				Addresses:    []netip.Prefix{netip.MustParsePrefix("100.64.0.1/32"), netip.MustParsePrefix("fd7a:115c:a1e0::1/128")},
+				Online:       &offline,
+			}).View(),
+			(&tailcfg.Node{
+				ComputedName: "web2",
+				Addresses:    []netip.Prefix{netip.MustParsePrefix("100.64.0.2/32")},
+				Online:       &online,
+			}).View(),
+		},
+	}
+
+	ts, err := New(NewConfig(WithZone("example.com"), WithHealthCheck(healthCheckOnline, 0, 0, 0)))
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	ts.processTailnet(tn)
+	want := map[netip.Addr]bool{netip.MustParseAddr("100.64.0.1"): true, netip.MustParseAddr("fd7a:115c:a1e0::1"): true}
+	if got := ts.reach.load(); !maps.Equal(got, want) {
+		t.Errorf("unreachable addresses: got %v, want %v", got, want)
+	}
+}
+
+func TestProbeAll(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	up, down := netip.MustParseAddr("127.0.0.1"), netip.MustParseAddr("127.0.0.2")
+	ts, err := New(NewConfig(WithZone("example.com"), WithHealthCheck(healthCheckTCP, uint16(ln.Addr().(*net.TCPAddr).Port), time.Second, 2)))
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	ts.update(func(d *zoneData) {
+		d.owners = map[string]nodeOwner{
+			"up":   {host: "up", addrs: []netip.Addr{up}},
+			"down": {host: "down", addrs: []netip.Addr{down}},
+		}
+	})
+
+	// An address is unreachable once as many probes as configured failed in a row.
+	ts.probeAll(context.Background())
+	if got := ts.reach.load(); len(got) != 0 {
+		t.Errorf("unreachable after one failure: %v", got)
+	}
+	ts.probeAll(context.Background())
+	if got := ts.reach.load(); len(got) != 1 || !got[down] {
+		t.Errorf("want only %s unreachable, got %v", down, got)
+	}
+}
+
+func TestMetadataAttribution(t *testing.T) {
+	tn := &Tailnet{
+		Peers: []tailcfg.NodeView{
+			(&tailcfg.Node{
+				StableID:     "nWeb1CNTRL",
+				ComputedName: "web1",
+				Addresses:    []netip.Prefix{netip.MustParsePrefix("100.64.0.1/32")},
+				Tags:         []string{"tag:cname-app"},
+			}).View(),
+			(&tailcfg.Node{
+				StableID:     "nWeb2CNTRL",
+				ComputedName: "web2",
+				Addresses:    []netip.Prefix{netip.MustParsePrefix("100.64.0.2/32")},
+				Tags:         []string{"tag:cname-app"},
+			}).View(),
+		},
+	}
+	ts, err := New(NewConfig(WithZone("example.com"), WithRecord("static A 192.0.2.1")))
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	ts.processTailnet(tn)
+
+	tests := []struct {
+		qname  string
+		qtype  uint16
+		source string
+		nodes  string
+		ids    string
+	}{
+		{"web1.example.com.", dns.TypeA, "hostname", "web1", "nWeb1CNTRL"},
+		{"app.example.com.", dns.TypeA, "tag_cname", "web1,web2", "nWeb1CNTRL,nWeb2CNTRL"},
+		{"static.example.com.", dns.TypeA, "static", "", ""},
+		{"2.0.64.100.in-addr.arpa.", dns.TypePTR, "", "web2", "nWeb2CNTRL"},
+		{"missing.example.com.", dns.TypeA, "", "", ""},
+	}
+	for _, tc := range tests {
+		var msg dns.Msg
+		msg.SetQuestion(tc.qname, tc.qtype)
+		w := dnstest.NewRecorder(&test.ResponseWriter{})
+		ctx := ts.Metadata(metadata.ContextWithMetadata(context.Background()), request.Request{W: w, Req: &msg})
+		ts.ServeDNS(ctx, w, &msg)
+		got := []string{
+			metadata.ValueFunc(ctx, "tailscale/answer_source")(),
+			metadata.ValueFunc(ctx, "tailscale/node")(),
+			metadata.ValueFunc(ctx, "tailscale/node_id")(),
+		}
+		if diff := cmp.Diff([]string{tc.source, tc.nodes, tc.ids}, got); diff != "" {
+			t.Errorf("%s: metadata mismatch (-want +got):\n%s", tc.qname, diff)
+		}
 	}
 }
@@ -0,0 +1,96 @@
+package tailscale
+
+import (
+	"net/netip"
+	"slices"
+	"strings"
+
+	"github.com/miekg/dns"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/views"
+)
+
+// Names of the records of the topology of the tailnet, published with topology_records.
+const (
+	// exitNodesName has the records of the exit nodes.
+	exitNodesName = "exit-nodes"
+	// routersName has the records of the subnet routers.
+	routersName = "routers"
+	// routesLabel is the label of the subzone with the records of the routers of each subnet route, as
+	// in 10-0-0-0-24.routes.<zone>.
+	routesLabel = "routes"
+)
+
+// topologyNode is a published node that is an exit node or routes subnets.
+type topologyNode struct {
+	hostname string
+	exitNode bool
+	routes   []netip.Prefix
+}
+
+// subnetRoutes returns the approved subnet routes of node, its own addresses and default routes left
+// out.
+func subnetRoutes(node tailcfg.NodeView) []netip.Prefix {
+	var routes []netip.Prefix
+	for _, pfx := range node.AllowedIPs().All() {
+		if pfx.Bits() == 0 || (pfx.IsSingleIP() && views.SliceContains(node.Addresses(), pfx)) {
+			continue
+		}
+		routes = append(routes, pfx.Masked())
+	}
+	return routes
+}
+
+// routeLabel turns a route into a DNS label, with its dots, colons and slash replaced by hyphens, as
+// in 10-0-0-0-24 for 10.0.0.0/24.
+func routeLabel(route netip.Prefix) string {
+	return strings.NewReplacer(".", "-", ":", "-", "/", "-").Replace(route.String())
+}
+
+// topologyRecords returns the records of the topology of the tailnet by name: the addresses of the
+// exit nodes at exit-nodes and of the subnet routers at routers, with the names of the nodes as TXT
+// record, and the addresses of the routers of each route at <route>.routes, with the route as TXT
+// record. devices holds the records of the nodes. Names without nodes are left out.
+func (t *Tailscale) topologyRecords(nodes []topologyNode, devices map[string]map[string][]string) map[string]map[string][]string {
+	if !t.topology {
+		return nil
+	}
+	records := map[string]map[string][]string{}
+	add := func(name, hostname, txt string) {
+		entry := records[name]
+		if entry == nil {
+			entry = map[string][]string{}
+			records[name] = entry
+		}
+		for _, rrtype := range []string{"A", "AAAA"} {
+			entry[rrtype] = append(entry[rrtype], devices[hostname][rrtype]...)
+		}
+		entry["TXT"] = append(entry["TXT"], txt)
+	}
+	for _, n := range nodes {
+		fqdn := dns.Fqdn(n.hostname + "." + t.zone)
+		if n.exitNode {
+			add(exitNodesName, n.hostname, fqdn)
+		}
+		if len(n.routes) > 0 {
+			add(routersName, n.hostname, fqdn)
+		}
+		for _, route := range n.routes {
+			add(routeLabel(route)+"."+routesLabel, n.hostname, route.String())
+		}
+	}
+
+	for name, entry := range records {
+		for rrtype, values := range entry {
+			slices.Sort(values)
+			entry[rrtype] = slices.Compact(values)
+			if len(entry[rrtype]) == 0 {
+				delete(entry, rrtype)
+			}
+		}
+		if len(entry["A"]) == 0 && len(entry["AAAA"]) == 0 {
+			delete(records, name)
+		}
+	}
+	return records
+}
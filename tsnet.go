@@ -0,0 +1,111 @@
+package tailscale
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+
+	"github.com/coredns/coredns/plugin"
+	"github.com/miekg/dns"
+)
+
+// envPrefix marks a secret in the Corefile as the name of the environment variable holding it.
+const envPrefix = "env:"
+
+// DefaultTailnetListen is the address DNS is served on in the tailnet by the embedded node, if enabled
+// without an address.
+const DefaultTailnetListen = ":53"
+
+// resolveSecret returns secret, or the value of the environment variable it names as env:NAME.
+func resolveSecret(secret string) (string, error) {
+	name, ok := strings.CutPrefix(secret, envPrefix)
+	if !ok {
+		return secret, nil
+	}
+	value := os.Getenv(name)
+	if value == "" {
+		return "", fmt.Errorf("environment variable %s is not set", name)
+	}
+	return value, nil
+}
+
+// serveTailnet serves DNS on the tailnet addresses of the embedded node until ctx is done. Queries are
+// handled by the plugin and those after it, since CoreDNS doesn't know about the listener. Like other
+// listeners, it waits for the node to be up first. With trusted_proxies, the listeners read the PROXY
+// protocol from trusted proxies.
+func (t *Tailscale) serveTailnet(ctx context.Context) {
+	status, err := t.srv.Up(ctx)
+	if err != nil {
+		if ctx.Err() == nil {
+			log.Errorf("Unable to serve DNS in the tailnet, the node isn't up: %v", err)
+		}
+		return
+	}
+	_, port, _ := net.SplitHostPort(t.tailnetListen)
+
+	var servers []*dns.Server
+	handler := dns.HandlerFunc(t.serveTailnetQuery)
+	if ln, err := t.srv.Listen("tcp", t.tailnetListen); err != nil {
+		log.Errorf("Unable to serve DNS over TCP in the tailnet: %v", err)
+	} else {
+		if len(t.trustedProxies) > 0 {
+			ln = proxyListener{Listener: ln, trusted: t.isTrustedProxy}
+		}
+		servers = append(servers, &dns.Server{Listener: ln, Handler: handler})
+	}
+	for _, addr := range status.TailscaleIPs {
+		pc, err := t.srv.ListenPacket("udp", net.JoinHostPort(addr.String(), port))
+		if err != nil {
+			log.Errorf("Unable to serve DNS over UDP on %s in the tailnet: %v", addr, err)
+			continue
+		}
+		if len(t.trustedProxies) > 0 {
+			pc = proxyPacketConn{PacketConn: pc, trusted: t.isTrustedProxy}
+		}
+		servers = append(servers, &dns.Server{PacketConn: pc, Handler: handler})
+	}
+
+	for _, srv := range servers {
+		t.bg.Go("serve_tailnet_listener", func(ctx context.Context) error {
+			if err := srv.ActivateAndServe(); err != nil && ctx.Err() == nil {
+				return fmt.Errorf("serving DNS in the tailnet: %w", err)
+			}
+			return nil
+		})
+	}
+	log.Infof("Serving DNS in the tailnet on %s", tailnetAddrs(status.TailscaleIPs, port))
+
+	<-ctx.Done()
+	for _, srv := range servers {
+		srv.Shutdown()
+	}
+}
+
+// serveTailnetQuery answers a query received in the tailnet. Error responses that CoreDNS would write
+// for other listeners are written here.
+func (t *Tailscale) serveTailnetQuery(w dns.ResponseWriter, r *dns.Msg) {
+	rcode, err := t.ServeDNS(context.Background(), w, r)
+	if err != nil {
+		log.Warningf("Unable to answer query from %s in the tailnet: %v", w.RemoteAddr(), err)
+	}
+	if !plugin.ClientWrite(rcode) {
+		msg := new(dns.Msg)
+		msg.SetRcode(r, rcode)
+		if err := w.WriteMsg(msg); err != nil && !errors.Is(err, net.ErrClosed) {
+			log.Debugf("Unable to write %s response: %v", dns.RcodeToString[rcode], err)
+		}
+	}
+}
+
+// tailnetAddrs formats the addresses DNS is served on in the tailnet, for logging.
+func tailnetAddrs(addrs []netip.Addr, port string) string {
+	s := make([]string, len(addrs))
+	for i, addr := range addrs {
+		s[i] = net.JoinHostPort(addr.String(), port)
+	}
+	return strings.Join(s, ", ")
+}
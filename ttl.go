@@ -0,0 +1,99 @@
+package tailscale
+
+import (
+	"fmt"
+	"maps"
+	"strings"
+
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/views"
+)
+
+// validateTTLOverride checks a TTL given for what, 0 meaning none.
+func validateTTLOverride(what string, ttl, jitter uint32) error {
+	if ttl == 0 {
+		return nil
+	}
+	if ttl > maxTTL {
+		return fmt.Errorf("ttl of %s must be at most %d seconds", what, maxTTL)
+	}
+	if jitter >= ttl {
+		return fmt.Errorf("ttl_jitter must be less than the TTL of %d seconds of %s", ttl, what)
+	}
+	return nil
+}
+
+// addTTL sets the TTL of the rrtype records of name in ttls, keeping the lowest if different ones
+// are set.
+func addTTL(ttls map[string]map[string]uint32, name, rrtype string, ttl uint32) {
+	if ttl == 0 {
+		return
+	}
+	if ttls[name] == nil {
+		ttls[name] = map[string]uint32{}
+	}
+	if cur, ok := ttls[name][rrtype]; !ok || ttl < cur {
+		ttls[name][rrtype] = ttl
+	}
+}
+
+// serviceTTLs adds the TTLs of the service mappings applying to node to ttls, for its SRV records
+// below each of names, the names node is published at.
+func (t *Tailscale) serviceTTLs(ttls map[string]map[string]uint32, node tailcfg.NodeView, names ...string) {
+	for _, m := range t.services {
+		if m.TTL == 0 || !views.SliceContains(node.Tags(), m.Tag) {
+			continue
+		}
+		for _, name := range names {
+			addTTL(ttls, "_"+m.Service+"._"+m.Proto+"."+name, "SRV", m.TTL)
+		}
+	}
+}
+
+// srvHost returns the host of the owner of SRV records, below the service and protocol labels.
+func srvHost(name string) string {
+	parts := strings.SplitN(name, ".", 3)
+	if len(parts) < 3 {
+		return name
+	}
+	return parts[2]
+}
+
+// mergeTTLs returns the TTL overrides of the records served, given those of the static records and
+// of the SRV records of devices. Each applies only if its source won the name, as returned by
+// mergeSources.
+func mergeTTLs(static, services map[string]map[string]uint32, owner map[string]string) map[string]map[string]uint32 {
+	ttls := map[string]map[string]uint32{}
+	for name, byType := range static {
+		if owner[name] == sourceManual {
+			ttls[name] = maps.Clone(byType)
+		}
+	}
+	for name, byType := range services {
+		if owner[srvHost(name)] == sourceDevice {
+			ttls[name] = maps.Clone(byType)
+		}
+	}
+	return ttls
+}
+
+// rrsetBaseTTL returns the TTL of the rrtype records of name before any jitter is applied: the TTL
+// set on the records, by a static record or a service mapping, if any, or the one of the host, see
+// hostBaseTTL. Either is shortened by adaptive_ttl and capped for nodes flagged offline. name is the owner of the
+// records relative to the primary zone, and for SRV records includes the service labels.
+func (t *Tailscale) rrsetBaseTTL(d *zoneData, name, rrtype string) uint32 {
+	host := name
+	if rrtype == "SRV" {
+		host = srvHost(name)
+	}
+	if ttl, ok := d.ttlOverrides[name][rrtype]; ok {
+		return t.offlineBaseTTL(d, host, t.adaptiveBaseTTL(d, host, ttl))
+	}
+	return t.hostBaseTTL(d, host)
+}
+
+// rrsetTTL returns the TTL to use for the rrtype records of name in a response, see rrsetBaseTTL
+// and ttl.
+func (t *Tailscale) rrsetTTL(d *zoneData, name, rrtype string) uint32 {
+	return t.jitter(t.rrsetBaseTTL(d, name, rrtype))
+}
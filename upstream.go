@@ -0,0 +1,82 @@
+package tailscale
+
+import (
+	"context"
+
+	clog "github.com/coredns/coredns/plugin/pkg/log"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+// upstreamLookup looks up names through the server the plugin is part of, like upstream.Upstream.
+type upstreamLookup interface {
+	Lookup(ctx context.Context, state request.Request, name string, typ uint16) (*dns.Msg, error)
+}
+
+// upstreamTarget is a CNAME target outside the zone, to be looked up for the records of qtype.
+type upstreamTarget struct {
+	name  string
+	qtype uint16
+}
+
+// upstreamTypes are the lookup types of resolveCNAME whose targets outside the zone are looked up
+// upstream, and the record types looked up for them.
+var upstreamTypes = map[int]uint16{
+	TypeA:     dns.TypeA,
+	TypeAAAA:  dns.TypeAAAA,
+	TypeTXT:   dns.TypeTXT,
+	TypeSVCB:  dns.TypeSVCB,
+	TypeHTTPS: dns.TypeHTTPS,
+}
+
+// deferUpstream notes target, a CNAME target outside the zone, to be looked up upstream for the
+// records of lookupType once the records of the zone are resolved. It does nothing without upstream.
+func (t *Tailscale) deferUpstream(ctx context.Context, target string, lookupType int) {
+	qtype, ok := upstreamTypes[lookupType]
+	if t.upstream == nil || !ok {
+		return
+	}
+	if r, ok := ctx.Value(resolutionKey{}).(*resolution); ok {
+		r.upstream = append(r.upstream, upstreamTarget{name: dns.Fqdn(target), qtype: qtype})
+	}
+}
+
+// resolvedUpstream reports whether CNAME targets outside the zone were noted to be looked up upstream
+// while answering the query of ctx.
+func resolvedUpstream(ctx context.Context) bool {
+	r, ok := ctx.Value(resolutionKey{}).(*resolution)
+	return ok && len(r.upstream) > 0
+}
+
+// resolveUpstream looks up the CNAME targets noted while answering the query of state, adding their
+// records to msg, after those of the zone. Targets that can't be resolved are left dangling, as they
+// are without upstream.
+func (t *Tailscale) resolveUpstream(ctx context.Context, state request.Request, msg *dns.Msg) {
+	r, ok := ctx.Value(resolutionKey{}).(*resolution)
+	if !ok {
+		return
+	}
+	targets := r.upstream
+	r.upstream = nil
+	for _, target := range targets {
+		if !t.spendLookup(ctx, target.name) {
+			return
+		}
+		if clog.D.Value() {
+			log.Debugf("Looking up %s record of CNAME target %s upstream", dns.TypeToString[target.qtype], t.logName(target.name))
+		}
+		resp, err := t.upstream.Lookup(ctx, state, target.name, target.qtype)
+		if err != nil {
+			log.Warningf("Unable to look up CNAME target %s upstream: %v", t.logName(target.name), err)
+			fail(ctx, failureUpstream)
+			continue
+		}
+		if resp != nil && resp.Rcode == dns.RcodeServerFailure {
+			fail(ctx, failureUpstream)
+		}
+		if resp == nil || resp.Rcode != dns.RcodeSuccess {
+			continue
+		}
+		msg.Answer = append(msg.Answer, resp.Answer...)
+	}
+}
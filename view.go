@@ -0,0 +1,363 @@
+package tailscale
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+
+	"github.com/coredns/coredns/plugin/metrics"
+	"github.com/miekg/dns"
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/tailcfg"
+)
+
+// Views answer clients according to who they are in the tailnet: the machines a view doesn't show
+// don't exist for the clients it applies to. Clients are identified through the LocalAPI by the
+// address their query comes from. A client gets the view granted to it in the policy file of the
+// tailnet if view_grants is enabled, or else the first configured view that applies to it. Clients
+// without a view see all machines.
+const (
+	// viewAll applies a view to any client, including clients outside the tailnet, or shows every
+	// machine.
+	viewAll = "*"
+	// viewSelf shows the client its own machine.
+	viewSelf = "self"
+	// viewGrantName is the name of views granted in the policy file, in logs and metrics.
+	viewGrantName = "grant"
+)
+
+// DefaultViewCapability is the app capability views are granted with in the policy file, e.g.
+//
+//	"grants": [{
+//	    "src": ["group:eng"],
+//	    "dst": ["tag:dns"],
+//	    "app": {"github.com/shrewdhydra/coredns-tailscale/cap/view": [{"show": ["tag:dev", "self"]}]}
+//	}]
+const DefaultViewCapability = "github.com/shrewdhydra/coredns-tailscale/cap/view"
+
+// View is a set of machines shown to the clients it applies to.
+type View struct {
+	Name string `json:"name" yaml:"name"`
+	// Clients the view applies to: tag:<name> for the machines with the tag, a login name for the
+	// machines of a user, or * for any client. Defaults to the tag named after the view.
+	Clients []string `json:"clients,omitempty" yaml:"clients,omitempty"`
+	// Show lists the machines shown: tag:<name> for the machines with the tag, a login name for the
+	// machines of a user, a machine name, self for the client's own machine, or * for all of them.
+	Show []string `json:"show" yaml:"show"`
+}
+
+// clients returns the clients the view applies to.
+func (v View) clients() []string {
+	if len(v.Clients) == 0 {
+		return []string{tagPrefix + v.Name}
+	}
+	return v.Clients
+}
+
+// validate reports whether the view is usable.
+func (v View) validate() error {
+	// The name is used as a tag if no clients are given, so it's restricted to what tags allow.
+	if v.Name == "" || v.Name == viewGrantName || strings.Trim(strings.ToLower(v.Name), "abcdefghijklmnopqrstuvwxyz0123456789-") != "" {
+		return fmt.Errorf("invalid view name %q", v.Name)
+	}
+	for _, client := range v.clients() {
+		if client != viewAll && !validViewSelector(client) {
+			return fmt.Errorf("invalid client %q of view %s", client, v.Name)
+		}
+	}
+	if len(v.Show) == 0 {
+		return fmt.Errorf("view %s shows no machines", v.Name)
+	}
+	for _, s := range v.Show {
+		if !validShowSelector(s) {
+			return fmt.Errorf("invalid machine %q shown by view %s", s, v.Name)
+		}
+	}
+	return nil
+}
+
+// validViewSelector reports whether s is a tag or a login name.
+func validViewSelector(s string) bool {
+	if strings.Contains(s, "@") {
+		return !strings.ContainsAny(s, " \t")
+	}
+	return strings.HasPrefix(s, tagPrefix) && validateTagFilter("view", []string{s}) == nil
+}
+
+// validShowSelector reports whether s selects the machines shown by a view.
+func validShowSelector(s string) bool {
+	if s == viewAll || s == viewSelf || validViewSelector(s) {
+		return true
+	}
+	_, ok := dns.IsDomainName(s)
+	return ok && s != "" && !strings.Contains(s, ".")
+}
+
+// validateViews checks the views, that their names are unique, and the capability views are
+// granted with, if any.
+func validateViews(views []View, capability string) error {
+	names := map[string]bool{}
+	for _, v := range views {
+		if err := v.validate(); err != nil {
+			return err
+		}
+		if names[v.Name] {
+			return fmt.Errorf("duplicate view %q", v.Name)
+		}
+		names[v.Name] = true
+	}
+	if capability != "" && (!strings.Contains(capability, "/") || strings.ContainsAny(capability, " \t")) {
+		return fmt.Errorf("invalid view_grants capability %q, want DOMAIN/PATH", capability)
+	}
+	return nil
+}
+
+// viewGrant is the value of a view granted in the policy file.
+type viewGrant struct {
+	Show []string `json:"show"`
+}
+
+// nodeOwner identifies the machine a published name belongs to, for views. id is its stable node
+// ID.
+type nodeOwner struct {
+	host  string
+	id    string
+	tags  []string
+	login string
+	addrs []netip.Addr
+}
+
+// clientView is the view a query is answered with.
+type clientView struct {
+	name string
+	show []string
+	// self is the name of the client's machine, empty for clients outside the tailnet.
+	self string
+}
+
+// shows reports whether the view shows the machine of owner.
+func (v *clientView) shows(owner nodeOwner) bool {
+	for _, s := range v.show {
+		switch {
+		case s == viewAll:
+			return true
+		case s == viewSelf:
+			if v.self != "" && v.self == owner.host {
+				return true
+			}
+		case strings.HasPrefix(s, tagPrefix):
+			if slices.Contains(owner.tags, s) {
+				return true
+			}
+		case strings.Contains(s, "@"):
+			if matchLogin(s, owner.login) {
+				return true
+			}
+		case strings.EqualFold(s, owner.host):
+			return true
+		}
+	}
+	return false
+}
+
+// matchLogin reports whether the login name selector s names the user with login. Users of Headscale
+// have no domain in their login name, they're selected with a trailing @, like in its policy file.
+func matchLogin(s, login string) bool {
+	if login == "" {
+		return false
+	}
+	if strings.EqualFold(s, login) {
+		return true
+	}
+	name, ok := strings.CutSuffix(s, "@")
+	return ok && !strings.Contains(login, "@") && strings.EqualFold(name, login)
+}
+
+// appliesTo reports whether the view applies to the client identified by who, nil for clients that
+// couldn't be identified.
+func (v View) appliesTo(who *apitype.WhoIsResponse) bool {
+	for _, client := range v.clients() {
+		switch {
+		case client == viewAll:
+			return true
+		case who == nil || who.Node == nil:
+		case strings.HasPrefix(client, tagPrefix):
+			if slices.Contains(who.Node.Tags, client) {
+				return true
+			}
+		case who.UserProfile != nil && !who.Node.IsTagged():
+			if matchLogin(client, who.UserProfile.LoginName) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// clientView returns the view the query of client is answered with, nil if the client sees all
+// machines. Clients are identified through the LocalAPI, see identify.
+func (t *Tailscale) clientView(ctx context.Context, client netip.Addr) *clientView {
+	if len(t.views) == 0 && t.viewCapability == "" {
+		return nil
+	}
+	var who *apitype.WhoIsResponse
+	if isTailnetAddr(client) {
+		var err error
+		if who, err = t.identify(ctx, client); err != nil {
+			log.Debugf("Unable to identify client %s for views, answering it as outside the tailnet: %v", client, err)
+			who = nil
+		}
+	}
+	var self string
+	if who != nil && who.Node != nil {
+		self, _ = t.fitName(strings.ToLower(who.Node.ComputedName))
+	}
+
+	if t.viewCapability != "" && who != nil {
+		grants, err := tailcfg.UnmarshalCapJSON[viewGrant](who.CapMap, tailcfg.PeerCapability(t.viewCapability))
+		if err != nil {
+			log.Warningf("Ignoring invalid view grant of %s: %v", client, err)
+		}
+		var show []string
+		for _, g := range grants {
+			show = append(show, g.Show...)
+		}
+		if len(grants) > 0 {
+			return t.countView(ctx, &clientView{name: viewGrantName, show: show, self: self})
+		}
+	}
+	for _, v := range t.views {
+		if v.appliesTo(who) {
+			return t.countView(ctx, &clientView{name: v.Name, show: v.Show, self: self})
+		}
+	}
+	return nil
+}
+
+// countView counts a query answered with v, and returns v.
+func (t *Tailscale) countView(ctx context.Context, v *clientView) *clientView {
+	ViewCount.WithLabelValues(metrics.WithServer(ctx), v.name).Inc()
+	return v
+}
+
+// ownerName returns the name in entries whose machine domainName belongs to, empty for names
+// outside the zone. Names below a machine, like lan.<host> and <host>.<endpoints>, belong to it.
+func (t *Tailscale) ownerName(d *zoneData, domainName string) string {
+	if !dns.IsSubDomain(dns.Fqdn(t.zone), dns.CanonicalName(domainName)) {
+		return ""
+	}
+	prefix, host := t.splitName(d, domainName)
+	if node, ok := t.endpointName(d, prefix, host); ok {
+		return node
+	}
+	return host
+}
+
+// visible reports whether domainName exists for clients with view v. The names of machines the view
+// doesn't show are hidden, along with all names below them, and so are the names of apps and of the
+// topology once the view shows none of the machines whose addresses they hold. Other names, like
+// static records, are visible to everyone.
+func (t *Tailscale) visible(d *zoneData, v *clientView, domainName string) bool {
+	if v == nil {
+		return true
+	}
+	name := t.ownerName(d, domainName)
+	if name == "" {
+		return true
+	}
+	switch d.sources[name] {
+	case sourceDevice, sourceStore:
+	case sourceTag:
+		return t.showsAddrs(d, v, d.entries[name])
+	default:
+		return true
+	}
+	// Records loaded from the store have no owners, they're hidden until synced.
+	owner, ok := d.owners[name]
+	return ok && v.shows(owner)
+}
+
+// visibleAddr reports whether the machine using the tailnet address addr is visible to clients with
+// view v. Addresses of no machine are.
+func (t *Tailscale) visibleAddr(d *zoneData, v *clientView, addr netip.Addr) bool {
+	if v == nil {
+		return true
+	}
+	for _, owner := range d.owners {
+		if slices.Contains(owner.addrs, addr) {
+			return v.shows(owner)
+		}
+	}
+	// Records loaded from the store have no owners, and the names of their addresses are hidden.
+	if name, ok := d.reverse[addr]; ok && !t.visible(d, v, name) {
+		return false
+	}
+	return true
+}
+
+// showsAddrs reports whether view v shows any of the machines whose addresses are in the A and AAAA
+// records of entry. Entries without addresses are shown, and so are those with addresses of no
+// machine.
+func (t *Tailscale) showsAddrs(d *zoneData, v *clientView, entry map[string][]string) bool {
+	var addrs bool
+	for _, rrtype := range []string{"A", "AAAA"} {
+		for _, value := range entry[rrtype] {
+			addr, err := netip.ParseAddr(value)
+			if err != nil {
+				continue
+			}
+			if t.visibleAddr(d, v, addr) {
+				return true
+			}
+			addrs = true
+		}
+	}
+	return !addrs
+}
+
+// applyView removes the records of the machines that view v doesn't show from msg, those owned by
+// their names along with those pointing to them, and returns the number removed. The records of apps
+// and of the topology hold those of several machines, of which only the ones of hidden machines are
+// removed: their addresses, and their names in TXT records.
+func (t *Tailscale) applyView(d *zoneData, v *clientView, msg *dns.Msg) int {
+	hidden := func(rr dns.RR) bool {
+		if !t.visible(d, v, rr.Header().Name) {
+			return true
+		}
+		var target string
+		switch rr := rr.(type) {
+		case *dns.A:
+			addr, ok := netip.AddrFromSlice(rr.A)
+			return ok && t.derived(d, rr.Hdr.Name) && !t.visibleAddr(d, v, addr.Unmap())
+		case *dns.AAAA:
+			addr, ok := netip.AddrFromSlice(rr.AAAA)
+			return ok && t.derived(d, rr.Hdr.Name) && !t.visibleAddr(d, v, addr.Unmap())
+		case *dns.TXT:
+			return len(rr.Txt) == 1 && dns.IsFqdn(rr.Txt[0]) && t.derived(d, rr.Hdr.Name) && !t.visible(d, v, rr.Txt[0])
+		case *dns.CNAME:
+			target = rr.Target
+		case *dns.PTR:
+			target = rr.Ptr
+		case *dns.SRV:
+			target = rr.Target
+		case *dns.SVCB:
+			target = rr.Target
+		case *dns.HTTPS:
+			target = rr.Target
+		}
+		return target != "" && !t.visible(d, v, target)
+	}
+	n := len(msg.Answer) + len(msg.Extra)
+	msg.Answer = slices.DeleteFunc(msg.Answer, hidden)
+	msg.Extra = slices.DeleteFunc(msg.Extra, hidden)
+	return n - len(msg.Answer) - len(msg.Extra)
+}
+
+// derived reports whether domainName has records derived from those of machines, like the records of
+// apps and of the topology.
+func (t *Tailscale) derived(d *zoneData, domainName string) bool {
+	name := t.ownerName(d, domainName)
+	return name != "" && d.sources[name] == sourceTag
+}
@@ -0,0 +1,75 @@
+package tailscale
+
+import (
+	"context"
+	"net/netip"
+	"sync"
+	"time"
+
+	"tailscale.com/client/tailscale/apitype"
+)
+
+const (
+	// whoIsCacheTTL is how long the identity of a client is reused before it's looked up again.
+	// Identities are also forgotten whenever the records change, since the tags of a node may have.
+	whoIsCacheTTL = time.Minute
+	// maxWhoIsCache is the number of clients whose identity is cached. The cache is emptied once
+	// it's full, as an address space scan mustn't grow it without bound.
+	maxWhoIsCache = 4096
+)
+
+// whoIsCache keeps the identities of clients looked up in the LocalAPI, by address, so they aren't
+// looked up for every query. Failed lookups aren't cached.
+type whoIsCache struct {
+	mu      sync.Mutex
+	entries map[netip.Addr]whoIsEntry
+}
+
+type whoIsEntry struct {
+	who     *apitype.WhoIsResponse
+	expires time.Time
+}
+
+// get returns the cached identity of addr, if it hasn't expired by now.
+func (c *whoIsCache) get(addr netip.Addr, now time.Time) (*apitype.WhoIsResponse, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[addr]
+	if !ok || now.After(entry.expires) {
+		return nil, false
+	}
+	return entry.who, true
+}
+
+// put caches the identity of addr until whoIsCacheTTL after now.
+func (c *whoIsCache) put(addr netip.Addr, who *apitype.WhoIsResponse, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries == nil || len(c.entries) >= maxWhoIsCache {
+		c.entries = map[netip.Addr]whoIsEntry{}
+	}
+	c.entries[addr] = whoIsEntry{who: who, expires: now.Add(whoIsCacheTTL)}
+}
+
+// flush forgets all identities.
+func (c *whoIsCache) flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = nil
+}
+
+// identify returns the identity of the tailnet node at addr, from the cache if it was looked up
+// recently. It's meant for lookups on every query; checks made once per request, like those of zone
+// transfers and agent registrations, use whoIs.
+func (t *Tailscale) identify(ctx context.Context, addr netip.Addr) (*apitype.WhoIsResponse, error) {
+	now := time.Now()
+	if who, ok := t.whoIsCache.get(addr, now); ok {
+		return who, nil
+	}
+	who, err := t.whoIs(ctx, addr.String())
+	if err != nil {
+		return nil, err
+	}
+	t.whoIsCache.put(addr, who, now)
+	return who, nil
+}
@@ -0,0 +1,57 @@
+package tailscale
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Wildcard modes, which decide whether the records of a host are served for names below it.
+const (
+	// wildcardOn serves the records of every host for names below it.
+	wildcardOn = "on"
+	// wildcardOff only serves records for the names of hosts themselves.
+	wildcardOff = "off"
+)
+
+// DefaultWildcard only serves records for the names of hosts, names below them are opted into with
+// the wildcard directive.
+const DefaultWildcard = wildcardOff
+
+// validateWildcard checks the argument to the wildcard directive: on, off, or a tag.
+func validateWildcard(mode string) error {
+	switch {
+	case mode == wildcardOn, mode == wildcardOff:
+		return nil
+	case strings.HasPrefix(mode, tagPrefix) && len(mode) > len(tagPrefix):
+		return nil
+	}
+	return fmt.Errorf("invalid wildcard %q, want on, off or a tag", mode)
+}
+
+// wildcardAllowed reports whether names with prefix in front of host get the records of host. With a
+// tag as wildcard mode, only hosts with the tag in their TXT record, which are machines, do.
+func (t *Tailscale) wildcardAllowed(d *zoneData, prefix, host string) bool {
+	switch t.wildcard {
+	case wildcardOn:
+		return true
+	case "", wildcardOff:
+		return prefix == ""
+	}
+	return prefix == "" || slices.Contains(d.entries[host]["TXT"], t.wildcard)
+}
+
+// prefixExists reports whether prefix in front of host names an existing name. Without wildcards,
+// those are just the owners of the SRV records of host, and the empty non-terminals above them.
+func (t *Tailscale) prefixExists(d *zoneData, prefix, host string) bool {
+	if t.wildcardAllowed(d, prefix, host) {
+		return true
+	}
+	for _, entry := range d.entries[host]["SRV"] {
+		owner, _, ok := parseSRVEntry(entry)
+		if ok && (strings.EqualFold(owner, prefix) || strings.HasSuffix(strings.ToLower(owner), "."+strings.ToLower(prefix))) {
+			return true
+		}
+	}
+	return false
+}
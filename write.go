@@ -0,0 +1,75 @@
+package tailscale
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/coredns/coredns/plugin/metrics"
+	"github.com/miekg/dns"
+)
+
+// Reasons a response could not be written, used as the reason label of WriteErrorCount.
+const (
+	// writeErrClientGone means the client closed or reset the connection.
+	writeErrClientGone = "client_gone"
+	// writeErrDeadline means the request deadline passed before or while writing.
+	writeErrDeadline = "deadline"
+	// writeErrTooLarge means the response didn't fit the buffer or datagram.
+	writeErrTooLarge = "too_large"
+	// writeErrPack means the response couldn't be packed, which points at a bug in the plugin.
+	writeErrPack = "pack"
+	// writeErrNetwork covers any other network error.
+	writeErrNetwork = "network"
+)
+
+// writeMsg writes msg to w, honouring the deadline of ctx if the writer supports write deadlines.
+// Failures are counted in WriteErrorCount by reason, and only those that indicate a problem on
+// our side are logged as warnings.
+func (t *Tailscale) writeMsg(ctx context.Context, w dns.ResponseWriter, msg *dns.Msg) error {
+	err := ctx.Err()
+	if err == nil {
+		if deadline, ok := ctx.Deadline(); ok {
+			if dw, ok := w.(interface{ SetWriteDeadline(time.Time) error }); ok {
+				_ = dw.SetWriteDeadline(deadline)
+			}
+		}
+		err = w.WriteMsg(msg)
+	}
+	if err == nil {
+		t.logQuery(ctx, msg)
+		return nil
+	}
+
+	reason := writeErrorReason(err)
+	WriteErrorCount.WithLabelValues(metrics.WithServer(ctx), reason).Inc()
+	switch reason {
+	case writeErrClientGone, writeErrDeadline:
+		log.Debugf("Unable to write %s response, %s: %v", dns.RcodeToString[msg.Rcode], reason, err)
+	default:
+		log.Warningf("Error writing %s response (%s): %v", dns.RcodeToString[msg.Rcode], reason, err)
+	}
+	return err
+}
+
+// writeErrorReason classifies an error returned while writing a response.
+func writeErrorReason(err error) string {
+	var dnsErr *dns.Error
+	var netErr net.Error
+	switch {
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, context.Canceled), errors.Is(err, os.ErrDeadlineExceeded):
+		return writeErrDeadline
+	case errors.Is(err, net.ErrClosed), errors.Is(err, syscall.EPIPE), errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.ECONNREFUSED):
+		return writeErrClientGone
+	case errors.Is(err, syscall.EMSGSIZE), errors.Is(err, dns.ErrBuf):
+		return writeErrTooLarge
+	case errors.As(err, &dnsErr):
+		return writeErrPack
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return writeErrDeadline
+	}
+	return writeErrNetwork
+}
@@ -0,0 +1,171 @@
+package tailscale
+
+import (
+	"context"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/metrics"
+	"github.com/coredns/coredns/plugin/transfer"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+// tagPrefix marks a transfer peer as a tag rather than a machine name.
+const tagPrefix = "tag:"
+
+// transferTimeout is how long the records of a transfer are offered to the transfer plugin. It stops
+// reading them when it fails to write them to the secondary, which would block sending them forever.
+const transferTimeout = 10 * time.Minute
+
+// validTransferPeer reports whether peer is a machine name or a tag.
+func validTransferPeer(peer string) bool {
+	name := strings.TrimPrefix(peer, tagPrefix)
+	_, ok := dns.IsDomainName(name)
+	return ok && name != "" && !strings.Contains(name, ".")
+}
+
+// Transfer implements the transfer.Transferer interface, so secondary servers can transfer the zones
+// with the transfer plugin. Every transfer is a full transfer (AXFR); IXFR requests for the current
+// serial only receive the SOA record.
+func (t *Tailscale) Transfer(zone string, serial uint32) (<-chan []dns.RR, error) {
+	zone = dns.CanonicalName(zone)
+	if dns.Fqdn(t.matchZone(zone)) != zone {
+		return nil, transfer.ErrNotAuthoritative
+	}
+
+	// Build the records up front from one snapshot, so that the transfer is consistent with its serial
+	// even if they change meanwhile.
+	d := t.load()
+	soa := t.soa(d, zone)
+	rrsets := t.zoneRRsets(d, zone)
+
+	ch := make(chan []dns.RR)
+	go func() {
+		defer close(ch)
+		ctx, cancel := context.WithTimeout(context.Background(), transferTimeout)
+		defer cancel()
+		send := func(rrs []dns.RR) bool {
+			select {
+			case ch <- rrs:
+				return true
+			case <-ctx.Done():
+				log.Warningf("Transfer of %s abandoned, the records weren't read within %s", zone, transferTimeout)
+				return false
+			}
+		}
+
+		if serial != 0 && serial >= soa.Serial {
+			send([]dns.RR{soa})
+			return
+		}
+		if !send(append([]dns.RR{soa}, t.nsRecords(zone)...)) {
+			return
+		}
+		for _, rrs := range rrsets {
+			if !send(rrs) {
+				return
+			}
+		}
+		send([]dns.RR{soa})
+	}()
+	return ch, nil
+}
+
+// zoneRRsets returns the records of every name in zone, grouped by name and sorted by name. Records
+// use the TTL without jitter, see rrsetBaseTTL.
+func (t *Tailscale) zoneRRsets(d *zoneData, zone string) [][]dns.RR {
+	ttl := t.baseTTL()
+	hdr := func(name string, rrtype uint16, ttl uint32) dns.RR_Header {
+		return dns.RR_Header{Name: name, Rrtype: rrtype, Class: dns.ClassINET, Ttl: ttl}
+	}
+
+	var rrsets [][]dns.RR
+	if t.rebindMarker {
+		name := dns.Fqdn(rebindMarkerLabel + "." + zone)
+		rrsets = append(rrsets, []dns.RR{&dns.TXT{Hdr: hdr(name, dns.TypeTXT, ttl), Txt: []string{rebindMarkerText}}})
+	}
+	for _, host := range slices.Sorted(maps.Keys(d.entries)) {
+		records := d.entries[host]
+		name := dns.Fqdn(host + "." + zone)
+		hostTTL := t.hostBaseTTL(d, host)
+
+		var rrs []dns.RR
+		for _, addr := range d.addrs[host].v4 {
+			rrs = append(rrs, &dns.A{Hdr: hdr(name, dns.TypeA, t.rrsetBaseTTL(d, host, "A")), A: addr.AsSlice()})
+		}
+		for _, addr := range d.addrs[host].v6 {
+			rrs = append(rrs, &dns.AAAA{Hdr: hdr(name, dns.TypeAAAA, t.rrsetBaseTTL(d, host, "AAAA")), AAAA: addr.AsSlice()})
+		}
+		for _, target := range records["CNAME"] {
+			rrs = append(rrs, &dns.CNAME{Hdr: hdr(name, dns.TypeCNAME, t.rrsetBaseTTL(d, host, "CNAME")), Target: dns.Fqdn(moveName(target, t.zone, zone))})
+		}
+		if tags, ok := records["TXT"]; ok {
+			rrs = append(rrs, &dns.TXT{Hdr: hdr(name, dns.TypeTXT, t.rrsetBaseTTL(d, host, "TXT")), Txt: tags})
+		}
+		for _, rrtype := range []uint16{dns.TypeSVCB, dns.TypeHTTPS} {
+			if rr := svcbRecord(name, rrtype, hostTTL, records, d.addrs[host]); rr != nil {
+				rrs = append(rrs, rr)
+			}
+		}
+		if len(rrs) > 0 {
+			rrsets = append(rrsets, rrs)
+		}
+		for _, entry := range records["SRV"] {
+			if prefix, port, ok := parseSRVEntry(entry); ok {
+				rrsets = append(rrsets, []dns.RR{&dns.SRV{Hdr: hdr(prefix+"."+name, dns.TypeSRV, t.rrsetBaseTTL(d, prefix+"."+host, "SRV")), Port: port, Target: name}})
+			}
+		}
+	}
+	if t.tagEnumeration {
+		for _, tag := range slices.Sorted(maps.Keys(d.tags)) {
+			name := dns.Fqdn(tagEnumerationLabel + "." + tag + "." + zone)
+			var rrs []dns.RR
+			for _, target := range d.tags[tag] {
+				rrs = append(rrs, &dns.PTR{Hdr: hdr(name, dns.TypePTR, ttl), Ptr: moveName(target, t.zone, zone)})
+			}
+			rrsets = append(rrsets, rrs)
+		}
+	}
+	return rrsets
+}
+
+// serveTransfer handles AXFR and IXFR queries. They're answered by the transfer plugin, which must come
+// after tailscale for transfer_peers to apply; queries from nodes that aren't transfer peers are
+// refused before they get there.
+func (t *Tailscale) serveTransfer(ctx context.Context, state request.Request) (int, error) {
+	if !t.transferAllowed(ctx, state.W.RemoteAddr().String()) {
+		log.Infof("Refusing zone transfer of %s to %s", state.Name(), state.IP())
+		RcodeCount.WithLabelValues(dns.RcodeToString[dns.RcodeRefused], metrics.WithServer(ctx)).Inc()
+		return dns.RcodeRefused, nil
+	}
+	return plugin.NextOrFailure(t.Name(), t.next, ctx, state.W, state.Req)
+}
+
+// transferAllowed reports whether the node at remoteAddr is one of the transfer peers, by machine name
+// or tag. Any client is allowed if there are no transfer peers, and no client outside the tailnet is
+// if there are.
+func (t *Tailscale) transferAllowed(ctx context.Context, remoteAddr string) bool {
+	if len(t.transferPeers) == 0 {
+		return true
+	}
+	who, err := t.whoIs(ctx, remoteAddr)
+	if err != nil || who.Node == nil {
+		log.Debugf("Unable to identify transfer client %s: %v", remoteAddr, err)
+		return false
+	}
+	host, _ := t.fitName(who.Node.ComputedName)
+	for _, peer := range t.transferPeers {
+		if strings.HasPrefix(peer, tagPrefix) {
+			if slices.Contains(who.Node.Tags, peer) {
+				return true
+			}
+		} else if host != "" && strings.EqualFold(host, peer) {
+			return true
+		}
+	}
+	return false
+}
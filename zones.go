@@ -0,0 +1,43 @@
+package tailscale
+
+import (
+	"github.com/coredns/coredns/plugin"
+	"github.com/miekg/dns"
+)
+
+// matchZone returns the zone qname is in, or the empty string if it's in none of them. If qname is
+// in several nested zones, the most specific one is returned.
+func (t *Tailscale) matchZone(qname string) string {
+	if len(t.zones) == 0 {
+		if dns.IsSubDomain(t.zone, qname) {
+			return t.zone
+		}
+		return ""
+	}
+	return plugin.Zones(t.zones).Matches(qname)
+}
+
+// moveName moves name from zone from to zone to. Names outside from are returned unchanged, so CNAME
+// targets pointing out of the zone are left alone.
+func moveName(name, from, to string) string {
+	from, fqdn := dns.Fqdn(from), dns.Fqdn(name)
+	if !dns.IsSubDomain(from, fqdn) {
+		return name
+	}
+	return fqdn[:len(fqdn)-len(from)] + dns.Fqdn(to)
+}
+
+// moveAnswers rewrites the names in the answer section of msg, which was resolved in the primary
+// zone, to zone.
+func (t *Tailscale) moveAnswers(msg *dns.Msg, zone string) {
+	for _, rr := range msg.Answer {
+		hdr := rr.Header()
+		hdr.Name = moveName(hdr.Name, t.zone, zone)
+		switch rr := rr.(type) {
+		case *dns.CNAME:
+			rr.Target = moveName(rr.Target, t.zone, zone)
+		case *dns.PTR:
+			rr.Ptr = moveName(rr.Ptr, t.zone, zone)
+		}
+	}
+}